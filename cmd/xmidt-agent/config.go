@@ -46,6 +46,84 @@ type Config struct {
 	XmidtAgentCrud   XmidtAgentCrud
 	Metadata         Metadata
 	NetworkService   NetworkService
+	Shutdown         Shutdown
+	RetryBudget      RetryBudget
+	Announcement     Announcement
+	Diagnostics      Diagnostics
+	StackDump        StackDump
+}
+
+type RetryBudget struct {
+	// Attempts is the number of network attempts allowed per Period, shared by
+	// the credentials service and the websocket.  Once they are used up, the
+	// attempts back off further until the budget recovers.  Zero disables the
+	// budget.
+	Attempts int
+	// Period is the time over which Attempts are allowed.
+	Period time.Duration
+}
+
+// Announcement is the configuration for the WRP event listing the registered
+// services, sent each time the websocket connects.
+type Announcement struct {
+	// Enabled turns on the announcement.
+	Enabled bool
+
+	// Destination is the destination of the announcement event.  The default
+	// is event:device-status/<device id>/services.
+	Destination string
+
+	// Reconnect is the configuration for the WRP event reporting how long the
+	// device was disconnected, sent each time the websocket reconnects.
+	Reconnect ReconnectAnnouncement
+}
+
+type ReconnectAnnouncement struct {
+	// Enabled turns on the reconnect announcement.
+	Enabled bool
+
+	// Destination is the destination of the reconnect announcement event.
+	// The default is event:device-status/<device id>/reconnect.
+	Destination string
+}
+
+// Diagnostics is the configuration for the service responding with a snapshot
+// of the transport, credential and qos state.
+type Diagnostics struct {
+	// Enabled turns on the diagnostics service.
+	Enabled bool
+
+	// ServiceName is the name of the service the diagnostics requests are
+	// sent to.
+	ServiceName string
+
+	// MaxDisconnects is the number of recent disconnects reported.  Zero uses
+	// the default.
+	MaxDisconnects int
+}
+
+// StackDump is the configuration for the service responding to trusted sources
+// with a dump of the stacks of all goroutines.
+type StackDump struct {
+	// Enabled turns on the stack dump service.
+	Enabled bool
+
+	// ServiceName is the name of the service the stack dump requests are sent
+	// to.
+	ServiceName string
+
+	// TrustedSources is the list of sources allowed to request a stack dump.
+	// Start up fails if the service is enabled without any.
+	TrustedSources []string
+
+	// MaxBytes is the size limit of the stack dump.  Zero uses the default.
+	MaxBytes int
+}
+
+type Shutdown struct {
+	// Timeout is the maximum time allowed for the components to stop.  Zero
+	// means shutdown is only bounded by the fx stop timeout.
+	Timeout time.Duration
 }
 
 type LibParodus struct {
@@ -57,6 +135,11 @@ type LibParodus struct {
 	ReceiveTimeout time.Duration
 	// SendTimeout is the send timeout for libparodus.
 	SendTimeout time.Duration
+	// RetryPolicy is the retry policy used when libparodus fails to start listening.
+	RetryPolicy retry.Config
+	// ReconnectInterval is the time waited between attempts to listen again
+	// after the libparodus socket failed.  Zero means one second.
+	ReconnectInterval time.Duration
 }
 
 type QOS struct {
@@ -64,6 +147,9 @@ type QOS struct {
 	MaxQueueBytes int64
 	// MaxMessageBytes is the largest allowable wrp message payload.
 	MaxMessageBytes int
+	// MaxQueueCount is the allowable max number of queued messages, regardless of their size.
+	// Zero means no count constraint.
+	MaxQueueCount int
 	// Priority determines what is used [newest, oldest message] for QualityOfService tie breakers and trimming,
 	// with the default being to prioritize the newest messages.
 	Priority qos.PriorityType
@@ -75,11 +161,28 @@ type QOS struct {
 	HighExpires time.Duration
 	// CriticalExpires determines when critical qos messages are trimmed.
 	CriticalExpires time.Duration
+	// DeliveryConcurrency is the number of queued messages that may be delivered concurrently.
+	DeliveryConcurrency int
+	// PreserveOrderPerDestination prevents concurrent deliveries of messages with the same destination.
+	PreserveOrderPerDestination bool
+	// PerDestinationFairness takes turns delivering to the destinations of messages with the same qos level.
+	PerDestinationFairness bool
+	// MaxQueueMemoryFraction is the max fraction of the process memory the queue may use
+	// before low qos messages are trimmed.  Zero disables the guard.
+	MaxQueueMemoryFraction float64
+	// PersistFile is the file, relative to the durable storage, the queue is saved to on shutdown
+	// and restored from on startup.  Empty disables persistence.
+	PersistFile string
 }
 
 type Pubsub struct {
 	// PublishTimeout sets the timeout for publishing a message
 	PublishTimeout time.Duration
+	// MaxFanout sets the maximum number of handlers a message is delivered to concurrently.
+	MaxFanout int
+	// MaxInFlightPerSource sets the maximum number of messages from a single
+	// source that may be in flight at once.  Zero means unlimited.
+	MaxInFlightPerSource int
 }
 
 type Websocket struct {
@@ -91,20 +194,52 @@ type Websocket struct {
 	BackUpURL string
 	// AdditionalHeaders are any additional headers for the WS connection.
 	AdditionalHeaders http.Header
+	// Subprotocols are the subprotocols offered to the server, in order of
+	// preference.  If set, the server must negotiate one of them.
+	Subprotocols []string
+	// FollowCloseRedirects enables reconnecting to the url hinted by a server
+	// close reason of the form `{"redirect":"wss://..."}`.  The hint is only
+	// used for the next dial.
+	FollowCloseRedirects bool
 	// FetchURLTimeout is the timeout for the fetching the WS url. If this is not set, the default is 30 seconds.
 	FetchURLTimeout time.Duration
 	// InactivityTimeout is the inactivity timeout for the WS connection.
 	InactivityTimeout time.Duration
+	// WatchdogTimeout is the maximum time the WS connection may go without any
+	// progress before a reconnect is forced.  If this is not set, the watchdog is disabled.
+	WatchdogTimeout time.Duration
+	// MaxConnectionLifetime is the maximum time a WS connection is kept before
+	// it is closed and reconnected, even if healthy.  If this is not set,
+	// connections are kept indefinitely.
+	MaxConnectionLifetime time.Duration
 	// PingWriteTimeout is the ping timeout for the WS connection.
 	PingWriteTimeout time.Duration
 	// SendTimeout is the send timeout for the WS connection.
 	SendTimeout time.Duration
+	// SendQueueDepth is the number of messages that may be queued for sending.
+	// A value of zero means sends are written synchronously.
+	SendQueueDepth int
+	// Compression is the permessage-deflate compression mode offered to the
+	// server: "disabled" (the default), "context-takeover" or
+	// "no-context-takeover".
+	Compression string
+	// CompressionThreshold is the minimum size of a message before it is
+	// compressed.  Zero uses the default for the mode.
+	CompressionThreshold int
+	// CompressionSkipContentTypes are the content types of messages that are
+	// sent uncompressed because they are already compressed.  A `type/*`
+	// entry matches every subtype.  If empty, a default list of image, video,
+	// audio and archive types is used.
+	CompressionSkipContentTypes []string
 	// HTTPClient is the configuration for the HTTP client.
 	HTTPClient arrangehttp.ClientConfig
 	// KeepAliveInterval is the keep alive interval for the WS connection.
 	KeepAliveInterval time.Duration
 	// MaxMessageBytes is the largest allowable message to send or receive.
 	MaxMessageBytes int64
+	// MaxHeaderBytes is the largest allowable handshake response header.  If
+	// this is not set, the HTTP transport default is used.
+	MaxHeaderBytes int64
 	// (optional) DisableV4 determines whether or not to allow IPv4 for the WS connection.
 	// If this is not set, the default is false (IPv4 is enabled).
 	// Either V4 or V6 can be disabled, but not both.
@@ -113,10 +248,49 @@ type Websocket struct {
 	// If this is not set, the default is false (IPv6 is enabled).
 	// Either V4 or V6 can be disabled, but not both.
 	DisableV6 bool
+	// (optional) StickyIPMode keeps the IP mode of the last successful
+	// connection for the next attempt, only alternating after a failure.
+	// If this is not set, the default is false.
+	StickyIPMode bool
+	// (optional) HappyEyeballs is the delay between starting racing IPv6 and
+	// IPv4 dials when both are enabled.  If this is not set, the IP modes are
+	// alternated across connection attempts.
+	HappyEyeballs time.Duration
 	// RetryPolicy sets the retry policy factory used for delaying between retry attempts for reconnection.
 	RetryPolicy retry.Config
 	// Once sets whether or not to only attempt to connect once.
 	Once bool
+	// PinnedCerts are the hex encoded SHA-256 fingerprints of the allowed
+	// server leaf certificates.  If empty, no pinning is done.
+	PinnedCerts []string
+	// InsecureSkipTLSVerify disables the verification of the server
+	// certificate.  Lab use only; it must never be enabled in production.
+	InsecureSkipTLSVerify bool
+	// ALPNProtocols are the ALPN protocols offered in the TLS handshake, in
+	// order of preference.  If empty, none are offered.
+	ALPNProtocols []string
+	// RequireALPN rejects a server that doesn't negotiate one of the
+	// ALPNProtocols.
+	RequireALPN bool
+	// ProxyURL is a fixed proxy to connect through.  If empty, the proxy is
+	// taken from the environment.
+	ProxyURL string
+	// ProxyUser and ProxyPassword are the basic auth credentials sent to the
+	// proxy.
+	ProxyUser     string
+	ProxyPassword string
+	// MaxReconnects is the number of consecutive failed connection attempts
+	// allowed before giving up.  Zero means unlimited.
+	MaxReconnects int
+	// DecodeFailureThreshold is the number of consecutive connections that may
+	// be closed for a malformed message before DecodeFailureBackoff is waited
+	// between reconnects.  Zero disables the decode failure backoff.
+	DecodeFailureThreshold int
+	DecodeFailureBackoff   time.Duration
+	// MinReconnectInterval is the minimum time between the starts of
+	// consecutive connection attempts, regardless of the retry policy.
+	// Zero means no minimum.
+	MinReconnectInterval time.Duration
 }
 
 // Identity contains the information that identifies the device.
@@ -125,6 +299,11 @@ type Identity struct {
 	// MAC address of the "primary" network interface.
 	DeviceID wrp.DeviceID
 
+	// DeviceIDSources are the sources of the device ID, in order of
+	// precedence.  The device ID is resolved from the first source that
+	// provides one at startup.  If empty, only DeviceID is used.
+	DeviceIDSources []DeviceIDSource
+
 	// SerialNumber is the serial number of the device.
 	SerialNumber string
 
@@ -141,14 +320,36 @@ type Identity struct {
 	PartnerID string
 }
 
+// DeviceIDSource is a single source of the device ID.
+type DeviceIDSource struct {
+	// Type is the kind of source: "config" uses Identity.DeviceID, "file"
+	// reads the device ID or MAC address from Path, "interface" uses the
+	// MAC address of Interface, and "network_service" uses the MAC address of
+	// the NetworkService interface named by Interface, or of the highest
+	// priority NetworkService interface if Interface is empty.
+	Type string
+
+	// Path is the file to read when Type is "file", for example
+	// `/sys/class/net/eth0/address`.
+	Path string
+
+	// Interface is the network interface to use when Type is "interface" or
+	// "network_service".
+	Interface string
+}
+
 // OperationalState contains the information about the device's operational state.
 type OperationalState struct {
 	// LastRebootReason is the reason for the last reboot.
 	LastRebootReason string
 
-	// BootTime is the time the device was last booted.
+	// BootTime is the time the device was last booted.  If not set, it is
+	// computed from the OS uptime.
 	BootTime time.Time
 
+	// UptimePath overrides the file the OS uptime is read from.
+	UptimePath string
+
 	// network interface to use for connection from agent to webpa cloud
 	WebpaInterfaceUsed string
 }
@@ -159,16 +360,57 @@ type XmidtCredentials struct {
 	// URL is the URL of the XMiDT credential server.
 	URL string
 
+	// BackupURLs are the backup XMiDT credential servers, tried in order when
+	// the URL fails.
+	BackupURLs []string
+
 	// HTTPClient is the configuration for the HTTP client used to retrieve the
 	// credentials.
 	HTTPClient arrangehttp.ClientConfig
 
+	// InsecureSkipTLSVerify disables the verification of the credential
+	// server certificate.  Lab use only; it must never be enabled in
+	// production.
+	InsecureSkipTLSVerify bool
+
 	// RefetchPercent is the percentage of the time between the last fetch and
 	// the expiration time to refetch the credentials.  For example, if the
 	// credentials are valid for 1 hour and the refetch percent is 90, then the
 	// credentials will be refetched after 54 minutes.
 	RefetchPercent float64
 
+	// RefetchJitter spreads the refetch time by up to this fraction in either
+	// direction, so devices that booted together don't refetch together.  It
+	// must be in the range [0, 1).
+	RefetchJitter float64
+
+	// MarkInvalidDebounce is the window during which repeated requests to
+	// invalidate the credentials are coalesced into a single refetch.
+	MarkInvalidDebounce time.Duration
+
+	// MinRetryAfter and MaxRetryAfter bound the retry delay requested by the
+	// credential server with Retry-After.  A MaxRetryAfter of zero means
+	// there is no upper bound.
+	MinRetryAfter time.Duration
+	MaxRetryAfter time.Duration
+
+	// MaxBodyBytes is the largest credential response body accepted.  If
+	// zero, the default of 1MiB is used.
+	MaxBodyBytes int64
+
+	// SuccessStatuses are the HTTP statuses of a credential response that
+	// carries the token.  If empty, only 200 is a success.
+	SuccessStatuses []int
+
+	// FallbackToken is a long lived, pre-shared token used when there is no
+	// usable token and FallbackAfter consecutive fetches have failed.  If
+	// empty, no fallback token is used.
+	FallbackToken string
+
+	// FallbackAfter is the number of consecutive failed fetches before the
+	// FallbackToken is used.
+	FallbackAfter int
+
 	// FileName is the name and path of the file to store the credentials.  There
 	// will be another file with the same name and a ".sha256" extension that
 	// contains the SHA256 hash of the credentials file.
@@ -178,7 +420,22 @@ type XmidtCredentials struct {
 	// file.
 	FilePermissions fs.FileMode
 
-	// WaitUntilFetched is the time the xmidt-agent blocks on startup until an attempt to fetch the credentials has been made.
+	// MaxCacheAge is the longest time since the fetch that the credentials
+	// file is trusted on start.  If zero, the age isn't checked.
+	MaxCacheAge time.Duration
+
+	// FailureLogFileName is the name and path of the file recording the most
+	// recent failed fetches, so the reason for repeated failures survives a
+	// restart.  The failure log is disabled if empty.
+	FailureLogFileName string
+
+	// FailureLogReplay is the number of the most recent recorded failures
+	// logged on startup.
+	FailureLogReplay int
+
+	// WaitUntilFetched is the grace period the xmidt-agent blocks on startup
+	// until the credentials are valid.  Once it expires, the websocket is
+	// started degraded, without credentials.
 	WaitUntilFetched time.Duration
 }
 
@@ -210,6 +467,24 @@ type JwtTxtRedirector struct {
 	// Timeout is the timeout for the JWT TXT redirector request.
 	Timeout time.Duration
 
+	// MinCacheTTL is the shortest time the resolved endpoint is cached, even
+	// if the TTL of the TXT record is shorter.  The TTL is only known when
+	// DNSServers are configured, the system resolver doesn't report it.
+	MinCacheTTL time.Duration
+
+	// MaxCacheTTL is the longest time the resolved endpoint is cached, even
+	// if the TTL of the TXT record is longer or unknown.  The endpoint is
+	// cached until the JWT expires if zero.
+	MaxCacheTTL time.Duration
+
+	// MaxRecordBytes is the largest JWT reassembled from the TXT record.  The
+	// default of 8KiB is used if zero.
+	MaxRecordBytes int
+
+	// DNSServers is the list of DNS servers, in host[:port] form, queried in
+	// order for the TXT record.  If empty, the system resolver is used.
+	DNSServers []string
+
 	// PEMs is the list of PEM-encoded public keys to use for verification.
 	PEMs []string
 
@@ -238,10 +513,70 @@ type MockTr181 struct {
 	FilePath    string
 	Enabled     bool
 	ServiceName string
+	// Persist writes SET changes back to FilePath.
+	Persist bool
 }
 
 type Metadata struct {
 	Fields []string
+
+	// CacheTTLs is how long the computed value of each field is reused.  Fields
+	// that are not listed are computed on every request.
+	CacheTTLs map[string]time.Duration
+
+	// InterfaceStats enables responding to metadata requests for the rx/tx
+	// counters of the available interfaces, read from /proc/net/dev.  The
+	// counters are never part of the convey header.
+	InterfaceStats bool
+
+	// InterfaceStatsPath overrides the file the interface counters are read
+	// from.
+	InterfaceStatsPath string
+
+	// FirmwareVersionFile is a file the firmware version is read from each
+	// time the metadata is computed, so a firmware update is picked up without
+	// a restart.  The identity firmware version is used if the file can't be
+	// read.
+	FirmwareVersionFile string
+
+	// Report re-sends the metadata as a WRP event when it changes.
+	Report MetadataReport
+
+	// Service responds to metadata requests, optionally limited to the fields
+	// listed by the request.
+	Service MetadataService
+}
+
+// MetadataService is the configuration for the service responding to
+// metadata requests.
+type MetadataService struct {
+	// Enabled turns on the metadata service.
+	Enabled bool
+
+	// ServiceName is the name of the service the metadata requests are sent
+	// to.
+	ServiceName string
+}
+
+// MetadataReport is the configuration for re-sending the metadata after the
+// handshake.
+type MetadataReport struct {
+	// Enabled turns on the periodic re-evaluation of the metadata.
+	Enabled bool
+
+	// Interval is how often the metadata is re-evaluated.
+	Interval time.Duration
+
+	// Destination is the destination of the WRP event.
+	Destination string
+
+	// Fields limits the reported fields.  All of the fields except the
+	// interface stats are reported by default.
+	Fields []string
+
+	// Always sends the metadata on every evaluation, even if it hasn't
+	// changed.
+	Always bool
 }
 
 type NetworkService struct {
@@ -7,6 +7,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/xmidt-org/xmidt-agent/internal/budget"
 	"github.com/xmidt-org/xmidt-agent/internal/credentials"
 	"github.com/xmidt-org/xmidt-agent/internal/credentials/event"
 	"github.com/xmidt-org/xmidt-agent/internal/fs"
@@ -24,8 +25,11 @@ type credsIn struct {
 	ID      Identity
 	Ops     OperationalState
 	Durable fs.FS `name:"durable_fs" optional:"true"`
+	Budget  *budget.Budget
 	LC      fx.Lifecycle
 	Logger  *zap.Logger
+
+	ShutdownCtx context.Context `name:"shutdown"`
 }
 
 type credsOut struct {
@@ -49,7 +53,7 @@ func (in credsIn) Options() ([]credentials.Option, error) {
 	}
 
 	opts := []credentials.Option{
-		credentials.URL(in.Creds.URL),
+		credentials.URLs(in.Creds.URL, in.Creds.BackupURLs...),
 		credentials.HTTPClient(client),
 		credentials.MacAddress(in.ID.DeviceID),
 		credentials.SerialNumber(in.ID.SerialNumber),
@@ -60,7 +64,12 @@ func (in credsIn) Options() ([]credentials.Option, error) {
 		credentials.LastRebootReason(in.Ops.LastRebootReason),
 		credentials.XmidtProtocol(xmidtProtocol),
 		credentials.BootRetryWait(time.Second),
+		credentials.ShutdownContext(in.ShutdownCtx),
 		credentials.RefetchPercent(in.Creds.RefetchPercent),
+		credentials.RefetchJitter(in.Creds.RefetchJitter),
+		credentials.MarkInvalidDebounce(in.Creds.MarkInvalidDebounce),
+		credentials.RetryAfterBounds(in.Creds.MinRetryAfter, in.Creds.MaxRetryAfter),
+		credentials.RetryBudget(in.Budget),
 		credentials.AddFetchListener(event.FetchListenerFunc(
 			func(e event.Fetch) {
 				logger.Debug("fetch",
@@ -74,12 +83,67 @@ func (in credsIn) Options() ([]credentials.Option, error) {
 					zap.Error(e.Err),
 				)
 			})),
+		credentials.AddExpiringListener(event.ExpiringListenerFunc(
+			func(e event.Expiring) {
+				logger.Debug("expiring",
+					zap.Time("at", e.At),
+					zap.Time("expires_at", e.ExpiresAt),
+					zap.Duration("time_remaining", e.TimeRemaining),
+				)
+			})),
+	}
+
+	if in.Creds.InsecureSkipTLSVerify {
+		logger.Warn("INSECURE: TLS verification of the credentials service is disabled, lab use only")
+		opts = append(opts, credentials.InsecureSkipTLSVerify(true))
+	}
+
+	if in.Creds.MaxBodyBytes > 0 {
+		opts = append(opts, credentials.MaxBodyBytes(in.Creds.MaxBodyBytes))
+	}
+
+	if len(in.Creds.SuccessStatuses) > 0 {
+		opts = append(opts, credentials.SuccessStatuses(in.Creds.SuccessStatuses))
+	}
+
+	if in.Creds.FallbackToken != "" {
+		opts = append(opts,
+			credentials.FallbackToken(in.Creds.FallbackToken, in.Creds.FallbackAfter),
+			credentials.AddFallbackListener(event.FallbackListenerFunc(
+				func(e event.Fallback) {
+					if e.Active {
+						logger.Warn("using the fallback token, running degraded",
+							zap.Int("failures", e.Failures),
+							zap.Error(e.Err),
+						)
+						return
+					}
+					logger.Info("fetched token recovered, fallback token no longer used")
+				})),
+		)
 	}
 
 	if in.Durable != nil {
 		opts = append(opts,
 			credentials.LocalStorage(in.Durable, in.Creds.FileName, in.Creds.FilePermissions),
+			credentials.MaxCacheAge(in.Creds.MaxCacheAge),
 		)
+
+		if in.Creds.FailureLogFileName != "" {
+			opts = append(opts,
+				credentials.FailureLog(in.Durable, in.Creds.FailureLogFileName),
+				credentials.FailureLogReplay(in.Creds.FailureLogReplay),
+				credentials.AddHistoryListener(event.HistoryListenerFunc(
+					func(e event.History) {
+						logger.Info("fetch failed before the last restart",
+							zap.Time("at", e.At),
+							zap.String("url", e.URL),
+							zap.Int("status_code", e.StatusCode),
+							zap.Error(e.Err),
+						)
+					})),
+			)
+		}
 	}
 
 	return opts, nil
@@ -77,6 +77,23 @@ func Test_credsIn_Options(t *testing.T) {
 				credentials.URL("http://example.com"),
 				credentials.MacAddress("mac:112233445566"),
 			},
+			checkLog: func(assert *assert.Assertions, logs []observer.LoggedEntry) {
+				assert.Empty(logs)
+			},
+		},
+		{
+			description: "TLS verification disabled",
+			in: credsIn{
+				Creds: XmidtCredentials{
+					URL:                   "https://example.com",
+					InsecureSkipTLSVerify: true,
+				},
+			},
+			checkLog: func(assert *assert.Assertions, logs []observer.LoggedEntry) {
+				assert.Len(logs, 1)
+				assert.Equal(zap.WarnLevel, logs[0].Level)
+				assert.Contains(logs[0].Message, "TLS verification of the credentials service is disabled")
+			},
 		},
 	}
 	for _, tc := range tests {
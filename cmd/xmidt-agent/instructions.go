@@ -43,6 +43,9 @@ func provideInstructions(in instructionsIn) (instructionsOut, error) {
 		jwtxt.DeviceID(string(in.ID.DeviceID)),
 		jwtxt.Algorithms(in.Service.JwtTxtRedirector.AllowedAlgorithms...),
 		jwtxt.Timeout(in.Service.JwtTxtRedirector.Timeout),
+		jwtxt.MinCacheTTL(in.Service.JwtTxtRedirector.MinCacheTTL),
+		jwtxt.MaxCacheTTL(in.Service.JwtTxtRedirector.MaxCacheTTL),
+		jwtxt.MaxRecordBytes(in.Service.JwtTxtRedirector.MaxRecordBytes),
 		jwtxt.WithFetchListener(event.FetchListenerFunc(
 			func(fe event.Fetch) {
 				logger.Debug("fetch",
@@ -54,6 +57,7 @@ func provideInstructions(in instructionsIn) (instructionsOut, error) {
 					zap.Duration("duration", fe.Duration),
 					zap.Time("prior_expiration", fe.PriorExpiration),
 					zap.Time("expiration", fe.Expiration),
+					zap.Time("cached_until", fe.CachedUntil),
 					zap.Bool("temporary_err", fe.TemporaryErr),
 					zap.String("endpoint", fe.Endpoint),
 					zap.ByteString("payload", fe.Payload),
@@ -62,6 +66,14 @@ func provideInstructions(in instructionsIn) (instructionsOut, error) {
 			})),
 	}
 
+	if len(in.Service.JwtTxtRedirector.DNSServers) > 0 {
+		resolvers := make([]jwtxt.Resolver, 0, len(in.Service.JwtTxtRedirector.DNSServers))
+		for _, server := range in.Service.JwtTxtRedirector.DNSServers {
+			resolvers = append(resolvers, jwtxt.DNSServer(server))
+		}
+		opts = append(opts, jwtxt.UseResolvers(resolvers...))
+	}
+
 	if len(in.Service.JwtTxtRedirector.PEMs) > 0 {
 		pems := make([][]byte, 0, len(in.Service.JwtTxtRedirector.PEMs))
 		for _, item := range in.Service.JwtTxtRedirector.PEMs {
@@ -4,11 +4,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 
 	"github.com/xmidt-org/xmidt-agent/internal/adapters/libparodus"
+	"github.com/xmidt-org/xmidt-agent/internal/adapters/libparodus/event"
 	"github.com/xmidt-org/xmidt-agent/internal/pubsub"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 type libParodusIn struct {
@@ -18,13 +21,37 @@ type libParodusIn struct {
 	LibParodus LibParodus
 
 	PubSub *pubsub.PubSub
+	Logger *zap.Logger
+
+	ShutdownCtx context.Context `name:"shutdown"`
 }
 
 func provideLibParodus(in libParodusIn) (*libparodus.Adapter, error) {
+	logger := in.Logger.Named("libparodus")
 	libParodusDefaults := []libparodus.Option{
 		libparodus.KeepaliveInterval(in.LibParodus.KeepAliveInterval),
 		libparodus.ReceiveTimeout(in.LibParodus.ReceiveTimeout),
 		libparodus.SendTimeout(in.LibParodus.SendTimeout),
+		libparodus.RetryPolicy(in.LibParodus.RetryPolicy),
+		libparodus.ReconnectInterval(in.LibParodus.ReconnectInterval),
+		libparodus.ShutdownContext(in.ShutdownCtx),
+		libparodus.AddDisconnectListener(
+			event.DisconnectListenerFunc(func(e event.Disconnect) {
+				logger.Warn("parodus service socket failed",
+					zap.String("url", e.URL),
+					zap.Error(e.Err))
+			})),
+		libparodus.AddConnectListener(
+			event.ConnectListenerFunc(func(e event.Connect) {
+				if e.Err != nil {
+					logger.Warn("unable to listen on the parodus service url",
+						zap.String("url", e.URL),
+						zap.Error(e.Err))
+					return
+				}
+				logger.Info("listening on the parodus service url again",
+					zap.String("url", e.URL))
+			})),
 	}
 	libParodus, err := libparodus.New(in.LibParodus.ParodusServiceURL, in.PubSub, libParodusDefaults...)
 	if err != nil {
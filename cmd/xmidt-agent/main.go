@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -13,8 +14,11 @@ import (
 	"github.com/goschtalt/goschtalt"
 	"github.com/xmidt-org/sallust"
 	"github.com/xmidt-org/xmidt-agent/internal/adapters/libparodus"
+	"github.com/xmidt-org/xmidt-agent/internal/budget"
 	"github.com/xmidt-org/xmidt-agent/internal/credentials"
+	"github.com/xmidt-org/xmidt-agent/internal/identity"
 	"github.com/xmidt-org/xmidt-agent/internal/loglevel"
+	"github.com/xmidt-org/xmidt-agent/internal/net"
 	"github.com/xmidt-org/xmidt-agent/internal/websocket"
 	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/qos"
 
@@ -44,8 +48,15 @@ type CLI struct {
 	Files   []string `optional:"" short:"f" help:"Specific configuration files or directories."`
 }
 
+var (
+	ErrShutdownTimeout = errors.New("shutdown timed out")
+)
+
 type LifeCycleIn struct {
 	fx.In
+	Shutdown         Shutdown
+	ShutdownCancel   context.CancelFunc `name:"shutdown"`
+	ShutdownCtx      context.Context    `name:"shutdown"`
 	Logger           *zap.Logger
 	LC               fx.Lifecycle
 	Shutdowner       fx.Shutdowner
@@ -98,6 +109,8 @@ func provideAppOptions(args []string) fx.Option {
 			provideInstructions,
 			provideWS,
 			provideLibParodus,
+			provideShutdownContext,
+			provideRetryBudget,
 
 			goschtalt.UnmarshalFunc[sallust.Config]("logger", goschtalt.Optional()),
 			goschtalt.UnmarshalFunc[Identity]("identity"),
@@ -112,12 +125,21 @@ func provideAppOptions(args []string) fx.Option {
 			goschtalt.UnmarshalFunc[NetworkService]("network_service"),
 			goschtalt.UnmarshalFunc[QOS]("qos"),
 			goschtalt.UnmarshalFunc[LibParodus]("lib_parodus"),
+			goschtalt.UnmarshalFunc[Shutdown]("shutdown", goschtalt.Optional()),
+			goschtalt.UnmarshalFunc[RetryBudget]("retry_budget", goschtalt.Optional()),
+			goschtalt.UnmarshalFunc[Announcement]("announcement", goschtalt.Optional()),
+			goschtalt.UnmarshalFunc[Diagnostics]("diagnostics", goschtalt.Optional()),
+			goschtalt.UnmarshalFunc[StackDump]("stack_dump", goschtalt.Optional()),
 
 			provideNetworkService,
 			provideMetadataProvider,
+			provideMetadataReporter,
+			provideMetadataHandler,
 			loglevel.New,
 		),
 
+		fx.Decorate(resolveIdentity),
+
 		fsProvide(),
 		provideWRPHandlers(),
 
@@ -241,7 +263,68 @@ func provideLogger(in LoggerIn) (*zap.AtomicLevel, *zap.Logger, error) {
 	return &zcfg.Level, logger, err
 }
 
-func onStart(cred *credentials.Credentials, ws *websocket.Websocket, libParodus *libparodus.Adapter, qos *qos.Handler, waitUntilFetched time.Duration, logger *zap.Logger) func(context.Context) error {
+type shutdownOut struct {
+	fx.Out
+	Ctx    context.Context    `name:"shutdown"`
+	Cancel context.CancelFunc `name:"shutdown"`
+}
+
+// provideShutdownContext provides the context shared by all components that
+// is canceled as soon as the xmidt-agent begins shutting down.  The websocket,
+// credentials, libparodus, qos and metadata reporter derive their run loops
+// from it, so they wind down without waiting for their turn to be stopped.
+func provideShutdownContext() shutdownOut {
+	ctx, cancel := context.WithCancel(context.Background())
+	return shutdownOut{
+		Ctx:    ctx,
+		Cancel: cancel,
+	}
+}
+
+// provideRetryBudget provides the retry budget shared by the credentials
+// service and the websocket.  If no attempts are configured, the budget is nil
+// and attempts are not limited.
+func provideRetryBudget(in RetryBudget) (*budget.Budget, error) {
+	if in.Attempts == 0 {
+		return nil, nil
+	}
+
+	return budget.New(in.Attempts, in.Period)
+}
+
+// resolveIdentity resolves the device ID from the configured sources, in
+// order of precedence.
+func resolveIdentity(in Identity, ns net.NetworkServicer) (Identity, error) {
+	if len(in.DeviceIDSources) == 0 {
+		return in, nil
+	}
+
+	sources := make([]identity.Source, 0, len(in.DeviceIDSources))
+	for _, src := range in.DeviceIDSources {
+		switch src.Type {
+		case "config":
+			sources = append(sources, identity.Static(in.DeviceID))
+		case "file":
+			sources = append(sources, identity.File(src.Path))
+		case "interface":
+			sources = append(sources, identity.Interface(src.Interface))
+		case "network_service":
+			sources = append(sources, identity.NetworkInterface(ns, src.Interface))
+		default:
+			return Identity{}, fmt.Errorf("%w: unknown device id source type '%s'", identity.ErrInvalidSource, src.Type)
+		}
+	}
+
+	id, err := identity.Resolve(sources...)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	in.DeviceID = id
+	return in, nil
+}
+
+func onStart(shutdownCtx context.Context, cred *credentials.Credentials, ws *websocket.Websocket, libParodus *libparodus.Adapter, qos *qos.Handler, waitUntilFetched time.Duration, logger *zap.Logger) func(context.Context) error {
 	logger = logger.Named("on_start")
 
 	return func(ctx context.Context) (err error) {
@@ -249,39 +332,87 @@ func onStart(cred *credentials.Credentials, ws *websocket.Websocket, libParodus
 			return err
 		}
 
+		// Stop starting up once shutdown begins.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stop := context.AfterFunc(shutdownCtx, cancel)
+		defer stop()
+
 		if ws == nil {
 			logger.Debug("websocket disabled")
 			return err
 		}
 
 		// Allow operations where no credentials are desired (cred will be nil).
+		var waiter credentialsWaiter
 		if cred != nil {
-			ctx, cancel := context.WithTimeout(ctx, waitUntilFetched)
-			defer cancel()
-			// blocks until an attempt to fetch the credentials has been made or the context is canceled
-			cred.WaitUntilFetched(ctx)
+			waiter = cred
 		}
+		waitForCredentials(ctx, waiter, waitUntilFetched, logger)
 
+		// The egress is started first so messages sent as soon as the
+		// websocket connects, such as the service announcement, are queued.
+		qos.Start()
 		ws.Start()
 		err = libParodus.Start()
-		qos.Start()
 
 		return err
 	}
 }
 
-func onStop(ws *websocket.Websocket, libParodus *libparodus.Adapter, qos *qos.Handler, shutdowner fx.Shutdowner, cancels []func(), logger *zap.Logger) func(context.Context) error {
+// credentialsWaiter is the part of the credentials service the start up
+// sequencing depends on.
+type credentialsWaiter interface {
+	WaitUntilValid(context.Context)
+	Credentials() (string, time.Time, error)
+}
+
+// waitForCredentials blocks until the credentials are valid or the grace
+// period expires, so the transport doesn't connect without a token unless it
+// has to.  It returns false and logs a warning if the transport is going to
+// start degraded, without valid credentials.
+func waitForCredentials(ctx context.Context, cred credentialsWaiter, grace time.Duration, logger *zap.Logger) bool {
+	if cred == nil {
+		logger.Info("no credentials configured, starting without credentials")
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+	cred.WaitUntilValid(ctx)
+
+	_, expiresAt, err := cred.Credentials()
+	if err == nil && !time.Now().Before(expiresAt) {
+		// The cached token is returned even once it has expired.
+		err = credentials.ErrTokenExpired
+	}
+	if err != nil {
+		logger.Warn("credentials are not valid, starting degraded",
+			zap.Duration("grace", grace), zap.Error(err))
+		return false
+	}
+
+	return true
+}
+
+func onStop(shutdownCancel context.CancelFunc, timeout time.Duration, ws *websocket.Websocket, libParodus *libparodus.Adapter, qos *qos.Handler, shutdowner fx.Shutdowner, cancels []func(), logger *zap.Logger) func(context.Context) error {
 	logger = logger.Named("on_stop")
 
-	return func(context.Context) (err error) {
+	return func(ctx context.Context) (err error) {
+		// Let every component observing the shutdown context know that
+		// shutdown has begun.
+		shutdownCancel()
+
 		if ws == nil {
 			logger.Debug("websocket disabled")
 			return nil
 		}
 
-		ws.Stop()
-		libParodus.Stop()
-		qos.Stop()
+		err = stopAll(ctx, timeout, ws.Stop, libParodus.Stop, qos.Stop)
+		if err != nil {
+			logger.Error("components failed to stop in time", zap.Error(err))
+		}
+
 		for _, c := range cancels {
 			if c == nil {
 				continue
@@ -290,7 +421,33 @@ func onStop(ws *websocket.Websocket, libParodus *libparodus.Adapter, qos *qos.Ha
 			c()
 		}
 
+		return err
+	}
+}
+
+// stopAll calls each of the stop functions in order, giving up once the
+// timeout elapses or the ctx is done.  A timeout of zero means only the ctx
+// bounds the shutdown.
+func stopAll(ctx context.Context, timeout time.Duration, stops ...func()) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, stop := range stops {
+			stop()
+		}
+	}()
+
+	select {
+	case <-done:
 		return nil
+	case <-ctx.Done():
+		return errors.Join(ErrShutdownTimeout, ctx.Err())
 	}
 }
 
@@ -298,8 +455,8 @@ func lifeCycle(in LifeCycleIn) {
 	logger := in.Logger.Named("fx_lifecycle")
 	in.LC.Append(
 		fx.Hook{
-			OnStart: onStart(in.Cred, in.WS, in.LibParodus, in.QOS, in.WaitUntilFetched, logger),
-			OnStop:  onStop(in.WS, in.LibParodus, in.QOS, in.Shutdowner, in.Cancels, logger),
+			OnStart: onStart(in.ShutdownCtx, in.Cred, in.WS, in.LibParodus, in.QOS, in.WaitUntilFetched, logger),
+			OnStop:  onStop(in.ShutdownCancel, in.Shutdown.Timeout, in.WS, in.LibParodus, in.QOS, in.Shutdowner, in.Cancels, logger),
 		},
 	)
 }
@@ -5,6 +5,9 @@ package main
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -14,6 +17,14 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/xmidt-org/sallust"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/identity"
+	"github.com/xmidt-org/xmidt-agent/internal/net"
+	"github.com/xmidt-org/xmidt-agent/internal/pubsub"
+	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/diagnostics"
+	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/qos"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func Test_provideCLI(t *testing.T) {
@@ -171,3 +182,293 @@ func Test_provideLogger(t *testing.T) {
 		})
 	}
 }
+
+func Test_stopAll(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	tests := []struct {
+		description string
+		timeout     time.Duration
+		stops       []func()
+		expectedErr error
+	}{
+		{
+			description: "every component stops",
+			timeout:     time.Second,
+			stops:       []func(){func() {}, func() {}},
+		}, {
+			description: "nothing to stop",
+			timeout:     time.Second,
+		}, {
+			description: "a component blocks",
+			timeout:     50 * time.Millisecond,
+			stops: []func(){
+				func() {},
+				func() { <-block },
+			},
+			expectedErr: ErrShutdownTimeout,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			start := time.Now()
+			err := stopAll(context.Background(), tc.timeout, tc.stops...)
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.Less(time.Since(start), tc.timeout+time.Second)
+		})
+	}
+}
+
+func Test_onStopBounded(t *testing.T) {
+	assert := assert.New(t)
+
+	shutdownCtx, shutdownCancel := context.WithCancel(context.Background())
+	defer shutdownCancel()
+
+	// The fx stop context bounds shutdown even without a configured timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	block := make(chan struct{})
+	defer close(block)
+
+	start := time.Now()
+	err := stopAll(ctx, 0, func() { <-block })
+	assert.ErrorIs(err, ErrShutdownTimeout)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.Less(time.Since(start), time.Second)
+
+	// Disabled websocket: only the shutdown context is canceled.
+	err = onStop(shutdownCancel, time.Second, nil, nil, nil, nil, nil, zap.NewNop())(context.Background())
+	assert.NoError(err)
+	assert.ErrorIs(shutdownCtx.Err(), context.Canceled)
+}
+
+type fakeCredentials struct {
+	valid chan struct{}
+	err   error
+	// expired is returned with a nil error, like the cached token is once it
+	// has expired.
+	expired bool
+}
+
+func (f *fakeCredentials) WaitUntilValid(ctx context.Context) {
+	select {
+	case <-f.valid:
+	case <-ctx.Done():
+	}
+}
+
+func (f *fakeCredentials) Credentials() (string, time.Time, error) {
+	select {
+	case <-f.valid:
+		return "token", time.Now().Add(time.Hour), nil
+	default:
+		if f.expired {
+			return "token", time.Now().Add(-time.Hour), nil
+		}
+		return "", time.Time{}, f.err
+	}
+}
+
+func Test_waitForCredentials(t *testing.T) {
+	valid := make(chan struct{})
+	close(valid)
+
+	tests := []struct {
+		description string
+		cred        credentialsWaiter
+		grace       time.Duration
+		expected    bool
+		warnings    int
+	}{
+		{
+			description: "valid credentials",
+			cred:        &fakeCredentials{valid: valid},
+			grace:       time.Minute,
+			expected:    true,
+		}, {
+			description: "invalid credentials, grace expired",
+			cred: &fakeCredentials{
+				valid: make(chan struct{}),
+				err:   errors.New("fetch failed"),
+			},
+			grace:    50 * time.Millisecond,
+			warnings: 1,
+		}, {
+			description: "expired credentials, grace expired",
+			cred: &fakeCredentials{
+				valid:   make(chan struct{}),
+				expired: true,
+			},
+			grace:    50 * time.Millisecond,
+			warnings: 1,
+		}, {
+			description: "no credentials",
+			grace:       time.Minute,
+			expected:    true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			core, logs := observer.New(zap.WarnLevel)
+
+			start := time.Now()
+			got := waitForCredentials(context.Background(), tc.cred, tc.grace, zap.New(core))
+			assert.Equal(tc.expected, got)
+			assert.Less(time.Since(start), tc.grace+time.Second)
+			assert.Equal(tc.warnings, logs.Len())
+		})
+	}
+}
+
+func Test_provideRetryBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	got, err := provideRetryBudget(RetryBudget{})
+	assert.NoError(err)
+	assert.Nil(got)
+
+	got, err = provideRetryBudget(RetryBudget{Attempts: 10, Period: time.Minute})
+	assert.NoError(err)
+	assert.NotNil(got)
+
+	got, err = provideRetryBudget(RetryBudget{Attempts: 10})
+	assert.Error(err)
+	assert.Nil(got)
+}
+
+func Test_subscribedServices(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(subscribedServices(nil))
+	assert.Equal([]string{"mock_config", "xmidt_agent"},
+		subscribedServices([]pubsub.SubscriptionInfo{
+			{Kind: "egress", Name: "*", Handlers: 1},
+			{Kind: "event", Name: "online", Handlers: 1},
+			{Kind: "service", Name: "*", Handlers: 1},
+			{Kind: "service", Name: "mock_config", Handlers: 1},
+			{Kind: "service", Name: "xmidt_agent", Handlers: 2},
+		}))
+}
+
+func Test_credentialsDiagnostics(t *testing.T) {
+	assert := assert.New(t)
+
+	errNoToken := errors.New("no token")
+	assert.Equal(diagnostics.Credentials{Err: "no token"},
+		credentialsDiagnostics("", time.Time{}, errNoToken))
+
+	future := time.Now().Add(time.Hour)
+	assert.Equal(diagnostics.Credentials{Valid: true, ExpiresAt: &future},
+		credentialsDiagnostics("token", future, nil))
+
+	past := time.Now().Add(-time.Hour)
+	assert.Equal(diagnostics.Credentials{ExpiresAt: &past},
+		credentialsDiagnostics("token", past, nil))
+}
+
+func Test_qosDiagnostics(t *testing.T) {
+	assert.Equal(t,
+		diagnostics.QOS{
+			QueuedMessages: 2,
+			QueuedBytes:    10,
+			MaxQueueBytes:  100,
+			Dropped:        map[string]uint64{"Low": 3, "Critical": 0},
+		},
+		qosDiagnostics(qos.Stats{
+			QueuedMessages: 2,
+			QueuedBytes:    10,
+			MaxQueueBytes:  100,
+			Dropped:        map[wrp.QOSLevel]uint64{wrp.QOSLow: 3, wrp.QOSCritical: 0},
+		}))
+}
+
+func Test_resolveIdentity(t *testing.T) {
+	ns := net.New(net.NewNetworkWrapper(), map[string]net.AllowedInterface{})
+	path := filepath.Join(t.TempDir(), "address")
+	require.NoError(t, os.WriteFile(path, []byte("aa:bb:cc:dd:ee:ff\n"), 0600))
+
+	tests := []struct {
+		description string
+		in          Identity
+		expected    wrp.DeviceID
+		expectedErr error
+	}{
+		{
+			description: "no sources",
+			in:          Identity{DeviceID: "mac:112233445566"},
+			expected:    "mac:112233445566",
+		}, {
+			description: "config first",
+			in: Identity{
+				DeviceID: "mac:112233445566",
+				DeviceIDSources: []DeviceIDSource{
+					{Type: "config"},
+					{Type: "file", Path: path},
+				},
+			},
+			expected: "mac:112233445566",
+		}, {
+			description: "file first",
+			in: Identity{
+				DeviceID: "mac:112233445566",
+				DeviceIDSources: []DeviceIDSource{
+					{Type: "file", Path: path},
+					{Type: "config"},
+				},
+			},
+			expected: "mac:aabbccddeeff",
+		}, {
+			description: "interface falls back to config",
+			in: Identity{
+				DeviceID: "mac:112233445566",
+				DeviceIDSources: []DeviceIDSource{
+					{Type: "interface", Interface: "does-not-exist0"},
+					{Type: "config"},
+				},
+			},
+			expected: "mac:112233445566",
+		}, {
+			description: "no network service interfaces allowed",
+			in: Identity{
+				DeviceID: "mac:112233445566",
+				DeviceIDSources: []DeviceIDSource{
+					{Type: "network_service"},
+					{Type: "config"},
+				},
+			},
+			expected: "mac:112233445566",
+		}, {
+			description: "no source provides a device id",
+			in: Identity{
+				DeviceIDSources: []DeviceIDSource{
+					{Type: "config"},
+				},
+			},
+			expectedErr: identity.ErrNoDeviceID,
+		}, {
+			description: "unknown source type",
+			in: Identity{
+				DeviceIDSources: []DeviceIDSource{
+					{Type: "unknown"},
+				},
+			},
+			expectedErr: identity.ErrInvalidSource,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := resolveIdentity(tc.in, ns)
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.Equal(tc.expected, got.DeviceID)
+		})
+	}
+}
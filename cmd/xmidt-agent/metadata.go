@@ -4,12 +4,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/xmidt-org/xmidt-agent/internal/metadata"
+	"github.com/xmidt-org/xmidt-agent/internal/pubsub"
+	loghandler "github.com/xmidt-org/xmidt-agent/internal/wrphandlers/logging"
+	metadatahandler "github.com/xmidt-org/xmidt-agent/internal/wrphandlers/metadata"
+	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/qos"
 
 	"github.com/xmidt-org/xmidt-agent/internal/net"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 type metadataIn struct {
@@ -30,9 +39,157 @@ func provideMetadataProvider(in metadataIn) (*metadata.MetadataProvider, error)
 		metadata.FirmwareOpt(in.ID.FirmwareVersion),
 		metadata.LastRebootReasonOpt(in.Ops.LastRebootReason),
 		metadata.XmidtProtocolOpt(xmidtProtocol),
-		metadata.BootTimeOpt(in.Ops.BootTime.String()),
+		metadata.BootTimeOpt(bootTime(in.Ops).String()),
 		metadata.BootRetryWaitOpt(time.Second), // should this be configured?
 		metadata.InterfaceUsedOpt(in.Ops.WebpaInterfaceUsed),
 	}
+	if in.Metadata.InterfaceStats {
+		opts = append(opts, metadata.InterfaceStatsSourceOpt(&net.ProcNetDev{
+			Path: in.Metadata.InterfaceStatsPath,
+		}))
+	}
+	if in.Metadata.FirmwareVersionFile != "" {
+		opts = append(opts, metadata.FirmwareFuncOpt(
+			firmwareFromFile(in.Metadata.FirmwareVersionFile, in.ID.FirmwareVersion),
+		))
+	}
+	for field, ttl := range in.Metadata.CacheTTLs {
+		opts = append(opts, metadata.FieldCacheTTLOpt(ttl, field))
+	}
 	return metadata.New(opts...)
 }
+
+// firmwareFromFile returns a function that reads the firmware version from
+// the file, or returns the fallback if the file can't be read or is empty.
+func firmwareFromFile(path, fallback string) func() string {
+	return func() string {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fallback
+		}
+
+		if fw := strings.TrimSpace(string(b)); fw != "" {
+			return fw
+		}
+		return fallback
+	}
+}
+
+type metadataReporterIn struct {
+	fx.In
+	ID       Identity
+	Metadata Metadata
+	Provider *metadata.MetadataProvider
+	Egress   *qos.Handler
+	LC       fx.Lifecycle
+
+	ShutdownCtx context.Context `name:"shutdown"`
+}
+
+type metadataReporterOut struct {
+	fx.Out
+
+	Cancels []func() `group:"cancels,flatten"`
+}
+
+func provideMetadataReporter(in metadataReporterIn) (metadataReporterOut, error) {
+	if !in.Metadata.Report.Enabled {
+		return metadataReporterOut{}, nil
+	}
+
+	opts := []metadata.ReporterOption{
+		metadata.ReportShutdownContext(in.ShutdownCtx),
+	}
+	if in.Metadata.Report.Fields != nil {
+		opts = append(opts, metadata.ReportFields(in.Metadata.Report.Fields...))
+	}
+	if in.Metadata.Report.Interval > 0 {
+		opts = append(opts, metadata.ReportInterval(in.Metadata.Report.Interval))
+	}
+	if in.Metadata.Report.Destination != "" {
+		opts = append(opts, metadata.ReportDestination(in.Metadata.Report.Destination))
+	}
+	if in.Metadata.Report.Always {
+		opts = append(opts, metadata.ReportAlways())
+	}
+
+	r, err := metadata.NewReporter(in.Provider, in.Egress, string(in.ID.DeviceID), opts...)
+	if err != nil {
+		return metadataReporterOut{}, err
+	}
+
+	in.LC.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			r.Start()
+			return nil
+		},
+	})
+
+	return metadataReporterOut{
+		Cancels: []func(){r.Stop},
+	}, nil
+}
+
+type metadataHandlerIn struct {
+	fx.In
+	ID       Identity
+	Metadata Metadata
+	Provider *metadata.MetadataProvider
+	Logger   *zap.Logger
+
+	PubSub *pubsub.PubSub
+	Egress *qos.Handler
+}
+
+type metadataHandlerOut struct {
+	fx.Out
+
+	Cancel func() `group:"cancels"`
+}
+
+// provideMetadataHandler subscribes the service responding to metadata
+// requests, if it is enabled.
+func provideMetadataHandler(in metadataHandlerIn) (metadataHandlerOut, error) {
+	if !in.Metadata.Service.Enabled {
+		return metadataHandlerOut{}, nil
+	}
+
+	h, err := metadatahandler.New(in.Egress, string(in.ID.DeviceID), in.Provider)
+	if err != nil {
+		return metadataHandlerOut{}, errors.Join(ErrWRPHandlerConfig, err)
+	}
+
+	lh, err := loghandler.New(h,
+		in.Logger.With(
+			zap.String("stage", "ingress"),
+			zap.String("handler", "metadata"),
+		))
+	if err != nil {
+		return metadataHandlerOut{}, err
+	}
+
+	cancel, err := in.PubSub.SubscribeService(in.Metadata.Service.ServiceName, lh)
+	if err != nil {
+		return metadataHandlerOut{}, errors.Join(ErrWRPHandlerConfig, err)
+	}
+
+	return metadataHandlerOut{
+		Cancel: cancel,
+	}, nil
+}
+
+// bootTime returns the configured boot time, or the boot time computed from
+// the OS uptime if none is configured.  The configured value is used as is
+// if the uptime is not available on the platform.
+func bootTime(ops OperationalState) time.Time {
+	if !ops.BootTime.IsZero() {
+		return ops.BootTime
+	}
+
+	bt, err := metadata.BootTimeFromUptime(&metadata.ProcUptime{Path: ops.UptimePath}, time.Now)
+	if err != nil {
+		return ops.BootTime
+	}
+
+	return bt
+}
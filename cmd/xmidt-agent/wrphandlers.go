@@ -3,18 +3,25 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/announce"
+	"github.com/xmidt-org/xmidt-agent/internal/credentials"
+	"github.com/xmidt-org/xmidt-agent/internal/fs"
 	"github.com/xmidt-org/xmidt-agent/internal/loglevel"
 	"github.com/xmidt-org/xmidt-agent/internal/pubsub"
 	"github.com/xmidt-org/xmidt-agent/internal/websocket"
 	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
 	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/auth"
+	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/diagnostics"
 	loghandler "github.com/xmidt-org/xmidt-agent/internal/wrphandlers/logging"
 	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/missing"
 	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/mocktr181"
 	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/qos"
+	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/stackdump"
 	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/xmidt_agent_crud"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
@@ -34,6 +41,9 @@ func provideWRPHandlers() fx.Option {
 			provideQOSHandler,
 			provideWSEventorToHandlerAdapter,
 			provideMockTr181Handler,
+			provideAnnouncer,
+			provideDiagnosticsHandler,
+			provideStackDumpHandler,
 		),
 	)
 }
@@ -76,9 +86,12 @@ func provideWSEventorToHandlerAdapter(in wsAdapterIn) (wsAdapterOut, error) {
 type qosIn struct {
 	fx.In
 
-	QOS    QOS
-	Logger *zap.Logger
-	WS     *websocket.Websocket
+	QOS     QOS
+	Logger  *zap.Logger
+	WS      *websocket.Websocket
+	Durable fs.FS `name:"durable_fs" optional:"true"`
+
+	ShutdownCtx context.Context `name:"shutdown"`
 }
 
 func provideQOSHandler(in qosIn) (*qos.Handler, error) {
@@ -90,16 +103,37 @@ func provideQOSHandler(in qosIn) (*qos.Handler, error) {
 		return nil, err
 	}
 
-	return qos.New(
-		lh,
+	dropLogger := in.Logger.With(zap.String("stage", "egress"), zap.String("handler", "qos"))
+
+	opts := []qos.Option{
 		qos.MaxQueueBytes(in.QOS.MaxQueueBytes),
 		qos.MaxMessageBytes(in.QOS.MaxMessageBytes),
+		qos.MaxQueueCount(in.QOS.MaxQueueCount),
 		qos.Priority(in.QOS.Priority),
 		qos.LowExpires(in.QOS.LowExpires),
 		qos.MediumExpires(in.QOS.MediumExpires),
 		qos.HighExpires(in.QOS.HighExpires),
 		qos.CriticalExpires(in.QOS.CriticalExpires),
-	)
+		qos.DeliveryConcurrency(in.QOS.DeliveryConcurrency),
+		qos.PreserveOrderPerDestination(in.QOS.PreserveOrderPerDestination),
+		qos.PerDestinationFairness(in.QOS.PerDestinationFairness),
+		qos.MaxQueueMemoryFraction(in.QOS.MaxQueueMemoryFraction),
+		qos.ShutdownContext(in.ShutdownCtx),
+		qos.WithDropHandler(func(msg wrp.Message, reason string) {
+			dropLogger.Warn("message dropped",
+				zap.String("reason", reason),
+				zap.String("destination", msg.Destination),
+				zap.String("transaction_uuid", msg.TransactionUUID),
+				zap.Int("qos", int(msg.QualityOfService)),
+			)
+		}),
+	}
+
+	if in.Durable != nil && in.QOS.PersistFile != "" {
+		opts = append(opts, qos.Persist(in.Durable, in.QOS.PersistFile))
+	}
+
+	return qos.New(lh, opts...)
 }
 
 type missingIn struct {
@@ -215,6 +249,8 @@ func providePubSubHandler(in pubsubIn) (pubsubOut, error) {
 
 	opts := []pubsub.Option{
 		pubsub.WithPublishTimeout(in.Pubsub.PublishTimeout),
+		pubsub.WithMaxFanout(in.Pubsub.MaxFanout),
+		pubsub.WithMaxInFlightPerSource(in.Pubsub.MaxInFlightPerSource),
 		pubsub.WithEgressHandler(lh, &cancel),
 	}
 	ps, err := pubsub.New(
@@ -264,6 +300,7 @@ func provideMockTr181Handler(in mockTr181In) (mockTr181Out, error) {
 	mockDefaults := []mocktr181.Option{
 		mocktr181.FilePath(in.MockTr181.FilePath),
 		mocktr181.Enabled(in.MockTr181.Enabled),
+		mocktr181.Persist(in.MockTr181.Persist),
 	}
 	mocktr181Handler, err := mocktr181.New(loggerOut, string(in.Identity.DeviceID), mockDefaults...)
 	if err != nil {
@@ -290,3 +327,220 @@ func provideMockTr181Handler(in mockTr181In) (mockTr181Out, error) {
 		Cancel: mocktr,
 	}, nil
 }
+
+type announcerIn struct {
+	fx.In
+
+	// Configuration
+	// Note, DeviceID is pulled from the Identity configuration
+	Identity     Identity
+	Announcement Announcement
+
+	WS     *websocket.Websocket
+	PubSub *pubsub.PubSub
+	Egress *qos.Handler
+}
+
+type announcerOut struct {
+	fx.Out
+	Cancels []func() `group:"cancels,flatten"`
+}
+
+func provideAnnouncer(in announcerIn) (announcerOut, error) {
+	if in.WS == nil {
+		return announcerOut{}, nil
+	}
+
+	var cancels []func()
+	if in.Announcement.Enabled {
+		var opts []announce.Option
+		if in.Announcement.Destination != "" {
+			opts = append(opts, announce.Destination(in.Announcement.Destination))
+		}
+
+		a, err := announce.New(in.Egress, string(in.Identity.DeviceID),
+			func() []string {
+				return subscribedServices(in.PubSub.Subscriptions())
+			},
+			opts...,
+		)
+		if err != nil {
+			return announcerOut{}, errors.Join(ErrWRPHandlerConfig, err)
+		}
+
+		cancels = append(cancels, in.WS.AddConnectListener(a))
+	}
+
+	if in.Announcement.Reconnect.Enabled {
+		var opts []announce.Option
+		if in.Announcement.Reconnect.Destination != "" {
+			opts = append(opts, announce.Destination(in.Announcement.Reconnect.Destination))
+		}
+
+		r, err := announce.NewReconnect(in.Egress, string(in.Identity.DeviceID), opts...)
+		if err != nil {
+			return announcerOut{}, errors.Join(ErrWRPHandlerConfig, err)
+		}
+
+		cancels = append(cancels,
+			in.WS.AddDisconnectListener(r),
+			in.WS.AddConnectListener(r),
+		)
+	}
+
+	return announcerOut{
+		Cancels: cancels,
+	}, nil
+}
+
+type diagnosticsIn struct {
+	fx.In
+
+	// Configuration
+	// Note, DeviceID is pulled from the Identity configuration
+	Identity    Identity
+	Diagnostics Diagnostics
+
+	WS     *websocket.Websocket
+	Cred   *credentials.Credentials
+	PubSub *pubsub.PubSub
+	Egress *qos.Handler
+}
+
+type diagnosticsOut struct {
+	fx.Out
+	Cancels []func() `group:"cancels,flatten"`
+}
+
+func provideDiagnosticsHandler(in diagnosticsIn) (diagnosticsOut, error) {
+	if !in.Diagnostics.Enabled || in.WS == nil {
+		return diagnosticsOut{}, nil
+	}
+
+	opts := []diagnostics.Option{
+		diagnostics.MaxDisconnects(in.Diagnostics.MaxDisconnects),
+		diagnostics.TransportFunc(func() diagnostics.Transport {
+			return diagnostics.Transport{
+				State: in.WS.ConnectionState().String(),
+				URL:   in.WS.URL(),
+			}
+		}),
+		diagnostics.QOSFunc(func() diagnostics.QOS {
+			return qosDiagnostics(in.Egress.Stats())
+		}),
+	}
+	if in.Cred != nil {
+		opts = append(opts, diagnostics.CredentialsFunc(func() diagnostics.Credentials {
+			return credentialsDiagnostics(in.Cred.Credentials())
+		}))
+	}
+
+	h, err := diagnostics.New(in.Egress, string(in.Identity.DeviceID), opts...)
+	if err != nil {
+		return diagnosticsOut{}, errors.Join(ErrWRPHandlerConfig, err)
+	}
+
+	cancel, err := in.PubSub.SubscribeService(in.Diagnostics.ServiceName, h)
+	if err != nil {
+		return diagnosticsOut{}, errors.Join(ErrWRPHandlerConfig, err)
+	}
+
+	return diagnosticsOut{
+		Cancels: []func(){
+			cancel,
+			in.WS.AddDisconnectListener(h),
+		},
+	}, nil
+}
+
+// credentialsDiagnostics converts the result of Credentials.Credentials into
+// the diagnostics credentials section.
+func credentialsDiagnostics(_ string, expiresAt time.Time, err error) diagnostics.Credentials {
+	if err != nil {
+		return diagnostics.Credentials{Err: err.Error()}
+	}
+
+	return diagnostics.Credentials{
+		Valid:     time.Now().Before(expiresAt),
+		ExpiresAt: &expiresAt,
+	}
+}
+
+// qosDiagnostics converts the qos stats into the diagnostics qos section,
+// naming the qos levels.
+func qosDiagnostics(s qos.Stats) diagnostics.QOS {
+	dropped := make(map[string]uint64, len(s.Dropped))
+	for level, n := range s.Dropped {
+		dropped[level.String()] = n
+	}
+
+	return diagnostics.QOS{
+		QueuedMessages: s.QueuedMessages,
+		QueuedBytes:    s.QueuedBytes,
+		MaxQueueBytes:  s.MaxQueueBytes,
+		Dropped:        dropped,
+	}
+}
+
+type stackDumpIn struct {
+	fx.In
+
+	// Configuration
+	// Note, DeviceID is pulled from the Identity configuration
+	Identity  Identity
+	StackDump StackDump
+	Logger    *zap.Logger
+
+	PubSub *pubsub.PubSub
+	Egress *qos.Handler
+}
+
+type stackDumpOut struct {
+	fx.Out
+	Cancel func() `group:"cancels"`
+}
+
+func provideStackDumpHandler(in stackDumpIn) (stackDumpOut, error) {
+	if !in.StackDump.Enabled {
+		return stackDumpOut{}, nil
+	}
+
+	h, err := stackdump.New(in.Egress, string(in.Identity.DeviceID),
+		stackdump.TrustedSources(in.StackDump.TrustedSources...),
+		stackdump.MaxBytes(in.StackDump.MaxBytes),
+	)
+	if err != nil {
+		return stackDumpOut{}, errors.Join(ErrWRPHandlerConfig, err)
+	}
+
+	lh, err := loghandler.New(h,
+		in.Logger.With(
+			zap.String("stage", "ingress"),
+			zap.String("handler", "stackDump"),
+		))
+	if err != nil {
+		return stackDumpOut{}, err
+	}
+
+	cancel, err := in.PubSub.SubscribeService(in.StackDump.ServiceName, lh)
+	if err != nil {
+		return stackDumpOut{}, errors.Join(ErrWRPHandlerConfig, err)
+	}
+
+	return stackDumpOut{
+		Cancel: cancel,
+	}, nil
+}
+
+// subscribedServices returns the names of the services with a subscription,
+// ignoring the wildcard.
+func subscribedServices(subs []pubsub.SubscriptionInfo) []string {
+	var services []string
+	for _, sub := range subs {
+		if sub.Kind == "service" && sub.Name != "*" {
+			services = append(services, sub.Name)
+		}
+	}
+
+	return services
+}
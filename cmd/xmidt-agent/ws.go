@@ -6,13 +6,16 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/url"
 	"time"
 
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/budget"
 	"github.com/xmidt-org/xmidt-agent/internal/credentials"
 	"github.com/xmidt-org/xmidt-agent/internal/jwtxt"
 	"github.com/xmidt-org/xmidt-agent/internal/metadata"
+	nhws "github.com/xmidt-org/xmidt-agent/internal/nhooyr.io/websocket"
 	"github.com/xmidt-org/xmidt-agent/internal/websocket"
 	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
 	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
@@ -24,6 +27,13 @@ var (
 	ErrWebsocketConfig = errors.New("websocket configuration error")
 )
 
+var compressionModes = map[string]nhws.CompressionMode{
+	"":                    nhws.CompressionDisabled,
+	"disabled":            nhws.CompressionDisabled,
+	"context-takeover":    nhws.CompressionContextTakeover,
+	"no-context-takeover": nhws.CompressionNoContextTakeover,
+}
+
 type wsIn struct {
 	fx.In
 	Identity  Identity
@@ -33,6 +43,9 @@ type wsIn struct {
 	Cred      *credentials.Credentials
 	Metadata  *metadata.MetadataProvider
 	Websocket Websocket
+	Budget    *budget.Budget
+
+	ShutdownCtx context.Context `name:"shutdown"`
 }
 
 type wsOut struct {
@@ -57,6 +70,12 @@ func provideWS(in wsIn) (wsOut, error) {
 		fetchURLFunc = in.JWTXT.Endpoint
 	}
 
+	compression, ok := compressionModes[in.Websocket.Compression]
+	if !ok {
+		return wsOut{}, errors.Join(ErrWebsocketConfig,
+			fmt.Errorf("unknown compression mode '%s'", in.Websocket.Compression))
+	}
+
 	var opts []websocket.Option
 	// Allow operations where no credentials are desired (in.Cred will be nil).
 	if in.Cred != nil {
@@ -70,26 +89,124 @@ func provideWS(in wsIn) (wsOut, error) {
 		websocket.FetchURL(
 			fetchURL(in.Websocket.URLPath, in.Websocket.BackUpURL,
 				fetchURLFunc)),
+		websocket.NormalizeURLScheme(),
 		websocket.InactivityTimeout(in.Websocket.InactivityTimeout),
+		websocket.WatchdogTimeout(in.Websocket.WatchdogTimeout),
+		websocket.MaxConnectionLifetime(in.Websocket.MaxConnectionLifetime),
 		websocket.PingWriteTimeout(in.Websocket.PingWriteTimeout),
 		websocket.SendTimeout(in.Websocket.SendTimeout),
+		websocket.SendQueueDepth(in.Websocket.SendQueueDepth),
+		websocket.Compression(compression, in.Websocket.CompressionThreshold),
 		websocket.KeepAliveInterval(in.Websocket.KeepAliveInterval),
 		websocket.HTTPClientWithForceSets(in.Websocket.HTTPClient),
 		websocket.MaxMessageBytes(in.Websocket.MaxMessageBytes),
+		websocket.MaxHeaderBytes(in.Websocket.MaxHeaderBytes),
 		websocket.ConveyDecorator(in.Metadata.Decorate),
 		websocket.AdditionalHeaders(in.Websocket.AdditionalHeaders),
 		websocket.NowFunc(time.Now),
+		websocket.ShutdownContext(in.ShutdownCtx),
 		websocket.WithIPv6(!in.Websocket.DisableV6),
 		websocket.WithIPv4(!in.Websocket.DisableV4),
+		websocket.StickyIPMode(in.Websocket.StickyIPMode),
+		websocket.HappyEyeballs(in.Websocket.HappyEyeballs),
 		websocket.Once(in.Websocket.Once),
+		websocket.MaxReconnects(in.Websocket.MaxReconnects),
+		websocket.MinReconnectInterval(in.Websocket.MinReconnectInterval),
 		websocket.RetryPolicy(in.Websocket.RetryPolicy),
+		websocket.RetryBudget(in.Budget),
 	)
 
+	if len(in.Websocket.PinnedCerts) > 0 {
+		opts = append(opts, websocket.PinnedCerts(in.Websocket.PinnedCerts...))
+	}
+	if len(in.Websocket.ALPNProtocols) > 0 {
+		opts = append(opts,
+			websocket.ALPNProtocols(in.Websocket.ALPNProtocols),
+			websocket.RequireALPN(in.Websocket.RequireALPN))
+	}
+	if in.Websocket.InsecureSkipTLSVerify {
+		in.Logger.Named("websocket").Warn("INSECURE: TLS verification of the websocket server is disabled, lab use only")
+		opts = append(opts, websocket.InsecureSkipTLSVerify(true))
+	}
+	if len(in.Websocket.CompressionSkipContentTypes) > 0 {
+		opts = append(opts,
+			websocket.CompressionSkipContentTypes(in.Websocket.CompressionSkipContentTypes...))
+	}
+	if len(in.Websocket.Subprotocols) > 0 {
+		opts = append(opts, websocket.Subprotocols(in.Websocket.Subprotocols))
+	}
+	if in.Websocket.FollowCloseRedirects {
+		opts = append(opts, websocket.CloseRedirect(websocket.ParseCloseRedirect))
+	}
+	// The backup url is used directly when there is no JWTXT, so it is only a
+	// fallback otherwise.
+	var backupURL string
+	if in.JWTXT != nil && in.Websocket.BackUpURL != "" {
+		var err error
+		backupURL, err = url.JoinPath(in.Websocket.BackUpURL, in.Websocket.URLPath)
+		if err != nil {
+			return wsOut{}, errors.Join(ErrWebsocketConfig, err)
+		}
+		opts = append(opts, websocket.BackupURL(backupURL))
+	}
+	if in.Websocket.DecodeFailureThreshold > 0 {
+		opts = append(opts,
+			websocket.DecodeFailureBackoff(in.Websocket.DecodeFailureThreshold,
+				in.Websocket.DecodeFailureBackoff))
+	}
+	if in.Websocket.ProxyURL != "" {
+		opts = append(opts,
+			websocket.ProxyConfig(in.Websocket.ProxyURL,
+				in.Websocket.ProxyUser, in.Websocket.ProxyPassword))
+	}
+
 	// Listener options
 	var (
-		msg, con, discon, heartbeat event.CancelFunc
-		cancels                     []func()
+		msg, con, discon, heartbeat, sendFailure, modeSwitch, rotation, urlFallback, decodeBackoff event.CancelFunc
+		cancels                                                                                    []func()
+	)
+
+	// Mode switches help diagnose a preferred IP mode that keeps failing, and
+	// rotations explain the reconnects of healthy connections.
+	modeLogger := in.Logger.Named("websocket")
+	opts = append(opts,
+		websocket.AddModeSwitchListener(
+			event.ModeSwitchListenerFunc(func(e event.ModeSwitch) {
+				modeLogger.Debug("ip mode switch",
+					zap.String("from", string(e.From)),
+					zap.String("to", string(e.To)),
+					zap.NamedError("prior_err", e.PriorErr),
+				)
+			}), &modeSwitch),
+		websocket.AddRotationListener(
+			event.RotationListenerFunc(func(e event.Rotation) {
+				modeLogger.Debug("connection rotated",
+					zap.Duration("lifetime", e.Lifetime),
+				)
+			}), &rotation),
+		websocket.AddDecodeBackoffListener(
+			event.DecodeBackoffListenerFunc(func(e event.DecodeBackoff) {
+				modeLogger.Info("backing off after malformed messages",
+					zap.Int("failures", e.Failures),
+					zap.Duration("backoff", e.Backoff),
+					zap.Error(e.Err),
+				)
+			}), &decodeBackoff),
 	)
+	cancels = append(cancels, modeSwitch, rotation, decodeBackoff)
+
+	if backupURL != "" {
+		opts = append(opts,
+			websocket.AddURLFallbackListener(
+				event.URLFallbackListenerFunc(func(e event.URLFallback) {
+					modeLogger.Info("using the backup url",
+						zap.String("url", e.URL),
+						zap.Error(e.Err),
+					)
+				}), &urlFallback),
+		)
+		cancels = append(cancels, urlFallback)
+	}
 	if in.CLI.Dev {
 		logger := in.Logger.Named("websocket")
 		opts = append(opts,
@@ -112,6 +229,10 @@ func provideWS(in wsIn) (wsOut, error) {
 				event.HeartbeatListenerFunc(func(e event.Heartbeat) {
 					logger.Info("heartbeat listener", zap.Any("event", e))
 				}), &heartbeat),
+			websocket.AddSendFailureListener(
+				event.SendFailureListenerFunc(func(e event.SendFailure) {
+					logger.Info("send failure listener", zap.Any("event", e))
+				}), &sendFailure),
 		)
 	}
 
@@ -121,7 +242,7 @@ func provideWS(in wsIn) (wsOut, error) {
 	}
 
 	if in.CLI.Dev {
-		cancels = append(cancels, msg, con, discon, heartbeat)
+		cancels = append(cancels, msg, con, discon, heartbeat, sendFailure)
 	}
 
 	return wsOut{
@@ -137,12 +258,9 @@ func fetchURL(path, backUpURL string, f func(context.Context) (string, error)) f
 			return url.JoinPath(backUpURL, path)
 		}
 
+		// Falling back to the backup url is handled by the websocket.
 		baseURL, err := f(ctx)
 		if err != nil {
-			if backUpURL != "" {
-				return url.JoinPath(backUpURL, path)
-			}
-
 			return "", err
 		}
 
@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_provideWS(t *testing.T) {
+	tests := []struct {
+		description string
+		in          wsIn
+		checkLog    func(assert *assert.Assertions, logs []observer.LoggedEntry)
+	}{
+		{
+			description: "TLS verification enabled",
+			checkLog: func(assert *assert.Assertions, logs []observer.LoggedEntry) {
+				assert.Empty(logs)
+			},
+		},
+		{
+			description: "TLS verification disabled",
+			in: wsIn{
+				Websocket: Websocket{
+					InsecureSkipTLSVerify: true,
+				},
+			},
+			checkLog: func(assert *assert.Assertions, logs []observer.LoggedEntry) {
+				assert.Len(logs, 1)
+				assert.Equal(zap.WarnLevel, logs[0].Level)
+				assert.Contains(logs[0].Message, "TLS verification of the websocket server is disabled")
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			core, logs := observer.New(zap.WarnLevel)
+			tc.in.Logger = zap.New(core)
+			tc.in.CLI = &CLI{}
+			tc.in.Identity.DeviceID = wrp.DeviceID("mac:112233445566")
+			tc.in.Websocket.BackUpURL = "https://example.com"
+			tc.in.ShutdownCtx = context.Background()
+
+			got, err := provideWS(tc.in)
+			require.NoError(err)
+			assert.NotNil(got.WS)
+
+			tc.checkLog(assert, logs.AllUntimed())
+		})
+	}
+}
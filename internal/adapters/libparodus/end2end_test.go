@@ -7,13 +7,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/retry"
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/adapters/libparodus/event"
 	"github.com/xmidt-org/xmidt-agent/internal/pubsub"
 	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
 	"go.nanomsg.org/mangos/v3"
@@ -318,9 +321,33 @@ func TestEnd2End(t *testing.T) {
 		},
 	})
 
+	// Both services are registered and the test service forwarded the
+	// message it sent as itself, which is also delivered back to it.
+	mOther.WaitFor(ctx, wrp.Message{
+		Type: wrp.SimpleRequestResponseMessageType,
+	})
+	assert.Eventually(func() bool {
+		services := a.Services()
+		return len(services) == 2 && services[1].Forwarded == 1
+	}, time.Second, 10*time.Millisecond)
+
+	services := a.Services()
+	require.Len(services, 2)
+	assert.Equal("other", services[0].Name)
+	assert.Equal("test", services[1].Name)
+	for _, s := range services {
+		assert.False(s.RegisteredAt.IsZero())
+		assert.NotZero(s.Delivered)
+		assert.Zero(s.Failed)
+	}
+	assert.Zero(services[0].Forwarded)
+	assert.GreaterOrEqual(services[1].Delivered, uint64(2))
+
 	// Send a message to the 'test' service.
 	a.Stop()
 
+	assert.Empty(a.Services())
+
 	// It's ok to stop it multiple times.
 	a.Stop()
 
@@ -336,3 +363,194 @@ func TestEnd2End(t *testing.T) {
 	})
 	assert.ErrorIs(err, wrpkit.ErrNotHandled)
 }
+
+func TestStartRetry(t *testing.T) {
+	tests := []struct {
+		description string
+		opts        []Option
+		expectErr   bool
+	}{
+		{
+			description: "retry until the address is available",
+			opts: []Option{
+				RetryPolicy(retry.Config{
+					Interval:   50 * time.Millisecond,
+					MaxRetries: 10,
+				}),
+			},
+		}, {
+			description: "no retry policy",
+			expectErr:   true,
+		}, {
+			description: "retries exhausted",
+			opts: []Option{
+				RetryPolicy(retry.Config{
+					Interval:   10 * time.Millisecond,
+					MaxRetries: 1,
+				}),
+			},
+			expectErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			// Hold the address so the first attempt to listen fails.
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(err)
+
+			ps, err := pubsub.New(wrp.DeviceID("mac:112233445566"))
+			require.NoError(err)
+
+			a, err := New("tcp://"+l.Addr().String(), ps,
+				append(tc.opts, ReceiveTimeout(100*time.Millisecond))...,
+			)
+			require.NoError(err)
+
+			time.AfterFunc(100*time.Millisecond, func() {
+				_ = l.Close()
+			})
+
+			err = a.Start()
+			defer a.Stop()
+
+			if tc.expectErr {
+				assert.Error(err)
+				return
+			}
+
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	lpURL := "tcp://" + l.Addr().String()
+	require.NoError(l.Close())
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	lpTestUrl := "tcp://" + l.Addr().String()
+	require.NoError(l.Close())
+
+	ps, err := pubsub.New(wrp.DeviceID("mac:112233445566"))
+	require.NoError(err)
+
+	connects := make(chan event.Connect, 10)
+	disconnects := make(chan event.Disconnect, 10)
+
+	a, err := New(lpURL, ps,
+		ReceiveTimeout(100*time.Millisecond),
+		SendTimeout(100*time.Millisecond),
+		KeepaliveInterval(100*time.Millisecond),
+		ReconnectInterval(50*time.Millisecond),
+		AddConnectListener(event.ConnectListenerFunc(func(c event.Connect) {
+			connects <- c
+		})),
+		AddDisconnectListener(event.DisconnectListenerFunc(func(d event.Disconnect) {
+			disconnects <- d
+		})),
+	)
+	require.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(a.Start())
+	defer a.Stop()
+
+	// Make the socket fail out from under the adapter.
+	a.lock.Lock()
+	sock := a.sock
+	a.lock.Unlock()
+	require.NotNil(sock)
+	require.NoError(sock.Close())
+
+	select {
+	case d := <-disconnects:
+		assert.Equal(lpURL, d.URL)
+		assert.ErrorIs(d.Err, mangos.ErrClosed)
+	case <-ctx.Done():
+		require.FailNow("timed out waiting for the disconnect event")
+	}
+
+	select {
+	case c := <-connects:
+		assert.Equal(lpURL, c.URL)
+		assert.NoError(c.Err)
+	case <-ctx.Done():
+		require.FailNow("timed out waiting for the connect event")
+	}
+
+	// A service is able to attach to the new socket.
+	mTest := mockLibParodus{
+		assert:  assert,
+		require: require,
+	}
+	mTest.Listen(ctx, lpTestUrl)
+
+	auth := wrp.Message{Type: wrp.AuthorizationMessageType}
+	for !mTest.HasReceived(auth) && ctx.Err() == nil {
+		_ = mTest.Send(lpURL, wrp.Message{
+			Type:        wrp.ServiceRegistrationMessageType,
+			URL:         lpTestUrl,
+			ServiceName: "test",
+		})
+		wait, stop := context.WithTimeout(ctx, 200*time.Millisecond)
+		mTest.WaitFor(wait, auth)
+		stop()
+	}
+	assert.True(mTest.HasReceived(auth))
+}
+
+func TestReconnectInterval(t *testing.T) {
+	ps, err := pubsub.New(wrp.DeviceID("mac:112233445566"))
+	require.NoError(t, err)
+
+	_, err = New("tcp://127.0.0.1:9999", ps, ReconnectInterval(-1))
+	assert.ErrorIs(t, err, ErrInvalidInput)
+
+	a, err := New("tcp://127.0.0.1:9999", ps, ReconnectInterval(0))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultReconnectInterval, a.reconnectInterval)
+}
+
+func TestShutdownContext(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	lpURL := "tcp://" + l.Addr().String()
+	require.NoError(l.Close())
+
+	ps, err := pubsub.New(wrp.DeviceID("mac:112233445566"))
+	require.NoError(err)
+
+	_, err = New(lpURL, ps, ShutdownContext(nil)) //nolint:staticcheck
+	require.ErrorIs(err, ErrInvalidInput)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a, err := New(lpURL, ps,
+		ReceiveTimeout(10*time.Millisecond),
+		ShutdownContext(ctx),
+	)
+	require.NoError(err)
+
+	require.NoError(a.Start())
+	defer a.Stop()
+
+	// Canceling the shutdown context closes the socket without calling Stop.
+	cancel()
+	require.Eventually(func() bool {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		return a.sock == nil
+	}, 2*time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package event
+
+import "time"
+
+// CancelFunc is the interface that provides a method to cancel a listener.
+type CancelFunc func()
+
+// Connect is the event that is sent when the adapter attempts to (re)listen
+// on the parodus service url after the socket failed.
+type Connect struct {
+	// At holds the time when the attempt succeeded/errored out.
+	At time.Time
+
+	// URL is the parodus service url.
+	URL string
+
+	// Error is the error returned from the attempt to listen.
+	Err error
+}
+
+// ConnectListener is the interface that must be implemented by types that
+// want to receive Connect notifications.
+type ConnectListener interface {
+	OnConnect(Connect)
+}
+
+// ConnectListenerFunc is a function type that implements ConnectListener.
+// It can be used as an adapter for functions that need to implement the
+// ConnectListener interface.
+type ConnectListenerFunc func(Connect)
+
+func (f ConnectListenerFunc) OnConnect(c Connect) {
+	f(c)
+}
+
+// Disconnect is the event that is sent when the socket listening on the
+// parodus service url fails.
+type Disconnect struct {
+	// At holds the time when the socket failed.
+	At time.Time
+
+	// URL is the parodus service url.
+	URL string
+
+	// Error is the error returned from the socket.
+	Err error
+}
+
+// DisconnectListener is the interface that must be implemented by types that
+// want to receive Disconnect notifications.
+type DisconnectListener interface {
+	OnDisconnect(Disconnect)
+}
+
+// DisconnectListenerFunc is a function type that implements DisconnectListener.
+// It can be used as an adapter for functions that need to implement the
+// DisconnectListener interface.
+type DisconnectListenerFunc func(Disconnect)
+
+func (f DisconnectListenerFunc) OnDisconnect(d Disconnect) {
+	f(d)
+}
@@ -6,6 +6,7 @@ package libparodus
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xmidt-org/wrp-go/v3"
@@ -45,6 +46,12 @@ type external struct {
 	name              string
 	heartbeatInterval time.Duration
 	terminate         func()
+	registeredAt      time.Time
+
+	// The message counts reported by Adapter.Services().
+	delivered atomic.Uint64
+	failed    atomic.Uint64
+	forwarded atomic.Uint64
 
 	// Everything below is private to the sub
 	lock sync.Mutex
@@ -64,6 +71,7 @@ func newExternal(ctx context.Context,
 	ex := external{
 		name:              name,
 		heartbeatInterval: heartbeatInterval,
+		registeredAt:      time.Now(),
 	}
 
 	ex.lock.Lock()
@@ -134,10 +142,28 @@ func (s *external) HandleWrp(msg wrp.Message) error {
 
 	var buf []byte
 	if err := wrp.NewEncoderBytes(&buf, wrp.Msgpack).Encode(msg); err != nil {
+		s.failed.Add(1)
+		return err
+	}
+
+	if err := s.sock.Send(buf); err != nil {
+		s.failed.Add(1)
 		return err
 	}
 
-	return s.sock.Send(buf)
+	s.delivered.Add(1)
+	return nil
+}
+
+// stat returns the registration time and message counts of the service.
+func (s *external) stat() ServiceStat {
+	return ServiceStat{
+		Name:         s.name,
+		RegisteredAt: s.registeredAt,
+		Delivered:    s.delivered.Load(),
+		Failed:       s.failed.Load(),
+		Forwarded:    s.forwarded.Load(),
+	}
 }
 
 // keepalive sends a keepalive message to the external service.  At some point
@@ -6,10 +6,15 @@ package libparodus
 import (
 	"context"
 	"errors"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/xmidt-org/eventor"
+	"github.com/xmidt-org/retry"
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/adapters/libparodus/event"
 	"github.com/xmidt-org/xmidt-agent/internal/pubsub"
 	"go.nanomsg.org/mangos/v3"
 	"go.nanomsg.org/mangos/v3/protocol/pull"
@@ -23,6 +28,12 @@ var (
 	ErrNoService    = errors.New("service not found")
 )
 
+const (
+	// DefaultReconnectInterval is the time waited between attempts to listen
+	// on the parodus service url again after the socket failed.
+	DefaultReconnectInterval = time.Second
+)
+
 // This package provides backwards compatibility for the libparodus library.
 
 // Adapter is a struct representing a service that listens for messages from
@@ -32,14 +43,44 @@ type Adapter struct {
 	lock        sync.Mutex
 	wg          sync.WaitGroup
 	shutdown    context.CancelFunc
+	shutdownCtx context.Context
 	listening   chan error
 	subServices map[string]*external
+	sock        mangos.Socket
 
 	parodusServiceURL string
 	keepaliveInterval time.Duration
 	recvTimeout       time.Duration
 	sendTimeout       time.Duration
+	retryPolicy       retry.PolicyFactory
+	reconnectInterval time.Duration
 	pubsub            *pubsub.PubSub
+
+	// connectListeners are notified after each attempt to listen again
+	// after the socket failed.
+	connectListeners eventor.Eventor[event.ConnectListener]
+
+	// disconnectListeners are notified when the socket fails.
+	disconnectListeners eventor.Eventor[event.DisconnectListener]
+}
+
+// ServiceStat describes a service registered with the adapter.
+type ServiceStat struct {
+	// Name is the name the service registered with.
+	Name string
+
+	// RegisteredAt is the time the service registered.
+	RegisteredAt time.Time
+
+	// Delivered is the number of messages sent to the service.
+	Delivered uint64
+
+	// Failed is the number of messages that could not be sent to the service.
+	Failed uint64
+
+	// Forwarded is the number of messages received from the service and
+	// forwarded by the adapter.
+	Forwarded uint64
 }
 
 // Option is the interface implemented by types that can be used to
@@ -67,7 +108,9 @@ func New(url string, pubsub *pubsub.PubSub, opts ...Option) (*Adapter, error) {
 		parodusServiceURL: url,
 		pubsub:            pubsub,
 		listening:         make(chan error),
+		reconnectInterval: DefaultReconnectInterval,
 		subServices:       make(map[string]*external),
+		shutdownCtx:       context.Background(),
 	}
 
 	opts = append(opts, required...)
@@ -84,8 +127,10 @@ func New(url string, pubsub *pubsub.PubSub, opts ...Option) (*Adapter, error) {
 }
 
 // Start starts the service.  If the service is already started, this function
-// does nothing.  If an error occurs, it is not recoverable and the service can
-// not be started.
+// does nothing.  If a retry policy is configured, transient failures to start
+// listening are retried and the error is only returned once the retries are
+// exhausted.  If an error is returned, it is not recoverable and the service
+// can not be started.
 func (a *Adapter) Start() error {
 	var ctx context.Context
 
@@ -96,7 +141,7 @@ func (a *Adapter) Start() error {
 		return nil
 	}
 
-	ctx, a.shutdown = context.WithCancel(context.Background())
+	ctx, a.shutdown = context.WithCancel(a.shutdownCtx)
 
 	a.lock.Unlock()
 
@@ -136,36 +181,50 @@ func (s *Adapter) Stop() {
 	s.wg.Wait()
 }
 
+// Services returns the services currently registered with the adapter,
+// sorted by name.
+func (a *Adapter) Services() []ServiceStat {
+	a.lock.Lock()
+	stats := make([]ServiceStat, 0, len(a.subServices))
+	for _, ext := range a.subServices {
+		stats = append(stats, ext.stat())
+	}
+	a.lock.Unlock()
+
+	slices.SortFunc(stats, func(a, b ServiceStat) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return stats
+}
+
 // receive listens for messages from libparodus and forwards them to the
-// pubsub until context is canceled and the service is stopped.
+// pubsub until context is canceled and the service is stopped.  If the socket
+// fails, a new one is listened on, so services are able to reattach.
+// notifyListening tells Start whether listening succeeded, unless Start has
+// already given up because the shutdown context was canceled.
+func (a *Adapter) notifyListening(ctx context.Context, err error) {
+	select {
+	case a.listening <- err:
+	case <-ctx.Done():
+	}
+}
+
 func (a *Adapter) receive(ctx context.Context) {
 	a.wg.Add(1)
 	defer a.wg.Done()
 
-	// If we can't create a socket, we can't do anything; exit.
-	sock, err := pull.NewSocket()
-	if err != nil {
-		a.listening <- err
-		return
-	}
-
-	// Use SetOption to set the receive deadline.  The other ways to set the
-	// receive deadline don't seem to work.
-	err = sock.SetOption(mangos.OptionRecvDeadline, a.recvTimeout)
-	if err != nil {
-		a.listening <- err
-		return
-	}
-
 	// If we can't listen, we can't do anything; exit.
-	err = sock.Listen(a.parodusServiceURL)
+	sock, err := a.open(ctx)
 	if err != nil {
-		a.listening <- err
+		a.notifyListening(ctx, err)
 		return
 	}
+	a.setSocket(sock)
+	defer a.closeSocket()
 
 	// Everything is set up and ready to go.  Tell Start() that we're listening.
-	a.listening <- nil
+	a.notifyListening(ctx, nil)
 
 	for {
 		if ctx.Err() != nil {
@@ -179,6 +238,19 @@ func (a *Adapter) receive(ctx context.Context) {
 			continue
 		}
 
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			sock = a.reconnect(ctx, err)
+			if sock == nil {
+				return
+			}
+
+			continue
+		}
+
 		var msg wrp.Message
 		err = wrp.NewDecoderBytes(bytes, wrp.Msgpack).Decode(&msg)
 		if err != nil {
@@ -203,6 +275,118 @@ func (a *Adapter) receive(ctx context.Context) {
 	}
 }
 
+// open creates a socket with the configured receive timeout and listens on
+// the parodus service url.
+func (a *Adapter) open(ctx context.Context) (mangos.Socket, error) {
+	sock, err := pull.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	// Use SetOption to set the receive deadline.  The other ways to set the
+	// receive deadline don't seem to work.
+	err = sock.SetOption(mangos.OptionRecvDeadline, a.recvTimeout)
+	if err == nil {
+		err = a.listen(ctx, sock)
+	}
+	if err != nil {
+		_ = sock.Close()
+		return nil, err
+	}
+
+	return sock, nil
+}
+
+// reconnect replaces the failed socket with a new one listening on the parodus
+// service url, waiting the reconnect interval between attempts.  nil is
+// returned once the context is canceled.
+func (a *Adapter) reconnect(ctx context.Context, cause error) mangos.Socket {
+	a.closeSocket()
+
+	a.disconnectListeners.Visit(func(l event.DisconnectListener) {
+		l.OnDisconnect(event.Disconnect{
+			At:  time.Now(),
+			URL: a.parodusServiceURL,
+			Err: cause,
+		})
+	})
+
+	for {
+		sock, err := a.open(ctx)
+		if ctx.Err() != nil {
+			if sock != nil {
+				_ = sock.Close()
+			}
+			return nil
+		}
+
+		a.connectListeners.Visit(func(l event.ConnectListener) {
+			l.OnConnect(event.Connect{
+				At:  time.Now(),
+				URL: a.parodusServiceURL,
+				Err: err,
+			})
+		})
+
+		if err == nil {
+			a.setSocket(sock)
+			return sock
+		}
+
+		select {
+		case <-time.After(a.reconnectInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// setSocket replaces the current socket and returns the previous one.
+func (a *Adapter) setSocket(sock mangos.Socket) mangos.Socket {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	prev := a.sock
+	a.sock = sock
+
+	return prev
+}
+
+// closeSocket closes the current socket, if there is one.
+func (a *Adapter) closeSocket() {
+	if prev := a.setSocket(nil); prev != nil {
+		_ = prev.Close()
+	}
+}
+
+// listen starts listening on the parodus service url, retrying transient
+// failures based on the configured retry policy.
+func (a *Adapter) listen(ctx context.Context, sock mangos.Socket) error {
+	var policy retry.Policy
+	if a.retryPolicy != nil {
+		policy = a.retryPolicy.NewPolicy(ctx)
+		defer policy.Cancel()
+	}
+
+	for {
+		err := sock.Listen(a.parodusServiceURL)
+		if err == nil || policy == nil {
+			return err
+		}
+
+		next, ok := policy.Next()
+		if !ok {
+			return err
+		}
+
+		select {
+		case <-time.After(next):
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		}
+	}
+}
+
 func (a *Adapter) register(ctx context.Context, msg wrp.Message) error {
 	name := msg.ServiceName
 
@@ -260,5 +444,7 @@ func (a *Adapter) forward(msg wrp.Message) error {
 		return ErrNoService
 	}
 
+	sc.forwarded.Add(1)
+
 	return sc.HandleWrp(msg)
 }
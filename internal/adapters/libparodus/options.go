@@ -4,8 +4,12 @@
 package libparodus
 
 import (
+	"context"
 	"fmt"
 	"time"
+
+	"github.com/xmidt-org/retry"
+	"github.com/xmidt-org/xmidt-agent/internal/adapters/libparodus/event"
 )
 
 func KeepaliveInterval(timeout time.Duration) Option {
@@ -29,6 +33,68 @@ func SendTimeout(timeout time.Duration) Option {
 	})
 }
 
+// ShutdownContext sets the context the adapter listens with.  Once it is
+// canceled the socket is closed and the services are no longer served,
+// without waiting for Stop.  The default is context.Background().
+func ShutdownContext(ctx context.Context) Option {
+	return optionFunc(func(s *Adapter) error {
+		if ctx == nil {
+			return fmt.Errorf("%w: nil shutdown context", ErrInvalidInput)
+		}
+
+		s.shutdownCtx = ctx
+		return nil
+	})
+}
+
+// RetryPolicy sets the retry policy factory used for delaying between attempts
+// to start listening for libparodus services.  If this is not set, no retries
+// are attempted.
+func RetryPolicy(pf retry.PolicyFactory) Option {
+	return optionFunc(func(s *Adapter) error {
+		s.retryPolicy = pf
+		return nil
+	})
+}
+
+// ReconnectInterval sets the time waited between attempts to listen on the
+// parodus service url again after the socket failed.  Each attempt still
+// follows the RetryPolicy.  The default is DefaultReconnectInterval.
+func ReconnectInterval(interval time.Duration) Option {
+	return optionFunc(func(s *Adapter) error {
+		if interval < 0 {
+			return fmt.Errorf("%w: negative reconnect interval", ErrInvalidInput)
+		} else if interval == 0 {
+			interval = DefaultReconnectInterval
+		}
+
+		s.reconnectInterval = interval
+		return nil
+	})
+}
+
+// AddConnectListener adds a listener that is notified after each attempt to
+// listen on the parodus service url again after the socket failed.
+func AddConnectListener(listener event.ConnectListener, cancel ...*event.CancelFunc) Option {
+	return optionFunc(func(s *Adapter) error {
+		var ignored event.CancelFunc
+		cancel = append(cancel, &ignored)
+		*cancel[0] = event.CancelFunc(s.connectListeners.Add(listener))
+		return nil
+	})
+}
+
+// AddDisconnectListener adds a listener that is notified when the socket
+// listening on the parodus service url fails.
+func AddDisconnectListener(listener event.DisconnectListener, cancel ...*event.CancelFunc) Option {
+	return optionFunc(func(s *Adapter) error {
+		var ignored event.CancelFunc
+		cancel = append(cancel, &ignored)
+		*cancel[0] = event.CancelFunc(s.disconnectListeners.Add(listener))
+		return nil
+	})
+}
+
 // -- Only Validators Below ----------------------------------------------------
 
 func validatePubSub() Option {
@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+// Package announce sends WRP events describing the device each time the
+// websocket connects, such as the registered services and how long the
+// device was disconnected.
+package announce
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+var (
+	ErrInvalidInput = errors.New("invalid input")
+)
+
+// ServicesFunc returns the names of the services registered on the device.
+type ServicesFunc func() []string
+
+// Option is a functional option type for the announcers.
+type Option interface {
+	apply(*options) error
+}
+
+type optionFunc func(*options) error
+
+func (f optionFunc) apply(o *options) error {
+	return f(o)
+}
+
+// options are the settings shared by the announcers.
+type options struct {
+	destination string
+}
+
+func newOptions(destination string, opts ...Option) (options, error) {
+	o := options{
+		destination: destination,
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			if err := opt.apply(&o); err != nil {
+				return options{}, err
+			}
+		}
+	}
+
+	return o, nil
+}
+
+// Announcer sends the list of registered services after each successful
+// connect.
+type Announcer struct {
+	egress      wrpkit.Handler
+	source      string
+	destination string
+	services    ServicesFunc
+}
+
+// Announcement is the payload of the announcement event.
+type Announcement struct {
+	Services []string `json:"services"`
+}
+
+var _ event.ConnectListener = (*Announcer)(nil)
+
+// New creates a new Announcer.  The parameter egress is the handler used to
+// send the announcement, source is the source of the announcement, normally
+// the device id, and services provides the registered services.
+//
+// The connect event is dispatched before the connection is ready to send, so
+// the egress is expected to queue the announcement.
+func New(egress wrpkit.Handler, source string, services ServicesFunc, opts ...Option) (*Announcer, error) {
+	if egress == nil || source == "" || services == nil {
+		return nil, ErrInvalidInput
+	}
+
+	o, err := newOptions(fmt.Sprintf("event:device-status/%s/services", source), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Announcer{
+		egress:      egress,
+		source:      source,
+		destination: o.destination,
+		services:    services,
+	}, nil
+}
+
+// Destination is the destination of the announcement event.  The default is
+// event:device-status/<source>/services for the services announcement and
+// event:device-status/<source>/reconnect for the reconnect announcement.
+func Destination(destination string) Option {
+	return optionFunc(
+		func(o *options) error {
+			if destination == "" {
+				return fmt.Errorf("%w: empty destination", ErrInvalidInput)
+			}
+			o.destination = destination
+			return nil
+		})
+}
+
+// OnConnect sends the announcement when the connect succeeded.  Failed
+// connection attempts are ignored.
+func (a *Announcer) OnConnect(e event.Connect) {
+	if e.Err != nil {
+		return
+	}
+
+	// The egress is responsible for retrying, so the error isn't acted on.
+	_ = a.Announce()
+}
+
+// Announce sends the list of registered services, sorted and without
+// duplicates.
+func (a *Announcer) Announce() error {
+	services := slices.Clone(a.services())
+	slices.Sort(services)
+	services = slices.Compact(services)
+	if services == nil {
+		services = []string{}
+	}
+
+	payload, err := json.Marshal(Announcement{Services: services})
+	if err != nil {
+		return err
+	}
+
+	return a.egress.HandleWrp(wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      a.source,
+		Destination: a.destination,
+		ContentType: "application/json",
+		Payload:     payload,
+	})
+}
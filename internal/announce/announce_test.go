@@ -0,0 +1,179 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package announce_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/announce"
+	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+func TestNew(t *testing.T) {
+	egress := wrpkit.HandlerFunc(func(wrp.Message) error { return nil })
+	services := func() []string { return nil }
+
+	tests := []struct {
+		description string
+		egress      wrpkit.Handler
+		source      string
+		services    announce.ServicesFunc
+		opts        []announce.Option
+		expectedErr error
+	}{
+		{
+			description: "defaults",
+			egress:      egress,
+			source:      "mac:112233445566",
+			services:    services,
+		}, {
+			description: "destination",
+			egress:      egress,
+			source:      "mac:112233445566",
+			services:    services,
+			opts:        []announce.Option{announce.Destination("event:services"), nil},
+		}, {
+			description: "nil egress",
+			source:      "mac:112233445566",
+			services:    services,
+			expectedErr: announce.ErrInvalidInput,
+		}, {
+			description: "empty source",
+			egress:      egress,
+			services:    services,
+			expectedErr: announce.ErrInvalidInput,
+		}, {
+			description: "nil services",
+			egress:      egress,
+			source:      "mac:112233445566",
+			expectedErr: announce.ErrInvalidInput,
+		}, {
+			description: "empty destination",
+			egress:      egress,
+			source:      "mac:112233445566",
+			services:    services,
+			opts:        []announce.Option{announce.Destination("")},
+			expectedErr: announce.ErrInvalidInput,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			a, err := announce.New(tc.egress, tc.source, tc.services, tc.opts...)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(err, tc.expectedErr)
+				assert.Nil(a)
+				return
+			}
+
+			assert.NoError(err)
+			assert.NotNil(a)
+		})
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var sent []wrp.Message
+	egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+		sent = append(sent, msg)
+		return nil
+	})
+
+	services := []string{"xmidt_agent", "mock_config"}
+	a, err := announce.New(egress, "mac:112233445566",
+		func() []string { return services },
+	)
+	require.NoError(err)
+
+	now := time.Now()
+	a.OnConnect(event.Connect{At: now, Err: errors.New("dial failed")})
+	assert.Empty(sent)
+
+	a.OnConnect(event.Connect{At: now})
+	require.Len(sent, 1)
+
+	// Failed attempts between connects don't announce.
+	a.OnConnect(event.Connect{At: now, Err: errors.New("dial failed")})
+	require.Len(sent, 1)
+
+	// Each connect announces the services registered at the time.
+	services = append(services, "config", "config")
+	a.OnConnect(event.Connect{At: now})
+	require.Len(sent, 2)
+
+	for _, msg := range sent {
+		assert.Equal(wrp.SimpleEventMessageType, msg.Type)
+		assert.Equal("mac:112233445566", msg.Source)
+		assert.Equal("event:device-status/mac:112233445566/services", msg.Destination)
+		assert.Equal("application/json", msg.ContentType)
+	}
+
+	var got announce.Announcement
+	require.NoError(json.Unmarshal(sent[0].Payload, &got))
+	assert.Equal([]string{"mock_config", "xmidt_agent"}, got.Services)
+
+	require.NoError(json.Unmarshal(sent[1].Payload, &got))
+	assert.Equal([]string{"config", "mock_config", "xmidt_agent"}, got.Services)
+}
+
+func TestAnnounce(t *testing.T) {
+	errUnknown := errors.New("unknown")
+
+	tests := []struct {
+		description string
+		services    []string
+		egressErr   error
+		expected    string
+		expectedErr error
+	}{
+		{
+			description: "no services",
+			expected:    `{"services":[]}`,
+		}, {
+			description: "services",
+			services:    []string{"b", "a"},
+			expected:    `{"services":["a","b"]}`,
+		}, {
+			description: "egress failure",
+			services:    []string{"a"},
+			egressErr:   errUnknown,
+			expected:    `{"services":["a"]}`,
+			expectedErr: errUnknown,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var got wrp.Message
+			egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+				got = msg
+				return tc.egressErr
+			})
+
+			a, err := announce.New(egress, "mac:112233445566",
+				func() []string { return tc.services },
+				announce.Destination("event:services"),
+			)
+			require.NoError(err)
+
+			err = a.Announce()
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.Equal("event:services", got.Destination)
+			assert.JSONEq(tc.expected, string(got.Payload))
+		})
+	}
+}
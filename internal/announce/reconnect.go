@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package announce
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+// Reconnect sends how long the device was disconnected each time the
+// websocket connects again, so the cloud can reconcile state.
+type Reconnect struct {
+	egress      wrpkit.Handler
+	source      string
+	destination string
+
+	m sync.Mutex
+	// disconnect is the disconnect that started the downtime, or nil while
+	// connected.
+	disconnect *event.Disconnect
+}
+
+// Downtime is the payload of the reconnect announcement event.
+type Downtime struct {
+	// DisconnectedAt is when the connection was lost.
+	DisconnectedAt time.Time `json:"disconnected_at"`
+
+	// ReconnectedAt is when the connection was made again.
+	ReconnectedAt time.Time `json:"reconnected_at"`
+
+	// Downtime is how long the device was disconnected, in seconds.
+	Downtime float64 `json:"downtime_seconds"`
+
+	// Code is the close status code sent by the server, if any.
+	Code int `json:"code,omitempty"`
+
+	// Reason is the close reason sent by the server, if any.
+	Reason string `json:"reason,omitempty"`
+}
+
+var (
+	_ event.ConnectListener    = (*Reconnect)(nil)
+	_ event.DisconnectListener = (*Reconnect)(nil)
+)
+
+// NewReconnect creates a new Reconnect announcer.  The parameter egress is the
+// handler used to send the announcement and source is the source of the
+// announcement, normally the device id.  The announcer must be added as both a
+// connect and a disconnect listener.
+//
+// The connect event is dispatched before the connection is ready to send, so
+// the egress is expected to queue the announcement.
+func NewReconnect(egress wrpkit.Handler, source string, opts ...Option) (*Reconnect, error) {
+	if egress == nil || source == "" {
+		return nil, ErrInvalidInput
+	}
+
+	o, err := newOptions(fmt.Sprintf("event:device-status/%s/reconnect", source), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reconnect{
+		egress:      egress,
+		source:      source,
+		destination: o.destination,
+	}, nil
+}
+
+// OnDisconnect records the start of the downtime.  Only the first disconnect
+// after a connect is recorded, so the downtime covers every failed attempt to
+// connect again.
+func (r *Reconnect) OnDisconnect(e event.Disconnect) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.disconnect == nil {
+		r.disconnect = &e
+	}
+}
+
+// OnConnect sends the downtime when the connect succeeded after a disconnect.
+// Failed connection attempts and the first connect are ignored.
+func (r *Reconnect) OnConnect(e event.Connect) {
+	if e.Err != nil {
+		return
+	}
+
+	r.m.Lock()
+	disconnect := r.disconnect
+	r.disconnect = nil
+	r.m.Unlock()
+
+	if disconnect == nil {
+		return
+	}
+
+	// The egress is responsible for retrying, so the error isn't acted on.
+	_ = r.announce(*disconnect, e.At)
+}
+
+func (r *Reconnect) announce(disconnect event.Disconnect, at time.Time) error {
+	payload, err := json.Marshal(Downtime{
+		DisconnectedAt: disconnect.At,
+		ReconnectedAt:  at,
+		Downtime:       at.Sub(disconnect.At).Seconds(),
+		Code:           disconnect.Code,
+		Reason:         disconnect.Reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.egress.HandleWrp(wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      r.source,
+		Destination: r.destination,
+		ContentType: "application/json",
+		Payload:     payload,
+	})
+}
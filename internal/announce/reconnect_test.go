@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package announce_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/announce"
+	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+func TestNewReconnect(t *testing.T) {
+	egress := wrpkit.HandlerFunc(func(wrp.Message) error { return nil })
+
+	tests := []struct {
+		description string
+		egress      wrpkit.Handler
+		source      string
+		opts        []announce.Option
+		expectedErr error
+	}{
+		{
+			description: "defaults",
+			egress:      egress,
+			source:      "mac:112233445566",
+		}, {
+			description: "destination",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []announce.Option{announce.Destination("event:reconnect")},
+		}, {
+			description: "nil egress",
+			source:      "mac:112233445566",
+			expectedErr: announce.ErrInvalidInput,
+		}, {
+			description: "empty source",
+			egress:      egress,
+			expectedErr: announce.ErrInvalidInput,
+		}, {
+			description: "empty destination",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []announce.Option{announce.Destination("")},
+			expectedErr: announce.ErrInvalidInput,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			r, err := announce.NewReconnect(tc.egress, tc.source, tc.opts...)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(err, tc.expectedErr)
+				assert.Nil(r)
+				return
+			}
+
+			assert.NoError(err)
+			assert.NotNil(r)
+		})
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var sent []wrp.Message
+	egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+		sent = append(sent, msg)
+		return nil
+	})
+
+	r, err := announce.NewReconnect(egress, "mac:112233445566")
+	require.NoError(err)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// The first connect isn't a reconnect.
+	r.OnConnect(event.Connect{At: start})
+	assert.Empty(sent)
+
+	// The server closes the connection and the next attempts fail.
+	r.OnDisconnect(event.Disconnect{
+		At:     start.Add(time.Minute),
+		Code:   1012,
+		Reason: "service restart",
+	})
+	r.OnConnect(event.Connect{At: start.Add(2 * time.Minute), Err: errors.New("dial failed")})
+	r.OnDisconnect(event.Disconnect{At: start.Add(3 * time.Minute), Err: errors.New("dial failed")})
+	assert.Empty(sent)
+
+	r.OnConnect(event.Connect{At: start.Add(5*time.Minute + 500*time.Millisecond)})
+	require.Len(sent, 1)
+
+	msg := sent[0]
+	assert.Equal(wrp.SimpleEventMessageType, msg.Type)
+	assert.Equal("mac:112233445566", msg.Source)
+	assert.Equal("event:device-status/mac:112233445566/reconnect", msg.Destination)
+	assert.Equal("application/json", msg.ContentType)
+
+	var got announce.Downtime
+	require.NoError(json.Unmarshal(msg.Payload, &got))
+	assert.Equal(announce.Downtime{
+		DisconnectedAt: start.Add(time.Minute),
+		ReconnectedAt:  start.Add(5*time.Minute + 500*time.Millisecond),
+		Downtime:       240.5,
+		Code:           1012,
+		Reason:         "service restart",
+	}, got)
+
+	// A connect without a disconnect in between isn't announced again.
+	r.OnConnect(event.Connect{At: start.Add(6 * time.Minute)})
+	assert.Len(sent, 1)
+
+	// The next outage is measured on its own.
+	r.OnDisconnect(event.Disconnect{At: start.Add(10 * time.Minute)})
+	r.OnConnect(event.Connect{At: start.Add(10*time.Minute + 3*time.Second)})
+	require.Len(sent, 2)
+
+	require.NoError(json.Unmarshal(sent[1].Payload, &got))
+	assert.Equal(3.0, got.Downtime)
+	assert.JSONEq(`{
+		"disconnected_at": "2024-01-01T00:10:00Z",
+		"reconnected_at": "2024-01-01T00:10:03Z",
+		"downtime_seconds": 3
+	}`, string(sent[1].Payload))
+}
@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+// Package budget provides a retry budget that can be shared by the components
+// making network attempts, so a broad outage doesn't cause each of them to
+// independently hammer the network.
+package budget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrInvalidBudget = errors.New("invalid retry budget")
+
+// maxCost is the most attempts a single attempt made while the budget is
+// exhausted is charged for.
+const maxCost = 8
+
+// Budget is a token bucket shared by all the components making network
+// attempts.  Up to the configured number of attempts may be made at once,
+// after which attempts are spread evenly across the configured period.  Each
+// attempt made while the budget is exhausted is charged twice as much as the
+// one before it (up to maxCost), so the attempts back off until one finds the
+// budget available again.  A nil Budget never limits attempts.
+type Budget struct {
+	m sync.Mutex
+	// burst is the max number of attempts that can be made at once.
+	burst float64
+	// interval is the time needed to earn a single attempt.
+	interval time.Duration
+	// tokens is the number of available attempts.  A negative value is the
+	// number of attempts already reserved by waiting callers.
+	tokens float64
+	// cost is the number of tokens the next attempt made while the budget is
+	// exhausted is charged.
+	cost float64
+	// last is the last time tokens was updated.
+	last    time.Time
+	nowFunc func() time.Time
+}
+
+// New creates a Budget allowing the given number of attempts per period.
+func New(attempts int, per time.Duration) (*Budget, error) {
+	if attempts <= 0 {
+		return nil, fmt.Errorf("%w: attempts must be positive", ErrInvalidBudget)
+	}
+	if per <= 0 {
+		return nil, fmt.Errorf("%w: period must be positive", ErrInvalidBudget)
+	}
+
+	return &Budget{
+		burst:    float64(attempts),
+		interval: per / time.Duration(attempts),
+		tokens:   float64(attempts),
+		cost:     1,
+		nowFunc:  time.Now,
+	}, nil
+}
+
+// Wait blocks until an attempt is allowed by the budget or the context is
+// canceled.  Callers are allowed in the order they called Wait.  A caller that
+// gives up is refunded, so the attempt it never made isn't charged.
+func (b *Budget) Wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	delay, cost := b.reserve()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.refund(cost)
+		return ctx.Err()
+	}
+}
+
+// reserve takes an attempt from the budget and returns how long the caller
+// must wait before making it and the number of tokens it was charged.
+func (b *Budget) reserve() (time.Duration, float64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.earn()
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.cost = 1
+		return 0, 1
+	}
+
+	cost := b.cost
+	b.tokens -= cost
+	b.cost = min(2*b.cost, maxCost)
+
+	return time.Duration(-b.tokens * float64(b.interval)), cost
+}
+
+// refund returns the tokens of an attempt that wasn't made, and rolls back
+// the cost it doubled so the next attempt isn't charged for it.
+func (b *Budget) refund(cost float64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.earn()
+	b.tokens = min(b.burst, b.tokens+cost)
+	b.cost = min(b.cost, cost)
+}
+
+// earn adds the tokens earned since the last update.
+func (b *Budget) earn() {
+	now := b.nowFunc()
+	if !b.last.IsZero() {
+		earned := float64(now.Sub(b.last)) / float64(b.interval)
+		b.tokens = min(b.burst, b.tokens+earned)
+	}
+	b.last = now
+}
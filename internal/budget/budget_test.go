@@ -0,0 +1,185 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package budget
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		description string
+		attempts    int
+		per         time.Duration
+		expectedErr error
+	}{
+		{
+			description: "valid",
+			attempts:    10,
+			per:         time.Second,
+		}, {
+			description: "zero attempts",
+			per:         time.Second,
+			expectedErr: ErrInvalidBudget,
+		}, {
+			description: "negative attempts",
+			attempts:    -1,
+			per:         time.Second,
+			expectedErr: ErrInvalidBudget,
+		}, {
+			description: "zero period",
+			attempts:    10,
+			expectedErr: ErrInvalidBudget,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := New(tc.attempts, tc.per)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(err, tc.expectedErr)
+				assert.Nil(got)
+				return
+			}
+
+			assert.NoError(err)
+			assert.NotNil(got)
+		})
+	}
+}
+
+func TestReserve(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	b, err := New(2, 2*time.Second)
+	require.NoError(err)
+
+	now := time.Unix(1000, 0)
+	b.nowFunc = func() time.Time {
+		return now
+	}
+	reserve := func() time.Duration {
+		delay, _ := b.reserve()
+		return delay
+	}
+
+	// The burst is available immediately.
+	assert.Zero(reserve())
+	assert.Zero(reserve())
+
+	// Further attempts are spread across the period, backing off once the
+	// budget is exhausted.
+	assert.Equal(time.Second, reserve())
+	assert.Equal(3*time.Second, reserve())
+
+	// Once the reservations are earned, attempts are allowed again.
+	now = now.Add(4 * time.Second)
+	assert.Zero(reserve())
+	assert.Equal(time.Second, reserve())
+
+	// The budget never exceeds the burst.
+	now = now.Add(time.Hour)
+	assert.Zero(reserve())
+	assert.Zero(reserve())
+	assert.Equal(time.Second, reserve())
+}
+
+func TestReserveBackoff(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	b, err := New(1, time.Second)
+	require.NoError(err)
+
+	now := time.Unix(1000, 0)
+	b.nowFunc = func() time.Time {
+		return now
+	}
+
+	delay, cost := b.reserve()
+	assert.Zero(delay)
+	assert.Equal(1.0, cost)
+
+	// Each attempt while exhausted is charged twice the one before, up to
+	// maxCost.
+	for _, expected := range []struct {
+		delay time.Duration
+		cost  float64
+	}{
+		{delay: time.Second, cost: 1},
+		{delay: 3 * time.Second, cost: 2},
+		{delay: 7 * time.Second, cost: 4},
+		{delay: 15 * time.Second, cost: 8},
+		{delay: 23 * time.Second, cost: 8},
+	} {
+		delay, cost := b.reserve()
+		assert.Equal(expected.delay, delay)
+		assert.Equal(expected.cost, cost)
+	}
+
+	// An attempt that finds the budget available resets the cost.
+	now = now.Add(24 * time.Second)
+	delay, cost = b.reserve()
+	assert.Zero(delay)
+	assert.Equal(1.0, cost)
+
+	delay, cost = b.reserve()
+	assert.Equal(time.Second, delay)
+	assert.Equal(1.0, cost)
+}
+
+func TestWait(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var b *Budget
+	assert.NoError(b.Wait(context.Background()))
+
+	b, err := New(1, time.Hour)
+	require.NoError(err)
+
+	assert.NoError(b.Wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(b.Wait(ctx), context.DeadlineExceeded)
+
+	// The attempt that was given up on is refunded, along with its cost.
+	b.m.Lock()
+	assert.InDelta(0, b.tokens, 0.01)
+	assert.Equal(1.0, b.cost)
+	b.m.Unlock()
+}
+
+func TestRefund(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	b, err := New(1, time.Second)
+	require.NoError(err)
+
+	now := time.Unix(1000, 0)
+	b.nowFunc = func() time.Time {
+		return now
+	}
+
+	_, _ = b.reserve()
+	_, _ = b.reserve()
+	_, cost := b.reserve()
+	assert.Equal(2.0, cost)
+
+	// Refunding the attempt restores the tokens and the cost it was charged,
+	// so the next attempt is charged the same.
+	b.refund(cost)
+	delay, cost := b.reserve()
+	assert.Equal(3*time.Second, delay)
+	assert.Equal(2.0, cost)
+}
@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package budget_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/retry"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/budget"
+	"github.com/xmidt-org/xmidt-agent/internal/credentials"
+	"github.com/xmidt-org/xmidt-agent/internal/websocket"
+)
+
+// TestSharedBudget simulates an outage where both the credentials service and
+// the websocket fail every attempt, and asserts their combined attempts are
+// bounded by the shared budget.
+func TestSharedBudget(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var credAttempts, wsAttempts atomic.Int64
+	credServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				credAttempts.Add(1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+	defer credServer.Close()
+
+	wsServer := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				wsAttempts.Add(1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+	defer wsServer.Close()
+
+	// 5 attempts at once, then one every 100ms.
+	b, err := budget.New(5, 500*time.Millisecond)
+	require.NoError(err)
+
+	creds, err := credentials.New(
+		credentials.URL(credServer.URL),
+		credentials.MacAddress(wrp.DeviceID("mac:112233445566")),
+		credentials.SerialNumber("1234567890"),
+		credentials.HardwareModel("model"),
+		credentials.HardwareManufacturer("manufacturer"),
+		credentials.FirmwareVersion("version"),
+		credentials.LastRebootReason("reason"),
+		credentials.XmidtProtocol("protocol"),
+		credentials.BootRetryWait(1),
+		credentials.RetryBudget(b),
+	)
+	require.NoError(err)
+
+	ws, err := websocket.New(
+		websocket.URL(wsServer.URL),
+		websocket.DeviceID("mac:112233445566"),
+		// Without the budget, the websocket would retry every millisecond.
+		websocket.RetryPolicy(&retry.Config{
+			Interval: time.Millisecond,
+		}),
+		websocket.WithIPv4(),
+		websocket.NowFunc(time.Now),
+		websocket.FetchURLTimeout(time.Second),
+		websocket.RetryBudget(b),
+	)
+	require.NoError(err)
+
+	start := time.Now()
+	creds.Start()
+	ws.Start()
+	time.Sleep(time.Second)
+	ws.Stop()
+	creds.Stop()
+	elapsed := time.Since(start)
+
+	assert.Positive(credAttempts.Load())
+	assert.Positive(wsAttempts.Load())
+
+	// The burst plus one attempt per 100ms.
+	allowed := 5 + int64(elapsed/(100*time.Millisecond))
+	assert.LessOrEqual(credAttempts.Load()+wsAttempts.Load(), allowed)
+}
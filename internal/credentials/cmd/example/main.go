@@ -7,15 +7,13 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/lestrrat-go/jwx/v2/jws"
-	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/xmidt-org/wrp-go/v3"
 	cred "github.com/xmidt-org/xmidt-agent/internal/credentials"
 	"github.com/xmidt-org/xmidt-agent/internal/credentials/event"
@@ -130,36 +128,18 @@ func main() {
 	fmt.Printf("JWT:     %s\n", tokenString)
 	fmt.Printf("Expires: %s\n", expires.Format(time.RFC3339))
 
-	token, err := jwt.ParseString(tokenString)
+	claims, err := credentials.Claims()
 	if err != nil {
 		panic(err)
 	}
 
 	fmt.Println("Claims:")
-	fmt.Printf("  ID:         %s\n", token.JwtID())
-	fmt.Printf("  Expiration: %s\n", token.Expiration())
-	fmt.Printf("  IssuedAt:   %s\n", token.IssuedAt())
-	fmt.Printf("  NotBefore:  %s\n", token.NotBefore())
-	fmt.Printf("  Issuer:     %s\n", token.Issuer())
-	fmt.Printf("  Subject:    %s\n", token.Subject())
-	fmt.Printf("  Audience:   %v\n", token.Audience())
-
-	header, body, _, err := jws.SplitCompactString(tokenString)
-	if err != nil {
-		panic(err)
-	}
-
-	decodedHeader, err := base64.RawURLEncoding.DecodeString(string(header))
-	if err != nil {
-		panic(err)
+	keys := make([]string, 0, len(claims))
+	for key := range claims {
+		keys = append(keys, key)
 	}
-
-	decodedBody, err := base64.RawURLEncoding.DecodeString(string(body))
-	if err != nil {
-		panic(err)
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %-12s %v\n", key+":", claims[key])
 	}
-
-	fmt.Println("Parts:")
-	fmt.Printf("  Header: %s\n", decodedHeader)
-	fmt.Printf("  Body:   %s\n", decodedBody)
 }
@@ -4,20 +4,29 @@
 package credentials
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	iofs "io/fs"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/ugorji/go/codec"
 	"github.com/xmidt-org/eventor"
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/budget"
 	"github.com/xmidt-org/xmidt-agent/internal/credentials/event"
 	"github.com/xmidt-org/xmidt-agent/internal/fs"
 )
@@ -29,10 +38,19 @@ var (
 	ErrTokenExpired      = fmt.Errorf("token expired")
 	ErrFetchNotAttempted = fmt.Errorf("fetch not attempted")
 	ErrFetchFailed       = fmt.Errorf("fetch failed")
+	ErrEmptyToken        = fmt.Errorf("empty token")
+	ErrMalformedToken    = fmt.Errorf("malformed token")
+	ErrTokenTooLarge     = fmt.Errorf("token too large")
+	ErrDigestMismatch    = fmt.Errorf("digest mismatch")
+	ErrCacheTooOld       = fmt.Errorf("cached token too old")
 )
 
 const (
 	DefaultRefetchPercent = 90.0
+
+	// DefaultMaxBodyBytes is the largest credential service response body
+	// read, by default.
+	DefaultMaxBodyBytes = 1024 * 1024
 )
 
 /*
@@ -48,24 +66,35 @@ type Credentials struct {
 	m                 sync.RWMutex
 	wg                sync.WaitGroup
 	shutdown          context.CancelFunc
+	shutdownCtx       context.Context
 	fetched           chan struct{}
 	valid             chan struct{}
-	wakeup            chan chan struct{}
+	wakeup            chan wakeup
 	nowFunc           func() time.Time
 	fetchListeners    eventor.Eventor[event.FetchListener]
 	decorateListeners eventor.Eventor[event.DecorateListener]
+	fallbackListeners eventor.Eventor[event.FallbackListener]
+	expiringListeners eventor.Eventor[event.ExpiringListener]
+	historyListeners  eventor.Eventor[event.HistoryListener]
 
 	// What we are using to fetch the credentials.
 
-	url                  string
+	urls                 []string
 	refetchPercent       float64
+	maxBodyBytes         int64
+	successStatuses      []int
+	refetchJitter        float64
+	randFunc             func() float64
 	assumedLifetime      time.Duration
 	ignoreBody           bool
 	required             bool
 	fs                   fs.FS
 	filename             string
 	perm                 iofs.FileMode
+	maxCacheAge          time.Duration
 	client               *http.Client
+	resolver             *net.Resolver
+	insecureSkipVerify   bool
 	macAddress           wrp.DeviceID
 	serialNumber         string
 	hardwareModel        string
@@ -74,6 +103,15 @@ type Credentials struct {
 	lastRebootReason     string
 	xmidtProtocol        string
 	bootRetryWait        time.Duration
+	minRetryAfter        time.Duration
+	maxRetryAfter        time.Duration
+	invalidateDebounce   time.Duration
+	retryBudget          *budget.Budget
+	fallbackToken        string
+	fallbackAfter        int
+	failureLog           *failureLog
+	failureReplay        int
+	fetchDurations       *fetchDurations
 	lastReconnectReason  func() string // dynamic
 	partnerID            func() string // dynamic
 
@@ -99,15 +137,21 @@ func New(opts ...Option) (*Credentials, error) {
 		lastRebootReasonVador(),
 		xmidtProtocolVador(),
 		bootRetryWaitVador(),
+		useResolver(),
+		useInsecureSkipTLSVerify(),
 	}
 
 	c := Credentials{
 		client:              http.DefaultClient,
+		shutdownCtx:         context.Background(),
 		fetched:             make(chan struct{}),
 		valid:               make(chan struct{}),
-		wakeup:              make(chan chan struct{}),
+		wakeup:              make(chan wakeup),
 		nowFunc:             time.Now,
+		randFunc:            rand.Float64, //nolint:gosec // jitter doesn't need a secure source
 		refetchPercent:      DefaultRefetchPercent,
+		maxBodyBytes:        DefaultMaxBodyBytes,
+		successStatuses:     []int{http.StatusOK},
 		lastReconnectReason: func() string { return "" },
 		partnerID:           func() string { return "" },
 	}
@@ -138,7 +182,7 @@ func (c *Credentials) Start() {
 	}
 
 	var ctx context.Context
-	ctx, c.shutdown = context.WithCancel(context.Background())
+	ctx, c.shutdown = context.WithCancel(c.shutdownCtx)
 
 	go c.run(ctx)
 }
@@ -179,19 +223,51 @@ func (c *Credentials) WaitUntilValid(ctx context.Context) {
 }
 
 // MarkInvalid marks the credentials as invalid and causes the service to
-// immediately attempt to fetch new credentials.
+// immediately attempt to fetch new credentials.  If a debounce window is
+// configured, calls made within the window of a prior call are coalesced into
+// the refetch that call caused.
 func (c *Credentials) MarkInvalid(ctx context.Context) {
-	ch := make(chan struct{})
+	c.wake(ctx, wakeup{})
+}
+
+// Reset clears the in memory token and the locally stored token, marks the
+// credentials as invalid and causes the service to immediately attempt to
+// fetch new credentials.  Unlike MarkInvalid, Reset is never debounced.
+func (c *Credentials) Reset(ctx context.Context) {
+	c.wake(ctx, wakeup{reset: true})
+}
+
+// Refresh causes the service to immediately attempt to fetch new credentials
+// while the current credentials remain valid for decoration.  Refresh blocks
+// until the fetch attempt completes or the ctx is done.  Refresh is never
+// debounced.
+func (c *Credentials) Refresh(ctx context.Context) {
+	c.wake(ctx, wakeup{refresh: true})
+}
+
+// wakeup is a request for the run() method to refetch the credentials.
+type wakeup struct {
+	// done is signaled once the request has been handled.
+	done chan struct{}
+	// reset is whether the current credentials should be discarded.
+	reset bool
+	// refresh is whether the current credentials should be kept, with done
+	// signaled once the fetch attempt completes.
+	refresh bool
+}
+
+func (c *Credentials) wake(ctx context.Context, w wakeup) {
+	// Buffered so the run() method never blocks on a caller that gave up.
+	w.done = make(chan struct{}, 1)
 
 	select {
-	case c.wakeup <- ch:
+	case c.wakeup <- w:
 		select {
-		case <-ch:
+		case <-w.done:
 		case <-ctx.Done():
 		}
 	case <-ctx.Done():
 	}
-
 }
 
 func (c *Credentials) Credentials() (string, time.Time, error) {
@@ -204,6 +280,40 @@ func (c *Credentials) Credentials() (string, time.Time, error) {
 	return c.token.Token, c.token.ExpiresAt, nil
 }
 
+// FetchDurationStats returns the stats of the durations of the most recent
+// fetches from the credential service.  The zero value is returned unless
+// RecordFetchDurations is used.
+func (c *Credentials) FetchDurationStats() FetchDurationStats {
+	if c.fetchDurations == nil {
+		return FetchDurationStats{}
+	}
+
+	return c.fetchDurations.stats()
+}
+
+// Claims returns the claim set of the cached token.  The token is parsed but
+// neither verified nor validated, since it was issued to this device by the
+// credential service.  ErrNoToken is returned if there is no token, and
+// ErrMalformedToken if the token is not a JWT.
+func (c *Credentials) Claims() (map[string]any, error) {
+	token, _, err := c.Credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := jwt.ParseString(token, jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		return nil, errors.Join(ErrMalformedToken, err)
+	}
+
+	claims, err := parsed.AsMap(context.Background())
+	if err != nil {
+		return nil, errors.Join(ErrMalformedToken, err)
+	}
+
+	return claims, nil
+}
+
 // Decorate decorates the headers with the credentials.  If the credentials
 // are not valid, an error is returned.
 func (c *Credentials) Decorate(headers http.Header) error {
@@ -243,14 +353,41 @@ func (c *Credentials) decorate(headers http.Header) error {
 	return c.dispatch(e)
 }
 
-// fetch fetches the credentials from the server.  This should only be called
-// by the run() method.
+// fetch fetches the credentials from each url in order until one succeeds.
+// The longest retry time requested by a failed url is returned along with the
+// last error.  This should only be called by the run() method.
 func (c *Credentials) fetch(ctx context.Context) (*xmidtInfo, time.Duration, error) {
+	var (
+		retryIn time.Duration
+		err     error
+	)
+	for _, url := range c.urls {
+		var (
+			token *xmidtInfo
+			after time.Duration
+		)
+		token, after, err = c.fetchFrom(ctx, url)
+		if err == nil {
+			return token, 0, nil
+		}
+
+		retryIn = max(retryIn, after)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, retryIn, err
+}
+
+// fetchFrom fetches the credentials from the url.
+func (c *Credentials) fetchFrom(ctx context.Context, url string) (*xmidtInfo, time.Duration, error) {
 	fe := event.Fetch{
 		Origin: "network",
+		URL:    url,
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		fe.Err = errors.Join(err, ErrFetchNotAttempted)
 		return nil, 0, c.dispatch(fe)
@@ -286,11 +423,11 @@ func (c *Credentials) fetch(ctx context.Context) (*xmidtInfo, time.Duration, err
 	defer resp.Body.Close()
 
 	fe.StatusCode = resp.StatusCode
-	if resp.StatusCode != http.StatusOK {
+	if !slices.Contains(c.successStatuses, resp.StatusCode) {
 		var retryIn time.Duration
 		if resp.StatusCode == http.StatusTooManyRequests {
-			if after, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
-				retryIn = time.Duration(after) * time.Second
+			if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), c.nowFunc()); ok {
+				retryIn = c.clampRetryAfter(after)
 			}
 		}
 
@@ -300,12 +437,23 @@ func (c *Credentials) fetch(ctx context.Context) (*xmidtInfo, time.Duration, err
 	}
 
 	var token xmidtInfo
-	body, err := io.ReadAll(resp.Body)
+	body, sum, err := c.readBody(resp.Body)
+	fe.BodySHA256 = sum
 	if err != nil {
 		fe.Err = errors.Join(err, ErrFetchFailed)
 		return nil, 0, c.dispatch(fe)
 	}
-	token.Token = string(body)
+	if body == "" {
+		// Caching an empty token only defers the failure to decoration.
+		fe.Err = errors.Join(ErrEmptyToken, ErrFetchFailed)
+		return nil, 0, c.dispatch(fe)
+	}
+	if err := verifyDigest(resp.Header.Values("Content-Digest"), sum); err != nil {
+		fe.Err = errors.Join(err, ErrFetchFailed)
+		return nil, 0, c.dispatch(fe)
+	}
+	token.Token = body
+	token.FetchedAt = c.nowFunc()
 
 	c.determineExpiration(resp, &token)
 
@@ -314,6 +462,47 @@ func (c *Credentials) fetch(ctx context.Context) (*xmidtInfo, time.Duration, err
 	return &token, 0, c.dispatch(fe)
 }
 
+// readBody streams the body through the size limit and a SHA256 hash at the
+// same time, so an oversized body is never buffered in full.  The hash covers
+// the bytes read, even when the body is too large.
+func (c *Credentials) readBody(r io.Reader) (string, []byte, error) {
+	var body strings.Builder
+	hash := sha256.New()
+
+	// Read one byte past the limit to detect an oversized body.
+	n, err := io.Copy(io.MultiWriter(&body, hash), io.LimitReader(r, c.maxBodyBytes+1))
+	if err == nil && n > c.maxBodyBytes {
+		err = fmt.Errorf("%w: more than %d bytes", ErrTokenTooLarge, c.maxBodyBytes)
+	}
+
+	return body.String(), hash.Sum(nil), err
+}
+
+// verifyDigest checks the sha-256 digest of the Content-Digest header values
+// (RFC 9530) against the streamed hash of the body.  Bodies without a sha-256
+// digest aren't checked.
+func verifyDigest(values []string, sum []byte) error {
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			alg, digest, found := strings.Cut(strings.TrimSpace(member), "=")
+			if !found || !strings.EqualFold(alg, "sha-256") {
+				continue
+			}
+
+			want, err := base64.StdEncoding.DecodeString(strings.Trim(digest, ":"))
+			if err != nil {
+				return fmt.Errorf("%w: invalid sha-256 digest", ErrDigestMismatch)
+			}
+			if !bytes.Equal(want, sum) {
+				return ErrDigestMismatch
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
 func (c *Credentials) determineExpiration(resp *http.Response, token *xmidtInfo) {
 	// One hundred years is forever.
 	token.ExpiresAt = c.nowFunc().Add(time.Hour * 24 * 365 * 100)
@@ -322,12 +511,65 @@ func (c *Credentials) determineExpiration(resp *http.Response, token *xmidtInfo)
 		token.ExpiresAt = c.nowFunc().Add(c.assumedLifetime)
 	}
 
+	if maxAge, ok := parseMaxAge(resp.Header.Values("Cache-Control")); ok {
+		// Better, we were told how long it lives.
+		token.ExpiresAt = c.nowFunc().Add(maxAge)
+	}
+
 	if expiration, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
 		// Even better, we were told when it expires.
 		token.ExpiresAt = expiration
 	}
 }
 
+// parseMaxAge returns the max-age directive from the Cache-Control header
+// values, if present and valid.
+func parseMaxAge(values []string) (time.Duration, bool) {
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, found := strings.Cut(strings.TrimSpace(directive), "=")
+			if !found || !strings.EqualFold(name, "max-age") {
+				continue
+			}
+
+			seconds, err := strconv.ParseUint(strings.Trim(arg, `"`), 10, 32)
+			if err != nil {
+				return 0, false
+			}
+
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
+
+// parseRetryAfter returns the delay from the Retry-After header value, which is
+// either a number of seconds or an HTTP-date relative to now, if valid.  Dates
+// in the past result in no delay.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		return max(when.Sub(now), 0), true
+	}
+
+	return 0, false
+}
+
+// clampRetryAfter limits the server provided retry delay to the
+// RetryAfterBounds.
+func (c *Credentials) clampRetryAfter(after time.Duration) time.Duration {
+	after = max(after, c.minRetryAfter)
+	if c.maxRetryAfter > 0 {
+		after = min(after, c.maxRetryAfter)
+	}
+
+	return after
+}
+
 // run is the main loop for the credentials service.
 func (c *Credentials) run(ctx context.Context) {
 	var (
@@ -337,11 +579,17 @@ func (c *Credentials) run(ctx context.Context) {
 		fetched   bool
 		valid     bool
 		retryIn   time.Duration
+		lastWake  time.Time
+		refreshed chan struct{}
+		failures  int
+		fallback  bool
 	)
 
 	c.wg.Add(1)
 	defer c.wg.Done()
 
+	c.replayFailures()
+
 	token, err := c.load()
 	if err == nil && token != nil {
 		fromDisc = true
@@ -350,6 +598,11 @@ func (c *Credentials) run(ctx context.Context) {
 
 	for {
 		if !skipFetch {
+			// Shutdown is the only reason the wait fails.
+			if c.retryBudget.Wait(ctx) != nil {
+				return
+			}
+
 			token, retryIn, err = c.fetch(ctx)
 			if err == nil {
 				fromDisc = false
@@ -367,6 +620,12 @@ func (c *Credentials) run(ctx context.Context) {
 		next := max(time.Second, retryIn)
 
 		if err == nil && token != nil {
+			failures = 0
+			if fallback {
+				fallback = false
+				c.dispatchFallback(fallback, failures, nil)
+			}
+
 			expires := token.ExpiresAt
 
 			c.m.Lock()
@@ -385,29 +644,141 @@ func (c *Credentials) run(ctx context.Context) {
 			until := expires.Sub(c.nowFunc())
 			if 0 < until {
 				// Add a timer to fetch the token again
-				next = time.Duration(float64(until) * c.refetchPercent / 100.0)
+				next = c.refetchIn(until)
+			}
+		} else {
+			failures++
+			if !fallback && c.useFallback(failures) {
+				fallback = true
+				c.m.Lock()
+				c.token = &xmidtInfo{
+					Token: c.fallbackToken,
+					// The fallback token is long lived.
+					ExpiresAt: c.nowFunc().Add(time.Hour * 24 * 365 * 100),
+				}
+				c.m.Unlock()
+
+				if !valid {
+					close(c.valid)
+					valid = true
+				}
+				c.dispatchFallback(fallback, failures, err)
 			}
 		}
 
+		if refreshed != nil {
+			refreshed <- struct{}{}
+			refreshed = nil
+		}
+
+		if !fallback {
+			c.dispatchExpiring()
+		}
+
 		timer = time.NewTimer(next)
 		defer timer.Stop()
 
-		select {
-		case ch := <-c.wakeup:
-			if valid {
-				c.m.Lock()
-				c.valid = make(chan struct{})
-				valid = false
-				c.m.Unlock()
+	wait:
+		for {
+			select {
+			case w := <-c.wakeup:
+				if w.refresh {
+					// Signaled once the fetch attempt completes.
+					refreshed = w.done
+					break wait
+				}
+
+				now := c.nowFunc()
+				if !w.reset && c.invalidateDebounce > 0 && !lastWake.IsZero() &&
+					now.Sub(lastWake) < c.invalidateDebounce {
+					// Coalesce with the refetch caused by the prior call.
+					w.done <- struct{}{}
+					continue
+				}
+				lastWake = now
+
+				if w.reset {
+					c.m.Lock()
+					c.token = nil
+					c.m.Unlock()
+
+					// The fallback token is cleared too, so start over.
+					failures = 0
+					fallback = false
+
+					// The on disk token is gone either way, errors are ignored.
+					_ = c.remove()
+				}
+
+				if valid {
+					c.m.Lock()
+					c.valid = make(chan struct{})
+					valid = false
+					c.m.Unlock()
+				}
+				w.done <- struct{}{}
+			case <-timer.C:
+			case <-ctx.Done():
+				return
 			}
-			ch <- struct{}{}
-		case <-timer.C:
-		case <-ctx.Done():
-			return
+			break wait
 		}
 	}
 }
 
+// refetchIn returns how long to wait before refetching a token that expires
+// after the given duration, spread by the refetch jitter.
+func (c *Credentials) refetchIn(until time.Duration) time.Duration {
+	next := float64(until) * c.refetchPercent / 100.0
+	if c.refetchJitter > 0 {
+		// Uniformly spread across [next*(1-jitter), next*(1+jitter)).
+		next *= 1 + c.refetchJitter*(2*c.randFunc()-1)
+	}
+
+	return time.Duration(next)
+}
+
+// useFallback determines whether the fallback token should be used after the
+// given number of consecutive failed fetches.  The fallback token never
+// replaces a usable token.
+func (c *Credentials) useFallback(failures int) bool {
+	if c.fallbackToken == "" || failures < c.fallbackAfter {
+		return false
+	}
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return c.token == nil || c.nowFunc().After(c.token.ExpiresAt)
+}
+
+func (c *Credentials) dispatchFallback(active bool, failures int, err error) {
+	_ = c.dispatch(event.Fallback{
+		At:       c.nowFunc(),
+		Active:   active,
+		Failures: failures,
+		Err:      err,
+	})
+}
+
+// dispatchExpiring reports the time left on the held token, if there is one.
+func (c *Credentials) dispatchExpiring() {
+	c.m.RLock()
+	token := c.token
+	c.m.RUnlock()
+
+	if token == nil {
+		return
+	}
+
+	now := c.nowFunc()
+	_ = c.dispatch(event.Expiring{
+		At:            now,
+		ExpiresAt:     token.ExpiresAt,
+		TimeRemaining: token.ExpiresAt.Sub(now),
+	})
+}
+
 func (c *Credentials) store(token *xmidtInfo) error {
 	if c.fs == nil {
 		return nil
@@ -426,6 +797,14 @@ func (c *Credentials) store(token *xmidtInfo) error {
 		fs.WriteFileWithSHA256(c.filename, buf, c.perm))
 }
 
+func (c *Credentials) remove() error {
+	if c.fs == nil {
+		return nil
+	}
+
+	return fs.Operate(c.fs, fs.RemoveFileWithSHA256(c.filename))
+}
+
 func (c *Credentials) load() (*xmidtInfo, error) {
 	fe := event.Fetch{
 		Origin: "fs",
@@ -457,14 +836,48 @@ func (c *Credentials) load() (*xmidtInfo, error) {
 		return nil, c.dispatch(fe)
 	}
 	fe.Expiration = token.ExpiresAt
+
+	if err := c.checkCacheAge(&token); err != nil {
+		fe.Err = errors.Join(err, ErrFetchFailed)
+		return nil, c.dispatch(fe)
+	}
 	return &token, c.dispatch(fe)
 }
 
+// checkCacheAge rejects a cached token fetched longer than the max cache age
+// ago.  Tokens cached without the fetch time have an unknown age, so they are
+// rejected too.
+func (c *Credentials) checkCacheAge(token *xmidtInfo) error {
+	if c.maxCacheAge <= 0 {
+		return nil
+	}
+
+	if token.FetchedAt.IsZero() {
+		return fmt.Errorf("%w: unknown age", ErrCacheTooOld)
+	}
+
+	if age := c.nowFunc().Sub(token.FetchedAt); c.maxCacheAge < age {
+		return fmt.Errorf("%w: fetched %s ago", ErrCacheTooOld, age)
+	}
+
+	return nil
+}
+
 // dispatch dispatches the event to the listeners and returns the error that
 // should be returned by the caller.
 func (c *Credentials) dispatch(evnt any) error {
 	switch evnt := evnt.(type) {
 	case event.Fetch:
+		if c.failureLog != nil && evnt.Origin == "network" && evnt.Err != nil &&
+			!errors.Is(evnt.Err, context.Canceled) {
+			// The failure log is best effort, and fetches interrupted by
+			// Stop aren't failures.
+			_ = c.failureLog.record(evnt)
+		}
+		if c.fetchDurations != nil && evnt.Origin == "network" && !evnt.At.IsZero() &&
+			!errors.Is(evnt.Err, context.Canceled) {
+			c.fetchDurations.record(evnt.Duration)
+		}
 		c.fetchListeners.Visit(func(listener event.FetchListener) {
 			listener.OnFetch(evnt)
 		})
@@ -474,14 +887,30 @@ func (c *Credentials) dispatch(evnt any) error {
 			listener.OnDecorate(evnt)
 		})
 		return evnt.Err
+	case event.Fallback:
+		c.fallbackListeners.Visit(func(listener event.FallbackListener) {
+			listener.OnFallback(evnt)
+		})
+		return evnt.Err
+	case event.Expiring:
+		c.expiringListeners.Visit(func(listener event.ExpiringListener) {
+			listener.OnExpiring(evnt)
+		})
+		return nil
+	case event.History:
+		c.historyListeners.Visit(func(listener event.HistoryListener) {
+			listener.OnHistory(evnt)
+		})
+		return nil
 	}
 
 	panic("unknown event type")
 }
 
 // xmidtInfo is the token returned from the server as well as the expiration
-// time.
+// time and when it was fetched.
 type xmidtInfo struct {
 	Token     string
 	ExpiresAt time.Time
+	FetchedAt time.Time
 }
@@ -5,18 +5,28 @@ package credentials
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/xmidt-org/wrp-go/v3"
 	"github.com/xmidt-org/xmidt-agent/internal/credentials/event"
 	"github.com/xmidt-org/xmidt-agent/internal/fs/mem"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestNew(t *testing.T) {
@@ -50,7 +60,7 @@ func TestNew(t *testing.T) {
 			description: "simplest config",
 			opts:        simplest,
 			check: func(assert *assert.Assertions, c *Credentials) {
-				assert.Equal("http://example.com", c.url)
+				assert.Equal([]string{"http://example.com"}, c.urls)
 				assert.Equal(wrp.DeviceID("mac:112233445566"), c.macAddress)
 				assert.Equal("1234567890", c.serialNumber)
 				assert.Equal("model", c.hardwareModel)
@@ -72,7 +82,7 @@ func TestNew(t *testing.T) {
 				LastReconnectReason(func() string { return "reconnect_reason" }),
 			}...),
 			check: func(assert *assert.Assertions, c *Credentials) {
-				assert.Equal("http://example.com", c.url)
+				assert.Equal([]string{"http://example.com"}, c.urls)
 				assert.Equal(wrp.DeviceID("mac:112233445566"), c.macAddress)
 				assert.Equal("1234567890", c.serialNumber)
 				assert.Equal("model", c.hardwareModel)
@@ -93,6 +103,46 @@ func TestNew(t *testing.T) {
 				URL(""),
 			}...),
 			expectedErr: ErrInvalidInput,
+		}, {
+			description: "refetch jitter",
+			opts: append(simplest, []Option{
+				RefetchJitter(0.25),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.Equal(0.25, c.refetchJitter)
+			},
+		}, {
+			description: "negative refetch jitter",
+			opts: append(simplest, []Option{
+				RefetchJitter(-0.1),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "refetch jitter of one",
+			opts: append(simplest, []Option{
+				RefetchJitter(1.0),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "backup urls",
+			opts: append(simplest, []Option{
+				URLs("http://primary.example.com", "http://backup.example.com"),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.Equal([]string{"http://primary.example.com", "http://backup.example.com"}, c.urls)
+			},
+		}, {
+			description: "invalid primary url",
+			opts: append(simplest, []Option{
+				URLs("", "http://backup.example.com"),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "invalid backup url",
+			opts: append(simplest, []Option{
+				URLs("http://primary.example.com", ""),
+			}...),
+			expectedErr: ErrInvalidInput,
 		}, {
 			description: "invalid mac address",
 			opts: append(simplest, []Option{
@@ -163,75 +213,1884 @@ func TestNew(t *testing.T) {
 			}...),
 			expectedErr: ErrInvalidInput,
 		}, {
-			description: "invalid http client",
-			opts: append(simplest, []Option{
-				HTTPClient(nil),
-			}...),
-			check: func(assert *assert.Assertions, c *Credentials) {
-				assert.NotNil(c.client)
+			description: "invalid http client",
+			opts: append(simplest, []Option{
+				HTTPClient(nil),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.NotNil(c.client)
+			},
+		}, {
+			description: "invalid partner id",
+			opts: append(simplest, []Option{
+				PartnerID(nil),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.NotNil(c.partnerID)
+			},
+		}, {
+			description: "invalid last reconnect reason",
+			opts: append(simplest, []Option{
+				LastReconnectReason(nil),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.NotNil(c.lastReconnectReason)
+			},
+		}, {
+			description: "mark invalid debounce",
+			opts: append(simplest, []Option{
+				MarkInvalidDebounce(time.Second),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.Equal(time.Second, c.invalidateDebounce)
+			},
+		}, {
+			description: "negative mark invalid debounce",
+			opts: append(simplest, []Option{
+				MarkInvalidDebounce(-1),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "empty fallback token",
+			opts: append(simplest, []Option{
+				FallbackToken("", 3),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "fallback token without failures",
+			opts: append(simplest, []Option{
+				FallbackToken("token", 0),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "failure log",
+			opts: append(simplest, []Option{
+				FailureLog(mem.New(), "failures.msgpack"),
+				FailureLogReplay(5),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				if assert.NotNil(c.failureLog) {
+					assert.Equal("failures.msgpack", c.failureLog.path)
+					assert.Equal(DefaultFailureLogSize, c.failureLog.size)
+				}
+				assert.Equal(5, c.failureReplay)
+			},
+		}, {
+			description: "failure log without a filesystem",
+			opts: append(simplest, []Option{
+				FailureLog(nil, "failures.msgpack"),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "failure log without a path",
+			opts: append(simplest, []Option{
+				FailureLog(mem.New(), ""),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "record fetch durations",
+			opts: append(simplest, []Option{
+				RecordFetchDurations(0),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				if assert.NotNil(c.fetchDurations) {
+					assert.Equal(DefaultFetchDurationSamples, c.fetchDurations.size)
+				}
+			},
+		}, {
+			description: "negative fetch duration samples",
+			opts: append(simplest, []Option{
+				RecordFetchDurations(-1),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "max body bytes",
+			opts: append(simplest, []Option{
+				MaxBodyBytes(4096),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.Equal(int64(4096), c.maxBodyBytes)
+			},
+		}, {
+			description: "invalid max body bytes",
+			opts: append(simplest, []Option{
+				MaxBodyBytes(0),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "max cache age",
+			opts: append(simplest, []Option{
+				MaxCacheAge(time.Hour),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.Equal(time.Hour, c.maxCacheAge)
+			},
+		}, {
+			description: "negative max cache age",
+			opts: append(simplest, []Option{
+				MaxCacheAge(-time.Hour),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "success statuses",
+			opts: append(simplest, []Option{
+				SuccessStatuses([]int{200, 202}),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.Equal([]int{200, 202}, c.successStatuses)
+			},
+		}, {
+			description: "empty success statuses",
+			opts: append(simplest, []Option{
+				SuccessStatuses(nil),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "non-2xx success status",
+			opts: append(simplest, []Option{
+				SuccessStatuses([]int{200, 302}),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "negative failure log replay",
+			opts: append(simplest, []Option{
+				FailureLogReplay(-1),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "resolver",
+			opts: append(simplest, []Option{
+				HTTPClient(&http.Client{Timeout: time.Minute}),
+				WithResolver(&net.Resolver{PreferGo: true}),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.NotNil(c.resolver)
+				assert.Equal(time.Minute, c.client.Timeout)
+				assert.IsType(&http.Transport{}, c.client.Transport)
+				assert.Nil(http.DefaultClient.Transport)
+			},
+		}, {
+			description: "nil shutdown context",
+			opts: append(simplest, []Option{
+				ShutdownContext(nil), //nolint:staticcheck
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "nil resolver",
+			opts: append(simplest, []Option{
+				WithResolver(nil),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "resolver with an unsupported transport",
+			opts: append(simplest, []Option{
+				HTTPClient(&http.Client{Transport: http.NewFileTransport(http.Dir("."))}),
+				WithResolver(&net.Resolver{PreferGo: true}),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "insecure skip TLS verify",
+			opts: append(simplest, []Option{
+				InsecureSkipTLSVerify(true),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				if assert.IsType(&http.Transport{}, c.client.Transport) {
+					transport := c.client.Transport.(*http.Transport)
+					assert.True(transport.TLSClientConfig.InsecureSkipVerify)
+				}
+				assert.Nil(http.DefaultClient.Transport)
+				if def := http.DefaultTransport.(*http.Transport).TLSClientConfig; def != nil {
+					assert.False(def.InsecureSkipVerify)
+				}
+			},
+		}, {
+			description: "insecure skip TLS verify not set",
+			opts: append(simplest, []Option{
+				InsecureSkipTLSVerify(false),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.Equal(http.DefaultClient, c.client)
+			},
+		}, {
+			description: "insecure skip TLS verify with an unsupported transport",
+			opts: append(simplest, []Option{
+				HTTPClient(&http.Client{Transport: http.NewFileTransport(http.Dir("."))}),
+				InsecureSkipTLSVerify(true),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "retry after bounds",
+			opts: append(simplest, []Option{
+				RetryAfterBounds(time.Second, time.Minute),
+			}...),
+			check: func(assert *assert.Assertions, c *Credentials) {
+				assert.Equal(time.Second, c.minRetryAfter)
+				assert.Equal(time.Minute, c.maxRetryAfter)
+			},
+		}, {
+			description: "negative retry after bound",
+			opts: append(simplest, []Option{
+				RetryAfterBounds(-time.Second, time.Minute),
+			}...),
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "inverted retry after bounds",
+			opts: append(simplest, []Option{
+				RetryAfterBounds(time.Minute, time.Second),
+			}...),
+			expectedErr: ErrInvalidInput,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			opts := append(tc.opts, tc.opt)
+
+			got, err := New(opts...)
+
+			checks := append(tc.checks, tc.check)
+			for _, check := range checks {
+				if check != nil {
+					check(assert, got)
+				}
+			}
+
+			if tc.expectedErr == nil {
+				assert.NotNil(got)
+				assert.NoError(err)
+				return
+			}
+
+			assert.Nil(got)
+			assert.ErrorIs(err, tc.expectedErr)
+		})
+	}
+}
+
+func TestEndToEnd429(t *testing.T) {
+	now := time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)
+
+	bounds := RetryAfterBounds(10*time.Second, time.Hour)
+
+	tests := []struct {
+		description string
+		retryAfter  string
+		opts        []Option
+		expected    time.Duration
+	}{
+		{
+			description: "integer seconds",
+			retryAfter:  "15",
+			expected:    15 * time.Second,
+		}, {
+			description: "http-date",
+			retryAfter:  now.Add(90 * time.Second).Format(http.TimeFormat),
+			expected:    90 * time.Second,
+		}, {
+			description: "http-date in the past",
+			retryAfter:  now.Add(-90 * time.Second).Format(http.TimeFormat),
+		}, {
+			description: "negative seconds",
+			retryAfter:  "-15",
+		}, {
+			description: "invalid",
+			retryAfter:  "soon",
+		}, {
+			description: "missing",
+		}, {
+			description: "below the bounds",
+			retryAfter:  "0",
+			opts:        []Option{bounds},
+			expected:    10 * time.Second,
+		}, {
+			description: "http-date in the past below the bounds",
+			retryAfter:  now.Add(-90 * time.Second).Format(http.TimeFormat),
+			opts:        []Option{bounds},
+			expected:    10 * time.Second,
+		}, {
+			description: "within the bounds",
+			retryAfter:  "15",
+			opts:        []Option{bounds},
+			expected:    15 * time.Second,
+		}, {
+			description: "above the bounds",
+			retryAfter:  "31536000",
+			opts:        []Option{bounds},
+			expected:    time.Hour,
+		}, {
+			description: "http-date above the bounds",
+			retryAfter:  now.Add(24 * time.Hour).Format(http.TimeFormat),
+			opts:        []Option{bounds},
+			expected:    time.Hour,
+		}, {
+			description: "missing with bounds",
+			opts:        []Option{bounds},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			server := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						r.Body.Close()
+
+						if tc.retryAfter != "" {
+							w.Header().Add("Retry-After", tc.retryAfter)
+						}
+						w.WriteHeader(http.StatusTooManyRequests)
+					},
+				),
+			)
+			defer server.Close()
+
+			var called int
+			c, err := New(append(tc.opts,
+				URL(server.URL),
+				MacAddress(wrp.DeviceID("mac:112233445566")),
+				SerialNumber("1234567890"),
+				HardwareModel("model"),
+				HardwareManufacturer("manufacturer"),
+				FirmwareVersion("version"),
+				LastRebootReason("reason"),
+				XmidtProtocol("protocol"),
+				BootRetryWait(1),
+				NowFunc(func() time.Time { return now }),
+				AddFetchListener(event.FetchListenerFunc(
+					func(e event.Fetch) {
+						if called == 0 {
+							assert.Equal(tc.expected, e.RetryIn)
+							assert.ErrorIs(e.Err, ErrFetchFailed)
+						}
+						called++
+					})),
+			)...)
+
+			require.NoError(err)
+			require.NotNil(c)
+
+			c.Start()
+			defer c.Stop()
+
+			ctx := context.Background()
+			deadline, cancel := context.WithDeadline(ctx, time.Now().Add(100*time.Millisecond))
+			defer cancel()
+			c.WaitUntilFetched(deadline)
+
+			// A retry delayed by Retry-After isn't attempted within the wait,
+			// the others may retry right away.
+			if tc.expected > 0 {
+				assert.Equal(1, called)
+				return
+			}
+			assert.NotZero(called)
+		})
+	}
+}
+
+// mockResolver returns a resolver that answers every A lookup with 127.0.0.1
+// and records the names looked up.
+func mockResolver(t *testing.T) (*net.Resolver, func() []string) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	var (
+		lock  sync.Mutex
+		names []string
+	)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) == 0 {
+				continue
+			}
+
+			q := req.Questions[0]
+			lock.Lock()
+			names = append(names, q.Name.String())
+			lock.Unlock()
+
+			resp := dnsmessage.Message{
+				Header: dnsmessage.Header{
+					ID:       req.ID,
+					Response: true,
+				},
+				Questions: req.Questions,
+			}
+			if q.Type == dnsmessage.TypeA {
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{
+						Name:  q.Name,
+						Type:  dnsmessage.TypeA,
+						Class: dnsmessage.ClassINET,
+						TTL:   60,
+					},
+					Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				}}
+			}
+
+			if msg, err := resp.Pack(); err == nil {
+				_, _ = conn.WriteTo(msg, addr)
+			}
+		}
+	}()
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp4", conn.LocalAddr().String())
+		},
+	}
+
+	return resolver, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, names...)
+	}
+}
+
+func TestEndToEndWithResolver(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				_, _ = w.Write([]byte(`token`))
+			},
+		),
+	)
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(err)
+
+	resolver, lookups := mockResolver(t)
+
+	c, err := New(
+		URL("http://credentials.example.com:"+port),
+		WithResolver(resolver),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+	)
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	c.WaitUntilValid(ctx)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	require.NoError(err)
+	assert.NoError(c.Decorate(req.Header))
+	assert.Equal("Bearer token", req.Header.Get("Authorization"))
+	assert.Contains(lookups(), "credentials.example.com.")
+}
+
+func TestEndToEndWithResolverKeepsDialer(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				_, _ = w.Write([]byte(`token`))
+			},
+		),
+	)
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(err)
+
+	resolver, lookups := mockResolver(t)
+
+	var (
+		lock   sync.Mutex
+		dialed []string
+	)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			lock.Lock()
+			dialed = append(dialed, addr)
+			lock.Unlock()
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	c, err := New(
+		URL("http://credentials.example.com:"+port),
+		HTTPClient(&http.Client{Transport: transport}),
+		WithResolver(resolver),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+	)
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+	defer c.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	c.WaitUntilValid(ctx)
+
+	token, _, err := c.Credentials()
+	require.NoError(err)
+	assert.Equal("token", token)
+	assert.Contains(lookups(), "credentials.example.com.")
+
+	// The resolved address is dialed with the transport's own dialer.
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Contains(dialed, "127.0.0.1:"+port)
+}
+
+func TestEndToEndInsecureSkipTLSVerify(t *testing.T) {
+	server := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				_, _ = w.Write([]byte(`token`))
+			},
+		),
+	)
+	defer server.Close()
+
+	tests := []struct {
+		description string
+		skip        bool
+		expectErr   bool
+	}{
+		{
+			description: "verification skipped",
+			skip:        true,
+		}, {
+			description: "self-signed certificate rejected",
+			expectErr:   true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			c, err := New(
+				URL(server.URL),
+				InsecureSkipTLSVerify(tc.skip),
+				MacAddress(wrp.DeviceID("mac:112233445566")),
+				SerialNumber("1234567890"),
+				HardwareModel("model"),
+				HardwareManufacturer("manufacturer"),
+				FirmwareVersion("version"),
+				LastRebootReason("reason"),
+				XmidtProtocol("protocol"),
+				BootRetryWait(1),
+			)
+			require.NoError(err)
+			require.NotNil(c)
+
+			token, _, err := c.fetch(context.Background())
+			if tc.expectErr {
+				var unknown x509.UnknownAuthorityError
+				assert.ErrorAs(err, &unknown)
+				assert.Nil(token)
+				return
+			}
+
+			assert.NoError(err)
+			if assert.NotNil(token) {
+				assert.Equal("token", token.Token)
+			}
+		})
+	}
+}
+
+func TestEndToEndWithExpires(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	when := time.Now().Add(1 * time.Hour)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				w.Header().Add("Expires", when.Format(http.TimeFormat))
+				_, _ = w.Write([]byte(`token`))
+			},
+		),
+	)
+	defer server.Close()
+
+	c, err := New(
+		URL(server.URL),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+		AddFetchListener(event.FetchListenerFunc(
+			func(e event.Fetch) {
+				assert.Equal(when.Format(http.TimeFormat), e.Expiration.Format(http.TimeFormat))
+				assert.NoError(e.Err)
+			})),
+	)
+
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+	defer c.Stop()
+
+	ctx := context.Background()
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
+	defer cancel()
+	c.WaitUntilValid(deadline)
+}
+
+func TestRefetchIn(t *testing.T) {
+	until := 100 * time.Second
+
+	tests := []struct {
+		description string
+		jitter      float64
+		rand        float64
+		expected    time.Duration
+	}{
+		{
+			description: "no jitter",
+			rand:        0.0,
+			expected:    90 * time.Second,
+		}, {
+			description: "earliest",
+			jitter:      0.1,
+			rand:        0.0,
+			expected:    81 * time.Second,
+		}, {
+			description: "middle",
+			jitter:      0.1,
+			rand:        0.5,
+			expected:    90 * time.Second,
+		}, {
+			description: "latest",
+			jitter:      0.1,
+			rand:        0.999,
+			expected:    98*time.Second + 982*time.Millisecond,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			c := Credentials{
+				refetchPercent: DefaultRefetchPercent,
+				refetchJitter:  tc.jitter,
+				randFunc:       func() float64 { return tc.rand },
+			}
+
+			assert.InDelta(tc.expected, c.refetchIn(until), float64(time.Millisecond))
+		})
+	}
+
+	// The default random source stays within the window.
+	c := Credentials{
+		refetchPercent: DefaultRefetchPercent,
+		refetchJitter:  0.1,
+		randFunc:       rand.Float64,
+	}
+	for i := 0; i < 1000; i++ {
+		next := c.refetchIn(until)
+		assert.GreaterOrEqual(t, next, 81*time.Second)
+		assert.Less(t, next, 99*time.Second)
+	}
+}
+
+func TestEndToEndBodyLimitAndDigest(t *testing.T) {
+	token := strings.Repeat("t", 64)
+	sum := sha256.Sum256([]byte(token))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	otherSum := sha256.Sum256([]byte("other"))
+	otherDigest := "sha-256=:" + base64.StdEncoding.EncodeToString(otherSum[:]) + ":"
+
+	tests := []struct {
+		description   string
+		body          string
+		maxBodyBytes  int64
+		contentDigest []string
+		// hashed is the part of the body expected to be hashed.
+		hashed      string
+		expectedErr error
+	}{
+		{
+			description: "within the limit",
+			body:        token,
+			hashed:      token,
+		}, {
+			description:  "exactly the limit",
+			body:         token,
+			maxBodyBytes: 64,
+			hashed:       token,
+		}, {
+			description:  "over the limit",
+			body:         token,
+			maxBodyBytes: 16,
+			// Only one byte past the limit is read.
+			hashed:      token[:17],
+			expectedErr: ErrTokenTooLarge,
+		}, {
+			description:   "matching digest",
+			body:          token,
+			contentDigest: []string{"sha-512=:ignored:, " + digest},
+			hashed:        token,
+		}, {
+			description:   "matching digest, case insensitive",
+			body:          token,
+			contentDigest: []string{"unknown=:ignored:", strings.ToUpper(digest[:7]) + digest[7:]},
+			hashed:        token,
+		}, {
+			description:   "mismatched digest",
+			body:          token,
+			contentDigest: []string{otherDigest},
+			hashed:        token,
+			expectedErr:   ErrDigestMismatch,
+		}, {
+			description:   "invalid digest",
+			body:          token,
+			contentDigest: []string{"sha-256=:not base64:"},
+			hashed:        token,
+			expectedErr:   ErrDigestMismatch,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			server := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						r.Body.Close()
+
+						for _, v := range tc.contentDigest {
+							w.Header().Add("Content-Digest", v)
+						}
+						_, _ = w.Write([]byte(tc.body))
+					},
+				),
+			)
+			defer server.Close()
+
+			fetches := make(chan event.Fetch, 10)
+			opts := []Option{
+				URL(server.URL),
+				MacAddress(wrp.DeviceID("mac:112233445566")),
+				SerialNumber("1234567890"),
+				HardwareModel("model"),
+				HardwareManufacturer("manufacturer"),
+				FirmwareVersion("version"),
+				LastRebootReason("reason"),
+				XmidtProtocol("protocol"),
+				BootRetryWait(1),
+				AddFetchListener(event.FetchListenerFunc(
+					func(e event.Fetch) {
+						fetches <- e
+					})),
+			}
+			if tc.maxBodyBytes > 0 {
+				opts = append(opts, MaxBodyBytes(tc.maxBodyBytes))
+			}
+
+			c, err := New(opts...)
+			require.NoError(err)
+			require.NotNil(c)
+
+			c.Start()
+			defer c.Stop()
+
+			var fe event.Fetch
+			select {
+			case fe = <-fetches:
+			case <-time.After(2 * time.Second):
+				require.FailNow("timed out waiting for the fetch")
+			}
+
+			want := sha256.Sum256([]byte(tc.hashed))
+			assert.Equal(want[:], fe.BodySHA256)
+
+			if tc.expectedErr != nil {
+				assert.ErrorIs(fe.Err, tc.expectedErr)
+				assert.ErrorIs(fe.Err, ErrFetchFailed)
+				_, _, err := c.Credentials()
+				assert.ErrorIs(err, ErrNoToken)
+				return
+			}
+
+			assert.NoError(fe.Err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			c.WaitUntilValid(ctx)
+
+			got, _, err := c.Credentials()
+			require.NoError(err)
+			assert.Equal(token, got)
+		})
+	}
+}
+
+func TestEndToEndSuccessStatuses(t *testing.T) {
+	tests := []struct {
+		description string
+		statuses    []int
+		expectedErr error
+	}{
+		{
+			description: "202 by default",
+			expectedErr: ErrFetchFailed,
+		}, {
+			description: "202 configured",
+			statuses:    []int{http.StatusOK, http.StatusAccepted},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			server := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						r.Body.Close()
+
+						w.WriteHeader(http.StatusAccepted)
+						_, _ = w.Write([]byte("token"))
+					},
+				),
+			)
+			defer server.Close()
+
+			fetches := make(chan event.Fetch, 10)
+			opts := []Option{
+				URL(server.URL),
+				MacAddress(wrp.DeviceID("mac:112233445566")),
+				SerialNumber("1234567890"),
+				HardwareModel("model"),
+				HardwareManufacturer("manufacturer"),
+				FirmwareVersion("version"),
+				LastRebootReason("reason"),
+				XmidtProtocol("protocol"),
+				BootRetryWait(1),
+				AddFetchListener(event.FetchListenerFunc(
+					func(e event.Fetch) {
+						fetches <- e
+					})),
+			}
+			if tc.statuses != nil {
+				opts = append(opts, SuccessStatuses(tc.statuses))
+			}
+
+			c, err := New(opts...)
+			require.NoError(err)
+			require.NotNil(c)
+
+			c.Start()
+			defer c.Stop()
+
+			var fe event.Fetch
+			select {
+			case fe = <-fetches:
+			case <-time.After(2 * time.Second):
+				require.FailNow("timed out waiting for the fetch")
+			}
+
+			assert.Equal(http.StatusAccepted, fe.StatusCode)
+
+			if tc.expectedErr != nil {
+				assert.ErrorIs(fe.Err, tc.expectedErr)
+				_, _, err := c.Credentials()
+				assert.ErrorIs(err, ErrNoToken)
+				return
+			}
+
+			assert.NoError(fe.Err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			c.WaitUntilValid(ctx)
+
+			got, _, err := c.Credentials()
+			require.NoError(err)
+			assert.Equal("token", got)
+		})
+	}
+}
+
+func TestDetermineExpiration(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	expires := now.Add(2 * time.Hour)
+	forever := now.Add(time.Hour * 24 * 365 * 100)
+
+	tests := []struct {
+		description string
+		headers     http.Header
+		lifetime    time.Duration
+		expected    time.Time
+	}{
+		{
+			description: "no headers",
+			expected:    forever,
+		}, {
+			description: "assumed lifetime",
+			lifetime:    time.Hour,
+			expected:    now.Add(time.Hour),
+		}, {
+			description: "max-age only",
+			headers:     http.Header{"Cache-Control": {"max-age=600"}},
+			expected:    now.Add(10 * time.Minute),
+		}, {
+			description: "max-age with other directives",
+			headers:     http.Header{"Cache-Control": {"private, no-transform", `MAX-AGE="600"`}},
+			expected:    now.Add(10 * time.Minute),
+		}, {
+			description: "max-age wins over the assumed lifetime",
+			headers:     http.Header{"Cache-Control": {"max-age=600"}},
+			lifetime:    time.Hour,
+			expected:    now.Add(10 * time.Minute),
+		}, {
+			description: "invalid max-age is ignored",
+			headers:     http.Header{"Cache-Control": {"max-age=-1"}},
+			lifetime:    time.Hour,
+			expected:    now.Add(time.Hour),
+		}, {
+			description: "expires only",
+			headers:     http.Header{"Expires": {expires.Format(http.TimeFormat)}},
+			expected:    expires,
+		}, {
+			description: "expires wins over max-age",
+			headers: http.Header{
+				"Cache-Control": {"max-age=600"},
+				"Expires":       {expires.Format(http.TimeFormat)},
+			},
+			expected: expires,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			c := Credentials{
+				nowFunc:         func() time.Time { return now },
+				assumedLifetime: tc.lifetime,
+			}
+
+			var token xmidtInfo
+			c.determineExpiration(&http.Response{Header: tc.headers}, &token)
+			assert.True(tc.expected.Equal(token.ExpiresAt), "expected %s, got %s", tc.expected, token.ExpiresAt)
+		})
+	}
+}
+
+func TestEndToEndMarkInvalid(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	counter := 1
+
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				_, _ = w.Write([]byte(`token`))
+				counter++
+			},
+		),
+	)
+	defer server.Close()
+
+	called := 0
+	c, err := New(
+		URL(server.URL),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+		AddFetchListener(event.FetchListenerFunc(
+			func(e event.Fetch) {
+				fmt.Println("Fetch:")
+				fmt.Printf("  At:         %s\n", e.At.Format(time.RFC3339Nano))
+				fmt.Printf("  Duration:   %s\n", e.Duration)
+				fmt.Printf("  UUID:       %s\n", e.UUID)
+				fmt.Printf("  StatusCode: %d\n", e.StatusCode)
+				fmt.Printf("  RetryIn:    %s\n", e.RetryIn)
+				fmt.Printf("  Expiration: %s\n", e.Expiration.Format(time.RFC3339))
+				assert.NoError(e.Err)
+				called++
+			})),
+	)
+
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+	defer c.Stop()
+
+	ctx := context.Background()
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
+	defer cancel()
+	c.WaitUntilValid(deadline)
+
+	c.MarkInvalid(deadline)
+
+	c.WaitUntilValid(deadline)
+
+	assert.Equal(2, called)
+}
+
+func TestEndToEndReset(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				n := fetches.Add(1)
+				if n > 2 {
+					// Hold the reset refetch so the reset state can be inspected.
+					<-release
+				}
+				_, _ = w.Write([]byte(fmt.Sprintf("token%d", n)))
+			},
+		),
+	)
+	defer server.Close()
+
+	fs := mem.New(mem.WithDir(".", 0755))
+
+	c, err := New(
+		URL(server.URL),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+		AssumedLifetime(24*time.Hour),
+		LocalStorage(fs, "credentials.msgpack", 0600),
+		// Reset is never debounced.
+		MarkInvalidDebounce(time.Minute),
+	)
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+	defer c.Stop()
+
+	ctx := context.Background()
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
+	defer cancel()
+	c.WaitUntilValid(deadline)
+
+	c.MarkInvalid(deadline)
+	c.WaitUntilValid(deadline)
+
+	token, _, err := c.Credentials()
+	require.NoError(err)
+	assert.Equal("token2", token)
+
+	// The reset is within the debounce window of the MarkInvalid call.
+	c.Reset(deadline)
+
+	// The token and the cache are gone while the refetch is in progress.
+	_, _, err = c.Credentials()
+	assert.ErrorIs(err, ErrNoToken)
+	assert.Empty(fs.Files)
+
+	close(release)
+	c.WaitUntilValid(deadline)
+	require.NoError(deadline.Err())
+
+	token, _, err = c.Credentials()
+	require.NoError(err)
+	assert.Equal("token3", token)
+	assert.Equal(int32(3), fetches.Load())
+}
+
+func TestEndToEndRefresh(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var fetches atomic.Int32
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				n := fetches.Add(1)
+				if n == 2 {
+					// Hold the refresh so the token can be inspected.
+					close(fetching)
+					<-release
+				}
+				_, _ = w.Write([]byte(fmt.Sprintf("token%d", n)))
+			},
+		),
+	)
+	defer server.Close()
+
+	c, err := New(
+		URL(server.URL),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+		AssumedLifetime(24*time.Hour),
+		// Refresh is never debounced.
+		MarkInvalidDebounce(time.Minute),
+	)
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+	defer c.Stop()
+
+	ctx := context.Background()
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(2*time.Second))
+	defer cancel()
+	c.WaitUntilValid(deadline)
+	require.NoError(deadline.Err())
+
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		c.Refresh(deadline)
+	}()
+
+	select {
+	case <-fetching:
+	case <-deadline.Done():
+		require.FailNow("timed out waiting for the refresh fetch")
+	}
+
+	// The current token stays valid while the refresh is in progress.
+	token, _, err := c.Credentials()
+	require.NoError(err)
+	assert.Equal("token1", token)
+
+	headers := http.Header{}
+	assert.NoError(c.Decorate(headers))
+	assert.Equal("Bearer token1", headers.Get("Authorization"))
+
+	valid, cancelValid := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelValid()
+	c.WaitUntilValid(valid)
+	assert.NoError(valid.Err())
+
+	// Refresh blocks until the fetch attempt completes.
+	select {
+	case <-refreshed:
+		assert.Fail("refresh returned before the fetch completed")
+	default:
+	}
+
+	close(release)
+	select {
+	case <-refreshed:
+	case <-deadline.Done():
+		require.FailNow("timed out waiting for the refresh to complete")
+	}
+
+	token, _, err = c.Credentials()
+	require.NoError(err)
+	assert.Equal("token2", token)
+	assert.Equal(int32(2), fetches.Load())
+}
+
+func TestEndToEndFailureLog(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var fetches atomic.Int32
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				fetches.Add(1)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		),
+	)
+	defer server.Close()
+
+	fs := mem.New(mem.WithDir(".", 0755))
+
+	newCreds := func(opts ...Option) *Credentials {
+		c, err := New(append([]Option{
+			// Each attempt fails twice, once per URL.
+			URLs(server.URL, server.URL+"/backup"),
+			MacAddress(wrp.DeviceID("mac:112233445566")),
+			SerialNumber("1234567890"),
+			HardwareModel("model"),
+			HardwareManufacturer("manufacturer"),
+			FirmwareVersion("version"),
+			LastRebootReason("reason"),
+			XmidtProtocol("protocol"),
+			BootRetryWait(1),
+			FailureLog(fs, "logs/failures.msgpack"),
+		}, opts...)...)
+		require.NoError(err)
+		require.NotNil(c)
+		return c
+	}
+
+	// The first run records its failures.
+	first := newCreds()
+	first.Start()
+	require.Eventually(func() bool {
+		return fetches.Load() >= 2
+	}, 2*time.Second, 10*time.Millisecond)
+	first.Stop()
+
+	recorded := first.failureLog.failures
+	require.NotEmpty(recorded)
+	assert.LessOrEqual(len(recorded), DefaultFailureLogSize)
+	assert.Contains(fs.Files, "logs/failures.msgpack")
+	assert.Contains(fs.Files, "logs/failures.msgpack.sha256")
+
+	// The next run replays the most recent failures before fetching.
+	var (
+		m       sync.Mutex
+		history []event.History
+		fetched bool
+	)
+	second := newCreds(
+		FailureLogReplay(2),
+		AddHistoryListener(event.HistoryListenerFunc(
+			func(e event.History) {
+				m.Lock()
+				defer m.Unlock()
+				assert.False(fetched, "history replayed after a fetch")
+				history = append(history, e)
+			})),
+		AddFetchListener(event.FetchListenerFunc(
+			func(event.Fetch) {
+				m.Lock()
+				defer m.Unlock()
+				fetched = true
+			})),
+	)
+	second.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	second.WaitUntilFetched(ctx)
+	second.Stop()
+
+	m.Lock()
+	defer m.Unlock()
+	require.Len(history, 2)
+	assert.Equal(server.URL, history[0].URL)
+	assert.Equal(server.URL+"/backup", history[1].URL)
+	for i, h := range history {
+		want := recorded[len(recorded)-2+i]
+		assert.True(want.At.Equal(h.At))
+		assert.Equal(want.URL, h.URL)
+		assert.Equal(http.StatusInternalServerError, h.StatusCode)
+		require.Error(h.Err)
+		assert.Equal(want.Err, h.Err.Error())
+	}
+}
+
+func TestFailureLogBounded(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fs := mem.New(mem.WithDir(".", 0755))
+	l := failureLog{
+		fs:   fs,
+		path: "failures.msgpack",
+		size: 3,
+	}
+
+	assert.Empty(l.load())
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		require.NoError(l.record(event.Fetch{
+			At:         start.Add(time.Duration(i) * time.Second),
+			StatusCode: 500 + i,
+			Err:        ErrFetchFailed,
+		}))
+	}
+
+	reloaded := failureLog{
+		fs:   fs,
+		path: "failures.msgpack",
+		size: 3,
+	}
+	got := reloaded.load()
+	require.Len(got, 3)
+	for i, f := range got {
+		assert.Equal(502+i, f.StatusCode)
+		assert.Equal(ErrFetchFailed.Error(), f.Err)
+	}
+
+	// A corrupt log is treated as empty.
+	corrupt := fs.Files["failures.msgpack"]
+	corrupt.Bytes = []byte("corrupt")
+	fs.Files["failures.msgpack"] = corrupt
+	assert.Empty(reloaded.load())
+}
+
+func TestFetchDurationStats(t *testing.T) {
+	ms := func(n int) time.Duration {
+		return time.Duration(n) * time.Millisecond
+	}
+	network := func(n int) event.Fetch {
+		return event.Fetch{
+			Origin:   "network",
+			At:       time.Now(),
+			Duration: ms(n),
+		}
+	}
+
+	tests := []struct {
+		description string
+		samples     int
+		fetches     []event.Fetch
+		expected    FetchDurationStats
+	}{
+		{
+			description: "no fetches",
+			samples:     10,
+		}, {
+			description: "one fetch",
+			samples:     10,
+			fetches:     []event.Fetch{network(7)},
+			expected: FetchDurationStats{
+				Count: 1, Min: ms(7), Max: ms(7), P50: ms(7), P95: ms(7),
+			},
+		}, {
+			description: "several fetches",
+			samples:     100,
+			fetches: func() []event.Fetch {
+				var fetches []event.Fetch
+				// Out of order, so the stats don't depend on the order.
+				for i := 20; i > 0; i-- {
+					fetches = append(fetches, network(i*10))
+				}
+				return fetches
+			}(),
+			expected: FetchDurationStats{
+				Count: 20, Min: ms(10), Max: ms(200), P50: ms(100), P95: ms(190),
+			},
+		}, {
+			description: "only the most recent fetches are kept",
+			samples:     3,
+			fetches: []event.Fetch{
+				network(1000), network(900), network(10), network(30), network(20),
+			},
+			expected: FetchDurationStats{
+				Count: 3, Min: ms(10), Max: ms(30), P50: ms(20), P95: ms(30),
+			},
+		}, {
+			description: "unsent, canceled and file fetches are ignored",
+			samples:     10,
+			fetches: []event.Fetch{
+				network(50),
+				{Origin: "network", Err: ErrFetchNotAttempted},
+				{Origin: "network", At: time.Now(), Duration: ms(900), Err: context.Canceled},
+				{Origin: "fs", At: time.Now(), Duration: ms(900)},
+			},
+			expected: FetchDurationStats{
+				Count: 1, Min: ms(50), Max: ms(50), P50: ms(50), P95: ms(50),
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			c, err := New(
+				URLs("http://example.com"),
+				MacAddress(wrp.DeviceID("mac:112233445566")),
+				SerialNumber("1234567890"),
+				HardwareModel("model"),
+				HardwareManufacturer("manufacturer"),
+				FirmwareVersion("version"),
+				LastRebootReason("sleepy"),
+				XmidtProtocol("protocol"),
+				BootRetryWait(1),
+				RecordFetchDurations(tc.samples),
+			)
+			require.NoError(err)
+
+			for _, fe := range tc.fetches {
+				_ = c.dispatch(fe)
+			}
+
+			assert.Equal(tc.expected, c.FetchDurationStats())
+		})
+	}
+}
+
+func TestEndToEndFetchDurationStats(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Each fetch takes a little longer than the previous one.
+	var fetches atomic.Int32
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				n := fetches.Add(1)
+				time.Sleep(time.Duration(n) * 10 * time.Millisecond)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		),
+	)
+	defer server.Close()
+
+	c, err := New(
+		URLs(server.URL),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("sleepy"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+		RecordFetchDurations(10),
+	)
+	require.NoError(err)
+
+	// Without a running service, each call is a single fetch.
+	for i := 0; i < 3; i++ {
+		_, _, err := c.fetch(context.Background())
+		assert.ErrorIs(err, ErrFetchFailed)
+	}
+
+	stats := c.FetchDurationStats()
+	assert.Equal(3, stats.Count)
+	assert.GreaterOrEqual(stats.Min, 10*time.Millisecond)
+	assert.GreaterOrEqual(stats.P50, 20*time.Millisecond)
+	assert.GreaterOrEqual(stats.Max, 30*time.Millisecond)
+	assert.Equal(stats.Max, stats.P95)
+	assert.LessOrEqual(stats.Min, stats.P50)
+	assert.LessOrEqual(stats.P50, stats.Max)
+}
+
+func TestEndToEndMarkInvalidDebounce(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var fetches atomic.Int64
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				fetches.Add(1)
+				_, _ = w.Write([]byte(`token`))
+			},
+		),
+	)
+	defer server.Close()
+
+	c, err := New(
+		URL(server.URL),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+		MarkInvalidDebounce(time.Minute),
+	)
+
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+	defer c.Stop()
+
+	ctx := context.Background()
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
+	defer cancel()
+	c.WaitUntilValid(deadline)
+	require.Equal(int64(1), fetches.Load())
+
+	// Several calls within the window only result in a single refetch.
+	for i := 0; i < 5; i++ {
+		c.MarkInvalid(deadline)
+	}
+	c.WaitUntilValid(deadline)
+
+	assert.Equal(int64(2), fetches.Load())
+}
+
+func TestEndToEnd(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				_, _ = w.Write([]byte(`token`))
+			},
+		),
+	)
+	defer server.Close()
+
+	fs := mem.New(mem.WithDir(".", 0755))
+
+	c, err := New(
+		URL(server.URL),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+		AssumedLifetime(24*time.Hour),
+		LocalStorage(fs, "credentials.msgpack", 0600),
+		AddFetchListener(event.FetchListenerFunc(
+			func(e event.Fetch) {
+				fmt.Println("Fetch:")
+				fmt.Printf("  At:         %s\n", e.At.Format(time.RFC3339))
+				fmt.Printf("  Duration:   %s\n", e.Duration)
+				fmt.Printf("  UUID:       %s\n", e.UUID)
+				fmt.Printf("  StatusCode: %d\n", e.StatusCode)
+				fmt.Printf("  RetryIn:    %s\n", e.RetryIn)
+				fmt.Printf("  Expiration: %s\n", e.Expiration.Format(time.RFC3339))
+				if e.Err != nil {
+					fmt.Printf("  Err:        %s\n", e.Err)
+				} else {
+					fmt.Println("  Err:        nil")
+				}
+			})),
+		AddDecorateListener(event.DecorateListenerFunc(
+			func(e event.Decorate) {
+				fmt.Println("Decorate:")
+				fmt.Printf("  Expiration: %s\n", e.Expiration.Format(time.RFC3339))
+				if e.Err != nil {
+					fmt.Printf("  Err:        %s\n", e.Err)
+				} else {
+					fmt.Println("  Err:        nil")
+				}
+			})),
+	)
+
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+
+	// Multiple calls to Start is ok.
+	c.Start()
+
+	ctx := context.Background()
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
+	c.WaitUntilFetched(deadline)
+	c.WaitUntilValid(deadline)
+	cancel()
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	assert.NoError(err)
+	assert.NotNil(req)
+
+	err = c.Decorate(req.Header)
+	assert.NoError(err)
+	assert.Equal("Bearer token", strings.TrimSpace(req.Header.Get("Authorization")))
+
+	// Decorate the a second time.
+	_ = c.Decorate(req.Header)
+
+	c.Stop()
+
+	// Multiple calls to Stop is ok.
+	c.Stop()
+
+	_, found := fs.Files["credentials.msgpack"]
+	assert.True(found)
+
+	_, found = fs.Files["credentials.msgpack.sha256"]
+	assert.True(found)
+}
+
+func TestContextExpires(t *testing.T) {
+	c, err := New(
+		URL("http://example.com"),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+	)
+
+	require.NoError(t, err)
+	require.NotNil(t, c)
+
+	ctx := context.Background()
+	deadline, cancel := context.WithTimeout(ctx, 1*time.Millisecond)
+	defer cancel()
+	c.WaitUntilFetched(deadline)
+
+	deadline, cancel = context.WithTimeout(ctx, 1*time.Millisecond)
+	defer cancel()
+	c.WaitUntilValid(deadline)
+
+	deadline, cancel = context.WithTimeout(ctx, 1*time.Millisecond)
+	defer cancel()
+	c.MarkInvalid(deadline)
+}
+
+func TestDecorate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
+
+				_, _ = w.Write([]byte(``))
+			},
+		),
+	)
+	defer server.Close()
+
+	var count int
+	c, err := New(
+		URL(server.URL),
+		MacAddress(wrp.DeviceID("mac:112233445566")),
+		SerialNumber("1234567890"),
+		HardwareModel("model"),
+		HardwareManufacturer("manufacturer"),
+		FirmwareVersion("version"),
+		LastRebootReason("reason"),
+		XmidtProtocol("protocol"),
+		BootRetryWait(1),
+		Required(),
+		AddFetchListener(event.FetchListenerFunc(
+			func(e event.Fetch) {
+				assert.ErrorIs(e.Err, ErrEmptyToken)
+			})),
+		AddDecorateListener(event.DecorateListenerFunc(
+			func(e event.Decorate) {
+				switch count {
+				case 0:
+					assert.ErrorIs(e.Err, ErrNilRequest)
+				case 1:
+					assert.ErrorIs(e.Err, ErrNoToken)
+				default:
+					assert.Fail("too many calls to decorate")
+				}
+				count++
+			})),
+	)
+
+	require.NoError(err)
+	require.NotNil(c)
+
+	c.Start()
+	defer c.Stop()
+
+	ctx := context.Background()
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
+	defer cancel()
+	c.WaitUntilFetched(deadline)
+
+	err = c.Decorate(nil)
+	assert.ErrorIs(err, ErrNilRequest)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
+	err = c.Decorate(req.Header)
+	assert.ErrorIs(err, ErrNoToken)
+
+	assert.Equal(2, count)
+}
+
+func TestClaims(t *testing.T) {
+	sign := func(t *testing.T, exp time.Time) string {
+		tok, err := jwt.NewBuilder().
+			JwtID("1234").
+			Issuer("themis").
+			Subject("client:supplied").
+			Expiration(exp).
+			Claim("partner-id", map[string]any{"partner": "comcast"}).
+			Claim("capabilities", []any{"x1:issuer:test:.*:all"}).
+			Build()
+		require.NoError(t, err)
+
+		buf, err := jwt.Sign(tok, jwt.WithKey(jwa.HS256, []byte("secret")))
+		require.NoError(t, err)
+		return string(buf)
+	}
+
+	tests := []struct {
+		description string
+		token       func(*testing.T) string
+		expired     bool
+		expectedErr error
+	}{
+		{
+			description: "valid token",
+			token: func(t *testing.T) string {
+				return sign(t, time.Now().Add(time.Hour).Truncate(time.Second))
+			},
+		}, {
+			description: "expired token",
+			token: func(t *testing.T) string {
+				return sign(t, time.Now().Add(-time.Hour).Truncate(time.Second))
 			},
+			expired: true,
 		}, {
-			description: "invalid partner id",
-			opts: append(simplest, []Option{
-				PartnerID(nil),
-			}...),
-			check: func(assert *assert.Assertions, c *Credentials) {
-				assert.NotNil(c.partnerID)
+			description: "malformed token",
+			token: func(*testing.T) string {
+				return "not-a-jwt"
 			},
+			expectedErr: ErrMalformedToken,
 		}, {
-			description: "invalid last reconnect reason",
-			opts: append(simplest, []Option{
-				LastReconnectReason(nil),
-			}...),
-			check: func(assert *assert.Assertions, c *Credentials) {
-				assert.NotNil(c.lastReconnectReason)
+			description: "no token",
+			token: func(*testing.T) string {
+				return ""
 			},
+			expectedErr: ErrNoToken,
 		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.description, func(t *testing.T) {
 			assert := assert.New(t)
-
-			opts := append(tc.opts, tc.opt)
-
-			got, err := New(opts...)
-
-			checks := append(tc.checks, tc.check)
-			for _, check := range checks {
-				if check != nil {
-					check(assert, got)
-				}
+			require := require.New(t)
+
+			c, err := New(
+				URL("http://example.com"),
+				MacAddress(wrp.DeviceID("mac:112233445566")),
+				SerialNumber("1234567890"),
+				HardwareModel("model"),
+				HardwareManufacturer("manufacturer"),
+				FirmwareVersion("version"),
+				LastRebootReason("reason"),
+				XmidtProtocol("protocol"),
+				BootRetryWait(1),
+			)
+			require.NoError(err)
+			require.NotNil(c)
+
+			if token := tc.token(t); token != "" {
+				c.token = &xmidtInfo{Token: token}
 			}
 
-			if tc.expectedErr == nil {
-				assert.NotNil(got)
-				assert.NoError(err)
+			claims, err := c.Claims()
+			if tc.expectedErr != nil {
+				assert.ErrorIs(err, tc.expectedErr)
+				assert.Nil(claims)
 				return
 			}
 
-			assert.Nil(got)
-			assert.ErrorIs(err, tc.expectedErr)
+			require.NoError(err)
+			assert.Equal("1234", claims[jwt.JwtIDKey])
+			assert.Equal("themis", claims[jwt.IssuerKey])
+			assert.Equal("client:supplied", claims[jwt.SubjectKey])
+			assert.Equal(map[string]any{"partner": "comcast"}, claims["partner-id"])
+			assert.Equal([]any{"x1:issuer:test:.*:all"}, claims["capabilities"])
+
+			exp, ok := claims[jwt.ExpirationKey].(time.Time)
+			require.True(ok)
+			assert.Equal(tc.expired, exp.Before(time.Now()))
 		})
 	}
 }
 
-func TestEndToEnd429(t *testing.T) {
+func TestEndToEndEmptyToken(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
+	var fetches atomic.Int32
 	server := httptest.NewServer(
 		http.HandlerFunc(
 			func(w http.ResponseWriter, r *http.Request) {
 				r.Body.Close()
 
-				w.Header().Add("Retry-After", "15")
-				w.WriteHeader(http.StatusTooManyRequests)
+				// The first response is an empty 200.
+				if fetches.Add(1) > 1 {
+					_, _ = w.Write([]byte(`token`))
+				}
 			},
 		),
 	)
 	defer server.Close()
 
-	var called int
+	var errs []error
 	c, err := New(
 		URL(server.URL),
 		MacAddress(wrp.DeviceID("mac:112233445566")),
@@ -244,12 +2103,9 @@ func TestEndToEnd429(t *testing.T) {
 		BootRetryWait(1),
 		AddFetchListener(event.FetchListenerFunc(
 			func(e event.Fetch) {
-				assert.Equal(15*time.Second, e.RetryIn)
-				assert.ErrorIs(e.Err, ErrFetchFailed)
-				called++
+				errs = append(errs, e.Err)
 			})),
 	)
-
 	require.NoError(err)
 	require.NotNil(c)
 
@@ -257,30 +2113,37 @@ func TestEndToEnd429(t *testing.T) {
 	defer c.Stop()
 
 	ctx := context.Background()
-	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(100*time.Millisecond))
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(3*time.Second))
 	defer cancel()
-	c.WaitUntilFetched(deadline)
-	assert.Equal(1, called)
+	c.WaitUntilValid(deadline)
+	require.NoError(deadline.Err())
+
+	token, _, err := c.Credentials()
+	require.NoError(err)
+	assert.Equal("token", token)
+
+	require.Len(errs, 2)
+	assert.ErrorIs(errs[0], ErrEmptyToken)
+	assert.ErrorIs(errs[0], ErrFetchFailed)
+	assert.NoError(errs[1])
 }
 
-func TestEndToEndWithExpires(t *testing.T) {
-	assert := assert.New(t)
+func TestEndToEndShutdownContext(t *testing.T) {
 	require := require.New(t)
 
-	when := time.Now().Add(1 * time.Hour)
-
+	var fetches atomic.Int32
 	server := httptest.NewServer(
 		http.HandlerFunc(
 			func(w http.ResponseWriter, r *http.Request) {
 				r.Body.Close()
-
-				w.Header().Add("Expires", when.Format(http.TimeFormat))
-				_, _ = w.Write([]byte(`token`))
+				fetches.Add(1)
+				w.WriteHeader(http.StatusInternalServerError)
 			},
 		),
 	)
 	defer server.Close()
 
+	ctx, cancel := context.WithCancel(context.Background())
 	c, err := New(
 		URL(server.URL),
 		MacAddress(wrp.DeviceID("mac:112233445566")),
@@ -291,46 +2154,57 @@ func TestEndToEndWithExpires(t *testing.T) {
 		LastRebootReason("reason"),
 		XmidtProtocol("protocol"),
 		BootRetryWait(1),
-		AddFetchListener(event.FetchListenerFunc(
-			func(e event.Fetch) {
-				assert.Equal(when.Format(http.TimeFormat), e.Expiration.Format(http.TimeFormat))
-				assert.NoError(e.Err)
-			})),
+		ShutdownContext(ctx),
 	)
-
 	require.NoError(err)
 	require.NotNil(c)
 
 	c.Start()
 	defer c.Stop()
 
-	ctx := context.Background()
-	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
-	defer cancel()
-	c.WaitUntilValid(deadline)
+	require.Eventually(func() bool {
+		return fetches.Load() > 0
+	}, 3*time.Second, time.Millisecond)
+
+	// Canceling the shutdown context stops the fetches without calling Stop.
+	cancel()
+	c.wg.Wait()
+
+	n := fetches.Load()
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(n, fetches.Load())
 }
 
-func TestEndToEndMarkInvalid(t *testing.T) {
+func TestEndToEndBackupURL(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
-	counter := 1
-
-	server := httptest.NewServer(
+	primary := httptest.NewServer(
 		http.HandlerFunc(
 			func(w http.ResponseWriter, r *http.Request) {
 				r.Body.Close()
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		),
+	)
+	defer primary.Close()
 
+	backup := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				r.Body.Close()
 				_, _ = w.Write([]byte(`token`))
-				counter++
 			},
 		),
 	)
-	defer server.Close()
+	defer backup.Close()
 
-	called := 0
+	var (
+		lock   sync.Mutex
+		events []event.Fetch
+	)
 	c, err := New(
-		URL(server.URL),
+		URLs(primary.URL, backup.URL),
 		MacAddress(wrp.DeviceID("mac:112233445566")),
 		SerialNumber("1234567890"),
 		HardwareModel("model"),
@@ -341,18 +2215,11 @@ func TestEndToEndMarkInvalid(t *testing.T) {
 		BootRetryWait(1),
 		AddFetchListener(event.FetchListenerFunc(
 			func(e event.Fetch) {
-				fmt.Println("Fetch:")
-				fmt.Printf("  At:         %s\n", e.At.Format(time.RFC3339Nano))
-				fmt.Printf("  Duration:   %s\n", e.Duration)
-				fmt.Printf("  UUID:       %s\n", e.UUID)
-				fmt.Printf("  StatusCode: %d\n", e.StatusCode)
-				fmt.Printf("  RetryIn:    %s\n", e.RetryIn)
-				fmt.Printf("  Expiration: %s\n", e.Expiration.Format(time.RFC3339))
-				assert.NoError(e.Err)
-				called++
+				lock.Lock()
+				defer lock.Unlock()
+				events = append(events, e)
 			})),
 	)
-
 	require.NoError(err)
 	require.NotNil(c)
 
@@ -360,34 +2227,52 @@ func TestEndToEndMarkInvalid(t *testing.T) {
 	defer c.Stop()
 
 	ctx := context.Background()
-	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(3*time.Second))
 	defer cancel()
 	c.WaitUntilValid(deadline)
+	require.NoError(deadline.Err())
 
-	c.MarkInvalid(deadline)
-
-	c.WaitUntilValid(deadline)
-
-	assert.Equal(2, called)
+	token, _, err := c.Credentials()
+	require.NoError(err)
+	assert.Equal("token", token)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(events, 2)
+	assert.Equal(primary.URL, events[0].URL)
+	assert.Equal(http.StatusInternalServerError, events[0].StatusCode)
+	assert.ErrorIs(events[0].Err, ErrFetchFailed)
+	assert.Equal(backup.URL, events[1].URL)
+	assert.Equal(http.StatusOK, events[1].StatusCode)
+	assert.NoError(events[1].Err)
 }
 
-func TestEndToEnd(t *testing.T) {
+func TestEndToEndExpiring(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
+	var (
+		lock     sync.Mutex
+		order    []string
+		expiring []event.Expiring
+	)
+	record := func(what string) {
+		lock.Lock()
+		defer lock.Unlock()
+		order = append(order, what)
+	}
+
 	server := httptest.NewServer(
 		http.HandlerFunc(
 			func(w http.ResponseWriter, r *http.Request) {
 				r.Body.Close()
-
 				_, _ = w.Write([]byte(`token`))
 			},
 		),
 	)
 	defer server.Close()
 
-	fs := mem.New(mem.WithDir(".", 0755))
-
+	lifetime := 200 * time.Millisecond
 	c, err := New(
 		URL(server.URL),
 		MacAddress(wrp.DeviceID("mac:112233445566")),
@@ -398,118 +2283,65 @@ func TestEndToEnd(t *testing.T) {
 		LastRebootReason("reason"),
 		XmidtProtocol("protocol"),
 		BootRetryWait(1),
-		AssumedLifetime(24*time.Hour),
-		LocalStorage(fs, "credentials.msgpack", 0600),
+		AssumedLifetime(lifetime),
 		AddFetchListener(event.FetchListenerFunc(
-			func(e event.Fetch) {
-				fmt.Println("Fetch:")
-				fmt.Printf("  At:         %s\n", e.At.Format(time.RFC3339))
-				fmt.Printf("  Duration:   %s\n", e.Duration)
-				fmt.Printf("  UUID:       %s\n", e.UUID)
-				fmt.Printf("  StatusCode: %d\n", e.StatusCode)
-				fmt.Printf("  RetryIn:    %s\n", e.RetryIn)
-				fmt.Printf("  Expiration: %s\n", e.Expiration.Format(time.RFC3339))
-				if e.Err != nil {
-					fmt.Printf("  Err:        %s\n", e.Err)
-				} else {
-					fmt.Println("  Err:        nil")
-				}
+			func(event.Fetch) {
+				record("fetch")
 			})),
-		AddDecorateListener(event.DecorateListenerFunc(
-			func(e event.Decorate) {
-				fmt.Println("Decorate:")
-				fmt.Printf("  Expiration: %s\n", e.Expiration.Format(time.RFC3339))
-				if e.Err != nil {
-					fmt.Printf("  Err:        %s\n", e.Err)
-				} else {
-					fmt.Println("  Err:        nil")
-				}
+		AddExpiringListener(event.ExpiringListenerFunc(
+			func(e event.Expiring) {
+				lock.Lock()
+				expiring = append(expiring, e)
+				lock.Unlock()
+				record("expiring")
 			})),
 	)
-
 	require.NoError(err)
 	require.NotNil(c)
 
 	c.Start()
+	defer c.Stop()
 
-	// Multiple calls to Start is ok.
-	c.Start()
-
-	ctx := context.Background()
-	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
-	c.WaitUntilFetched(deadline)
-	c.WaitUntilValid(deadline)
-	cancel()
-
-	req, err := http.NewRequest(http.MethodGet, "https://example.com", nil)
-	assert.NoError(err)
-	assert.NotNil(req)
-
-	err = c.Decorate(req.Header)
-	assert.NoError(err)
-	assert.Equal("Bearer token", strings.TrimSpace(req.Header.Get("Authorization")))
-
-	// Decorate the a second time.
-	_ = c.Decorate(req.Header)
-
-	c.Stop()
-
-	// Multiple calls to Stop is ok.
-	c.Stop()
-
-	_, found := fs.Files["credentials.msgpack"]
-	assert.True(found)
-
-	_, found = fs.Files["credentials.msgpack.sha256"]
-	assert.True(found)
-}
-
-func TestContextExpires(t *testing.T) {
-	c, err := New(
-		URL("http://example.com"),
-		MacAddress(wrp.DeviceID("mac:112233445566")),
-		SerialNumber("1234567890"),
-		HardwareModel("model"),
-		HardwareManufacturer("manufacturer"),
-		FirmwareVersion("version"),
-		LastRebootReason("reason"),
-		XmidtProtocol("protocol"),
-		BootRetryWait(1),
-	)
-
-	require.NoError(t, err)
-	require.NotNil(t, c)
-
-	ctx := context.Background()
-	deadline, cancel := context.WithTimeout(ctx, 1*time.Millisecond)
-	defer cancel()
-	c.WaitUntilFetched(deadline)
-
-	deadline, cancel = context.WithTimeout(ctx, 1*time.Millisecond)
-	defer cancel()
-	c.WaitUntilValid(deadline)
-
-	deadline, cancel = context.WithTimeout(ctx, 1*time.Millisecond)
-	defer cancel()
-	c.MarkInvalid(deadline)
+	require.Eventually(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(order) >= 3
+	}, 3*time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The expiring event is sent when the refetch is scheduled, before the
+	// refetch happens.
+	assert.Equal([]string{"fetch", "expiring", "fetch"}, order[:3])
+	require.NotEmpty(expiring)
+	assert.Positive(expiring[0].TimeRemaining)
+	assert.LessOrEqual(expiring[0].TimeRemaining, lifetime)
+	assert.Equal(expiring[0].ExpiresAt.Sub(expiring[0].At), expiring[0].TimeRemaining)
 }
 
-func TestDecorate(t *testing.T) {
+func TestEndToEndFallbackToken(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
 
+	var failing atomic.Bool
+	failing.Store(true)
 	server := httptest.NewServer(
 		http.HandlerFunc(
 			func(w http.ResponseWriter, r *http.Request) {
 				r.Body.Close()
 
-				_, _ = w.Write([]byte(``))
+				if failing.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				_, _ = w.Write([]byte(`token`))
 			},
 		),
 	)
 	defer server.Close()
 
-	var count int
+	fallbacks := make(chan event.Fallback, 2)
 	c, err := New(
 		URL(server.URL),
 		MacAddress(wrp.DeviceID("mac:112233445566")),
@@ -520,44 +2352,47 @@ func TestDecorate(t *testing.T) {
 		LastRebootReason("reason"),
 		XmidtProtocol("protocol"),
 		BootRetryWait(1),
-		Required(),
-		AddFetchListener(event.FetchListenerFunc(
-			func(e event.Fetch) {
-				assert.NoError(e.Err)
-			})),
-		AddDecorateListener(event.DecorateListenerFunc(
-			func(e event.Decorate) {
-				switch count {
-				case 0:
-					assert.ErrorIs(e.Err, ErrNilRequest)
-				case 1:
-					assert.ErrorIs(e.Err, ErrNoToken)
-				default:
-					assert.Fail("too many calls to decorate")
-				}
-				count++
+		FallbackToken("fallback", 2),
+		AddFallbackListener(event.FallbackListenerFunc(
+			func(e event.Fallback) {
+				fallbacks <- e
 			})),
 	)
-
 	require.NoError(err)
 	require.NotNil(c)
 
 	c.Start()
 	defer c.Stop()
 
+	// The fallback token is used after the second failed fetch.
 	ctx := context.Background()
-	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(1*time.Second))
+	deadline, cancel := context.WithDeadline(ctx, time.Now().Add(3*time.Second))
 	defer cancel()
-	c.WaitUntilFetched(deadline)
-
-	err = c.Decorate(nil)
-	assert.ErrorIs(err, ErrNilRequest)
+	c.WaitUntilValid(deadline)
+	require.NoError(deadline.Err())
 
-	req, _ := http.NewRequest(http.MethodGet, "https://example.com", nil)
-	err = c.Decorate(req.Header)
-	assert.ErrorIs(err, ErrNoToken)
+	token, _, err := c.Credentials()
+	require.NoError(err)
+	assert.Equal("fallback", token)
+
+	e := <-fallbacks
+	assert.True(e.Active)
+	assert.Equal(2, e.Failures)
+	assert.ErrorIs(e.Err, ErrFetchFailed)
+
+	// The fetched token takes over once the server recovers.
+	failing.Store(false)
+	select {
+	case e = <-fallbacks:
+		assert.False(e.Active)
+		assert.NoError(e.Err)
+	case <-time.After(3 * time.Second):
+		require.Fail("timed out waiting for the recovery")
+	}
 
-	assert.Equal(2, count)
+	token, _, err = c.Credentials()
+	require.NoError(err)
+	assert.Equal("token", token)
 }
 
 func TestToAndFromFile(t *testing.T) {
@@ -641,3 +2476,103 @@ func TestToAndFromFile(t *testing.T) {
 
 	assert.Equal(1, count)
 }
+
+func TestMaxCacheAge(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		description string
+		fetchedAt   time.Time
+		expectedErr error
+	}{
+		{
+			description: "fresh cache",
+			fetchedAt:   now.Add(-time.Minute),
+		}, {
+			description: "stale cache",
+			fetchedAt:   now.Add(-48 * time.Hour),
+			expectedErr: ErrCacheTooOld,
+		}, {
+			description: "cache without a fetch time",
+			expectedErr: ErrCacheTooOld,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var count int
+			server := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						r.Body.Close()
+
+						w.Header().Add("Expires", time.Now().Add(time.Hour).Format(http.TimeFormat))
+						_, _ = w.Write([]byte(`network`))
+						count++
+					},
+				),
+			)
+			defer server.Close()
+
+			fs := mem.New(mem.WithDir(".", 0755))
+
+			fetches := make(chan event.Fetch, 10)
+			c, err := New(
+				URL(server.URL),
+				MacAddress(wrp.DeviceID("mac:112233445566")),
+				SerialNumber("1234567890"),
+				HardwareModel("model"),
+				HardwareManufacturer("manufacturer"),
+				FirmwareVersion("version"),
+				LastRebootReason("reason"),
+				XmidtProtocol("protocol"),
+				BootRetryWait(1),
+				LocalStorage(fs, "credentials.msgpack", 0600),
+				MaxCacheAge(24*time.Hour),
+				AddFetchListener(event.FetchListenerFunc(
+					func(e event.Fetch) {
+						fetches <- e
+					})),
+			)
+			require.NoError(err)
+			require.NotNil(c)
+
+			require.NoError(c.store(&xmidtInfo{
+				Token:     "cached",
+				ExpiresAt: now.Add(time.Hour),
+				FetchedAt: tc.fetchedAt,
+			}))
+
+			c.Start()
+			defer c.Stop()
+
+			var fe event.Fetch
+			select {
+			case fe = <-fetches:
+			case <-time.After(2 * time.Second):
+				require.FailNow("timed out waiting for the load")
+			}
+			assert.Equal("fs", fe.Origin)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			c.WaitUntilValid(ctx)
+
+			got, _, err := c.Credentials()
+			require.NoError(err)
+
+			if tc.expectedErr != nil {
+				assert.ErrorIs(fe.Err, tc.expectedErr)
+				assert.Equal("network", got)
+				assert.Equal(1, count)
+				return
+			}
+
+			assert.NoError(fe.Err)
+			assert.Equal("cached", got)
+			assert.Equal(0, count)
+		})
+	}
+}
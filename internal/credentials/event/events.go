@@ -18,6 +18,10 @@ type Fetch struct {
 	// The origin of the data - "fs" or "network" are the only valid values.
 	Origin string
 
+	// URL is the credential service URL the request was sent to.  It is
+	// empty unless the origin is "network".
+	URL string
+
 	// At holds the time when the fetch request was made.
 	At time.Time
 
@@ -38,6 +42,10 @@ type Fetch struct {
 	// Expiration is the time the token expires.
 	Expiration time.Time
 
+	// BodySHA256 is the SHA256 hash of the response body, computed while it
+	// was read.  It is nil unless a response body was read.
+	BodySHA256 []byte
+
 	// Error is the error returned from the SAT service.
 	Err error
 }
@@ -80,3 +88,96 @@ type DecorateListenerFunc func(Decorate)
 func (f DecorateListenerFunc) OnDecorate(e Decorate) {
 	f(e)
 }
+
+// Fallback is the event that is sent when the fallback token starts or stops
+// being used in place of a fetched token.
+type Fallback struct {
+	// At holds the time when the fallback token started or stopped being used.
+	At time.Time
+
+	// Active is true if the fallback token is now in use, and false once a
+	// fetched token has taken over again.
+	Active bool
+
+	// Failures is the number of consecutive failed fetches.
+	Failures int
+
+	// Err is the error from the most recent failed fetch.  It is nil once a
+	// fetched token has taken over again.
+	Err error
+}
+
+// FallbackListener is the interface that must be implemented by types that
+// want to receive Fallback notifications.
+type FallbackListener interface {
+	OnFallback(Fallback)
+}
+
+// FallbackListenerFunc is a function type that implements FallbackListener.
+// It can be used as an adapter for functions that need to implement the
+// FallbackListener interface.
+type FallbackListenerFunc func(Fallback)
+
+func (f FallbackListenerFunc) OnFallback(e Fallback) {
+	f(e)
+}
+
+// Expiring is the event that is sent each time the next fetch is scheduled
+// while a fetched token is held, whether or not the fetch succeeded.
+type Expiring struct {
+	// At holds the time when the next fetch was scheduled.
+	At time.Time
+
+	// ExpiresAt is the time the held token expires.
+	ExpiresAt time.Time
+
+	// TimeRemaining is the time left before the held token expires.  It is
+	// negative once the token has expired.
+	TimeRemaining time.Duration
+}
+
+// ExpiringListener is the interface that must be implemented by types that
+// want to receive Expiring notifications.
+type ExpiringListener interface {
+	OnExpiring(Expiring)
+}
+
+// ExpiringListenerFunc is a function type that implements ExpiringListener.
+// It can be used as an adapter for functions that need to implement the
+// ExpiringListener interface.
+type ExpiringListenerFunc func(Expiring)
+
+func (f ExpiringListenerFunc) OnExpiring(e Expiring) {
+	f(e)
+}
+
+// History is the event that is sent for each fetch failure recorded in the
+// failure log by a previous run, replayed when the service starts.
+type History struct {
+	// At holds the time when the failed fetch request was made.
+	At time.Time
+
+	// URL is the credential service URL the request was sent to.
+	URL string
+
+	// StatusCode is the status code returned from the SAT service.
+	StatusCode int
+
+	// Err is the error the fetch failed with.
+	Err error
+}
+
+// HistoryListener is the interface that must be implemented by types that
+// want to receive History notifications.
+type HistoryListener interface {
+	OnHistory(History)
+}
+
+// HistoryListenerFunc is a function type that implements HistoryListener.
+// It can be used as an adapter for functions that need to implement the
+// HistoryListener interface.
+type HistoryListenerFunc func(History)
+
+func (f HistoryListenerFunc) OnHistory(e History) {
+	f(e)
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package credentials
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ugorji/go/codec"
+	"github.com/xmidt-org/xmidt-agent/internal/credentials/event"
+	"github.com/xmidt-org/xmidt-agent/internal/fs"
+)
+
+const (
+	// DefaultFailureLogSize is the number of fetch failures kept in the
+	// failure log.
+	DefaultFailureLogSize = 32
+
+	// failureLogPerm is the permission of the failure log.
+	failureLogPerm = 0600
+
+	// failureLogDirPerm is the permission of any directories created for the
+	// failure log.
+	failureLogDirPerm = 0700
+)
+
+// failure is a failed fetch as recorded in the failure log.
+type failure struct {
+	At         time.Time `codec:"at"`
+	URL        string    `codec:"url"`
+	StatusCode int       `codec:"status_code"`
+	Err        string    `codec:"err"`
+}
+
+// failureLog is a bounded, on disk record of the most recent fetch failures,
+// kept so the reason of repeated failures survives a restart.
+type failureLog struct {
+	m        sync.Mutex
+	fs       fs.FS
+	path     string
+	size     int
+	failures []failure
+}
+
+// load reads the failures recorded by a previous run.  A missing or corrupt
+// log is treated as empty.
+func (l *failureLog) load() []failure {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	var buf []byte
+	err := fs.Operate(l.fs,
+		fs.WithPath(l.path, failureLogDirPerm),
+		fs.ReadFileWithSHA256(l.path, &buf))
+	if err != nil {
+		return nil
+	}
+
+	var failures []failure
+	dec := codec.NewDecoderBytes(buf, new(codec.MsgpackHandle))
+	if err := dec.Decode(&failures); err != nil {
+		return nil
+	}
+
+	l.failures = trimFailures(failures, l.size)
+	return append([]failure{}, l.failures...)
+}
+
+// record appends the failed fetch to the log, dropping the oldest failures
+// once the log is full.
+func (l *failureLog) record(e event.Fetch) error {
+	f := failure{
+		At:         e.At,
+		URL:        e.URL,
+		StatusCode: e.StatusCode,
+	}
+	if e.Err != nil {
+		f.Err = e.Err.Error()
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.failures = trimFailures(append(l.failures, f), l.size)
+
+	var buf []byte
+	enc := codec.NewEncoderBytes(&buf, new(codec.MsgpackHandle))
+	if err := enc.Encode(l.failures); err != nil {
+		return err
+	}
+
+	return fs.Operate(l.fs,
+		fs.WithPath(l.path, failureLogDirPerm),
+		fs.WriteFileWithSHA256(l.path, buf, failureLogPerm))
+}
+
+// trimFailures keeps the newest size failures.
+func trimFailures(failures []failure, size int) []failure {
+	if len(failures) > size {
+		failures = append([]failure{}, failures[len(failures)-size:]...)
+	}
+	return failures
+}
+
+// replayFailures loads the failure log and sends the most recent
+// failureReplay failures to the history listeners, oldest first.
+func (c *Credentials) replayFailures() {
+	if c.failureLog == nil {
+		return
+	}
+
+	failures := c.failureLog.load()
+	if c.failureReplay < len(failures) {
+		failures = failures[len(failures)-c.failureReplay:]
+	}
+
+	for _, f := range failures {
+		h := event.History{
+			At:         f.At,
+			URL:        f.URL,
+			StatusCode: f.StatusCode,
+		}
+		if f.Err != "" {
+			h.Err = errors.New(f.Err)
+		}
+		_ = c.dispatch(h)
+	}
+}
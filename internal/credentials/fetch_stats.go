@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package credentials
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFetchDurationSamples is the number of the most recent fetch
+	// durations the stats are computed from.
+	DefaultFetchDurationSamples = 256
+)
+
+// FetchDurationStats summarizes the durations of the most recent fetches from
+// the credential service.
+type FetchDurationStats struct {
+	// Count is the number of fetch durations the stats are computed from.
+	Count int
+
+	Min time.Duration
+	Max time.Duration
+	P50 time.Duration
+	P95 time.Duration
+}
+
+// fetchDurations is a bounded, in memory record of the most recent fetch
+// durations.
+type fetchDurations struct {
+	m       sync.Mutex
+	size    int
+	next    int
+	samples []time.Duration
+}
+
+// record adds the duration, replacing the oldest one once the record is full.
+func (d *fetchDurations) record(duration time.Duration) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if len(d.samples) < d.size {
+		d.samples = append(d.samples, duration)
+		return
+	}
+
+	d.samples[d.next] = duration
+	d.next = (d.next + 1) % d.size
+}
+
+// stats computes the stats of the recorded durations.  The percentiles use
+// the nearest rank method.
+func (d *fetchDurations) stats() FetchDurationStats {
+	d.m.Lock()
+	sorted := slices.Clone(d.samples)
+	d.m.Unlock()
+
+	if len(sorted) == 0 {
+		return FetchDurationStats{}
+	}
+
+	slices.Sort(sorted)
+
+	return FetchDurationStats{
+		Count: len(sorted),
+		Min:   sorted[0],
+		Max:   sorted[len(sorted)-1],
+		P50:   percentile(sorted, 0.50),
+		P95:   percentile(sorted, 0.95),
+	}
+}
+
+// percentile returns the p percentile of the sorted, non-empty durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
@@ -3,12 +3,19 @@
 
 package credentials
 
-import "fmt"
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
 
 func urlVador() Option {
 	return optionFunc(
 		func(c *Credentials) error {
-			if c.url == "" {
+			if len(c.urls) == 0 || c.urls[0] == "" {
 				return fmt.Errorf("%w URL is missing", ErrInvalidInput)
 			}
 			return nil
@@ -94,3 +101,107 @@ func bootRetryWaitVador() Option {
 			return nil
 		})
 }
+
+// useResolver threads the resolver into the dialer of a copy of the HTTP
+// client, once the client is known.
+func useResolver() Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if c.resolver == nil {
+				return nil
+			}
+
+			transport, ok := http.DefaultTransport.(*http.Transport)
+			if c.client.Transport != nil {
+				transport, ok = c.client.Transport.(*http.Transport)
+			}
+			if !ok {
+				return fmt.Errorf("%w: resolver requires an *http.Transport", ErrInvalidInput)
+			}
+
+			transport = transport.Clone()
+			transport.DialContext = resolvingDialer(c.resolver, transport.DialContext)
+
+			client := *c.client
+			client.Transport = transport
+			c.client = &client
+			return nil
+		})
+}
+
+// resolvingDialer looks up the host with the resolver and dials the addresses
+// found in order with dial, keeping the settings of the transport's dialer.
+func resolvingDialer(resolver *net.Resolver, dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		lookup := "ip"
+		switch network {
+		case "tcp4":
+			lookup = "ip4"
+		case "tcp6":
+			lookup = "ip6"
+		}
+
+		ips, err := resolver.LookupNetIP(ctx, lookup, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var errs error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = errors.Join(errs, err)
+		}
+
+		if errs == nil {
+			errs = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, errs
+	}
+}
+
+// useInsecureSkipTLSVerify disables the certificate verification of a copy of
+// the HTTP client, once the client is known.
+func useInsecureSkipTLSVerify() Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if !c.insecureSkipVerify {
+				return nil
+			}
+
+			transport, ok := http.DefaultTransport.(*http.Transport)
+			if c.client.Transport != nil {
+				transport, ok = c.client.Transport.(*http.Transport)
+			}
+			if !ok {
+				return fmt.Errorf("%w: skipping TLS verification requires an *http.Transport", ErrInvalidInput)
+			}
+
+			transport = transport.Clone()
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{} //nolint:gosec
+			}
+			transport.TLSClientConfig.InsecureSkipVerify = true //nolint:gosec
+
+			client := *c.client
+			client.Transport = transport
+			c.client = &client
+			return nil
+		})
+}
@@ -4,11 +4,15 @@
 package credentials
 
 import (
+	"context"
 	iofs "io/fs"
+	"net"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/budget"
 	"github.com/xmidt-org/xmidt-agent/internal/credentials/event"
 	"github.com/xmidt-org/xmidt-agent/internal/fs"
 )
@@ -32,9 +36,35 @@ func (f nilOptionFunc) apply(c *Credentials) error {
 
 // URL is the URL of the credential service.
 func URL(url string) Option {
-	return nilOptionFunc(
-		func(c *Credentials) {
-			c.url = url
+	return URLs(url)
+}
+
+// URLs are the URLs of the credential service, tried in order until one
+// returns a token.  The backups are only used when the primary fails.
+func URLs(primary string, backups ...string) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if slices.Contains(backups, "") {
+				return ErrInvalidInput
+			}
+
+			c.urls = append([]string{primary}, backups...)
+			return nil
+		})
+}
+
+// ShutdownContext is the context the credentials are refreshed with.  Once
+// it is canceled no further fetches are made, without waiting for Stop.  The
+// default is context.Background().
+func ShutdownContext(ctx context.Context) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if ctx == nil {
+				return ErrInvalidInput
+			}
+
+			c.shutdownCtx = ctx
+			return nil
 		})
 }
 
@@ -49,6 +79,35 @@ func HTTPClient(client *http.Client) Option {
 		})
 }
 
+// WithResolver sets the DNS resolver used to look up the credential server.
+// The addresses it finds are dialed with the existing dialer of a copy of the
+// HTTP client's transport, which must be an *http.Transport (or nil for the
+// default transport).  If this is not set, the transport's dialer is used as
+// is.
+func WithResolver(resolver *net.Resolver) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if resolver == nil {
+				return ErrInvalidInput
+			}
+			c.resolver = resolver
+			return nil
+		})
+}
+
+// InsecureSkipTLSVerify disables the verification of the credential server's
+// certificate chain and host name, so a server with a self-signed certificate
+// can be used.  This is only meant for lab environments and must never be
+// used in production.  Like WithResolver, this requires the HTTP client's
+// transport to be an *http.Transport (or nil for the default transport).  The
+// default is to verify the server certificate.
+func InsecureSkipTLSVerify(skip bool) Option {
+	return nilOptionFunc(
+		func(c *Credentials) {
+			c.insecureSkipVerify = skip
+		})
+}
+
 // RefetchPercent is the percentage of the lifetime of the credentials
 // that must pass before a refetch is attempted. The accepted range is 0.0 to
 // 100.0. If 0.0 is specified the default is used. The default is 90.0.
@@ -68,6 +127,58 @@ func RefetchPercent(percent float64) Option {
 		})
 }
 
+// RefetchJitter spreads the refetch time computed from RefetchPercent by up
+// to the given fraction in either direction, so a fleet of devices that booted
+// together doesn't refetch at the same moment.  The fraction must be in the
+// range [0, 1).  The default is zero, which disables the jitter.
+func RefetchJitter(fraction float64) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if fraction < 0.0 || fraction >= 1.0 {
+				return ErrInvalidInput
+			}
+
+			c.refetchJitter = fraction
+			return nil
+		})
+}
+
+// MaxBodyBytes is the largest credential service response body that is read.
+// Larger responses fail the fetch without being buffered in full.  The
+// default is DefaultMaxBodyBytes.
+func MaxBodyBytes(n int64) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if n < 1 {
+				return ErrInvalidInput
+			}
+
+			c.maxBodyBytes = n
+			return nil
+		})
+}
+
+// SuccessStatuses are the HTTP status codes of a credential service response
+// that carries the token, such as 202 from some proxies.  The list replaces
+// the default, so 200 must be included to remain a success.  Only 2xx
+// statuses are allowed.  The default is 200.
+func SuccessStatuses(statuses []int) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if len(statuses) == 0 {
+				return ErrInvalidInput
+			}
+			for _, status := range statuses {
+				if status < 200 || 299 < status {
+					return ErrInvalidInput
+				}
+			}
+
+			c.successStatuses = slices.Clone(statuses)
+			return nil
+		})
+}
+
 // AssumedLifetime is the lifetime of the credentials that is assumed if the
 // credentials service does not return a lifetime.  A value of zero means that
 // no assumed lifetime is used.  The default is zero.
@@ -109,6 +220,22 @@ func LocalStorage(fs fs.FS, filename string, perm iofs.FileMode) Option {
 		})
 }
 
+// MaxCacheAge is the longest time since the fetch that a token cached in the
+// local storage is trusted, even if it hasn't expired.  Older tokens are
+// ignored on start, forcing a fresh fetch.  A value of zero means the age
+// isn't checked.  The default is zero.
+func MaxCacheAge(age time.Duration) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if age < 0 {
+				return ErrInvalidInput
+			}
+
+			c.maxCacheAge = age
+			return nil
+		})
+}
+
 // MacAddress is the MAC address of the device.
 func MacAddress(macAddress wrp.DeviceID) Option {
 	return nilOptionFunc(
@@ -175,6 +302,126 @@ func BootRetryWait(bootRetryWait time.Duration) Option {
 		})
 }
 
+// RetryAfterBounds limits the retry delay the credential server asks for with
+// the Retry-After header of a 429 response to the range [minimum, maximum], so
+// an absurd value can't stall or hammer the server.  A maximum of zero means
+// there is no upper bound.  The default is no bounds.
+func RetryAfterBounds(minimum, maximum time.Duration) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if minimum < 0 || maximum < 0 || (maximum > 0 && maximum < minimum) {
+				return ErrInvalidInput
+			}
+			c.minRetryAfter = minimum
+			c.maxRetryAfter = maximum
+			return nil
+		})
+}
+
+// MarkInvalidDebounce is the window during which subsequent calls to
+// MarkInvalid are coalesced into the single refetch caused by the first call.
+// This protects the credential service when the connection flaps.  A value of
+// zero disables the debounce.  The default is zero.
+func MarkInvalidDebounce(window time.Duration) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if window < 0 {
+				return ErrInvalidInput
+			}
+			c.invalidateDebounce = window
+			return nil
+		})
+}
+
+// FallbackToken is a long lived, pre-shared token used in degraded mode, when
+// there is no usable token and the given number of consecutive fetches have
+// failed.  Fetching continues, and the fetched token takes over as soon as a
+// fetch succeeds.  The fallback token is never stored locally.  A Fallback
+// event is sent when degraded mode is entered and exited.
+func FallbackToken(token string, after int) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if token == "" || after < 1 {
+				return ErrInvalidInput
+			}
+			c.fallbackToken = token
+			c.fallbackAfter = after
+			return nil
+		})
+}
+
+// FailureLog records each failed fetch from the credential service (the time,
+// status code and error) to a log, so the reason for repeated failures
+// survives a restart.  The log keeps the most recent DefaultFailureLogSize
+// failures and is checksummed like the locally stored credentials.
+//
+// The path (and filename) is relative to the provided filesystem.  The
+// default is no failure log.
+func FailureLog(fsys fs.FS, path string) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if fsys == nil || path == "" {
+				return ErrInvalidInput
+			}
+
+			c.failureLog = &failureLog{
+				fs:   fsys,
+				path: path,
+				size: DefaultFailureLogSize,
+			}
+			return nil
+		})
+}
+
+// FailureLogReplay is the number of the most recent failures in the failure
+// log that are sent to the history listeners when the service starts.  The
+// default is zero, which only loads the log.
+func FailureLogReplay(n int) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if n < 0 {
+				return ErrInvalidInput
+			}
+			c.failureReplay = n
+			return nil
+		})
+}
+
+// RecordFetchDurations keeps the durations of the most recent fetches from the
+// credential service in memory, so their stats are available from
+// Credentials.FetchDurationStats.  Fetches that were never sent or were
+// interrupted by Stop are not recorded.  The number of samples kept defaults
+// to DefaultFetchDurationSamples if zero.  The default is not to record the
+// durations.
+func RecordFetchDurations(samples int) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			if samples < 0 {
+				return ErrInvalidInput
+			}
+			if samples == 0 {
+				samples = DefaultFetchDurationSamples
+			}
+
+			c.fetchDurations = &fetchDurations{
+				size: samples,
+			}
+			return nil
+		})
+}
+
+// RetryBudget is the retry budget consulted before each attempt to fetch the
+// credentials.  The budget may be shared with other components, such as the
+// websocket, to bound the combined rate of network attempts.  A nil budget
+// does not limit attempts.  The default is nil.
+func RetryBudget(b *budget.Budget) Option {
+	return optionFunc(
+		func(c *Credentials) error {
+			c.retryBudget = b
+			return nil
+		})
+}
+
 // LastReconnectReason is the reason for the most recent reconnect of the
 // device.  This is a dynamic value that is obtained by calling the function
 // provided.
@@ -236,3 +483,42 @@ func AddDecorateListener(listener event.DecorateListener, cancel ...*event.Cance
 			}
 		})
 }
+
+// AddFallbackListener adds a listener for fallback events.  If the optional
+// cancel parameter is provided, it is set to a function that can be used to
+// cancel the listener.
+func AddFallbackListener(listener event.FallbackListener, cancel ...*event.CancelListenerFunc) Option {
+	return nilOptionFunc(
+		func(c *Credentials) {
+			cncl := c.fallbackListeners.Add(listener)
+			if len(cancel) > 0 && cancel[0] != nil {
+				*cancel[0] = event.CancelListenerFunc(cncl)
+			}
+		})
+}
+
+// AddExpiringListener adds a listener for expiring events.  If the optional
+// cancel parameter is provided, it is set to a function that can be used to
+// cancel the listener.
+func AddExpiringListener(listener event.ExpiringListener, cancel ...*event.CancelListenerFunc) Option {
+	return nilOptionFunc(
+		func(c *Credentials) {
+			cncl := c.expiringListeners.Add(listener)
+			if len(cancel) > 0 && cancel[0] != nil {
+				*cancel[0] = event.CancelListenerFunc(cncl)
+			}
+		})
+}
+
+// AddHistoryListener adds a listener for history events, the fetch failures
+// replayed from the failure log.  If the optional cancel parameter is
+// provided, it is set to a function that can be used to cancel the listener.
+func AddHistoryListener(listener event.HistoryListener, cancel ...*event.CancelListenerFunc) Option {
+	return nilOptionFunc(
+		func(c *Credentials) {
+			cncl := c.historyListeners.Add(listener)
+			if len(cancel) > 0 && cancel[0] != nil {
+				*cancel[0] = event.CancelListenerFunc(cncl)
+			}
+		})
+}
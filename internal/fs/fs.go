@@ -20,6 +20,9 @@ type FS interface {
 
 	// WriteFile writes the file with the specified permissions.  Should match os.WriteFile().
 	WriteFile(name string, data []byte, perm fs.FileMode) error
+
+	// Remove removes the named file.  Should match os.Remove().
+	Remove(name string) error
 }
 
 // Option is an interface for options that can be applied in order via the Operate function.
@@ -345,3 +345,64 @@ func TestWriteileWithSHA256(t *testing.T) {
 		})
 	}
 }
+
+func TestRemoveFileWithSHA256(t *testing.T) {
+	tests := []struct {
+		description string
+		filename    string
+		start       *mem.FS
+		expectFiles []string
+		expectErr   error
+	}{
+		{
+			description: "simple path",
+			filename:    "foo",
+			start: mem.New(
+				mem.WithDir(".", 0755),
+				mem.WithFile("foo", "text\n", 0644),
+				mem.WithFile("foo.sha256", "b9e68e1bea3e5b19ca6b2f98b73a54b73daafaa250484902e09982e07a12e733  foo\n", 0644),
+				mem.WithFile("bar", "text\n", 0644)),
+			expectFiles: []string{"bar"},
+		}, {
+			description: "missing files",
+			filename:    "foo",
+			start: mem.New(
+				mem.WithDir(".", 0755),
+				mem.WithFile("bar", "text\n", 0644)),
+			expectFiles: []string{"bar"},
+		}, {
+			description: "missing sha file",
+			filename:    "foo",
+			start: mem.New(
+				mem.WithDir(".", 0755),
+				mem.WithFile("foo", "text\n", 0644)),
+		}, {
+			description: "unable to remove the file",
+			filename:    "foo",
+			start: mem.New(
+				mem.WithDir(".", 0755),
+				mem.WithFile("foo.sha256", "b9e68e1bea3e5b19ca6b2f98b73a54b73daafaa250484902e09982e07a12e733  foo\n", 0644),
+				mem.WithError("foo", errUnknown)),
+			expectFiles: []string{"foo.sha256"},
+			expectErr:   errUnknown,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			fs := tc.start
+
+			err := xafs.Operate(fs, xafs.RemoveFileWithSHA256(tc.filename))
+
+			assert.ErrorIs(err, tc.expectErr)
+
+			files := make([]string, 0, len(fs.Files))
+			for name := range fs.Files {
+				files = append(files, name)
+			}
+			assert.ElementsMatch(tc.expectFiles, files)
+		})
+	}
+}
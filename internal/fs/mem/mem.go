@@ -168,6 +168,19 @@ func (fs *FS) WriteFile(name string, data []byte, perm iofs.FileMode) error {
 	return nil
 }
 
+func (fs *FS) Remove(name string) error {
+	if err := fs.hasPerms(name, iofs.FileMode(0222)); err != nil {
+		return err
+	}
+
+	if _, found := fs.Files[name]; !found {
+		return fmt.Errorf("%w: file named: '%s'", iofs.ErrNotExist, name)
+	}
+	delete(fs.Files, name)
+
+	return nil
+}
+
 func (fs *FS) hasPerms(name string, perm iofs.FileMode) error {
 	if name == "" {
 		return iofs.ErrInvalid
@@ -485,3 +485,61 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestFS_Remove(t *testing.T) {
+	tests := []struct {
+		description string
+		fs          FS
+		filename    string
+		expect      FS
+		expectedErr error
+	}{
+		{
+			description: "simple rel path",
+			filename:    "foo.txt",
+			fs: FS{
+				Files: map[string]File{
+					"foo.txt": {
+						Bytes: []byte("foo file"),
+						Perm:  0644,
+					},
+				},
+			},
+			expect: FS{
+				Files: map[string]File{},
+			},
+		}, {
+			description: "missing file",
+			filename:    "foo.txt",
+			expectedErr: iofs.ErrNotExist,
+		}, {
+			description: "missing path",
+			filename:    "foo/bar.txt",
+			expectedErr: iofs.ErrNotExist,
+		}, {
+			description: "error path",
+			filename:    "foo.txt",
+			fs: FS{
+				Errs: map[string]error{
+					"foo.txt": iofs.ErrInvalid,
+				},
+			},
+			expect: FS{
+				Errs: map[string]error{
+					"foo.txt": iofs.ErrInvalid,
+				},
+			},
+			expectedErr: iofs.ErrInvalid,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			err := tc.fs.Remove(tc.filename)
+
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.Equal(tc.expect, tc.fs)
+		})
+	}
+}
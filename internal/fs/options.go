@@ -132,6 +132,21 @@ func ReadFileWithSHA256(name string, data *[]byte) Option {
 		})
 }
 
+// RemoveFileWithSHA256 removes both the file and its checksum file.  Files
+// that do not exist are ignored.
+func RemoveFileWithSHA256(name string) Option {
+	return OptionFunc(
+		func(f FS) error {
+			for _, n := range []string{name, shaSumName(name)} {
+				if err := f.Remove(n); err != nil && !errors.Is(err, fs.ErrNotExist) {
+					return err
+				}
+			}
+
+			return nil
+		})
+}
+
 func shaSumName(name string) string {
 	return name + ".sha256"
 }
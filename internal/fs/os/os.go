@@ -50,3 +50,7 @@ func (f *fs) ReadFile(name string) ([]byte, error) {
 func (f *fs) WriteFile(name string, data []byte, perm iofs.FileMode) error {
 	return os.WriteFile(filepath.Join(f.base, name), data, perm)
 }
+
+func (f *fs) Remove(name string) error {
+	return os.Remove(filepath.Join(f.base, name))
+}
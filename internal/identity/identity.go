@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+// Package identity resolves the device ID from an ordered list of sources,
+// so hardware that only exposes its MAC address at runtime can still be
+// identified.
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+var (
+	ErrNoDeviceID    = errors.New("no device id found")
+	ErrInvalidSource = errors.New("invalid device id source")
+)
+
+// Source provides the device ID.
+type Source interface {
+	DeviceID() (wrp.DeviceID, error)
+}
+
+// SourceFunc is a function type that implements Source.
+type SourceFunc func() (wrp.DeviceID, error)
+
+func (f SourceFunc) DeviceID() (wrp.DeviceID, error) {
+	return f()
+}
+
+// Static is a Source that provides a fixed device ID, such as one from the
+// configuration.  An empty device ID is treated as not found.
+func Static(id wrp.DeviceID) Source {
+	return SourceFunc(
+		func() (wrp.DeviceID, error) {
+			if id == "" {
+				return "", fmt.Errorf("%w: static device id is empty", ErrInvalidSource)
+			}
+
+			return parse(string(id))
+		})
+}
+
+// File is a Source that reads the device ID from a file, such as
+// `/sys/class/net/eth0/address`.  The file may contain either a device ID
+// (`mac:112233445566`) or a bare MAC address (`11:22:33:44:55:66`).
+func File(path string) Source {
+	return SourceFunc(
+		func() (wrp.DeviceID, error) {
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				return "", errors.Join(ErrInvalidSource, err)
+			}
+
+			return parse(strings.TrimSpace(string(buf)))
+		})
+}
+
+// Interface is a Source that uses the MAC address of the named network
+// interface.
+func Interface(name string) Source {
+	return SourceFunc(
+		func() (wrp.DeviceID, error) {
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				return "", errors.Join(ErrInvalidSource, err)
+			}
+
+			return macDeviceID(*iface)
+		})
+}
+
+// InterfaceLister lists the network interfaces in priority order, such as a
+// NetworkServicer from the internal net package.
+type InterfaceLister interface {
+	GetInterfaces() ([]net.Interface, error)
+}
+
+// NetworkInterface is a Source that uses the MAC address of the named
+// interface from the lister.  If name is empty, the highest priority
+// interface with a MAC address is used.
+func NetworkInterface(lister InterfaceLister, name string) Source {
+	return SourceFunc(
+		func() (wrp.DeviceID, error) {
+			if lister == nil {
+				return "", fmt.Errorf("%w: nil interface lister", ErrInvalidSource)
+			}
+
+			ifaces, err := lister.GetInterfaces()
+			if err != nil {
+				return "", errors.Join(ErrInvalidSource, err)
+			}
+
+			errs := []error{ErrInvalidSource}
+			for _, iface := range ifaces {
+				if name != "" && !strings.EqualFold(name, iface.Name) {
+					continue
+				}
+
+				id, err := macDeviceID(iface)
+				if err == nil {
+					return id, nil
+				}
+				errs = append(errs, err)
+			}
+
+			if name != "" && len(errs) == 1 {
+				return "", fmt.Errorf("%w: interface '%s' not found", ErrInvalidSource, name)
+			}
+			if len(errs) == 1 {
+				return "", fmt.Errorf("%w: no interfaces found", ErrInvalidSource)
+			}
+
+			return "", errors.Join(errs...)
+		})
+}
+
+// Resolve returns the device ID from the first source that provides one.  The
+// sources are listed in order of precedence.  If no source provides a device
+// ID, ErrNoDeviceID is returned along with the error from each source.
+func Resolve(sources ...Source) (wrp.DeviceID, error) {
+	errs := []error{ErrNoDeviceID}
+	for _, src := range sources {
+		if src == nil {
+			continue
+		}
+
+		id, err := src.DeviceID()
+		if err == nil {
+			return id, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return "", errors.Join(errs...)
+}
+
+// macDeviceID formats the interface's MAC address as a device ID.  Interfaces
+// without an EUI-48 or EUI-64 hardware address, such as loopback or tunnel
+// interfaces, are rejected.
+func macDeviceID(iface net.Interface) (wrp.DeviceID, error) {
+	switch len(iface.HardwareAddr) {
+	case 6, 8:
+	case 0:
+		return "", fmt.Errorf("%w: interface '%s' has no hardware address", ErrInvalidSource, iface.Name)
+	default:
+		return "", fmt.Errorf("%w: interface '%s' hardware address is not a MAC address", ErrInvalidSource, iface.Name)
+	}
+
+	return parse("mac:" + iface.HardwareAddr.String())
+}
+
+// parse normalizes a device ID, treating a value without a scheme as a MAC
+// address.
+func parse(s string) (wrp.DeviceID, error) {
+	id, err := wrp.ParseDeviceID(s)
+	if err == nil {
+		return id, nil
+	}
+
+	id, err = wrp.ParseDeviceID("mac:" + s)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid device id '%s'", ErrInvalidSource, s)
+	}
+
+	return id, nil
+}
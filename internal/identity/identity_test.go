@@ -0,0 +1,330 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package identity
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	xnet "github.com/xmidt-org/xmidt-agent/internal/net"
+)
+
+var errUnknown = errors.New("unknown error")
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "address")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestStatic(t *testing.T) {
+	tests := []struct {
+		description string
+		id          wrp.DeviceID
+		expected    wrp.DeviceID
+		expectedErr error
+	}{
+		{
+			description: "device id",
+			id:          "mac:112233445566",
+			expected:    "mac:112233445566",
+		}, {
+			description: "device id is normalized",
+			id:          "MAC:11:22:33:44:55:66",
+			expected:    "mac:112233445566",
+		}, {
+			description: "empty device id",
+			expectedErr: ErrInvalidSource,
+		}, {
+			description: "invalid device id",
+			id:          "invalid",
+			expectedErr: ErrInvalidSource,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := Static(tc.id).DeviceID()
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	tests := []struct {
+		description string
+		content     *string
+		expected    wrp.DeviceID
+		expectedErr error
+	}{
+		{
+			description: "sysfs mac address",
+			content:     ptr("11:22:33:44:55:66\n"),
+			expected:    "mac:112233445566",
+		}, {
+			description: "device id",
+			content:     ptr("mac:112233445566"),
+			expected:    "mac:112233445566",
+		}, {
+			description: "empty file",
+			content:     ptr(""),
+			expectedErr: ErrInvalidSource,
+		}, {
+			description: "missing file",
+			expectedErr: ErrInvalidSource,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			path := filepath.Join(t.TempDir(), "missing")
+			if tc.content != nil {
+				path = writeFile(t, *tc.content)
+			}
+
+			got, err := File(path).DeviceID()
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
+func TestInterface(t *testing.T) {
+	t.Run("missing interface", func(t *testing.T) {
+		got, err := Interface("does-not-exist0").DeviceID()
+		assert.ErrorIs(t, err, ErrInvalidSource)
+		assert.Empty(t, got)
+	})
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	for _, iface := range ifaces {
+		if len(iface.HardwareAddr) == 0 {
+			t.Run("no hardware address", func(t *testing.T) {
+				got, err := Interface(iface.Name).DeviceID()
+				assert.ErrorIs(t, err, ErrInvalidSource)
+				assert.Empty(t, got)
+			})
+			break
+		}
+	}
+
+	for _, iface := range ifaces {
+		if len(iface.HardwareAddr) == 6 {
+			t.Run("hardware address", func(t *testing.T) {
+				expected, err := wrp.ParseDeviceID("mac:" + iface.HardwareAddr.String())
+				require.NoError(t, err)
+
+				got, err := Interface(iface.Name).DeviceID()
+				assert.NoError(t, err)
+				assert.Equal(t, expected, got)
+			})
+			break
+		}
+	}
+}
+
+type mockNetworkWrapper struct {
+	mock.Mock
+}
+
+func (m *mockNetworkWrapper) Interfaces() ([]net.Interface, error) {
+	args := m.Called()
+	return args.Get(0).([]net.Interface), args.Error(1)
+}
+
+func TestNetworkInterface(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		hw, err := net.ParseMAC(s)
+		require.NoError(t, err)
+		return hw
+	}
+	running := net.FlagUp | net.FlagRunning
+
+	eth0 := net.Interface{Name: "eth0", Flags: running, HardwareAddr: mac("11:22:33:44:55:66")}
+	wlan0 := net.Interface{Name: "wlan0", Flags: running, HardwareAddr: mac("aa:bb:cc:dd:ee:ff")}
+	tun0 := net.Interface{Name: "tun0", Flags: running}
+	ib0 := net.Interface{Name: "ib0", Flags: running,
+		HardwareAddr: mac("00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01")}
+
+	allowed := map[string]xnet.AllowedInterface{
+		"tun0":  {Priority: 1, Enabled: true},
+		"ib0":   {Priority: 2, Enabled: true},
+		"wlan0": {Priority: 3, Enabled: true},
+		"eth0":  {Priority: 4, Enabled: true},
+	}
+
+	tests := []struct {
+		description string
+		ifaces      []net.Interface
+		err         error
+		name        string
+		expected    wrp.DeviceID
+		expectedErr error
+	}{
+		{
+			description: "named interface",
+			ifaces:      []net.Interface{eth0, wlan0},
+			name:        "eth0",
+			expected:    "mac:112233445566",
+		}, {
+			description: "named interface is case insensitive",
+			ifaces:      []net.Interface{eth0, wlan0},
+			name:        "ETH0",
+			expected:    "mac:112233445566",
+		}, {
+			description: "highest priority interface",
+			ifaces:      []net.Interface{eth0, wlan0},
+			expected:    "mac:aabbccddeeff",
+		}, {
+			description: "non-mac interfaces are skipped",
+			ifaces:      []net.Interface{eth0, tun0, ib0},
+			expected:    "mac:112233445566",
+		}, {
+			description: "missing named interface",
+			ifaces:      []net.Interface{eth0, wlan0},
+			name:        "eth1",
+			expectedErr: ErrInvalidSource,
+		}, {
+			description: "named interface without a hardware address",
+			ifaces:      []net.Interface{eth0, tun0},
+			name:        "tun0",
+			expectedErr: ErrInvalidSource,
+		}, {
+			description: "named interface without a mac address",
+			ifaces:      []net.Interface{eth0, ib0},
+			name:        "ib0",
+			expectedErr: ErrInvalidSource,
+		}, {
+			description: "only non-mac interfaces",
+			ifaces:      []net.Interface{tun0, ib0},
+			expectedErr: ErrInvalidSource,
+		}, {
+			description: "no interfaces",
+			ifaces:      []net.Interface{},
+			expectedErr: ErrInvalidSource,
+		}, {
+			description: "enumeration fails",
+			ifaces:      []net.Interface{},
+			err:         errUnknown,
+			expectedErr: errUnknown,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			m := new(mockNetworkWrapper)
+			m.On("Interfaces").Return(tc.ifaces, tc.err)
+
+			got, err := NetworkInterface(xnet.New(m, allowed), tc.name).DeviceID()
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.Equal(tc.expected, got)
+			m.AssertExpectations(t)
+		})
+	}
+
+	t.Run("nil lister", func(t *testing.T) {
+		got, err := NetworkInterface(nil, "eth0").DeviceID()
+		assert.ErrorIs(t, err, ErrInvalidSource)
+		assert.Empty(t, got)
+	})
+}
+
+func TestResolve(t *testing.T) {
+	file := func(t *testing.T) Source {
+		return File(writeFile(t, "aa:bb:cc:dd:ee:ff\n"))
+	}
+	missing := func(t *testing.T) Source {
+		return File(filepath.Join(t.TempDir(), "missing"))
+	}
+
+	tests := []struct {
+		description string
+		sources     func(*testing.T) []Source
+		expected    wrp.DeviceID
+		expectedErr error
+	}{
+		{
+			description: "config takes precedence over the file",
+			sources: func(t *testing.T) []Source {
+				return []Source{Static("mac:112233445566"), file(t)}
+			},
+			expected: "mac:112233445566",
+		}, {
+			description: "file takes precedence over config",
+			sources: func(t *testing.T) []Source {
+				return []Source{file(t), Static("mac:112233445566")}
+			},
+			expected: "mac:aabbccddeeff",
+		}, {
+			description: "empty config falls through to the file",
+			sources: func(t *testing.T) []Source {
+				return []Source{Static(""), file(t)}
+			},
+			expected: "mac:aabbccddeeff",
+		}, {
+			description: "failed sources are skipped",
+			sources: func(t *testing.T) []Source {
+				return []Source{nil, missing(t), Interface("does-not-exist0"), Static("mac:112233445566")}
+			},
+			expected: "mac:112233445566",
+		}, {
+			description: "no sources",
+			sources: func(*testing.T) []Source {
+				return nil
+			},
+			expectedErr: ErrNoDeviceID,
+		}, {
+			description: "every source fails",
+			sources: func(t *testing.T) []Source {
+				return []Source{missing(t), Static("")}
+			},
+			expectedErr: ErrInvalidSource,
+		}, {
+			description: "custom source",
+			sources: func(*testing.T) []Source {
+				return []Source{
+					SourceFunc(func() (wrp.DeviceID, error) {
+						return "", errUnknown
+					}),
+					SourceFunc(func() (wrp.DeviceID, error) {
+						return "mac:665544332211", nil
+					}),
+				}
+			},
+			expected: "mac:665544332211",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := Resolve(tc.sources(t)...)
+			assert.Equal(tc.expected, got)
+			if tc.expectedErr == nil {
+				assert.NoError(err)
+				return
+			}
+
+			assert.ErrorIs(err, ErrNoDeviceID)
+			assert.ErrorIs(err, tc.expectedErr)
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
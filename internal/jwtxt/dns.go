@@ -0,0 +1,183 @@
+// SPDX-FileCopyrightText: 2023 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package jwtxt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsUDPSize is the largest UDP response advertised to the DNS server, which
+// fits most JWTs without falling back to TCP.
+const dnsUDPSize = 4096
+
+// LookupTXTWithTTL queries the DNS server for the TXT records of name,
+// returning them with the smallest TTL of the answers.  Like LookupTXT, the
+// strings of each record are joined.  The query is repeated over TCP if the
+// UDP response is truncated.
+func (d *dnsServer) LookupTXTWithTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	fqdn := name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+
+	qname, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name, Server: d.addr}
+	}
+
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name, Server: d.addr}
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Uint32()),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+		}},
+		Additionals: []dnsmessage.Resource{{
+			Header: opt,
+			Body:   &dnsmessage.OPTResource{},
+		}},
+	}
+
+	resp, err := d.exchange(ctx, "udp", query)
+	if err == nil && resp.Truncated {
+		resp, err = d.exchange(ctx, "tcp", query)
+	}
+	if err != nil {
+		return nil, 0, &net.DNSError{
+			Err:         err.Error(),
+			Name:        name,
+			Server:      d.addr,
+			IsTimeout:   errors.Is(err, os.ErrDeadlineExceeded) || ctx.Err() != nil,
+			IsTemporary: true,
+		}
+	}
+
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: d.addr, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server misbehaving", Name: name, Server: d.addr, IsTemporary: true}
+	}
+
+	var (
+		lines []string
+		ttl   uint32
+	)
+	for i, answer := range resp.Answers {
+		if i == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+
+		if txt, ok := answer.Body.(*dnsmessage.TXTResource); ok {
+			lines = append(lines, strings.Join(txt.TXT, ""))
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: d.addr, IsNotFound: true}
+	}
+
+	return lines, time.Duration(ttl) * time.Second, nil
+}
+
+// exchange sends the query to the DNS server over the network given and
+// returns its response.
+func (d *dnsServer) exchange(ctx context.Context, network string, query dnsmessage.Message) (*dnsmessage.Message, error) {
+	msg, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var buf []byte
+	if network == "tcp" {
+		buf, err = exchangeStream(conn, msg)
+	} else {
+		buf, err = exchangePacket(conn, msg, query.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+
+	if resp.ID != query.ID || !resp.Response {
+		return nil, errors.New("invalid dns response")
+	}
+
+	return &resp, nil
+}
+
+// exchangePacket sends msg as a single datagram, skipping any responses not
+// matching the id of the query.
+func exchangePacket(conn net.Conn, msg []byte, id uint16) ([]byte, error) {
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends msg prefixed by its length, as done over TCP.
+func exchangeStream(conn net.Conn, msg []byte) ([]byte, error) {
+	req := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(req, uint16(len(msg)))
+	if _, err := conn.Write(append(req, msg...)); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
@@ -12,7 +12,8 @@ type Fetch struct {
 	// FQDN is the fully qualified domain name of the TXT record.
 	FQDN string
 
-	// Server is the DNS server that was queried.
+	// Server is the DNS server that answered, or the last one queried if none
+	// did.  It is empty if the resolver doesn't report the server.
 	Server string
 
 	// Found indicates whether the TXT record was found.
@@ -33,6 +34,10 @@ type Fetch struct {
 	// Expiration is the expiration time of the TXT record.
 	Expiration time.Time
 
+	// CachedUntil is when the TXT record will be resolved again.  It is no
+	// later than the Expiration.
+	CachedUntil time.Time
+
 	// TemporaryErr indicates whether a temporary error occurred during the query.
 	TemporaryErr bool
 
@@ -50,19 +50,37 @@ func (f fetchListener) apply(ins *Instructions) error {
 	return nil
 }
 
-// UseResolver sets the resolver to use for DNS queries.
+// UseResolver sets the resolver to use for DNS queries.  It is the same as
+// UseResolvers with a single resolver.
 func UseResolver(resolver Resolver) Option {
-	return &useResolver{
-		resolver: resolver,
+	return UseResolvers(resolver)
+}
+
+// UseResolvers sets the resolvers to use for DNS queries.  The resolvers are
+// queried in order, moving to the next one when a query fails or times out.
+// Each query is allowed the full Timeout.  At least one resolver is required.
+func UseResolvers(resolvers ...Resolver) Option {
+	return &useResolvers{
+		resolvers: resolvers,
 	}
 }
 
-type useResolver struct {
-	resolver Resolver
+type useResolvers struct {
+	resolvers []Resolver
 }
 
-func (u useResolver) apply(ins *Instructions) error {
-	ins.resolver = u.resolver
+func (u useResolvers) apply(ins *Instructions) error {
+	if len(u.resolvers) == 0 {
+		return fmt.Errorf("%w: zero provided resolvers", ErrInvalidInput)
+	}
+
+	for _, r := range u.resolvers {
+		if r == nil {
+			return fmt.Errorf("%w: nil resolver", ErrInvalidInput)
+		}
+	}
+
+	ins.resolvers = append([]Resolver{}, u.resolvers...)
 	return nil
 }
 
@@ -125,7 +143,7 @@ func (a algorithms) apply(ins *Instructions) error {
 	return nil
 }
 
-// Timeout sets the timeout for DNS queries.  0 means use the default timeout.
+// Timeout sets the timeout for each DNS query.  0 means use the default timeout.
 // A negative timeout is invalid.
 func Timeout(timeout time.Duration) Option {
 	return &timeoutOption{
@@ -148,6 +166,74 @@ func (t timeoutOption) apply(ins *Instructions) error {
 	return nil
 }
 
+// MaxRecordBytes sets the largest JWT reassembled from the TXT record
+// fragments.  Larger records fail the fetch with ErrRecordTooBig.  0 means
+// use the default of DefaultMaxRecordBytes.  A negative value is invalid.
+func MaxRecordBytes(n int) Option {
+	return &maxRecordBytes{
+		n: n,
+	}
+}
+
+type maxRecordBytes struct {
+	n int
+}
+
+func (m maxRecordBytes) apply(ins *Instructions) error {
+	if m.n < 0 {
+		return fmt.Errorf("%w: max record bytes is invalid %d", ErrInvalidInput, m.n)
+	}
+	if m.n == 0 {
+		m.n = DefaultMaxRecordBytes
+	}
+	ins.maxRecordBytes = m.n
+	return nil
+}
+
+// MinCacheTTL sets the shortest time the endpoint assembled from the TXT
+// record is cached, even if the TTL of the record is shorter.  The endpoint
+// is never cached beyond the expiration of the JWT.  0 means no minimum.  A
+// negative value is invalid.
+func MinCacheTTL(d time.Duration) Option {
+	return &minCacheTTL{
+		ttl: d,
+	}
+}
+
+type minCacheTTL struct {
+	ttl time.Duration
+}
+
+func (m minCacheTTL) apply(ins *Instructions) error {
+	if m.ttl < 0 {
+		return fmt.Errorf("%w: min cache ttl is invalid %s", ErrInvalidInput, m.ttl)
+	}
+	ins.minCacheTTL = m.ttl
+	return nil
+}
+
+// MaxCacheTTL sets the longest time the endpoint assembled from the TXT
+// record is cached, even if the TTL of the record is longer or unknown.  0
+// means no maximum, so the endpoint is cached until the JWT expires.  A
+// negative value is invalid.
+func MaxCacheTTL(d time.Duration) Option {
+	return &maxCacheTTL{
+		ttl: d,
+	}
+}
+
+type maxCacheTTL struct {
+	ttl time.Duration
+}
+
+func (m maxCacheTTL) apply(ins *Instructions) error {
+	if m.ttl < 0 {
+		return fmt.Errorf("%w: max cache ttl is invalid %s", ErrInvalidInput, m.ttl)
+	}
+	ins.maxCacheTTL = m.ttl
+	return nil
+}
+
 // WithPEMs adds PEM-encoded keys to the list of keys to use for verification.
 func WithPEMs(pems ...[]byte) Option {
 	return &pemOption{
@@ -261,6 +347,21 @@ func (validateAlgorithms) apply(ins *Instructions) error {
 	return nil
 }
 
+func validateCacheTTLs() Option {
+	return &validateCacheTTL{}
+}
+
+type validateCacheTTL struct{}
+
+func (validateCacheTTL) apply(ins *Instructions) error {
+	if 0 < ins.maxCacheTTL && ins.maxCacheTTL < ins.minCacheTTL {
+		return fmt.Errorf("%w: min cache ttl %s exceeds the max cache ttl %s",
+			ErrInvalidInput, ins.minCacheTTL, ins.maxCacheTTL)
+	}
+
+	return nil
+}
+
 func validateBase() Option {
 	return &validateBaseURL{}
 }
@@ -29,11 +29,16 @@ var (
 	ErrNoKeys        = errors.New("no keys provided")
 	ErrNoKeysMatch   = errors.New("no keys match jwt")
 	ErrInvalidInput  = errors.New("invalid input")
+	ErrRecordTooBig  = errors.New("txt record too large")
 )
 
 const (
 	// DefaultTimeout is the default timeout for DNS queries.
 	DefaultTimeout = time.Second * 15
+
+	// DefaultMaxRecordBytes is the default largest JWT reassembled from the
+	// TXT record.
+	DefaultMaxRecordBytes = 8 * 1024
 )
 
 // The Resolver interface allows users to provide their own resolver for
@@ -42,6 +47,56 @@ type Resolver interface {
 	LookupTXT(context.Context, string) ([]string, error)
 }
 
+// TTLResolver is a Resolver that also reports the TTL of the TXT record.  If
+// the resolver provided implements TTLResolver, the assembled endpoint is
+// cached no longer than the TTL, clamped by the MinCacheTTL and MaxCacheTTL.
+// The resolvers returned by DNSServer implement TTLResolver, the system
+// resolver doesn't.
+type TTLResolver interface {
+	Resolver
+
+	// LookupTXTWithTTL returns the TXT records and the smallest TTL of them.
+	LookupTXTWithTTL(context.Context, string) ([]string, time.Duration, error)
+}
+
+// NamedResolver is a Resolver that reports the DNS server it queries, so the
+// server that answered is recorded in the fetch event.
+type NamedResolver interface {
+	Resolver
+
+	// Server returns the address of the DNS server queried.
+	Server() string
+}
+
+// DNSServer returns a Resolver that sends the queries to the DNS server at
+// addr instead of the servers configured on the system.  If addr has no port,
+// port 53 is used.  The Resolver also implements TTLResolver.
+func DNSServer(addr string) NamedResolver {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	var d net.Dialer
+	return &dnsServer{
+		addr: addr,
+		Resolver: net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+type dnsServer struct {
+	net.Resolver
+	addr string
+}
+
+func (d *dnsServer) Server() string {
+	return d.addr
+}
+
 type Instructions struct {
 	// baseURL is the base url to examine for a JWT from a DNS TXT record.
 	baseURL string
@@ -58,6 +113,9 @@ type Instructions struct {
 	// timeout is the timeout for the DNS query.
 	timeout time.Duration
 
+	// maxRecordBytes is the largest JWT reassembled from the TXT record.
+	maxRecordBytes int
+
 	// algorithms is the list of algorithms allowed for JWT validation.
 	algorithms map[jwa.SignatureAlgorithm]struct{}
 
@@ -71,13 +129,20 @@ type Instructions struct {
 	// it's here just for testing support.
 	now func() time.Time
 
-	// resolver is used to supply the resolver to use; it's here just for
-	// testing support.
-	resolver Resolver
+	// resolvers are queried in order until one answers.
+	resolvers []Resolver
 
 	// fetchListeners calls back listeners when a fetch event occurs.
 	fetchListeners eventor.Eventor[event.FetchListener]
 
+	// minCacheTTL is the shortest time the assembled endpoint is cached,
+	// unless the JWT expires sooner.  Zero means no minimum.
+	minCacheTTL time.Duration
+
+	// maxCacheTTL is the longest time the assembled endpoint is cached.  Zero
+	// means no maximum.
+	maxCacheTTL time.Duration
+
 	// ---- These fields are populated/used by the fetch method. ----
 
 	// m protects the fields below.
@@ -91,19 +156,32 @@ type Instructions struct {
 
 	// payload is the payload of the most recent valid JWT.
 	payload []byte
+
+	// cache is the assembled endpoint per FQDN, along with when it must be
+	// resolved again.
+	cache map[string]cachedEndpoint
+}
+
+// cachedEndpoint is an endpoint assembled from a TXT record.
+type cachedEndpoint struct {
+	endpoint string
+	until    time.Time
 }
 
 // New creates a new secure Instruction object.
 func New(opts ...Option) (*Instructions, error) {
 	ins := Instructions{
-		now:        time.Now,
-		resolver:   net.DefaultResolver,
-		timeout:    DefaultTimeout,
-		algorithms: map[jwa.SignatureAlgorithm]struct{}{},
+		now:            time.Now,
+		resolvers:      []Resolver{net.DefaultResolver},
+		timeout:        DefaultTimeout,
+		maxRecordBytes: DefaultMaxRecordBytes,
+		algorithms:     map[jwa.SignatureAlgorithm]struct{}{},
+		cache:          map[string]cachedEndpoint{},
 	}
 
 	full := append(opts,
 		validateAlgs(),
+		validateCacheTTLs(),
 		validateBase(),
 		validateTheID(),
 		makeSet(),
@@ -136,35 +214,80 @@ func (ins *Instructions) Endpoint(ctx context.Context) (string, error) {
 	ins.m.Lock()
 	defer ins.m.Unlock()
 
-	if ins.now().Before(ins.validUntil) {
-		return ins.endpoint, nil
+	now := ins.now()
+	if cached, found := ins.cache[ins.fqdn]; found && now.Before(cached.until) {
+		return cached.endpoint, nil
 	}
 
 	err := ins.fetch(ctx)
 	if err != nil {
+		// The TXT record couldn't be resolved again, but the prior JWT is
+		// still valid.
+		if now.Before(ins.validUntil) {
+			return ins.endpoint, nil
+		}
 		return "", err
 	}
 
 	return ins.endpoint, nil
 }
 
-func (ins *Instructions) fetch(ctx context.Context) error {
-	fe := event.Fetch{
-		FQDN:            ins.fqdn,
-		PriorExpiration: ins.validUntil,
+// lookup resolves the TXT record with each resolver in turn until one
+// answers, along with the TTL if the resolver reports one.  The server that
+// answered, or the details of the last failure, are recorded in fe.
+func (ins *Instructions) lookup(ctx context.Context, fe *event.Fetch) ([]string, time.Duration, bool, error) {
+	var err error
+	for _, resolver := range ins.resolvers {
+		var lines []string
+		var ttl time.Duration
+		var known bool
+
+		lines, ttl, known, err = ins.lookupWith(ctx, resolver, fe)
+		if err == nil {
+			return lines, ttl, known, nil
+		}
+
+		// Stop if the caller gave up rather than the resolver.
+		if ctx.Err() != nil {
+			break
+		}
 	}
 
+	return nil, 0, false, err
+}
+
+// lookupWith resolves the TXT record with a single resolver, allowing it up
+// to the timeout.
+func (ins *Instructions) lookupWith(ctx context.Context, resolver Resolver, fe *event.Fetch) ([]string, time.Duration, bool, error) {
 	// Don't wait forever if things are broken.
 	ctx, cancel := context.WithTimeout(ctx, ins.timeout)
 	defer cancel()
 
-	fe.At = time.Now()
-	lines, err := ins.resolver.LookupTXT(ctx, ins.fqdn)
+	fe.Server = ""
+	if named, ok := resolver.(NamedResolver); ok {
+		fe.Server = named.Server()
+	}
+	fe.Timeout = false
+	fe.TemporaryErr = false
+
+	var lines []string
+	var ttl time.Duration
+	var known bool
+	var err error
+	if r, ok := resolver.(TTLResolver); ok {
+		lines, ttl, err = r.LookupTXTWithTTL(ctx, ins.fqdn)
+		known = true
+	} else {
+		lines, err = resolver.LookupTXT(ctx, ins.fqdn)
+	}
+
 	if err != nil {
 		var dnsError *net.DNSError
 
 		if errors.As(err, &dnsError) {
-			fe.Server = dnsError.Server
+			if dnsError.Server != "" {
+				fe.Server = dnsError.Server
+			}
 			fe.Timeout = dnsError.Timeout()
 			fe.TemporaryErr = dnsError.Temporary()
 		} else {
@@ -173,6 +296,45 @@ func (ins *Instructions) fetch(ctx context.Context) error {
 				fe.TemporaryErr = true
 			}
 		}
+		return nil, 0, false, err
+	}
+
+	return lines, ttl, known, nil
+}
+
+// cacheUntil returns when the endpoint must be resolved again: the earlier of
+// the JWT expiration and the TTL clamped by the min and max cache TTLs.  An
+// unknown TTL is only limited by the max cache TTL.
+func (ins *Instructions) cacheUntil(now time.Time, ttl time.Duration, known bool) time.Time {
+	if !known {
+		if ins.maxCacheTTL <= 0 {
+			return ins.validUntil
+		}
+		ttl = ins.maxCacheTTL
+	}
+
+	if 0 < ins.minCacheTTL && ttl < ins.minCacheTTL {
+		ttl = ins.minCacheTTL
+	}
+	if 0 < ins.maxCacheTTL && ins.maxCacheTTL < ttl {
+		ttl = ins.maxCacheTTL
+	}
+
+	if until := now.Add(ttl); until.Before(ins.validUntil) {
+		return until
+	}
+	return ins.validUntil
+}
+
+func (ins *Instructions) fetch(ctx context.Context) error {
+	fe := event.Fetch{
+		FQDN:            ins.fqdn,
+		PriorExpiration: ins.validUntil,
+	}
+
+	fe.At = time.Now()
+	lines, ttl, known, err := ins.lookup(ctx, &fe)
+	if err != nil {
 		fe.Duration = time.Since(fe.At)
 		fe.Err = err
 		return ins.dispatch(fe)
@@ -181,7 +343,11 @@ func (ins *Instructions) fetch(ctx context.Context) error {
 
 	fe.Found = true
 
-	txt := ins.reassemble(lines)
+	txt, err := ins.reassemble(lines)
+	if err != nil {
+		fe.Err = err
+		return ins.dispatch(fe)
+	}
 
 	err = ins.validate(txt)
 	if err != nil {
@@ -189,8 +355,15 @@ func (ins *Instructions) fetch(ctx context.Context) error {
 		return ins.dispatch(fe)
 	}
 
+	cached := cachedEndpoint{
+		endpoint: ins.endpoint,
+		until:    ins.cacheUntil(ins.now(), ttl, known),
+	}
+	ins.cache[ins.fqdn] = cached
+
 	fe.Endpoint = ins.endpoint
 	fe.Expiration = ins.validUntil
+	fe.CachedUntil = cached.until
 	fe.Payload = ins.payload
 
 	return ins.dispatch(fe)
@@ -211,7 +384,9 @@ func (ins *Instructions) fetch(ctx context.Context) error {
 //   - each line can be 255 bytes long including the leading 3 characters
 //   - it doesn't really matter if we are missing something because the JWT
 //     won't compute and will be discarded.
-func (ins *Instructions) reassemble(lines []string) string {
+//   - reassembly stops with ErrRecordTooBig once the JWT grows past the
+//     max record bytes.
+func (ins *Instructions) reassemble(lines []string) (string, error) {
 	parts := make(map[string]string)
 
 	// The value in the TXT record should be 1 (really 1, but make this tolerant
@@ -238,10 +413,13 @@ func (ins *Instructions) reassemble(lines []string) string {
 		if !found {
 			break
 		}
+		if ins.maxRecordBytes < buf.Len()+len(val) {
+			return "", fmt.Errorf("%w: more than %d bytes", ErrRecordTooBig, ins.maxRecordBytes)
+		}
 		buf.WriteString(val)
 	}
 
-	return buf.String()
+	return buf.String(), nil
 }
 
 // validate takes a string that is believed to be a JWT and validates it.
@@ -5,8 +5,12 @@ package jwtxt
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,6 +19,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/xmidt-org/xmidt-agent/internal/jwtxt/event"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // The orignal JWT:
@@ -30,17 +35,31 @@ import (
 
 func randomResolver() Option {
 	return UseResolver(&mockdns.Resolver{
-		Zones: map[string]mockdns.Zone{
-			"112233445566.fabric.random.example.org.": {
-				TXT: []string{
-					"01:eyJhbGciOiJFUzI1NiIsInR5cCI6IkpXVCJ9.eyJlbmRwb2ludCI6I",
-					"02:mZhYnJpYy54bWlkdC5leGFtcGxlLm9yZyIsImV4cCI6MTY5MDAwMDA",
-					"03:wMH0.4ELQaJAcX67M0Me1ZjTAusZT3QZpiCj2WQATDCvgllnEN9g4R",
-					"04:xMeDqnqnYAE_GdzsXI_e9fAGI9o1QuIym7_zQ",
-				},
+		Zones: randomZones(),
+	})
+}
+
+func randomZones() map[string]mockdns.Zone {
+	return map[string]mockdns.Zone{
+		"112233445566.fabric.random.example.org.": {
+			TXT: []string{
+				"01:eyJhbGciOiJFUzI1NiIsInR5cCI6IkpXVCJ9.eyJlbmRwb2ludCI6I",
+				"02:mZhYnJpYy54bWlkdC5leGFtcGxlLm9yZyIsImV4cCI6MTY5MDAwMDA",
+				"03:wMH0.4ELQaJAcX67M0Me1ZjTAusZT3QZpiCj2WQATDCvgllnEN9g4R",
+				"04:xMeDqnqnYAE_GdzsXI_e9fAGI9o1QuIym7_zQ",
 			},
 		},
-	})
+	}
+}
+
+// oversizedFragments returns every supported fragment at the largest size,
+// which is well past the default max record bytes.
+func oversizedFragments() []string {
+	lines := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("%0.2d:%s", i, strings.Repeat("a", 252)))
+	}
+	return lines
 }
 
 type niceNeverResolver struct{}
@@ -62,6 +81,29 @@ func (notNiceNeverResolver) LookupTXT(ctx context.Context, _ string) ([]string,
 	return nil, errors.New("context canceled")
 }
 
+// namedResolver reports the server of the wrapped resolver.
+type namedResolver struct {
+	Resolver
+	server string
+}
+
+func (n namedResolver) Server() string {
+	return n.server
+}
+
+// timeoutResolver fails every query with a timeout from the server.
+type timeoutResolver struct {
+	server string
+}
+
+func (t timeoutResolver) LookupTXT(context.Context, string) ([]string, error) {
+	return nil, &net.DNSError{
+		Err:       "i/o timeout",
+		Server:    t.server,
+		IsTimeout: true,
+	}
+}
+
 func TestInstructions_EndToEnd(t *testing.T) {
 	unknownErr := errors.New("unknown")
 	tests := []struct {
@@ -254,6 +296,91 @@ func TestInstructions_EndToEnd(t *testing.T) {
 				assert.Empty(fe.Endpoint)
 				assert.Error(fe.Err)
 			},
+		}, {
+			description: "falls back to the next resolver",
+			times:       []int64{1680000000},
+			opts: []Option{
+				BaseURL("https://fabric.random.example.org"),
+				DeviceID("mac:112233445566"),
+				Algorithms("ES256"),
+				publicECOption(),
+				UseResolvers(
+					timeoutResolver{server: "192.0.2.1:53"},
+					namedResolver{
+						Resolver: &mockdns.Resolver{Zones: randomZones()},
+						server:   "192.0.2.2:53",
+					},
+				),
+			},
+			listener: func(assert *assert.Assertions, fe event.Fetch) {
+				assert.Equal("112233445566.fabric.random.example.org", fe.FQDN)
+				assert.Equal("192.0.2.2:53", fe.Server)
+				assert.True(fe.Found)
+				assert.False(fe.Timeout)
+				assert.False(fe.TemporaryErr)
+				assert.Equal("fabric.xmidt.example.org", fe.Endpoint)
+				assert.NoError(fe.Err)
+			},
+			expectedEndpoint: "fabric.xmidt.example.org",
+		}, {
+			description:         "every resolver times out",
+			times:               []int64{1680000000},
+			expectedEndpointErr: unknownErr,
+			opts: []Option{
+				BaseURL("https://fabric.random.example.org"),
+				DeviceID("mac:112233445566"),
+				Algorithms("ES256"),
+				publicECOption(),
+				UseResolvers(
+					timeoutResolver{server: "192.0.2.1:53"},
+					timeoutResolver{server: "192.0.2.2:53"},
+				),
+			},
+			listener: func(assert *assert.Assertions, fe event.Fetch) {
+				assert.Equal("192.0.2.2:53", fe.Server)
+				assert.False(fe.Found)
+				assert.True(fe.Timeout)
+				assert.Empty(fe.Endpoint)
+				assert.Error(fe.Err)
+			},
+		}, {
+			description:         "record too large",
+			times:               []int64{1680000000},
+			expectedEndpointErr: ErrRecordTooBig,
+			opts: []Option{
+				BaseURL("https://fabric.random.example.org"),
+				DeviceID("mac:112233445566"),
+				Algorithms("ES256"),
+				publicECOption(),
+				UseResolver(&mockdns.Resolver{
+					Zones: map[string]mockdns.Zone{
+						"112233445566.fabric.random.example.org.": {
+							TXT: oversizedFragments(),
+						},
+					},
+				}),
+			},
+			listener: func(assert *assert.Assertions, fe event.Fetch) {
+				assert.True(fe.Found)
+				assert.Empty(fe.Endpoint)
+				assert.ErrorIs(fe.Err, ErrRecordTooBig)
+			},
+		}, {
+			description:         "record larger than the configured limit",
+			times:               []int64{1680000000},
+			expectedEndpointErr: ErrRecordTooBig,
+			opts: []Option{
+				BaseURL("https://fabric.random.example.org"),
+				DeviceID("mac:112233445566"),
+				Algorithms("ES256"),
+				publicECOption(),
+				randomResolver(),
+				MaxRecordBytes(64),
+			},
+			listener: func(assert *assert.Assertions, fe event.Fetch) {
+				assert.True(fe.Found)
+				assert.ErrorIs(fe.Err, ErrRecordTooBig)
+			},
 		}, {
 			description:    "no algorithms",
 			times:          []int64{1680000000},
@@ -316,6 +443,25 @@ func TestInstructions_EndToEnd(t *testing.T) {
 				WithPEMs([]byte("invalid")),
 			},
 			expectedNewErr: ErrInvalidInput,
+		}, {
+			description: "no resolvers",
+			opts: []Option{
+				UseResolvers(),
+			},
+			expectedNewErr: ErrInvalidInput,
+		}, {
+			description: "nil resolver",
+			opts: []Option{
+				UseResolver(nil),
+			},
+			expectedNewErr: ErrInvalidInput,
+		}, {
+			description: "invalid max record bytes",
+			opts: []Option{
+				MaxRecordBytes(0), // ok, just set the default again.
+				MaxRecordBytes(-1),
+			},
+			expectedNewErr: ErrInvalidInput,
 		}, {
 			description: "invalid timeout",
 			opts: []Option{
@@ -379,3 +525,376 @@ func TestInstructions_EndToEnd(t *testing.T) {
 		})
 	}
 }
+
+// countingResolver counts the lookups made through the mockdns resolver, and
+// reports a TTL if one is set.
+type countingResolver struct {
+	mockdns.Resolver
+	lookups int
+	ttl     time.Duration
+	err     error
+}
+
+func (c *countingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	c.lookups++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.Resolver.LookupTXT(ctx, name)
+}
+
+type countingTTLResolver struct {
+	countingResolver
+}
+
+func (c *countingTTLResolver) LookupTXTWithTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	lines, err := c.LookupTXT(ctx, name)
+	return lines, c.ttl, err
+}
+
+func TestInstructions_CacheTTL(t *testing.T) {
+	unknownErr := errors.New("unknown")
+
+	tests := []struct {
+		description string
+		ttl         time.Duration
+		unknownTTL  bool
+		opts        []Option
+		// elapsed is the time since the first call when the second call is
+		// made.
+		elapsed         time.Duration
+		failSecond      bool
+		expectedLookups int
+		cachedFor       time.Duration
+	}{
+		{
+			description:     "second call within the ttl",
+			ttl:             5 * time.Minute,
+			elapsed:         4 * time.Minute,
+			expectedLookups: 1,
+			cachedFor:       5 * time.Minute,
+		}, {
+			description:     "second call after the ttl",
+			ttl:             5 * time.Minute,
+			elapsed:         6 * time.Minute,
+			expectedLookups: 2,
+			cachedFor:       5 * time.Minute,
+		}, {
+			description:     "ttl clamped by the max",
+			ttl:             time.Hour,
+			opts:            []Option{MaxCacheTTL(time.Minute)},
+			elapsed:         2 * time.Minute,
+			expectedLookups: 2,
+			cachedFor:       time.Minute,
+		}, {
+			description:     "ttl clamped by the min",
+			ttl:             time.Second,
+			opts:            []Option{MinCacheTTL(time.Minute)},
+			elapsed:         30 * time.Second,
+			expectedLookups: 1,
+			cachedFor:       time.Minute,
+		}, {
+			description:     "ttl beyond the jwt expiration",
+			ttl:             10000 * time.Hour,
+			elapsed:         time.Hour,
+			expectedLookups: 1,
+			cachedFor:       10000000 * time.Second,
+		}, {
+			description:     "unknown ttl is cached until the jwt expires",
+			unknownTTL:      true,
+			elapsed:         24 * time.Hour,
+			expectedLookups: 1,
+			cachedFor:       10000000 * time.Second,
+		}, {
+			description:     "unknown ttl clamped by the max",
+			unknownTTL:      true,
+			opts:            []Option{MinCacheTTL(time.Second), MaxCacheTTL(time.Minute)},
+			elapsed:         2 * time.Minute,
+			expectedLookups: 2,
+			cachedFor:       time.Minute,
+		}, {
+			description:     "failed refresh of a valid jwt",
+			ttl:             time.Minute,
+			elapsed:         2 * time.Minute,
+			failSecond:      true,
+			expectedLookups: 2,
+			cachedFor:       time.Minute,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			counting := countingResolver{
+				Resolver: mockdns.Resolver{Zones: randomZones()},
+				ttl:      tc.ttl,
+			}
+			var resolver Resolver = &countingTTLResolver{counting}
+			lookups := func() int { return resolver.(*countingTTLResolver).lookups }
+			fail := func() { resolver.(*countingTTLResolver).err = unknownErr }
+			if tc.unknownTTL {
+				resolver = &counting
+				lookups = func() int { return counting.lookups }
+				fail = func() { counting.err = unknownErr }
+			}
+
+			start := time.Unix(1680000000, 0)
+			now := start
+			then := func() time.Time { return now }
+
+			var cachedUntil time.Time
+			opts := append(tc.opts,
+				BaseURL("https://fabric.random.example.org"),
+				DeviceID("mac:112233445566"),
+				Algorithms("ES256"),
+				publicECOption(),
+				UseResolver(resolver),
+				UseNowFunc(then),
+				WithFetchListener(event.FetchListenerFunc(
+					func(fe event.Fetch) {
+						if fe.Err == nil {
+							cachedUntil = fe.CachedUntil
+						}
+					})),
+			)
+			obj, err := New(opts...)
+			require.NoError(err)
+			require.NotNil(obj)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
+
+			endpoint, err := obj.Endpoint(ctx)
+			require.NoError(err)
+			assert.Equal("fabric.xmidt.example.org", endpoint)
+			assert.Equal(1, lookups())
+			assert.Equal(start.Add(tc.cachedFor), cachedUntil)
+
+			if tc.failSecond {
+				fail()
+			}
+
+			now = start.Add(tc.elapsed)
+			endpoint, err = obj.Endpoint(ctx)
+			require.NoError(err)
+			assert.Equal("fabric.xmidt.example.org", endpoint)
+			assert.Equal(tc.expectedLookups, lookups())
+		})
+	}
+}
+
+func TestCacheTTLOptions(t *testing.T) {
+	tests := []struct {
+		description string
+		opts        []Option
+		expectedErr error
+	}{
+		{
+			description: "min and max",
+			opts:        []Option{MinCacheTTL(time.Second), MaxCacheTTL(time.Minute)},
+		}, {
+			description: "min without a max",
+			opts:        []Option{MinCacheTTL(time.Hour)},
+		}, {
+			description: "negative min",
+			opts:        []Option{MinCacheTTL(-1)},
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "negative max",
+			opts:        []Option{MaxCacheTTL(-1)},
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "min exceeds the max",
+			opts:        []Option{MinCacheTTL(time.Hour), MaxCacheTTL(time.Minute)},
+			expectedErr: ErrInvalidInput,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			opts := append(tc.opts,
+				BaseURL("https://fabric.random.example.org"),
+				DeviceID("mac:112233445566"),
+				Algorithms("ES256"),
+				publicECOption(),
+				randomResolver(),
+			)
+			obj, err := New(opts...)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(err, tc.expectedErr)
+				assert.Nil(obj)
+				return
+			}
+
+			assert.NoError(err)
+			assert.NotNil(obj)
+		})
+	}
+}
+
+func TestDNSServer(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("192.0.2.1:53", DNSServer("192.0.2.1").Server())
+	assert.Equal("192.0.2.1:5353", DNSServer("192.0.2.1:5353").Server())
+	assert.Equal("[2001:db8::1]:53", DNSServer("2001:db8::1").Server())
+}
+
+// newTXTServer serves the TXT records of each name over UDP and TCP on the same
+// port.  The UDP responses of the names in truncated only set the truncated
+// bit, so the records are only returned over TCP.
+func newTXTServer(t *testing.T, records map[string][]dnsmessage.Resource, truncated map[string]bool) string {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+
+	l, err := net.Listen("tcp4", pc.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	respond := func(buf []byte, udp bool) []byte {
+		var req dnsmessage.Message
+		if err := req.Unpack(buf); err != nil || len(req.Questions) == 0 {
+			return nil
+		}
+
+		q := req.Questions[0]
+		resp := dnsmessage.Message{
+			Header: dnsmessage.Header{
+				ID:       req.ID,
+				Response: true,
+			},
+			Questions: req.Questions,
+		}
+
+		answers, ok := records[q.Name.String()]
+		switch {
+		case !ok:
+			resp.RCode = dnsmessage.RCodeNameError
+		case udp && truncated[q.Name.String()]:
+			resp.Truncated = true
+		default:
+			resp.Answers = answers
+		}
+
+		msg, err := resp.Pack()
+		if err != nil {
+			return nil
+		}
+		return msg
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if msg := respond(buf[:n], true); msg != nil {
+				_, _ = pc.WriteTo(msg, addr)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err == nil {
+				buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					if msg := respond(buf, false); msg != nil {
+						binary.BigEndian.PutUint16(length[:], uint16(len(msg)))
+						_, _ = conn.Write(append(length[:], msg...))
+					}
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func txtRecord(name string, ttl uint32, txt ...string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		},
+		Body: &dnsmessage.TXTResource{TXT: txt},
+	}
+}
+
+func TestDNSServer_LookupTXTWithTTL(t *testing.T) {
+	addr := newTXTServer(t,
+		map[string][]dnsmessage.Resource{
+			"mac112233445566.example.com.": {
+				txtRecord("mac112233445566.example.com.", 300, "00:first", "-part"),
+				txtRecord("mac112233445566.example.com.", 60, "01:second"),
+			},
+			"large.example.com.": {
+				txtRecord("large.example.com.", 120, "00:large"),
+			},
+		},
+		map[string]bool{"large.example.com.": true},
+	)
+
+	tests := []struct {
+		description string
+		name        string
+		expected    []string
+		ttl         time.Duration
+		notFound    bool
+	}{
+		{
+			description: "smallest ttl of the records",
+			name:        "mac112233445566.example.com",
+			expected:    []string{"00:first-part", "01:second"},
+			ttl:         60 * time.Second,
+		}, {
+			description: "truncated response is repeated over tcp",
+			name:        "large.example.com",
+			expected:    []string{"00:large"},
+			ttl:         120 * time.Second,
+		}, {
+			description: "no such name",
+			name:        "missing.example.com",
+			notFound:    true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			resolver, ok := DNSServer(addr).(TTLResolver)
+			require.True(ok)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			lines, ttl, err := resolver.LookupTXTWithTTL(ctx, tc.name)
+			if tc.notFound {
+				var dnsErr *net.DNSError
+				require.ErrorAs(err, &dnsErr)
+				assert.True(dnsErr.IsNotFound)
+				assert.Equal(addr, dnsErr.Server)
+				return
+			}
+
+			require.NoError(err)
+			assert.Equal(tc.expected, lines)
+			assert.Equal(tc.ttl, ttl)
+		})
+	}
+}
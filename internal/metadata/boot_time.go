@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package metadata
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultProcUptimePath = "/proc/uptime"
+
+var ErrInvalidUptime = errors.New("invalid uptime")
+
+// UptimeSource provides the time elapsed since the device booted.
+type UptimeSource interface {
+	Uptime() (time.Duration, error)
+}
+
+// ProcUptime is an UptimeSource that reads the uptime from the linux
+// /proc/uptime file.
+type ProcUptime struct {
+	// Path is the file to read.  Defaults to DefaultProcUptimePath.
+	Path string
+}
+
+func (p *ProcUptime) Uptime() (time.Duration, error) {
+	path := p.Path
+	if path == "" {
+		path = DefaultProcUptimePath
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return ParseProcUptime(f)
+}
+
+// ParseProcUptime parses the contents of a /proc/uptime formatted file, which
+// holds the uptime and the idle time in seconds.
+func ParseProcUptime(r io.Reader) (time.Duration, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("%w: empty", ErrInvalidUptime)
+	}
+
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || seconds < 0 {
+		return 0, errors.Join(fmt.Errorf("%w: '%s'", ErrInvalidUptime, fields[0]), err)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// BootTimeFromUptime computes when the device booted from the uptime source, to the
+// second.
+func BootTimeFromUptime(source UptimeSource, now func() time.Time) (time.Time, error) {
+	if source == nil || now == nil {
+		return time.Time{}, fmt.Errorf("%w: nil uptime source or now func", ErrInvalidUptime)
+	}
+
+	uptime, err := source.Uptime()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return now().Add(-uptime).Truncate(time.Second), nil
+}
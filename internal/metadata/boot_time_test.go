@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package metadata
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type uptimeFunc func() (time.Duration, error)
+
+func (f uptimeFunc) Uptime() (time.Duration, error) {
+	return f()
+}
+
+func TestParseProcUptime(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		expected    time.Duration
+		expectedErr error
+	}{
+		{
+			description: "uptime and idle time",
+			input:       "350735.47 234388.90\n",
+			expected:    350735*time.Second + 470*time.Millisecond,
+		}, {
+			description: "no trailing newline",
+			input:       "12.00 1.00",
+			expected:    12 * time.Second,
+		}, {
+			description: "empty",
+			expectedErr: ErrInvalidUptime,
+		}, {
+			description: "not a number",
+			input:       "uptime 1.00\n",
+			expectedErr: ErrInvalidUptime,
+		}, {
+			description: "negative",
+			input:       "-1.00 1.00\n",
+			expectedErr: ErrInvalidUptime,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := ParseProcUptime(strings.NewReader(tc.input))
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.InDelta(tc.expected, got, float64(time.Microsecond))
+		})
+	}
+}
+
+func TestProcUptime(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "uptime")
+	require.NoError(os.WriteFile(path, []byte("60.00 30.00\n"), 0600))
+
+	got, err := (&ProcUptime{Path: path}).Uptime()
+	assert.NoError(err)
+	assert.Equal(time.Minute, got)
+
+	_, err = (&ProcUptime{Path: filepath.Join(t.TempDir(), "missing")}).Uptime()
+	assert.ErrorIs(err, os.ErrNotExist)
+}
+
+func TestBootTimeFromUptime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	errUptime := errors.New("uptime error")
+
+	tests := []struct {
+		description string
+		source      UptimeSource
+		expected    time.Time
+		expectedErr error
+	}{
+		{
+			description: "boot time",
+			source: uptimeFunc(func() (time.Duration, error) {
+				return time.Hour, nil
+			}),
+			expected: now.Add(-time.Hour),
+		}, {
+			description: "boot time to the second",
+			source: uptimeFunc(func() (time.Duration, error) {
+				return time.Hour + 250*time.Millisecond, nil
+			}),
+			expected: now.Add(-time.Hour - time.Second),
+		}, {
+			description: "uptime error",
+			source: uptimeFunc(func() (time.Duration, error) {
+				return 0, errUptime
+			}),
+			expectedErr: errUptime,
+		}, {
+			description: "nil source",
+			expectedErr: ErrInvalidUptime,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := BootTimeFromUptime(tc.source, func() time.Time { return now })
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.True(tc.expected.Equal(got), "expected %s, got %s", tc.expected, got)
+		})
+	}
+}
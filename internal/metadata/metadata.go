@@ -7,7 +7,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"encoding/base64"
 
@@ -40,12 +43,14 @@ const (
 	BootTimeRetryDelay         = "boot-time-retry-wait"
 	InterfaceUsed       string = "webpa-interface-used"
 	InterfacesAvailable        = "interfaces-available"
+	InterfaceStats             = "interface-stats"
 )
 
 type MetadataProvider struct {
 	networkService     net.NetworkServicer
 	fields             []string
 	firmware           string
+	firmwareFunc       func() string
 	hardware           string
 	manufacturer       string
 	serialNumber       string
@@ -54,10 +59,28 @@ type MetadataProvider struct {
 	bootTime           string
 	bootTimeRetryDelay string
 	interfaceUsed      string
+
+	// statsSource provides the per interface counters.  If nil, the
+	// interface stats field is never reported.
+	statsSource net.InterfaceStatsSource
+
+	// cacheTTLs is how long computed values are reused, per field.
+	cacheTTLs map[string]time.Duration
+	cacheLock sync.Mutex
+	cache     map[string]cachedValue
+	nowFunc   func() time.Time
+}
+
+// cachedValue is a previously computed field value.
+type cachedValue struct {
+	value   interface{}
+	expires time.Time
 }
 
 func New(opts ...Option) (*MetadataProvider, error) {
-	metadataProvider := &MetadataProvider{}
+	metadataProvider := &MetadataProvider{
+		nowFunc: time.Now,
+	}
 
 	for _, opt := range opts {
 		if opt != nil {
@@ -71,43 +94,141 @@ func New(opts ...Option) (*MetadataProvider, error) {
 }
 
 func (c *MetadataProvider) GetMetadata() map[string]interface{} {
-	header := make(map[string]interface{})
+	return c.getMetadata(c.fields)
+}
 
-	for _, field := range c.fields {
-		switch field {
-		case Firmware:
-			header[field] = c.firmware
-		case Hardware:
-			header[field] = c.hardware
-		case Manufacturer:
-			header[field] = c.manufacturer
-		case SerialNumber:
-			header[field] = c.serialNumber
-		case LastRebootReason:
-			header[field] = c.lastRebootReason
-		case Protocol:
-			header[field] = c.protocol
-		case BootTime:
-			header[field] = c.bootTime
-		case BootTimeRetryDelay:
-			header[field] = c.bootTimeRetryDelay
-		case InterfaceUsed:
-			header[field] = c.interfaceUsed
-		case InterfacesAvailable: // what if we can't get interfaces available?
-			names, err := c.networkService.GetInterfaceNames()
-			if err != nil {
-				// The err itself is ignored. Log this somewhere tho
-				continue
-			}
-			header[field] = strings.Join(names, ",")
-		default:
+// GetMetadataFields returns only the requested metadata fields, intersected
+// with the configured fields.  Requested fields that are not configured are
+// ignored.  The interface stats field is also returned if requested and a
+// stats source is set.
+func (c *MetadataProvider) GetMetadataFields(requested []string) map[string]interface{} {
+	fields := make([]string, 0, len(requested))
+	for _, field := range requested {
+		if c.requestable(field) && !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+
+	return c.getMetadata(fields)
+}
 
+// requestable determines whether the field can be returned by GetMetadataFields.
+func (c *MetadataProvider) requestable(field string) bool {
+	if field == InterfaceStats {
+		return c.statsSource != nil
+	}
+	return slices.Contains(c.fields, field)
+}
+
+func (c *MetadataProvider) getMetadata(fields []string) map[string]interface{} {
+	header := make(map[string]interface{})
+
+	for _, field := range fields {
+		if value, ok := c.cachedValue(field); ok {
+			header[field] = value
 		}
 	}
 
 	return header
 }
 
+// cachedValue returns the value of the field, reusing a previously computed
+// value if the field has a cache TTL and the cached value hasn't expired.
+func (c *MetadataProvider) cachedValue(field string) (interface{}, bool) {
+	ttl := c.cacheTTLs[field]
+	if ttl <= 0 {
+		return c.value(field)
+	}
+
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	now := c.nowFunc()
+	if cached, found := c.cache[field]; found && now.Before(cached.expires) {
+		return cached.value, true
+	}
+
+	value, ok := c.value(field)
+	if !ok {
+		return nil, false
+	}
+
+	if c.cache == nil {
+		c.cache = make(map[string]cachedValue)
+	}
+	c.cache[field] = cachedValue{
+		value:   value,
+		expires: now.Add(ttl),
+	}
+
+	return value, true
+}
+
+// value computes the value of the field.
+func (c *MetadataProvider) value(field string) (interface{}, bool) {
+	switch field {
+	case Firmware:
+		if c.firmwareFunc != nil {
+			return c.firmwareFunc(), true
+		}
+		return c.firmware, true
+	case Hardware:
+		return c.hardware, true
+	case Manufacturer:
+		return c.manufacturer, true
+	case SerialNumber:
+		return c.serialNumber, true
+	case LastRebootReason:
+		return c.lastRebootReason, true
+	case Protocol:
+		return c.protocol, true
+	case BootTime:
+		return c.bootTime, true
+	case BootTimeRetryDelay:
+		return c.bootTimeRetryDelay, true
+	case InterfaceUsed:
+		return c.interfaceUsed, true
+	case InterfacesAvailable: // what if we can't get interfaces available?
+		names, err := c.networkService.GetInterfaceNames()
+		if err != nil {
+			// The err itself is ignored. Log this somewhere tho
+			return nil, false
+		}
+		return strings.Join(names, ","), true
+	case InterfaceStats:
+		return c.interfaceStats()
+	default:
+	}
+
+	return nil, false
+}
+
+// interfaceStats returns the counters of the available interfaces.
+func (c *MetadataProvider) interfaceStats() (interface{}, bool) {
+	if c.statsSource == nil {
+		return nil, false
+	}
+
+	names, err := c.networkService.GetInterfaceNames()
+	if err != nil {
+		return nil, false
+	}
+
+	all, err := c.statsSource.GetInterfaceStats()
+	if err != nil {
+		return nil, false
+	}
+
+	stats := make(map[string]net.InterfaceStats, len(names))
+	for _, name := range names {
+		if s, found := all[name]; found {
+			stats[name] = s
+		}
+	}
+
+	return stats, true
+}
+
 func (c *MetadataProvider) Decorate(headers http.Header) error {
 	header := c.GetMetadata()
 	headerBytes, err := json.Marshal(header)
@@ -4,6 +4,7 @@
 package metadata
 
 import (
+	"errors"
 	"net"
 	"net/http"
 	"testing"
@@ -12,6 +13,7 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 	"github.com/xmidt-org/wrp-go/v3"
+	xnet "github.com/xmidt-org/xmidt-agent/internal/net"
 )
 
 type mockNetworkService struct {
@@ -30,6 +32,15 @@ func (m *mockNetworkService) GetInterfaceNames() ([]string, error) {
 	return args.Get(0).([]string), args.Error(1)
 }
 
+type mockStatsSource struct {
+	mock.Mock
+}
+
+func (m *mockStatsSource) GetInterfaceStats() (map[string]xnet.InterfaceStats, error) {
+	args := m.Called()
+	return args.Get(0).(map[string]xnet.InterfaceStats), args.Error(1)
+}
+
 type ConveySuite struct {
 	suite.Suite
 	conveyHeaderProvider *MetadataProvider
@@ -99,6 +110,151 @@ func (suite *ConveySuite) TestGetConveyHeaderSubsetFields() {
 	suite.Nil(header["webpa-interface-used"])
 }
 
+func (suite *ConveySuite) TestGetMetadataFields() {
+	suite.mockNetworkService.On("GetInterfaceNames").Return([]string{"erouter0", "eth0"}, nil)
+
+	// A subset of the configured fields.
+	header := suite.conveyHeaderProvider.GetMetadataFields([]string{"fw-name", "interfaces-available", "fw-name"})
+	suite.Equal(map[string]interface{}{
+		"fw-name":              "1.1",
+		"interfaces-available": "erouter0,eth0",
+	}, header)
+
+	// The full set matches GetMetadata.
+	header = suite.conveyHeaderProvider.GetMetadataFields(suite.conveyHeaderProvider.fields)
+	suite.Equal(suite.conveyHeaderProvider.GetMetadata(), header)
+
+	// Fields that are not configured are never returned.
+	suite.conveyHeaderProvider.fields = []string{"fw-name", "hw-model"}
+	header = suite.conveyHeaderProvider.GetMetadataFields([]string{"hw-model", "hw-serial-number", "unknown"})
+	suite.Equal(map[string]interface{}{
+		"hw-model": "some-model",
+	}, header)
+
+	suite.Empty(suite.conveyHeaderProvider.GetMetadataFields(nil))
+}
+
+func (suite *ConveySuite) TestFieldCacheTTL() {
+	suite.mockNetworkService.On("GetInterfaceNames").Return([]string{"erouter0", "eth0"}, nil)
+
+	provider, err := New(
+		NetworkServiceOpt(suite.mockNetworkService),
+		FieldsOpt([]string{"fw-name", "interfaces-available"}),
+		FirmwareOpt("1.1"),
+		FieldCacheTTLOpt(time.Minute, "interfaces-available"),
+	)
+	suite.Require().NoError(err)
+
+	now := time.Unix(1000, 0)
+	provider.nowFunc = func() time.Time { return now }
+
+	// The first request computes the value.
+	header := provider.GetMetadata()
+	suite.Equal("erouter0,eth0", header["interfaces-available"])
+	suite.mockNetworkService.AssertNumberOfCalls(suite.T(), "GetInterfaceNames", 1)
+
+	// Within the ttl the cached value is reused.
+	now = now.Add(30 * time.Second)
+	header = provider.GetMetadata()
+	suite.Equal("erouter0,eth0", header["interfaces-available"])
+	suite.Equal("1.1", header["fw-name"])
+	suite.mockNetworkService.AssertNumberOfCalls(suite.T(), "GetInterfaceNames", 1)
+
+	// After the ttl the value is recomputed.
+	now = now.Add(time.Minute)
+	header = provider.GetMetadata()
+	suite.Equal("erouter0,eth0", header["interfaces-available"])
+	suite.mockNetworkService.AssertNumberOfCalls(suite.T(), "GetInterfaceNames", 2)
+}
+
+func (suite *ConveySuite) TestFieldCacheTTLOptErrors() {
+	_, err := New(FieldCacheTTLOpt(-time.Second, "interfaces-available"))
+	suite.ErrorIs(err, ErrInvalidInput)
+
+	_, err = New(FieldCacheTTLOpt(time.Second, "unknown"))
+	suite.ErrorIs(err, ErrInvalidInput)
+}
+
+func (suite *ConveySuite) TestFirmwareFunc() {
+	firmware := "1.1"
+	provider, err := New(
+		FieldsOpt([]string{"fw-name"}),
+		FirmwareOpt("ignored"),
+		FirmwareFuncOpt(func() string { return firmware }),
+	)
+	suite.NoError(err)
+
+	suite.Equal("1.1", provider.GetMetadata()["fw-name"])
+
+	firmware = "2.2"
+	suite.Equal("2.2", provider.GetMetadata()["fw-name"])
+
+	_, err = New(FirmwareFuncOpt(nil))
+	suite.ErrorIs(err, ErrInvalidInput)
+}
+
+func (suite *ConveySuite) TestInterfaceStats() {
+	suite.mockNetworkService.On("GetInterfaceNames").Return([]string{"erouter0", "eth0"}, nil)
+
+	source := &mockStatsSource{}
+	source.On("GetInterfaceStats").Return(map[string]xnet.InterfaceStats{
+		"erouter0": {RxBytes: 100, RxPackets: 10, TxBytes: 200, TxPackets: 20},
+		"eth0":     {RxBytes: 1, RxPackets: 2, TxBytes: 3, TxPackets: 4},
+		"lo":       {RxBytes: 5, RxPackets: 6, TxBytes: 7, TxPackets: 8},
+	}, nil)
+
+	provider, err := New(
+		NetworkServiceOpt(suite.mockNetworkService),
+		FieldsOpt([]string{"fw-name"}),
+		FirmwareOpt("1.1"),
+		InterfaceStatsSourceOpt(source),
+	)
+	suite.Require().NoError(err)
+
+	// The counters are never part of the convey header.
+	suite.NotContains(provider.GetMetadata(), "interface-stats")
+	source.AssertNotCalled(suite.T(), "GetInterfaceStats")
+
+	// Only the available interfaces are reported.
+	header := provider.GetMetadataFields([]string{"fw-name", "interface-stats"})
+	suite.Equal("1.1", header["fw-name"])
+	suite.Equal(map[string]xnet.InterfaceStats{
+		"erouter0": {RxBytes: 100, RxPackets: 10, TxBytes: 200, TxPackets: 20},
+		"eth0":     {RxBytes: 1, RxPackets: 2, TxBytes: 3, TxPackets: 4},
+	}, header["interface-stats"])
+	source.AssertNumberOfCalls(suite.T(), "GetInterfaceStats", 1)
+
+	// The field can't be configured as part of the convey header.
+	_, err = New(FieldsOpt([]string{"interface-stats"}))
+	suite.ErrorIs(err, ErrInvalidInput)
+}
+
+func (suite *ConveySuite) TestInterfaceStatsDisabled() {
+	suite.mockNetworkService.On("GetInterfaceNames").Return([]string{"erouter0"}, nil)
+
+	// Without a stats source the field is never reported.
+	header := suite.conveyHeaderProvider.GetMetadataFields([]string{"fw-name", "interface-stats"})
+	suite.NotContains(header, "interface-stats")
+	suite.Equal("1.1", header["fw-name"])
+}
+
+func (suite *ConveySuite) TestInterfaceStatsError() {
+	suite.mockNetworkService.On("GetInterfaceNames").Return([]string{"erouter0"}, nil)
+
+	source := &mockStatsSource{}
+	source.On("GetInterfaceStats").Return(map[string]xnet.InterfaceStats(nil), errors.New("unreadable"))
+
+	provider, err := New(
+		NetworkServiceOpt(suite.mockNetworkService),
+		InterfaceStatsSourceOpt(source),
+	)
+	suite.Require().NoError(err)
+	suite.Empty(provider.GetMetadataFields([]string{"interface-stats"}))
+
+	_, err = New(InterfaceStatsSourceOpt(nil))
+	suite.ErrorIs(err, ErrInvalidInput)
+}
+
 func (suite *ConveySuite) TestDecorate() {
 	suite.mockNetworkService.On("GetInterfaceNames").Return([]string{"docsis"}, nil)
 
@@ -6,6 +6,7 @@ package metadata
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/xmidt-org/xmidt-agent/internal/net"
@@ -27,6 +28,21 @@ func NetworkServiceOpt(networkService net.NetworkServicer) Option {
 		})
 }
 
+// InterfaceStatsSourceOpt enables reporting the rx/tx counters of the
+// available interfaces in the interface stats field.  The field is only
+// returned by GetMetadataFields when requested, never as part of the convey
+// header.
+func InterfaceStatsSourceOpt(source net.InterfaceStatsSource) Option {
+	return optionFunc(
+		func(c *MetadataProvider) error {
+			if source == nil {
+				return fmt.Errorf("%w: nil interface stats source", ErrInvalidInput)
+			}
+			c.statsSource = source
+			return nil
+		})
+}
+
 func FieldsOpt(fields []string) Option {
 	return optionFunc(
 		func(c *MetadataProvider) error {
@@ -70,6 +86,20 @@ func FirmwareOpt(firmware string) Option {
 		})
 }
 
+// FirmwareFuncOpt provides the firmware version each time the metadata is
+// computed, so a firmware update is reported without a restart.  It takes
+// precedence over FirmwareOpt.
+func FirmwareFuncOpt(firmware func() string) Option {
+	return optionFunc(
+		func(c *MetadataProvider) error {
+			if firmware == nil {
+				return fmt.Errorf("%w: nil firmware func", ErrInvalidInput)
+			}
+			c.firmwareFunc = firmware
+			return nil
+		})
+}
+
 func ManufacturerOpt(manufacturer string) Option {
 	return optionFunc(
 		func(c *MetadataProvider) error {
@@ -118,3 +148,25 @@ func InterfaceUsedOpt(interfaceUsed string) Option {
 			return nil
 		})
 }
+
+// FieldCacheTTLOpt caches the computed value of the given fields for the ttl,
+// so frequent requests don't recompute expensive fields (such as the list of
+// available interfaces) each time.  A ttl of 0 disables caching.
+func FieldCacheTTLOpt(ttl time.Duration, fields ...string) Option {
+	return optionFunc(
+		func(c *MetadataProvider) error {
+			if ttl < 0 {
+				return fmt.Errorf("%w: negative cache ttl", ErrInvalidInput)
+			}
+			for _, field := range fields {
+				if !slices.Contains(validFields, field) {
+					return fmt.Errorf("%w: invalid metadata field", ErrInvalidInput)
+				}
+				if c.cacheTTLs == nil {
+					c.cacheTTLs = make(map[string]time.Duration)
+				}
+				c.cacheTTLs[field] = ttl
+			}
+			return nil
+		})
+}
@@ -0,0 +1,253 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+const (
+	// DefaultReportInterval is how often the metadata is re-evaluated.
+	DefaultReportInterval = 5 * time.Minute
+)
+
+// ReporterOption is a functional option type for Reporter.
+type ReporterOption interface {
+	apply(*Reporter) error
+}
+
+type reporterOptionFunc func(*Reporter) error
+
+func (f reporterOptionFunc) apply(r *Reporter) error {
+	return f(r)
+}
+
+// Reporter periodically re-evaluates the convey metadata and sends it as a
+// WRP event when it differs from what was last reported, so the cloud isn't
+// left with stale values (such as the firmware version) until the next
+// reconnect.
+type Reporter struct {
+	provider    *MetadataProvider
+	egress      wrpkit.Handler
+	source      string
+	destination string
+	interval    time.Duration
+	fields      []string
+	always      bool
+
+	// last is the most recently reported metadata.
+	last []byte
+
+	// shutdownCtx is the parent of the context the metadata is re-evaluated
+	// with.
+	shutdownCtx context.Context
+
+	m        sync.Mutex
+	wg       sync.WaitGroup
+	shutdown context.CancelFunc
+}
+
+// NewReporter creates a new Reporter.  The parameter provider computes the
+// metadata, egress sends the WRP event and source is the source of the event,
+// normally the device id.
+//
+// The metadata present when the Reporter is created is assumed to have been
+// sent during the handshake, so only later changes are reported.
+func NewReporter(provider *MetadataProvider, egress wrpkit.Handler, source string, opts ...ReporterOption) (*Reporter, error) {
+	if provider == nil || egress == nil || source == "" {
+		return nil, ErrInvalidInput
+	}
+
+	r := Reporter{
+		provider:    provider,
+		egress:      egress,
+		source:      source,
+		destination: fmt.Sprintf("event:device-status/%s/metadata", source),
+		interval:    DefaultReportInterval,
+		shutdownCtx: context.Background(),
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			if err := opt.apply(&r); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if r.fields == nil {
+		r.fields = slices.Clone(provider.fields)
+	}
+
+	last, err := r.metadata()
+	if err != nil {
+		return nil, err
+	}
+	r.last = last
+
+	return &r, nil
+}
+
+// ReportInterval is how often the metadata is re-evaluated.  The default is
+// DefaultReportInterval.
+func ReportInterval(interval time.Duration) ReporterOption {
+	return reporterOptionFunc(
+		func(r *Reporter) error {
+			if interval <= 0 {
+				return fmt.Errorf("%w: non-positive report interval", ErrInvalidInput)
+			}
+			r.interval = interval
+			return nil
+		})
+}
+
+// ReportDestination is the destination of the WRP event.  The default is
+// event:device-status/<source>/metadata.
+func ReportDestination(destination string) ReporterOption {
+	return reporterOptionFunc(
+		func(r *Reporter) error {
+			if destination == "" {
+				return fmt.Errorf("%w: empty report destination", ErrInvalidInput)
+			}
+			r.destination = destination
+			return nil
+		})
+}
+
+// ReportFields limits the reported fields, intersected with the fields of the
+// provider.  The default is all of the fields of the provider.
+func ReportFields(fields ...string) ReporterOption {
+	return reporterOptionFunc(
+		func(r *Reporter) error {
+			for _, field := range fields {
+				if !slices.Contains(validFields, field) {
+					return fmt.Errorf("%w: invalid metadata field", ErrInvalidInput)
+				}
+			}
+			r.fields = append([]string{}, fields...)
+			return nil
+		})
+}
+
+// ReportShutdownContext is the context the metadata is re-evaluated with.
+// Once it is canceled the metadata is no longer reported, without waiting for
+// Stop.  The default is context.Background().
+func ReportShutdownContext(ctx context.Context) ReporterOption {
+	return reporterOptionFunc(
+		func(r *Reporter) error {
+			if ctx == nil {
+				return fmt.Errorf("%w: nil shutdown context", ErrInvalidInput)
+			}
+			r.shutdownCtx = ctx
+			return nil
+		})
+}
+
+// ReportAlways sends the metadata on every evaluation, even if it hasn't
+// changed.
+func ReportAlways() ReporterOption {
+	return reporterOptionFunc(
+		func(r *Reporter) error {
+			r.always = true
+			return nil
+		})
+}
+
+// Start starts periodically re-evaluating the metadata.
+func (r *Reporter) Start() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.shutdown != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, r.shutdown = context.WithCancel(r.shutdownCtx)
+
+	r.wg.Add(1)
+	go r.run(ctx)
+}
+
+// Stop stops re-evaluating the metadata.
+func (r *Reporter) Stop() {
+	r.m.Lock()
+	shutdown := r.shutdown
+	r.shutdown = nil
+	r.m.Unlock()
+
+	if shutdown != nil {
+		shutdown()
+	}
+	r.wg.Wait()
+}
+
+func (r *Reporter) run(ctx context.Context) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Failures are retried on the next evaluation.
+			_, _ = r.Report()
+		}
+	}
+}
+
+// Report re-evaluates the metadata and sends it if it has changed since it
+// was last reported, or always if ReportAlways is set.  Report returns
+// whether the metadata was sent.
+func (r *Reporter) Report() (bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	current, err := r.metadata()
+	if err != nil {
+		return false, err
+	}
+
+	if !r.always && bytes.Equal(current, r.last) {
+		return false, nil
+	}
+
+	msg := wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      r.source,
+		Destination: r.destination,
+		ContentType: "application/json",
+		Payload:     current,
+	}
+
+	if err := r.egress.HandleWrp(msg); err != nil {
+		return false, err
+	}
+
+	r.last = current
+	return true, nil
+}
+
+// metadata returns the reported fields, encoded as json.  The keys are sorted
+// so the encoding can be compared.
+func (r *Reporter) metadata() ([]byte, error) {
+	b, err := json.Marshal(r.provider.GetMetadataFields(r.fields))
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling metadata: %w", err)
+	}
+
+	return b, nil
+}
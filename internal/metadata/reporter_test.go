@@ -0,0 +1,315 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+type msgRecorder struct {
+	m    sync.Mutex
+	msgs []wrp.Message
+	err  error
+}
+
+func (r *msgRecorder) HandleWrp(msg wrp.Message) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	r.msgs = append(r.msgs, msg)
+	return nil
+}
+
+func (r *msgRecorder) messages() []wrp.Message {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return append([]wrp.Message{}, r.msgs...)
+}
+
+func newReporterProvider(t *testing.T, firmware *atomic.Value) *MetadataProvider {
+	mockNetworkService := newMockNetworkService()
+	mockNetworkService.On("GetInterfaceNames").Return([]string{"erouter0"}, nil)
+
+	firmware.Store("1.1")
+	provider, err := New(
+		NetworkServiceOpt(mockNetworkService),
+		FieldsOpt([]string{Firmware, Hardware, BootTime, InterfacesAvailable}),
+		HardwareModelOpt("some-model"),
+		BootTimeOpt("1111111111"),
+		FirmwareFuncOpt(func() string {
+			return firmware.Load().(string)
+		}),
+	)
+	require.NoError(t, err)
+
+	return provider
+}
+
+func TestNewReporter(t *testing.T) {
+	provider := newReporterProvider(t, &atomic.Value{})
+	egress := &msgRecorder{}
+
+	tests := []struct {
+		description string
+		provider    *MetadataProvider
+		egress      wrpkit.Handler
+		source      string
+		opts        []ReporterOption
+		expectedErr error
+	}{
+		{
+			description: "defaults",
+			provider:    provider,
+			egress:      egress,
+			source:      "mac:112233445566",
+		}, {
+			description: "all options",
+			provider:    provider,
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts: []ReporterOption{
+				ReportInterval(time.Minute),
+				ReportDestination("event:metadata"),
+				ReportFields(Firmware),
+				ReportAlways(),
+				ReportShutdownContext(context.Background()),
+				nil,
+			},
+		}, {
+			description: "nil provider",
+			egress:      egress,
+			source:      "mac:112233445566",
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "nil egress",
+			provider:    provider,
+			source:      "mac:112233445566",
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "empty source",
+			provider:    provider,
+			egress:      egress,
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "invalid interval",
+			provider:    provider,
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []ReporterOption{ReportInterval(0)},
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "empty destination",
+			provider:    provider,
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []ReporterOption{ReportDestination("")},
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "invalid field",
+			provider:    provider,
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []ReporterOption{ReportFields("invalid")},
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "nil shutdown context",
+			provider:    provider,
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []ReporterOption{ReportShutdownContext(nil)}, //nolint:staticcheck
+			expectedErr: ErrInvalidInput,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			r, err := NewReporter(tc.provider, tc.egress, tc.source, tc.opts...)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(err, tc.expectedErr)
+				assert.Nil(r)
+				return
+			}
+
+			assert.NoError(err)
+			assert.NotNil(r)
+		})
+	}
+}
+
+func TestReporterReport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var firmware atomic.Value
+	provider := newReporterProvider(t, &firmware)
+	egress := &msgRecorder{}
+
+	r, err := NewReporter(provider, egress, "mac:112233445566")
+	require.NoError(err)
+
+	// Nothing has changed since the handshake.
+	sent, err := r.Report()
+	require.NoError(err)
+	assert.False(sent)
+	assert.Empty(egress.messages())
+
+	// The firmware is updated without a reconnect.
+	firmware.Store("2.2")
+
+	sent, err = r.Report()
+	require.NoError(err)
+	assert.True(sent)
+
+	msgs := egress.messages()
+	require.Len(msgs, 1)
+	assert.Equal(wrp.SimpleEventMessageType, msgs[0].Type)
+	assert.Equal("mac:112233445566", msgs[0].Source)
+	assert.Equal("event:device-status/mac:112233445566/metadata", msgs[0].Destination)
+	assert.Equal("application/json", msgs[0].ContentType)
+
+	var payload map[string]string
+	require.NoError(json.Unmarshal(msgs[0].Payload, &payload))
+	assert.Equal(map[string]string{
+		Firmware:            "2.2",
+		Hardware:            "some-model",
+		BootTime:            "1111111111",
+		InterfacesAvailable: "erouter0",
+	}, payload)
+
+	// The change is only reported once.
+	sent, err = r.Report()
+	require.NoError(err)
+	assert.False(sent)
+	assert.Len(egress.messages(), 1)
+}
+
+func TestReporterReportFailure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var firmware atomic.Value
+	provider := newReporterProvider(t, &firmware)
+	errUnknown := errors.New("unknown")
+	egress := &msgRecorder{err: errUnknown}
+
+	r, err := NewReporter(provider, egress, "mac:112233445566", ReportFields(Firmware))
+	require.NoError(err)
+
+	firmware.Store("2.2")
+
+	sent, err := r.Report()
+	assert.ErrorIs(err, errUnknown)
+	assert.False(sent)
+
+	// The change is reported once the egress recovers.
+	egress.m.Lock()
+	egress.err = nil
+	egress.m.Unlock()
+
+	sent, err = r.Report()
+	require.NoError(err)
+	assert.True(sent)
+
+	msgs := egress.messages()
+	require.Len(msgs, 1)
+	assert.JSONEq(`{"fw-name":"2.2"}`, string(msgs[0].Payload))
+}
+
+func TestReporterReportAlways(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	provider := newReporterProvider(t, &atomic.Value{})
+	egress := &msgRecorder{}
+
+	r, err := NewReporter(provider, egress, "mac:112233445566",
+		ReportAlways(),
+		ReportDestination("event:metadata"),
+	)
+	require.NoError(err)
+
+	for i := 0; i < 2; i++ {
+		sent, err := r.Report()
+		require.NoError(err)
+		assert.True(sent)
+	}
+
+	msgs := egress.messages()
+	require.Len(msgs, 2)
+	assert.Equal("event:metadata", msgs[1].Destination)
+}
+
+func TestReporterStartStop(t *testing.T) {
+	require := require.New(t)
+
+	var firmware atomic.Value
+	provider := newReporterProvider(t, &firmware)
+	egress := &msgRecorder{}
+
+	r, err := NewReporter(provider, egress, "mac:112233445566",
+		ReportInterval(time.Millisecond),
+	)
+	require.NoError(err)
+
+	r.Start()
+	r.Start()
+	defer r.Stop()
+
+	firmware.Store("2.2")
+
+	require.Eventually(func() bool {
+		return len(egress.messages()) == 1
+	}, time.Second, time.Millisecond)
+
+	r.Stop()
+	r.Stop()
+
+	require.Len(egress.messages(), 1)
+}
+
+func TestReporterShutdownContext(t *testing.T) {
+	require := require.New(t)
+
+	provider := newReporterProvider(t, &atomic.Value{})
+	egress := &msgRecorder{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := NewReporter(provider, egress, "mac:112233445566",
+		ReportInterval(time.Millisecond),
+		ReportAlways(),
+		ReportShutdownContext(ctx),
+	)
+	require.NoError(err)
+
+	r.Start()
+	defer r.Stop()
+
+	require.Eventually(func() bool {
+		return len(egress.messages()) > 0
+	}, time.Second, time.Millisecond)
+
+	// Canceling the shutdown context stops the reports without calling Stop.
+	cancel()
+	r.wg.Wait()
+
+	sent := len(egress.messages())
+	time.Sleep(10 * time.Millisecond)
+	require.Len(egress.messages(), sent)
+}
@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package net
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const DefaultProcNetDevPath = "/proc/net/dev"
+
+var ErrInvalidStats = errors.New("invalid interface stats")
+
+// InterfaceStats are the byte and packet counters for a network interface.
+type InterfaceStats struct {
+	RxBytes   uint64 `json:"rx-bytes"`
+	RxPackets uint64 `json:"rx-packets"`
+	TxBytes   uint64 `json:"tx-bytes"`
+	TxPackets uint64 `json:"tx-packets"`
+}
+
+// InterfaceStatsSource provides the counters for each network interface,
+// keyed by interface name.
+type InterfaceStatsSource interface {
+	GetInterfaceStats() (map[string]InterfaceStats, error)
+}
+
+// ProcNetDev is an InterfaceStatsSource that reads the counters from the
+// linux /proc/net/dev file.
+type ProcNetDev struct {
+	// Path is the file to read.  Defaults to DefaultProcNetDevPath.
+	Path string
+}
+
+func (p *ProcNetDev) GetInterfaceStats() (map[string]InterfaceStats, error) {
+	path := p.Path
+	if path == "" {
+		path = DefaultProcNetDevPath
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseProcNetDev(f)
+}
+
+// ParseProcNetDev parses the contents of a /proc/net/dev formatted file.
+func ParseProcNetDev(r io.Reader) (map[string]InterfaceStats, error) {
+	stats := make(map[string]InterfaceStats)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, counters, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			// The header lines don't contain a ':'.
+			continue
+		}
+
+		name = strings.TrimSpace(name)
+		fields := strings.Fields(counters)
+		if name == "" || len(fields) < 10 {
+			return nil, fmt.Errorf("%w: malformed line for '%s'", ErrInvalidStats, name)
+		}
+
+		// The receive counters are first, followed by the transmit counters.
+		var values [4]uint64
+		for i, idx := range []int{0, 1, 8, 9} {
+			v, err := strconv.ParseUint(fields[idx], 10, 64)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("%w: invalid counter for '%s'", ErrInvalidStats, name), err)
+			}
+			values[i] = v
+		}
+
+		stats[name] = InterfaceStats{
+			RxBytes:   values[0],
+			RxPackets: values[1],
+			TxBytes:   values[2],
+			TxPackets: values[3],
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package net
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const procNetDev = `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1234      12    0    0    0     0          0         0     1234      12    0    0    0     0       0          0
+erouter0: 987654321  654321    1    2    0     0          0        10 123456789  54321    0    0    0     0       0          0
+`
+
+func TestParseProcNetDev(t *testing.T) {
+	tests := []struct {
+		description string
+		in          string
+		expected    map[string]InterfaceStats
+		expectedErr error
+	}{
+		{
+			description: "valid",
+			in:          procNetDev,
+			expected: map[string]InterfaceStats{
+				"lo": {
+					RxBytes:   1234,
+					RxPackets: 12,
+					TxBytes:   1234,
+					TxPackets: 12,
+				},
+				"erouter0": {
+					RxBytes:   987654321,
+					RxPackets: 654321,
+					TxBytes:   123456789,
+					TxPackets: 54321,
+				},
+			},
+		}, {
+			description: "empty",
+			expected:    map[string]InterfaceStats{},
+		}, {
+			description: "too few counters",
+			in:          "eth0: 1 2 3\n",
+			expectedErr: ErrInvalidStats,
+		}, {
+			description: "invalid counter",
+			in:          "eth0: 1 2 0 0 0 0 0 0 x 4 0 0 0 0 0 0\n",
+			expectedErr: ErrInvalidStats,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := ParseProcNetDev(strings.NewReader(tc.in))
+			if tc.expectedErr != nil {
+				assert.ErrorIs(err, tc.expectedErr)
+				assert.Nil(got)
+				return
+			}
+
+			assert.NoError(err)
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
+func TestProcNetDev(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "dev")
+	require.NoError(os.WriteFile(path, []byte(procNetDev), 0600))
+
+	got, err := (&ProcNetDev{Path: path}).GetInterfaceStats()
+	require.NoError(err)
+	assert.Equal(uint64(987654321), got["erouter0"].RxBytes)
+
+	_, err = (&ProcNetDev{Path: filepath.Join(t.TempDir(), "missing")}).GetInterfaceStats()
+	assert.Error(err)
+}
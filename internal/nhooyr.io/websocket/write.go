@@ -51,6 +51,17 @@ func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
 	return nil
 }
 
+// WriteUncompressed writes a message to the connection in a single frame
+// without compressing it, even if compression was negotiated.  This is useful
+// for payloads that are already compressed.
+func (c *Conn) WriteUncompressed(ctx context.Context, typ MessageType, p []byte) error {
+	_, err := c.writeUncompressed(ctx, typ, p)
+	if err != nil {
+		return fmt.Errorf("failed to write msg: %w", err)
+	}
+	return nil
+}
+
 type msgWriter struct {
 	c *Conn
 
@@ -123,6 +134,16 @@ func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) (int, error
 	return n, err
 }
 
+func (c *Conn) writeUncompressed(ctx context.Context, typ MessageType, p []byte) (int, error) {
+	_, err := c.writer(ctx, typ)
+	if err != nil {
+		return 0, err
+	}
+
+	defer c.msgWriter.mu.unlock()
+	return c.writeFrame(ctx, true, false, c.msgWriter.opcode, p)
+}
+
 func (mw *msgWriter) reset(ctx context.Context, typ MessageType) error {
 	err := mw.mu.lock(ctx)
 	if err != nil {
@@ -192,6 +192,12 @@ func (c *Conn) Ping(ctx context.Context) error {
 	return nil
 }
 
+// WriteUncompressed is the same as Write, since compression is handled by
+// the browser for Wasm.
+func (c *Conn) WriteUncompressed(ctx context.Context, typ MessageType, p []byte) error {
+	return c.Write(ctx, typ, p)
+}
+
 // Write writes a message of the given type to the connection.
 // Always non blocking.
 func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
@@ -5,6 +5,7 @@ package pubsub_test
 
 import (
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -284,3 +285,271 @@ func TestTimeout(t *testing.T) {
 	err = ps.HandleWrp(msg)
 	assert.ErrorIs(err, pubsub.ErrTimeout)
 }
+
+func TestSubscriptions(t *testing.T) {
+	id := wrp.DeviceID("mac:112233445566")
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	noop := wrpkit.HandlerFunc(
+		func(wrp.Message) error {
+			return nil
+		})
+
+	var cancel pubsub.CancelFunc
+	ps, err := pubsub.New(id,
+		pubsub.WithEgressHandler(noop),
+		pubsub.WithEventHandler("*", noop),
+		pubsub.WithEventHandler("event_2", noop),
+		pubsub.WithServiceHandler("service", noop),
+		pubsub.WithServiceHandler("service", noop),
+		pubsub.WithServiceHandler("config", noop, &cancel),
+	)
+	require.NoError(err)
+	require.NotNil(ps)
+
+	assert.Equal([]pubsub.SubscriptionInfo{
+		{Kind: "egress", Name: "*", Handlers: 1},
+		{Kind: "event", Name: "*", Handlers: 1},
+		{Kind: "event", Name: "event_2", Handlers: 1},
+		{Kind: "service", Name: "config", Handlers: 1},
+		{Kind: "service", Name: "service", Handlers: 2},
+	}, ps.Subscriptions())
+
+	// Canceled subscriptions are no longer listed.
+	cancel()
+	assert.Equal([]pubsub.SubscriptionInfo{
+		{Kind: "egress", Name: "*", Handlers: 1},
+		{Kind: "event", Name: "*", Handlers: 1},
+		{Kind: "event", Name: "event_2", Handlers: 1},
+		{Kind: "service", Name: "service", Handlers: 2},
+	}, ps.Subscriptions())
+}
+
+func TestPathSubscriptions(t *testing.T) {
+	id := wrp.DeviceID("mac:112233445566")
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		lock   sync.Mutex
+		called []string
+	)
+	recorder := func(name string) wrpkit.Handler {
+		return wrpkit.HandlerFunc(
+			func(wrp.Message) error {
+				lock.Lock()
+				defer lock.Unlock()
+				called = append(called, name)
+
+				// Not handling the message makes the publish wait for every
+				// handler.
+				return wrpkit.ErrNotHandled
+			})
+	}
+
+	ps, err := pubsub.New(id,
+		pubsub.WithPublishTimeout(time.Second),
+		pubsub.WithPathHandler("config/a", recorder("exact")),
+		pubsub.WithPathHandler("config/*", recorder("config wildcard")),
+		pubsub.WithPathHandler("config/*", recorder("config wildcard 2")),
+		pubsub.WithPathHandler("*/status", recorder("status wildcard")),
+		pubsub.WithPathHandler("*", recorder("any")),
+		pubsub.WithServiceHandler("config", recorder("service")),
+	)
+	require.NoError(err)
+	require.NotNil(ps)
+
+	tests := []struct {
+		dest     string
+		expected []string
+	}{
+		{
+			dest:     "mac:112233445566/config/a",
+			expected: []string{"exact", "service"},
+		}, {
+			dest:     "mac:112233445566/config/b",
+			expected: []string{"config wildcard", "config wildcard 2", "service"},
+		}, {
+			dest:     "mac:112233445566/config/a/b",
+			expected: []string{"config wildcard", "config wildcard 2", "service"},
+		}, {
+			// The literal first segment beats the leading wildcard.
+			dest:     "mac:112233445566/config/status",
+			expected: []string{"config wildcard", "config wildcard 2", "service"},
+		}, {
+			dest:     "mac:112233445566/device/status",
+			expected: []string{"status wildcard"},
+		}, {
+			dest:     "mac:112233445566/device",
+			expected: []string{"any"},
+		}, {
+			// Other devices are never matched.
+			dest: "mac:665544332211/config/a",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.dest, func(t *testing.T) {
+			lock.Lock()
+			called = nil
+			lock.Unlock()
+
+			err := ps.HandleWrp(wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service",
+				Destination: tc.dest,
+			})
+			assert.ErrorIs(err, wrpkit.ErrNotHandled)
+
+			lock.Lock()
+			defer lock.Unlock()
+			assert.ElementsMatch(tc.expected, called)
+		})
+	}
+
+	assert.Contains(ps.Subscriptions(),
+		pubsub.SubscriptionInfo{Kind: "path", Name: "config/*", Handlers: 2})
+}
+
+func TestMaxFanout(t *testing.T) {
+	id := wrp.DeviceID("mac:112233445566")
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const (
+		subscribers = 20
+		maxFanout   = 3
+	)
+
+	var (
+		wg                sync.WaitGroup
+		received, current atomic.Int64
+		peak              atomic.Int64
+	)
+
+	opts := []pubsub.Option{
+		pubsub.WithPublishTimeout(time.Second),
+		pubsub.WithMaxFanout(maxFanout),
+	}
+	for i := 0; i < subscribers; i++ {
+		opts = append(opts, pubsub.WithEventHandler("*",
+			wrpkit.HandlerFunc(func(wrp.Message) error {
+				defer wg.Done()
+
+				n := current.Add(1)
+				defer current.Add(-1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+
+				time.Sleep(5 * time.Millisecond)
+				received.Add(1)
+				return wrpkit.ErrNotHandled
+			})))
+	}
+
+	ps, err := pubsub.New(id, opts...)
+	require.NoError(err)
+	require.NotNil(ps)
+
+	wg.Add(subscribers)
+	err = ps.HandleWrp(wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "self:/service/ignored",
+		Destination: "event:event_1/ignored",
+	})
+	assert.ErrorIs(err, wrpkit.ErrNotHandled)
+
+	wg.Wait()
+	assert.Equal(int64(subscribers), received.Load())
+	assert.LessOrEqual(peak.Load(), int64(maxFanout))
+}
+
+func TestMaxInFlightPerSource(t *testing.T) {
+	id := wrp.DeviceID("mac:112233445566")
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const limit = 2
+
+	var (
+		entered = make(chan struct{}, limit)
+		unblock = make(chan struct{})
+		lock    sync.Mutex
+		egress  []wrp.Message
+	)
+
+	ps, err := pubsub.New(id,
+		pubsub.WithPublishTimeout(time.Second),
+		pubsub.WithMaxInFlightPerSource(limit),
+		pubsub.WithServiceHandler("config",
+			wrpkit.HandlerFunc(func(msg wrp.Message) error {
+				// Only the noisy source is slow to be handled.
+				if msg.Source == "dns:noisy.example.com" {
+					entered <- struct{}{}
+					<-unblock
+				}
+				return nil
+			})),
+		pubsub.WithEgressHandler(
+			wrpkit.HandlerFunc(func(msg wrp.Message) error {
+				lock.Lock()
+				defer lock.Unlock()
+				egress = append(egress, msg)
+				return nil
+			})),
+	)
+	require.NoError(err)
+	require.NotNil(ps)
+
+	request := func(source string) wrp.Message {
+		return wrp.Message{
+			Type:            wrp.SimpleRequestResponseMessageType,
+			Source:          source,
+			Destination:     "mac:112233445566/config",
+			TransactionUUID: "1234",
+		}
+	}
+
+	// Fill the noisy source's in flight slots.
+	var wg sync.WaitGroup
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(ps.HandleWrp(request("dns:noisy.example.com")))
+		}()
+		<-entered
+	}
+
+	// The noisy source is over its limit and gets a busy response.
+	err = ps.HandleWrp(request("dns:noisy.example.com"))
+	assert.ErrorIs(err, pubsub.ErrBusy)
+
+	// Other sources are unaffected.
+	assert.NoError(ps.HandleWrp(request("dns:quiet.example.com")))
+
+	close(unblock)
+	wg.Wait()
+
+	lock.Lock()
+	require.Len(egress, 1)
+	assert.Equal("dns:noisy.example.com", egress[0].Destination)
+	assert.Equal("mac:112233445566/config", egress[0].Source)
+	if assert.NotNil(egress[0].Status) {
+		assert.Equal(int64(503), *egress[0].Status)
+	}
+	lock.Unlock()
+
+	// Once the in flight messages finish, the noisy source is accepted again.
+	assert.Eventually(func() bool {
+		return ps.HandleWrp(request("dns:noisy.example.com")) == nil
+	}, time.Second, 10*time.Millisecond)
+}
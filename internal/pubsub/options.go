@@ -65,6 +65,24 @@ func WithServiceHandler(service string, handler wrpkit.Handler, cancel ...*Cance
 	})
 }
 
+// WithPathHandler is an option that adds a handler for the destination paths
+// matching the pattern.  See PubSub.SubscribePath for the pattern syntax.
+// If the optional cancel parameter is provided, it will be set to a function
+// that can be used to cancel the subscription.
+func WithPathHandler(pattern string, handler wrpkit.Handler, cancel ...*CancelFunc) Option {
+	return optionFunc(func(ps *PubSub) error {
+		c, err := ps.SubscribePath(pattern, handler)
+		if err != nil {
+			return err
+		}
+		if len(cancel) > 0 && cancel[0] != nil {
+			*cancel[0] = c
+		}
+
+		return nil
+	})
+}
+
 // WithEventHandler is an option that adds a handler for event messages.
 // If the optional cancel parameter is provided, it will be set to a function
 // that can be used to cancel the subscription.
@@ -93,3 +111,31 @@ func WithPublishTimeout(timeout time.Duration) Option {
 		return nil
 	})
 }
+
+// WithMaxFanout is an option that sets the maximum number of handlers a single
+// message is delivered to concurrently.  A value of zero (the default) means
+// every handler is delivered to concurrently.
+func WithMaxFanout(n int) Option {
+	return optionFunc(func(ps *PubSub) error {
+		if n < 0 {
+			return fmt.Errorf("%w: max fanout must be zero or larger", ErrInvalidInput)
+		}
+		ps.maxFanout = n
+		return nil
+	})
+}
+
+// WithMaxInFlightPerSource is an option that sets the maximum number of
+// messages from a single source that may be in flight at once.  Messages over
+// the limit are rejected with ErrBusy, and a busy response is sent to the
+// source if the message requires one.  A value of zero (the default) means
+// there is no limit.
+func WithMaxInFlightPerSource(n int) Option {
+	return optionFunc(func(ps *PubSub) error {
+		if n < 0 {
+			return fmt.Errorf("%w: max in flight per source must be zero or larger", ErrInvalidInput)
+		}
+		ps.maxInFlightPerSource = n
+		return nil
+	})
+}
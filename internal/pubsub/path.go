@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// wildcard is the path segment that matches any segment.
+const wildcard = "*"
+
+// validatePattern ensures the path pattern is made of non-empty segments that
+// are either a wildcard or free of wildcards.
+func validatePattern(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("%w: path pattern may not be empty", ErrInvalidInput)
+	}
+
+	for _, seg := range strings.Split(pattern, "/") {
+		if seg == "" {
+			return fmt.Errorf("%w: path pattern '%s' may not contain empty segments", ErrInvalidInput, pattern)
+		}
+		if seg != wildcard && strings.Contains(seg, wildcard) {
+			return fmt.Errorf("%w: path pattern '%s' may only use '*' as a whole segment", ErrInvalidInput, pattern)
+		}
+	}
+
+	return nil
+}
+
+// destPath returns the segments of the path of a destination on this device,
+// starting with the service.
+func destPath(dest wrp.Locator) []string {
+	path := strings.Trim(dest.Service+dest.Ignored, "/")
+	return strings.Split(path, "/")
+}
+
+// matchPattern determines if the pattern matches the path.  A '*' segment
+// matches any single segment, except as the last segment of the pattern,
+// where it matches all of the remaining segments.
+func matchPattern(pattern, path []string) bool {
+	if len(path) < len(pattern) {
+		return false
+	}
+
+	for i, seg := range pattern {
+		if seg != wildcard && seg != path[i] {
+			return false
+		}
+	}
+
+	return len(path) == len(pattern) || pattern[len(pattern)-1] == wildcard
+}
+
+// comparePatterns orders two patterns that match the same path by precedence,
+// returning a positive number if a takes precedence over b.  The first
+// segment where one pattern is literal and the other is a wildcard decides,
+// so an exact match always beats a wildcard.  Otherwise the longer pattern
+// takes precedence.
+func comparePatterns(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		aWild, bWild := a[i] == wildcard, b[i] == wildcard
+		switch {
+		case aWild && !bWild:
+			return -1
+		case !aWild && bWild:
+			return 1
+		}
+	}
+
+	return len(a) - len(b)
+}
+
+// bestPattern returns the route of the matching path pattern with the highest
+// precedence, or false if no pattern matches.
+func bestPattern(routes []string, path []string) (string, bool) {
+	var (
+		best     string
+		bestSegs []string
+	)
+	for _, route := range routes {
+		segs := strings.Split(strings.TrimPrefix(route, pathRoute("")), "/")
+		if !matchPattern(segs, path) {
+			continue
+		}
+
+		if bestSegs == nil || comparePatterns(segs, bestSegs) > 0 {
+			best, bestSegs = route, segs
+		}
+	}
+
+	return best, bestSegs != nil
+}
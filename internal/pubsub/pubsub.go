@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +20,13 @@ import (
 var (
 	ErrInvalidInput = fmt.Errorf("invalid input")
 	ErrTimeout      = fmt.Errorf("timeout")
+	ErrBusy         = fmt.Errorf("busy")
+)
+
+const (
+	// busyStatusCode is the status code returned to a source that has too
+	// many requests in flight.
+	busyStatusCode = 503
 )
 
 // CancelFunc removes the associated listener with and cancels any future events
@@ -38,6 +46,13 @@ type PubSub struct {
 	desired        *wrp.Normifier
 	routes         map[string]*eventor.Eventor[wrpkit.Handler]
 	publishTimeout time.Duration
+	maxFanout      int
+
+	// maxInFlightPerSource is the maximum number of messages from a single
+	// source that may be in flight at once.  Zero means unlimited.
+	maxInFlightPerSource int
+	inFlightLock         sync.Mutex
+	inFlight             map[string]int
 }
 
 var _ wrpkit.Handler = (*PubSub)(nil)
@@ -58,8 +73,9 @@ func New(self wrp.DeviceID, opts ...Option) (*PubSub, error) {
 	}
 
 	ps := PubSub{
-		routes: make(map[string]*eventor.Eventor[wrpkit.Handler]),
-		self:   self,
+		routes:   make(map[string]*eventor.Eventor[wrpkit.Handler]),
+		self:     self,
+		inFlight: make(map[string]int),
 		required: wrp.NewNormifier(
 			// Only the absolutely required normalizers are included here.
 			wrp.ValidateDestination(),
@@ -102,6 +118,26 @@ func (ps *PubSub) SubscribeService(service string, h wrpkit.Handler) (CancelFunc
 	return ps.subscribe(serviceRoute(service), h)
 }
 
+// SubscribePath subscribes to the destination paths on this device matching the
+// pattern, such as 'config/*'.  The path of a destination starts with the
+// service, so 'config/*' matches 'mac:112233445566/config/a'.  A '*' segment
+// matches any single segment, except as the last segment of the pattern, where
+// it matches all of the remaining segments.
+//
+// Only the handlers of the matching pattern with the highest precedence are
+// called: the first segment where one pattern is literal and the other is a
+// wildcard decides, so an exact match always beats a wildcard, and otherwise
+// the longer pattern wins.  Path subscriptions are independent of service
+// subscriptions.  The returned CancelFunc may be called to remove the listener
+// and cancel any future events sent to that listener.
+func (ps *PubSub) SubscribePath(pattern string, h wrpkit.Handler) (CancelFunc, error) {
+	if err := validatePattern(pattern); err != nil {
+		return nil, err
+	}
+
+	return ps.subscribe(pathRoute(pattern), h)
+}
+
 // SubscribeEvent subscribes to the specified event.  The listener will be called
 // when a message matches the event.  An event value of '*' may be used to match
 // any event.  The returned CancelFunc may be called to remove the listener and
@@ -114,6 +150,51 @@ func (ps *PubSub) SubscribeEvent(event string, h wrpkit.Handler) (CancelFunc, er
 	return ps.subscribe(eventRoute(event), h)
 }
 
+// SubscriptionInfo describes a registered subscription route.
+type SubscriptionInfo struct {
+	// Kind is the kind of route subscribed to: "service", "path", "event" or
+	// "egress".
+	Kind string
+
+	// Name is the service, path pattern or event name subscribed to.  A value
+	// of '*' matches any service or event.  The egress route is always '*'.
+	Name string
+
+	// Handlers is the number of handlers subscribed to the route.
+	Handlers int
+}
+
+// Subscriptions returns the routes with at least one subscribed handler,
+// sorted by kind and name.
+func (ps *PubSub) Subscriptions() []SubscriptionInfo {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	subs := make([]SubscriptionInfo, 0, len(ps.routes))
+	for route, handlers := range ps.routes {
+		n := handlers.Len()
+		if n == 0 {
+			continue
+		}
+
+		kind, name, _ := strings.Cut(route, ":")
+		subs = append(subs, SubscriptionInfo{
+			Kind:     kind,
+			Name:     name,
+			Handlers: n,
+		})
+	}
+
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].Kind != subs[j].Kind {
+			return subs[i].Kind < subs[j].Kind
+		}
+		return subs[i].Name < subs[j].Name
+	})
+
+	return subs
+}
+
 func validateString(s, typ string) error {
 	if s == "" {
 		return fmt.Errorf("%w: %s may not be empty", ErrInvalidInput, typ)
@@ -145,12 +226,92 @@ func (ps *PubSub) subscribe(route string, h wrpkit.Handler) (CancelFunc, error)
 // HandleWrp publishes a wrp message to the appropriate listeners and returns
 // if there was at least one handler that accepted the message.  The error
 // wrpkit.ErrNotHandled is returned if no listeners were found for the message.
+// The error ErrBusy is returned if the source of the message has too many
+// messages in flight; a busy response is sent to the source if the message
+// requires one.
 func (ps *PubSub) HandleWrp(msg wrp.Message) error {
 	normalized, dest, err := ps.normalize(&msg)
 	if err != nil {
 		return errors.Join(err, wrpkit.ErrNotHandled)
 	}
 
+	if !ps.acquire(normalized.Source) {
+		return ps.busy(*normalized)
+	}
+
+	return ps.publish(normalized, dest, func() {
+		ps.release(normalized.Source)
+	})
+}
+
+// acquire reserves an in flight slot for the source, returning false if the
+// source is already at its limit.
+func (ps *PubSub) acquire(source string) bool {
+	if ps.maxInFlightPerSource == 0 {
+		return true
+	}
+
+	ps.inFlightLock.Lock()
+	defer ps.inFlightLock.Unlock()
+
+	if ps.inFlight[source] >= ps.maxInFlightPerSource {
+		return false
+	}
+
+	ps.inFlight[source]++
+	return true
+}
+
+// release frees an in flight slot previously acquired for the source.
+func (ps *PubSub) release(source string) {
+	if ps.maxInFlightPerSource == 0 {
+		return
+	}
+
+	ps.inFlightLock.Lock()
+	defer ps.inFlightLock.Unlock()
+
+	ps.inFlight[source]--
+	if ps.inFlight[source] <= 0 {
+		delete(ps.inFlight, source)
+	}
+}
+
+// busy rejects the message, sending a busy response to the source if the
+// message requires a response.  The response isn't subject to the in flight
+// limits so a busy source can't cause a chain of busy responses.
+func (ps *PubSub) busy(msg wrp.Message) error {
+	if !msg.Type.RequiresTransaction() {
+		return ErrBusy
+	}
+
+	response := msg
+	response.Destination = msg.Source
+	response.Source = msg.Destination
+	response.ContentType = "application/json"
+
+	code := int64(busyStatusCode)
+	response.Status = &code
+	response.Payload = []byte(fmt.Sprintf(`{"statusCode": %d}`, code))
+
+	normalized, dest, err := ps.normalize(&response)
+	if err != nil {
+		return errors.Join(ErrBusy, err)
+	}
+
+	err = ps.publish(normalized, dest, func() {})
+	if err != nil {
+		return errors.Join(ErrBusy, err)
+	}
+
+	return ErrBusy
+}
+
+// publish delivers the normalized message to the handlers of the matching
+// routes.  The done function is called once every handler has returned.
+func (ps *PubSub) publish(normalized *wrp.Message, dest wrp.Locator, done func()) error {
+	var err error
+
 	// Unless the destination is this device, the message will be sent to the
 	// egress route.  If the destination is this device, the message will be sent
 	// to the service route.
@@ -169,8 +330,36 @@ func (ps *PubSub) HandleWrp(msg wrp.Message) error {
 		}
 	}
 
+	var handlers []wrpkit.Handler
 	ps.lock.RLock()
-	defer ps.lock.RUnlock()
+	if dest.ID == ps.self {
+		if route, found := ps.matchPath(destPath(dest)); found {
+			routes = append(routes, route)
+		}
+	}
+	for _, route := range routes {
+		if _, found := ps.routes[route]; found {
+			ps.routes[route].Visit(func(h wrpkit.Handler) {
+				if h != nil {
+					handlers = append(handlers, h)
+				}
+			})
+		}
+	}
+	ps.lock.RUnlock()
+
+	// Bound the number of concurrent deliveries when configured, otherwise
+	// every handler gets its own goroutine.
+	workers := len(handlers)
+	if 0 < ps.maxFanout && ps.maxFanout < workers {
+		workers = ps.maxFanout
+	}
+
+	work := make(chan wrpkit.Handler, len(handlers))
+	for _, h := range handlers {
+		work <- h
+	}
+	close(work)
 
 	wg := sync.WaitGroup{}
 	stop := make(chan struct{})
@@ -178,47 +367,44 @@ func (ps *PubSub) HandleWrp(msg wrp.Message) error {
 	ctx, cancel := context.WithTimeout(context.Background(), ps.publishTimeout)
 	defer cancel()
 
-	for _, route := range routes {
-		if _, found := ps.routes[route]; found {
-			ps.routes[route].Visit(func(h wrpkit.Handler) {
-				// By making this a go routine, we can avoid deadlocks if the handler
-				// tries to subscribe to the same service.  It also avoids blocking the
-				// caller if the handler takes a long time to process the message.
-				if h != nil {
-					wg.Add(1)
-					go func() {
-						defer wg.Done()
-
-						err := h.HandleWrp(*normalized)
-						if errors.Is(err, wrpkit.ErrNotHandled) {
-							return
-						}
-
-						// Signal that the message was handled, or stop
-						// trying to send the message if the stop channel
-						// is closed.
-						select {
-						case handled <- struct{}{}:
-						case <-stop:
-						}
-					}()
+	for i := 0; i < workers; i++ {
+		// By making this a go routine, we can avoid deadlocks if the handler
+		// tries to subscribe to the same service.  It also avoids blocking the
+		// caller if the handler takes a long time to process the message.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for h := range work {
+				err := h.HandleWrp(*normalized)
+				if errors.Is(err, wrpkit.ErrNotHandled) {
+					continue
 				}
-			})
-		}
+
+				// Signal that the message was handled, or stop
+				// trying to send the message if the stop channel
+				// is closed.
+				select {
+				case handled <- struct{}{}:
+				case <-stop:
+				}
+			}
+		}()
 	}
 
 	// Make waiting operate on a channel so that it can be interrupted if the
 	// message is handled, or a timeout is reached.
-	done := make(chan struct{})
+	finished := make(chan struct{})
 	go func() {
 		wg.Wait()
-		close(done)
+		done()
+		close(finished)
 	}()
 
 	select {
 	case <-handled: // No more responses are needed.
 		err = nil
-	case <-done: // All handlers have finished.
+	case <-finished: // All handlers have finished.
 		err = wrpkit.ErrNotHandled
 	case <-ctx.Done(): // The timeout has been reached.
 		err = ErrTimeout
@@ -248,10 +434,27 @@ func (ps *PubSub) normalize(msg *wrp.Message) (*wrp.Message, wrp.Locator, error)
 	return msg, dst, nil
 }
 
+// matchPath returns the path route with the highest precedence matching the
+// path.  The caller must hold the lock.
+func (ps *PubSub) matchPath(path []string) (string, bool) {
+	var patterns []string
+	for route, handlers := range ps.routes {
+		if strings.HasPrefix(route, pathRoute("")) && handlers.Len() > 0 {
+			patterns = append(patterns, route)
+		}
+	}
+
+	return bestPattern(patterns, path)
+}
+
 func serviceRoute(service string) string {
 	return "service:" + service
 }
 
+func pathRoute(pattern string) string {
+	return "path:" + pattern
+}
+
 func egressRoute() string {
 	return "egress:*"
 }
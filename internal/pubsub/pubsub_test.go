@@ -4,6 +4,7 @@
 package pubsub
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -78,6 +79,17 @@ func TestNew(t *testing.T) {
 				a.NotNil(ps.routes["service:*"])
 				a.NotNil(ps.routes["service:config"])
 			},
+		}, {
+			description: "Confirm path handlers",
+			self:        "mac:112233445566",
+			opts: []Option{
+				WithPathHandler("config/*", fn),
+				WithPathHandler("*/status", fn),
+			},
+			validate: func(a *assert.Assertions, ps *PubSub) {
+				a.NotNil(ps.routes["path:config/*"])
+				a.NotNil(ps.routes["path:*/status"])
+			},
 		}, {
 			description: "Confirm normify options",
 			self:        "mac:112233445566",
@@ -88,6 +100,20 @@ func TestNew(t *testing.T) {
 				a.NotNil(ps.desiredOpts)
 				a.Equal(1, len(ps.desiredOpts))
 			},
+		}, {
+			description: "Confirm max fanout",
+			self:        "mac:112233445566",
+			opt:         WithMaxFanout(4),
+			validate: func(a *assert.Assertions, ps *PubSub) {
+				a.Equal(4, ps.maxFanout)
+			},
+		}, {
+			description: "Confirm max in flight per source",
+			self:        "mac:112233445566",
+			opt:         WithMaxInFlightPerSource(2),
+			validate: func(a *assert.Assertions, ps *PubSub) {
+				a.Equal(2, ps.maxInFlightPerSource)
+			},
 		},
 
 		// Error Cases
@@ -109,6 +135,21 @@ func TestNew(t *testing.T) {
 			self:        "mac:112233445566",
 			opts:        []Option{WithServiceHandler("", fn)},
 			expectedErr: ErrInvalidInput,
+		}, {
+			description: "Empty Path Pattern",
+			self:        "mac:112233445566",
+			opts:        []Option{WithPathHandler("", fn)},
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "Path Pattern With An Empty Segment",
+			self:        "mac:112233445566",
+			opts:        []Option{WithPathHandler("config//a", fn)},
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "Path Pattern With A Partial Wildcard",
+			self:        "mac:112233445566",
+			opts:        []Option{WithPathHandler("config/a*", fn)},
+			expectedErr: ErrInvalidInput,
 		}, {
 			description: "Invalid Event Name",
 			self:        "mac:112233445566",
@@ -124,6 +165,16 @@ func TestNew(t *testing.T) {
 			self:        "mac:112233445566",
 			opts:        []Option{WithPublishTimeout(-1 * time.Second)},
 			expectedErr: ErrInvalidInput,
+		}, {
+			description: "Invalid max fanout",
+			self:        "mac:112233445566",
+			opts:        []Option{WithMaxFanout(-1)},
+			expectedErr: ErrInvalidInput,
+		}, {
+			description: "Invalid max in flight per source",
+			self:        "mac:112233445566",
+			opts:        []Option{WithMaxInFlightPerSource(-1)},
+			expectedErr: ErrInvalidInput,
 		},
 	}
 	for _, tc := range tests {
@@ -150,3 +201,84 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{pattern: "config", path: "config", match: true},
+		{pattern: "config", path: "config/a"},
+		{pattern: "config/a", path: "config"},
+		{pattern: "config/*", path: "config/a", match: true},
+		{pattern: "config/*", path: "config/a/b", match: true},
+		{pattern: "config/*", path: "config"},
+		{pattern: "*/status", path: "config/status", match: true},
+		{pattern: "*/status", path: "config/status/a"},
+		{pattern: "*/status", path: "config/other"},
+		{pattern: "*", path: "config/a", match: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.pattern+" "+tc.path, func(t *testing.T) {
+			got := matchPattern(strings.Split(tc.pattern, "/"), strings.Split(tc.path, "/"))
+			assert.Equal(t, tc.match, got)
+		})
+	}
+}
+
+func TestBestPattern(t *testing.T) {
+	tests := []struct {
+		description string
+		patterns    []string
+		path        string
+		expected    string
+	}{
+		{
+			description: "no match",
+			patterns:    []string{"config/*", "*/status"},
+			path:        "other",
+		}, {
+			description: "exact beats wildcard",
+			patterns:    []string{"*", "config/*", "config/a", "*/a"},
+			path:        "config/a",
+			expected:    "config/a",
+		}, {
+			description: "the first literal segment decides",
+			patterns:    []string{"*/a/b", "config/*"},
+			path:        "config/a/b",
+			expected:    "config/*",
+		}, {
+			description: "longer pattern wins",
+			patterns:    []string{"config/*", "config/a/*"},
+			path:        "config/a/b",
+			expected:    "config/a/*",
+		}, {
+			description: "longer wildcard pattern wins",
+			patterns:    []string{"*/*/*", "*", "*/*"},
+			path:        "config/a/b",
+			expected:    "*/*/*",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			// The order of the routes doesn't matter.
+			for i := range tc.patterns {
+				var routes []string
+				for j := range tc.patterns {
+					routes = append(routes, pathRoute(tc.patterns[(i+j)%len(tc.patterns)]))
+				}
+
+				got, found := bestPattern(routes, strings.Split(tc.path, "/"))
+				if tc.expected == "" {
+					assert.False(found)
+					continue
+				}
+				assert.True(found)
+				assert.Equal(pathRoute(tc.expected), got)
+			}
+		})
+	}
+}
@@ -5,12 +5,19 @@ package websocket_test
 
 import (
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -18,11 +25,14 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/arrange/arrangehttp"
+	"github.com/xmidt-org/arrange/arrangetls"
 	"github.com/xmidt-org/retry"
 	"github.com/xmidt-org/wrp-go/v3"
 	"github.com/xmidt-org/xmidt-agent/internal/nhooyr.io/websocket"
 	ws "github.com/xmidt-org/xmidt-agent/internal/websocket"
 	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestEndToEnd(t *testing.T) {
@@ -502,3 +512,2894 @@ func TestEndToEndInactivityTimeout(t *testing.T) {
 	time.Sleep(400 * time.Millisecond)
 	got.Stop()
 }
+
+func TestEndToEndWatchdogTimeout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The server never sends anything, simulating a stalled read path.
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				_, _, _ = c.Read(r.Context())
+			}))
+	defer s.Close()
+
+	var (
+		connectCnt, watchdogCnt atomic.Int64
+	)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connectCnt.Add(1)
+					}
+				})),
+		ws.AddDisconnectListener(
+			event.DisconnectListenerFunc(
+				func(e event.Disconnect) {
+					if errors.Is(e.Err, ws.ErrWatchdogTimeout) {
+						watchdogCnt.Add(1)
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		// The inactivity timeout is long enough to never trigger.
+		ws.InactivityTimeout(time.Minute),
+		ws.WatchdogTimeout(50*time.Millisecond),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	assert.Eventually(func() bool {
+		return watchdogCnt.Load() > 0 && connectCnt.Load() > 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestEndToEndWatchdogTimeoutPongs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The server only sends unsolicited pongs, written as raw frames since
+	// the websocket library never sends them on its own.
+	done := make(chan struct{})
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				h := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+
+				conn, rw, err := http.NewResponseController(w).Hijack()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+					"Upgrade: websocket\r\n" +
+					"Connection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h[:]) + "\r\n\r\n")
+				if err = rw.Flush(); err != nil {
+					return
+				}
+
+				// The client only writes to close the connection, which is
+				// done right away rather than with a close handshake.
+				go func() {
+					_, _ = rw.Read(make([]byte, 1))
+					conn.Close()
+				}()
+
+				ticker := time.NewTicker(10 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+						// An empty, final pong frame.
+						if _, err = conn.Write([]byte{0x8a, 0x00}); err != nil {
+							return
+						}
+					}
+				}
+			}))
+	defer s.Close()
+	defer close(done)
+
+	var (
+		connectCnt, watchdogCnt, pongCnt atomic.Int64
+	)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connectCnt.Add(1)
+					}
+				})),
+		ws.AddDisconnectListener(
+			event.DisconnectListenerFunc(
+				func(e event.Disconnect) {
+					if errors.Is(e.Err, ws.ErrWatchdogTimeout) {
+						watchdogCnt.Add(1)
+					}
+				})),
+		ws.AddHeartbeatListener(
+			event.HeartbeatListenerFunc(
+				func(e event.Heartbeat) {
+					if e.Type == event.PONG {
+						pongCnt.Add(1)
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		// The inactivity timeout is long enough to never trigger.
+		ws.InactivityTimeout(time.Minute),
+		ws.WatchdogTimeout(50*time.Millisecond),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	// The pongs keep the idle connection from being considered stalled.
+	assert.Eventually(func() bool {
+		return pongCnt.Load() > 20
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(int64(1), connectCnt.Load())
+	assert.Zero(watchdogCnt.Load())
+}
+
+func TestEndToEndWatchdogTimeoutStuckListener(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The server sends a message on every connection, which the listener
+	// never returns from.
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.CloseNow()
+
+				msg := wrp.Message{
+					Type:   wrp.SimpleEventMessageType,
+					Source: "server",
+				}
+				if err = c.Write(r.Context(), websocket.MessageBinary, wrp.MustEncode(&msg, wrp.Msgpack)); err != nil {
+					return
+				}
+
+				_, _, _ = c.Read(r.Context())
+			}))
+	defer s.Close()
+
+	var (
+		connectCnt, watchdogCnt, msgCnt atomic.Int64
+		block                           = make(chan struct{})
+	)
+
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connectCnt.Add(1)
+					}
+				})),
+		ws.AddDisconnectListener(
+			event.DisconnectListenerFunc(
+				func(e event.Disconnect) {
+					if errors.Is(e.Err, ws.ErrWatchdogTimeout) {
+						watchdogCnt.Add(1)
+					}
+				})),
+		ws.AddMessageListener(
+			event.MsgListenerFunc(
+				func(wrp.Message) {
+					msgCnt.Add(1)
+					<-block
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		// The inactivity timeout is long enough to never trigger.
+		ws.InactivityTimeout(time.Minute),
+		ws.WatchdogTimeout(50*time.Millisecond),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+	// Release the stuck listeners before stopping.
+	defer close(block)
+
+	// Each fresh connection delivers its message to a new stuck listener.
+	assert.Eventually(func() bool {
+		return watchdogCnt.Load() > 0 && connectCnt.Load() > 1 && msgCnt.Load() > 1
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestEndToEndMaxConnectionLifetime(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		accepted atomic.Int64
+		lock     sync.Mutex
+		statuses []websocket.StatusCode
+	)
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+				accepted.Add(1)
+
+				_, _, err = c.Read(r.Context())
+				lock.Lock()
+				statuses = append(statuses, websocket.CloseStatus(err))
+				lock.Unlock()
+			}))
+	defer s.Close()
+
+	var (
+		rotations   atomic.Int64
+		disconnects atomic.Int64
+	)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddRotationListener(
+			event.RotationListenerFunc(
+				func(e event.Rotation) {
+					if e.Lifetime >= 50*time.Millisecond {
+						rotations.Add(1)
+					}
+				})),
+		ws.AddDisconnectListener(
+			event.DisconnectListenerFunc(
+				func(e event.Disconnect) {
+					if errors.Is(e.Err, ws.ErrRotated) {
+						disconnects.Add(1)
+					}
+				})),
+		// Long enough that only rotations reconnect in time.
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Second,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.InactivityTimeout(time.Minute),
+		ws.MaxConnectionLifetime(50*time.Millisecond),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	require.Eventually(func() bool {
+		return rotations.Load() >= 2 && accepted.Load() >= 3
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(disconnects.Load(), int64(2))
+
+	// The server is told the close is normal.
+	lock.Lock()
+	defer lock.Unlock()
+	require.NotEmpty(statuses)
+	assert.Equal(websocket.StatusNormalClosure, statuses[0])
+}
+
+func TestEndToEndMinReconnectInterval(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Every connection fails right after it is established.
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				c.Close(websocket.StatusCode(4000), "flap")
+			}))
+	defer s.Close()
+
+	const floor = 100 * time.Millisecond
+
+	var (
+		lock    sync.Mutex
+		started []time.Time
+	)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						lock.Lock()
+						started = append(started, e.Started)
+						lock.Unlock()
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.MinReconnectInterval(floor),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	require.Eventually(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(started) >= 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i := 1; i < len(started); i++ {
+		assert.GreaterOrEqual(started[i].Sub(started[i-1]), floor)
+	}
+}
+
+func TestEndToEndNormalizeURLScheme(t *testing.T) {
+	tests := []struct {
+		description string
+		scheme      string
+		expectedErr error
+	}{
+		{
+			description: "http",
+			scheme:      "http",
+		}, {
+			description: "ws",
+			scheme:      "ws",
+		}, {
+			description: "upper case ws",
+			scheme:      "WS",
+		}, {
+			description: "unsupported scheme",
+			scheme:      "ftp",
+			expectedErr: ws.ErrInvalidURL,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			s := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						c, err := websocket.Accept(w, r, nil)
+						if err != nil {
+							return
+						}
+						defer c.CloseNow()
+
+						_, _, _ = c.Read(r.Context())
+					}))
+			defer s.Close()
+
+			connected := make(chan event.Connect, 10)
+			got, err := ws.New(
+				ws.URL(tc.scheme+strings.TrimPrefix(s.URL, "http")),
+				ws.NormalizeURLScheme(),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: 10 * time.Millisecond,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+				ws.CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+			)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			select {
+			case e := <-connected:
+				assert.ErrorIs(e.Err, tc.expectedErr)
+				if tc.expectedErr == nil {
+					assert.Equal("ws"+strings.TrimPrefix(s.URL, "http"), got.URL())
+				}
+			case <-time.After(2 * time.Second):
+				assert.Fail("timed out waiting for the connection attempt")
+			}
+		})
+	}
+}
+
+func TestEndToEndDecodeFailureBackoff(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Every connection gets a malformed message.
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				_ = c.Write(r.Context(), websocket.MessageBinary, []byte{0xc1, 0xff, 0x00})
+				_, _, _ = c.Read(r.Context())
+			}))
+	defer s.Close()
+
+	const (
+		threshold = 3
+		backoff   = 300 * time.Millisecond
+	)
+
+	var (
+		lock     sync.Mutex
+		started  []time.Time
+		backoffs []event.DecodeBackoff
+	)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						lock.Lock()
+						started = append(started, e.Started)
+						lock.Unlock()
+					}
+				})),
+		ws.AddDecodeBackoffListener(
+			event.DecodeBackoffListenerFunc(
+				func(e event.DecodeBackoff) {
+					lock.Lock()
+					backoffs = append(backoffs, e)
+					lock.Unlock()
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.DecodeFailureBackoff(threshold, backoff),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	require.Eventually(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(started) >= threshold+2
+	}, 3*time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The reconnects are quick until the threshold is reached, then each
+	// one waits for the backoff.
+	for i := 1; i < threshold; i++ {
+		assert.Less(started[i].Sub(started[i-1]), backoff)
+	}
+	for i := threshold; i < len(started); i++ {
+		assert.GreaterOrEqual(started[i].Sub(started[i-1]), backoff)
+	}
+
+	require.GreaterOrEqual(len(backoffs), 2)
+	assert.Equal(threshold, backoffs[0].Failures)
+	assert.Equal(threshold+1, backoffs[1].Failures)
+	assert.Equal(backoff, backoffs[0].Backoff)
+	assert.Error(backoffs[0].Err)
+}
+
+func TestEndToEndSetDeviceID(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		lock sync.Mutex
+		ids  []string
+	)
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				ids = append(ids, r.Header.Get("X-Webpa-Device-Name"))
+				lock.Unlock()
+
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				_, _, _ = c.Read(r.Context())
+			}))
+	defer s.Close()
+
+	var connectCnt atomic.Int64
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connectCnt.Add(1)
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	assert.ErrorIs(got.SetDeviceID("invalid"), ws.ErrMisconfiguredWS)
+
+	got.Start()
+	defer got.Stop()
+
+	require.Eventually(func() bool {
+		return connectCnt.Load() > 0
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(got.SetDeviceID("mac:665544332211"))
+
+	require.Eventually(func() bool {
+		return connectCnt.Load() > 1
+	}, time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.GreaterOrEqual(len(ids), 2)
+	assert.Equal("mac:112233445566", ids[0])
+	assert.Equal("mac:665544332211", ids[len(ids)-1])
+}
+
+func TestEndToEndDisconnectCloseCode(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				_ = c.Close(websocket.StatusCode(4000), "policy violation")
+			}))
+	defer s.Close()
+
+	disconnected := make(chan event.Disconnect, 10)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddDisconnectListener(
+			event.DisconnectListenerFunc(
+				func(e event.Disconnect) {
+					select {
+					case disconnected <- e:
+					default:
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: time.Second,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	select {
+	case e := <-disconnected:
+		assert.Error(e.Err)
+		assert.Equal(4000, e.Code)
+		assert.Equal("policy violation", e.Reason)
+	case <-time.After(2 * time.Second):
+		assert.Fail("timed out waiting for the disconnect")
+	}
+}
+
+func TestEndToEndSendQueue(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	received := make(chan wrp.Message, 10)
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				for {
+					mt, b, err := c.Read(r.Context())
+					if err != nil {
+						return
+					}
+					assert.Equal(websocket.MessageBinary, mt)
+
+					var msg wrp.Message
+					assert.NoError(wrp.NewDecoderBytes(b, wrp.Msgpack).Decode(&msg))
+					received <- msg
+				}
+			}))
+	defer s.Close()
+
+	var connectCnt atomic.Int64
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connectCnt.Add(1)
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: time.Second,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.SendTimeout(time.Second),
+		ws.SendQueueDepth(10),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	require.Eventually(func() bool {
+		return connectCnt.Load() > 0
+	}, time.Second, 10*time.Millisecond)
+
+	sources := []string{"client-1", "client-2", "client-3"}
+	for _, source := range sources {
+		require.NoError(got.Send(context.Background(),
+			wrp.Message{
+				Type:   wrp.SimpleEventMessageType,
+				Source: source,
+			}))
+	}
+
+	for _, source := range sources {
+		select {
+		case msg := <-received:
+			assert.Equal(source, msg.Source)
+		case <-time.After(time.Second):
+			assert.Fail("timed out waiting for messages")
+			return
+		}
+	}
+}
+
+func TestEndToEndCompression(t *testing.T) {
+	tests := []struct {
+		description string
+		client      websocket.CompressionMode
+		server      websocket.CompressionMode
+		compressed  bool
+	}{
+		{
+			description: "compression negotiated",
+			client:      websocket.CompressionContextTakeover,
+			server:      websocket.CompressionContextTakeover,
+			compressed:  true,
+		}, {
+			description: "client disables compression",
+			client:      websocket.CompressionDisabled,
+			server:      websocket.CompressionContextTakeover,
+		}, {
+			description: "server doesn't support compression",
+			client:      websocket.CompressionNoContextTakeover,
+			server:      websocket.CompressionDisabled,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			s := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						c, err := websocket.Accept(w, r,
+							&websocket.AcceptOptions{
+								CompressionMode: tc.server,
+							})
+						require.NoError(err)
+						defer c.CloseNow()
+
+						_, _, _ = c.Read(r.Context())
+					}))
+			defer s.Close()
+
+			connected := make(chan event.Connect, 10)
+			got, err := ws.New(
+				ws.URL(s.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: time.Second,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+				ws.CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.Compression(tc.client, 0),
+			)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			select {
+			case e := <-connected:
+				assert.NoError(e.Err)
+				assert.Equal(tc.compressed, e.Compressed)
+			case <-time.After(2 * time.Second):
+				assert.Fail("timed out waiting for the connection")
+			}
+		})
+	}
+}
+
+// countingListener counts the raw bytes read from every accepted connection.
+type countingListener struct {
+	net.Listener
+	read *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: c, read: l.read}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestEndToEndCompressionSkipContentTypes(t *testing.T) {
+	const payloadSize = 64 * 1024
+
+	tests := []struct {
+		description string
+		contentType string
+		opts        []ws.Option
+		compressed  bool
+	}{
+		{
+			description: "compressible content type",
+			contentType: "application/json",
+			compressed:  true,
+		}, {
+			description: "default skip list, wildcard match",
+			contentType: "image/png",
+		}, {
+			description: "default skip list, exact match with parameters",
+			contentType: "application/gzip; charset=binary",
+		}, {
+			description: "custom skip list",
+			contentType: "application/json",
+			opts: []ws.Option{
+				ws.CompressionSkipContentTypes("application/json"),
+			},
+		}, {
+			description: "custom skip list replaces the default",
+			contentType: "image/png",
+			opts: []ws.Option{
+				ws.CompressionSkipContentTypes("application/json"),
+			},
+			compressed: true,
+		}, {
+			description: "empty skip list",
+			contentType: "image/png",
+			opts: []ws.Option{
+				ws.CompressionSkipContentTypes(),
+			},
+			compressed: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var read atomic.Int64
+			received := make(chan wrp.Message, 1)
+			s := httptest.NewUnstartedServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						c, err := websocket.Accept(w, r,
+							&websocket.AcceptOptions{
+								CompressionMode: websocket.CompressionContextTakeover,
+							})
+						require.NoError(err)
+						defer c.CloseNow()
+
+						c.SetReadLimit(2 * payloadSize)
+						_, data, err := c.Read(r.Context())
+						if err != nil {
+							return
+						}
+
+						var msg wrp.Message
+						require.NoError(wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&msg))
+						received <- msg
+					}))
+			s.Listener = countingListener{Listener: s.Listener, read: &read}
+			s.Start()
+			defer s.Close()
+
+			opts := append([]ws.Option{
+				ws.URL(s.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.RetryPolicy(&retry.Config{
+					Interval: time.Second,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.SendTimeout(time.Second),
+				ws.FetchURLTimeout(30 * time.Second),
+				ws.MaxMessageBytes(256 * 1024),
+				ws.Compression(websocket.CompressionContextTakeover, 0),
+			}, tc.opts...)
+			got, err := ws.New(opts...)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			require.Eventually(func() bool {
+				return got.ConnectionState() == ws.Connected
+			}, 2*time.Second, 10*time.Millisecond)
+
+			handshake := read.Load()
+			msg := wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "mac:112233445566",
+				Destination: "event:test",
+				ContentType: tc.contentType,
+				Payload:     make([]byte, payloadSize),
+			}
+			require.NoError(got.Send(context.Background(), msg))
+
+			select {
+			case m := <-received:
+				assert.Equal(msg.Payload, m.Payload)
+			case <-time.After(2 * time.Second):
+				require.Fail("timed out waiting for the message")
+			}
+
+			sent := read.Load() - handshake
+			if tc.compressed {
+				assert.Less(sent, int64(payloadSize/8))
+			} else {
+				assert.Greater(sent, int64(payloadSize))
+			}
+		})
+	}
+}
+
+type recordingMetrics struct {
+	lock                sync.Mutex
+	attempts, successes int
+	disconnects         []string
+	sent, received      int
+}
+
+func (m *recordingMetrics) IncConnectAttempt() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.attempts++
+}
+
+func (m *recordingMetrics) IncConnectSuccess() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.successes++
+}
+
+func (m *recordingMetrics) IncDisconnect(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.disconnects = append(m.disconnects, reason)
+}
+
+func (m *recordingMetrics) ObserveSentBytes(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sent += n
+}
+
+func (m *recordingMetrics) ObserveReceivedBytes(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.received += n
+}
+
+func TestEndToEndMetrics(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fromServer := wrp.Message{
+		Type:   wrp.SimpleEventMessageType,
+		Source: "server",
+	}
+	fromClient := wrp.Message{
+		Type:   wrp.SimpleEventMessageType,
+		Source: "client",
+	}
+
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				err = c.Write(r.Context(), websocket.MessageBinary, wrp.MustEncode(&fromServer, wrp.Msgpack))
+				require.NoError(err)
+
+				_, _, err = c.Read(r.Context())
+				require.NoError(err)
+
+				c.Close(websocket.StatusCode(4000), "done")
+			}))
+	defer s.Close()
+
+	var (
+		metrics recordingMetrics
+		msgCnt  atomic.Int64
+	)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddMessageListener(
+			event.MsgListenerFunc(
+				func(wrp.Message) {
+					msgCnt.Add(1)
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: time.Second,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.SendTimeout(time.Second),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.WithMetrics(&metrics),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	require.Eventually(func() bool {
+		return msgCnt.Load() > 0
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(got.Send(context.Background(), fromClient))
+
+	require.Eventually(func() bool {
+		metrics.lock.Lock()
+		defer metrics.lock.Unlock()
+		return len(metrics.disconnects) > 0
+	}, time.Second, 10*time.Millisecond)
+
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	assert.Equal(1, metrics.attempts)
+	assert.Equal(1, metrics.successes)
+	assert.Equal([]string{ws.DisconnectReasonClosed}, metrics.disconnects)
+	assert.Equal(len(wrp.MustEncode(&fromClient, wrp.Msgpack)), metrics.sent)
+	assert.Equal(len(wrp.MustEncode(&fromServer, wrp.Msgpack)), metrics.received)
+}
+
+func TestEndToEndMaxReconnects(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// The server isn't started yet, so every attempt fails.
+	s := httptest.NewUnstartedServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.CloseNow()
+
+				_, _, _ = c.Read(r.Context())
+			}))
+	defer s.Close()
+
+	var (
+		attempts     atomic.Int64
+		connected    = make(chan struct{}, 1)
+		disconnected = make(chan event.Disconnect, 10)
+	)
+	got, err := ws.New(
+		ws.FetchURL(func(context.Context) (string, error) {
+			if s.URL == "" {
+				return "", fmt.Errorf("no url")
+			}
+			return s.URL, nil
+		}),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connected <- struct{}{}
+						return
+					}
+					attempts.Add(1)
+				})),
+		ws.AddDisconnectListener(
+			event.DisconnectListenerFunc(
+				func(e event.Disconnect) {
+					disconnected <- e
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.MaxReconnects(2),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+
+	select {
+	case e := <-disconnected:
+		assert.ErrorIs(e.Err, ws.ErrMaxReconnectsExceeded)
+	case <-time.After(2 * time.Second):
+		assert.Fail("timed out waiting for the disconnect")
+	}
+
+	// Exactly the 2 allowed attempts are made.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(int64(2), attempts.Load())
+	assert.Empty(disconnected)
+
+	// Once it gave up, the websocket can be started again.
+	s.Start()
+	got.Start()
+	defer got.Stop()
+
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		assert.Fail("timed out waiting for the connection after a restart")
+	}
+	assert.Equal(int64(2), attempts.Load())
+}
+
+func TestEndToEndProxyConfig(t *testing.T) {
+	const (
+		user = "user"
+		pass = "secret"
+	)
+
+	tests := []struct {
+		description string
+		user, pass  string
+		connected   bool
+	}{
+		{
+			description: "valid proxy credentials",
+			user:        user,
+			pass:        pass,
+			connected:   true,
+		}, {
+			description: "invalid proxy credentials",
+			user:        user,
+			pass:        "wrong",
+		}, {
+			description: "no proxy credentials",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			s := httptest.NewTLSServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						c, err := websocket.Accept(w, r, nil)
+						require.NoError(err)
+						defer c.CloseNow()
+
+						_, _, _ = c.Read(r.Context())
+					}))
+			defer s.Close()
+
+			// A CONNECT proxy that requires basic auth.
+			var proxied atomic.Int64
+			proxy := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						u, p, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+						if r.Method != http.MethodConnect || !ok || u != user || p != pass {
+							w.WriteHeader(http.StatusProxyAuthRequired)
+							return
+						}
+
+						upstream, err := net.Dial("tcp", r.Host)
+						if err != nil {
+							w.WriteHeader(http.StatusBadGateway)
+							return
+						}
+						defer upstream.Close()
+
+						w.WriteHeader(http.StatusOK)
+						downstream, _, err := http.NewResponseController(w).Hijack()
+						if err != nil {
+							return
+						}
+						defer downstream.Close()
+						proxied.Add(1)
+
+						go func() {
+							_, _ = io.Copy(upstream, downstream)
+						}()
+						_, _ = io.Copy(downstream, upstream)
+					}))
+			defer proxy.Close()
+
+			connected := make(chan event.Connect, 10)
+			got, err := ws.New(
+				ws.URL(s.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: time.Second,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+				ws.CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.HTTPClient(arrangehttp.ClientConfig{
+					Timeout: time.Second,
+					TLS: &arrangetls.Config{
+						InsecureSkipVerify: true,
+					},
+				}),
+				ws.ProxyConfig(proxy.URL, tc.user, tc.pass),
+			)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			select {
+			case e := <-connected:
+				if tc.connected {
+					assert.NoError(e.Err)
+					assert.Equal(int64(1), proxied.Load())
+				} else {
+					assert.Error(e.Err)
+					assert.Zero(proxied.Load())
+				}
+			case <-time.After(2 * time.Second):
+				assert.Fail("timed out waiting for the connection attempt")
+			}
+		})
+	}
+}
+
+func parseProxyAuth(auth string) (user, pass string, ok bool) {
+	r := http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	return r.BasicAuth()
+}
+
+func TestEndToEndPinnedCerts(t *testing.T) {
+	s := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.CloseNow()
+
+				_, _, _ = c.Read(r.Context())
+			}))
+	defer s.Close()
+
+	sum := sha256.Sum256(s.Certificate().Raw)
+	match := hex.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("some other certificate"))
+
+	tests := []struct {
+		description string
+		pins        []string
+		expectedErr error
+	}{
+		{
+			description: "matching pin",
+			pins:        []string{hex.EncodeToString(other[:]), strings.ToUpper(match)},
+		}, {
+			description: "non-matching pin",
+			pins:        []string{hex.EncodeToString(other[:])},
+			expectedErr: ws.ErrPinMismatch,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			connected := make(chan event.Connect, 10)
+			got, err := ws.New(
+				ws.URL(s.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: time.Second,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+				ws.CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+				// The test server's certificate isn't signed by a trusted CA,
+				// so only the pin is verified.
+				ws.HTTPClient(arrangehttp.ClientConfig{
+					Timeout: time.Second,
+					TLS: &arrangetls.Config{
+						InsecureSkipVerify: true,
+					},
+				}),
+				ws.PinnedCerts(tc.pins...),
+			)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			select {
+			case e := <-connected:
+				if tc.expectedErr != nil {
+					assert.ErrorIs(e.Err, tc.expectedErr)
+				} else {
+					assert.NoError(e.Err)
+				}
+			case <-time.After(2 * time.Second):
+				assert.Fail("timed out waiting for the connection attempt")
+			}
+		})
+	}
+}
+
+func TestEndToEndInsecureSkipTLSVerify(t *testing.T) {
+	s := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.CloseNow()
+
+				_, _, _ = c.Read(r.Context())
+			}))
+	defer s.Close()
+
+	tests := []struct {
+		description string
+		skip        bool
+		expectErr   bool
+	}{
+		{
+			description: "verification skipped",
+			skip:        true,
+		}, {
+			description: "self-signed certificate rejected",
+			expectErr:   true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			connected := make(chan event.Connect, 10)
+			got, err := ws.New(
+				ws.URL(s.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: time.Second,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+				ws.CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.HTTPClient(arrangehttp.ClientConfig{
+					Timeout: time.Second,
+				}),
+				ws.InsecureSkipTLSVerify(tc.skip),
+			)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			select {
+			case e := <-connected:
+				if tc.expectErr {
+					var unknown x509.UnknownAuthorityError
+					assert.ErrorAs(e.Err, &unknown)
+				} else {
+					assert.NoError(e.Err)
+				}
+			case <-time.After(2 * time.Second):
+				assert.Fail("timed out waiting for the connection attempt")
+			}
+		})
+	}
+}
+
+func TestEndToEndALPNProtocols(t *testing.T) {
+	tests := []struct {
+		description  string
+		serverProtos []string
+		opts         []ws.Option
+		offered      []string
+		negotiated   string
+		expectedErr  error
+	}{
+		{
+			// The test server only serves http/1.1.
+			description:  "offered and negotiated",
+			serverProtos: []string{"http/1.1"},
+			opts: []ws.Option{
+				ws.ALPNProtocols([]string{"edge/1", "http/1.1"}),
+				ws.RequireALPN(),
+			},
+			offered:    []string{"edge/1", "http/1.1"},
+			negotiated: "http/1.1",
+		}, {
+			description: "nothing negotiated is accepted",
+			opts: []ws.Option{
+				ws.ALPNProtocols([]string{"edge/1"}),
+			},
+			offered: []string{"edge/1"},
+		}, {
+			description: "nothing negotiated is rejected",
+			opts: []ws.Option{
+				ws.ALPNProtocols([]string{"edge/1"}),
+				ws.RequireALPN(),
+			},
+			offered:     []string{"edge/1"},
+			expectedErr: ws.ErrALPNMismatch,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			negotiated := make(chan string, 10)
+			s := httptest.NewUnstartedServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						select {
+						case negotiated <- r.TLS.NegotiatedProtocol:
+						default:
+						}
+
+						c, err := websocket.Accept(w, r, nil)
+						if err != nil {
+							return
+						}
+						defer c.CloseNow()
+
+						_, _, _ = c.Read(r.Context())
+					}))
+
+			offered := make(chan []string, 10)
+			s.TLS = &tls.Config{
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					select {
+					case offered <- hello.SupportedProtos:
+					default:
+					}
+
+					cfg := s.TLS.Clone()
+					cfg.GetConfigForClient = nil
+					cfg.NextProtos = tc.serverProtos
+					return cfg, nil
+				},
+			}
+			s.StartTLS()
+			defer s.Close()
+
+			connected := make(chan event.Connect, 10)
+			got, err := ws.New(append([]ws.Option{
+				ws.URL(s.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: time.Second,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30 * time.Second),
+				ws.MaxMessageBytes(256 * 1024),
+				ws.CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.HTTPClient(arrangehttp.ClientConfig{
+					Timeout: time.Second,
+				}),
+				ws.InsecureSkipTLSVerify(true),
+			}, tc.opts...)...)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			select {
+			case e := <-connected:
+				if tc.expectedErr != nil {
+					assert.ErrorIs(e.Err, tc.expectedErr)
+				} else {
+					assert.NoError(e.Err)
+				}
+			case <-time.After(2 * time.Second):
+				require.FailNow("timed out waiting for the connection attempt")
+			}
+
+			select {
+			case protos := <-offered:
+				assert.Equal(tc.offered, protos)
+			default:
+				assert.Fail("no TLS handshake was made")
+			}
+
+			if tc.expectedErr == nil {
+				select {
+				case proto := <-negotiated:
+					assert.Equal(tc.negotiated, proto)
+				case <-time.After(2 * time.Second):
+					assert.Fail("timed out waiting for the upgrade request")
+				}
+			}
+		})
+	}
+}
+
+func TestEndToEndHappyEyeballs(t *testing.T) {
+	tests := []struct {
+		description string
+		opts        []ws.Option
+		failures    bool
+	}{
+		{
+			description: "racing always uses the working stack",
+			opts:        []ws.Option{ws.HappyEyeballs(time.Second)},
+		}, {
+			description: "alternating wastes attempts on the dead stack",
+			failures:    true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			// The server only listens on IPv4, so the IPv6 stack is dead.
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			require.NoError(err)
+
+			// Close every connection right away to force reconnects.
+			s := httptest.NewUnstartedServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						c, err := websocket.Accept(w, r, nil)
+						if err != nil {
+							return
+						}
+						c.Close(websocket.StatusNormalClosure, "")
+					}))
+			s.Listener = l
+			s.Start()
+			defer s.Close()
+
+			_, port, err := net.SplitHostPort(l.Addr().String())
+			require.NoError(err)
+
+			connected := make(chan event.Connect, 100)
+			got, err := ws.New(append(tc.opts,
+				ws.URL("http://localhost:"+port),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: 10 * time.Millisecond,
+				}),
+				ws.WithIPv4(),
+				ws.WithIPv6(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+				ws.CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+			)...)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			var failures int
+			for i := 0; i < 4; i++ {
+				select {
+				case e := <-connected:
+					if e.Err != nil {
+						failures++
+						assert.Equal(event.IPv6, e.Mode)
+					} else {
+						assert.Equal(event.IPv4, e.Mode)
+					}
+				case <-time.After(2 * time.Second):
+					assert.Fail("timed out waiting for the connection attempts")
+					return
+				}
+			}
+
+			if tc.failures {
+				assert.NotZero(failures)
+			} else {
+				assert.Zero(failures)
+			}
+		})
+	}
+}
+
+// dnsServer is a DNS server that records the type of every question it is
+// asked and answers A questions with 127.0.0.1 and other questions with no
+// records.
+type dnsServer struct {
+	conn net.PacketConn
+
+	lock  sync.Mutex
+	types []dnsmessage.Type
+}
+
+func newDNSServer(t *testing.T) *dnsServer {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := dnsServer{conn: conn}
+	go s.serve()
+	t.Cleanup(func() { conn.Close() })
+
+	return &s
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) == 0 {
+			continue
+		}
+
+		q := req.Questions[0]
+		s.lock.Lock()
+		s.types = append(s.types, q.Type)
+		s.lock.Unlock()
+
+		resp := dnsmessage.Message{
+			Header: dnsmessage.Header{
+				ID:                 req.ID,
+				Response:           true,
+				Authoritative:      true,
+				RecursionAvailable: true,
+			},
+			Questions: req.Questions,
+		}
+		if q.Type == dnsmessage.TypeA {
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			}}
+		}
+
+		if msg, err := resp.Pack(); err == nil {
+			_, _ = s.conn.WriteTo(msg, addr)
+		}
+	}
+}
+
+// resolver returns a resolver that sends every lookup to the server.
+func (s *dnsServer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp4", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+// questions returns the types of the questions asked so far.
+func (s *dnsServer) questions() []dnsmessage.Type {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]dnsmessage.Type{}, s.types...)
+}
+
+func TestEndToEndIPv4OnlyLookups(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(err)
+
+	s := httptest.NewUnstartedServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				c.Close(websocket.StatusNormalClosure, "")
+			}))
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(err)
+
+	dns := newDNSServer(t)
+
+	connected := make(chan event.Connect, 10)
+	got, err := ws.New(
+		ws.URL("http://fabric.example.com:"+port),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					select {
+					case connected <- e:
+					default:
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.WithIPv6(false),
+		ws.Resolver(dns.resolver()),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	select {
+	case e := <-connected:
+		require.NoError(e.Err)
+		assert.Equal(event.IPv4, e.Mode)
+	case <-time.After(2 * time.Second):
+		require.Fail("timed out waiting for the connection")
+	}
+
+	questions := dns.questions()
+	require.NotEmpty(questions)
+	for _, q := range questions {
+		assert.Equal(dnsmessage.TypeA, q)
+	}
+}
+
+func TestEndToEndStickyIPMode(t *testing.T) {
+	// attempt is the mode of a connection attempt and whether it connected.
+	type attempt struct {
+		mode      event.IPMode
+		connected bool
+	}
+
+	tests := []struct {
+		description string
+		opts        []ws.Option
+		expected    []attempt
+	}{
+		{
+			description: "alternating",
+			expected: []attempt{
+				{event.IPv4, false},
+				{event.IPv6, false},
+				{event.IPv4, true},
+				{event.IPv6, false},
+				{event.IPv4, true},
+			},
+		}, {
+			description: "sticky",
+			opts:        []ws.Option{ws.StickyIPMode(true)},
+			expected: []attempt{
+				{event.IPv4, false},
+				{event.IPv6, false},
+				{event.IPv4, true},
+				{event.IPv4, true},
+				{event.IPv4, true},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			// The server only listens on IPv4, so the IPv6 stack is dead.
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			require.NoError(err)
+
+			// Reject the first attempt, then close every connection right
+			// away to force reconnects.
+			var requests atomic.Int64
+			s := httptest.NewUnstartedServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						if requests.Add(1) == 1 {
+							w.WriteHeader(http.StatusServiceUnavailable)
+							return
+						}
+						c, err := websocket.Accept(w, r, nil)
+						if err != nil {
+							return
+						}
+						c.Close(websocket.StatusNormalClosure, "")
+					}))
+			s.Listener = l
+			s.Start()
+			defer s.Close()
+
+			_, port, err := net.SplitHostPort(l.Addr().String())
+			require.NoError(err)
+
+			connected := make(chan event.Connect, 100)
+			got, err := ws.New(append(tc.opts,
+				ws.URL("http://localhost:"+port),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: 10 * time.Millisecond,
+				}),
+				ws.WithIPv4(),
+				ws.WithIPv6(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+				ws.CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ws.ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+			)...)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			var attempts []attempt
+			for range tc.expected {
+				select {
+				case e := <-connected:
+					attempts = append(attempts, attempt{mode: e.Mode, connected: e.Err == nil})
+				case <-time.After(2 * time.Second):
+					assert.Fail("timed out waiting for the connection attempts")
+					return
+				}
+			}
+
+			assert.Equal(tc.expected, attempts)
+		})
+	}
+}
+
+func TestEndToEndModeSwitch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Nothing listens on the port, so every attempt fails right away.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(err)
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(err)
+	require.NoError(l.Close())
+
+	switches := make(chan event.ModeSwitch, 100)
+	got, err := ws.New(
+		ws.URL("http://localhost:"+port),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddModeSwitchListener(
+			event.ModeSwitchListenerFunc(
+				func(e event.ModeSwitch) {
+					select {
+					case switches <- e:
+					default:
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.WithIPv6(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	// The first attempt uses IPv4, then the modes alternate.
+	from := event.IPv4
+	for i := 0; i < 4; i++ {
+		select {
+		case e := <-switches:
+			to := event.IPv6
+			if from == event.IPv6 {
+				to = event.IPv4
+			}
+			assert.Equal(from, e.From)
+			assert.Equal(to, e.To)
+			assert.Error(e.PriorErr)
+			assert.False(e.At.IsZero())
+			from = to
+		case <-time.After(2 * time.Second):
+			assert.Fail("timed out waiting for the mode switches")
+			return
+		}
+	}
+}
+
+func TestEndToEndConnectionState(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	closeConn := make(chan struct{})
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				select {
+				case <-closeConn:
+					c.Close(websocket.StatusNormalClosure, "")
+				case <-r.Context().Done():
+				}
+			}))
+	defer s.Close()
+
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	got, err := ws.New(
+		ws.FetchURL(func(ctx context.Context) (string, error) {
+			// Hold the first attempt so the connecting state is observable.
+			once.Do(func() {
+				close(fetching)
+				<-release
+			})
+			return s.URL, nil
+		}),
+		ws.DeviceID("mac:112233445566"),
+		// Long enough that the test finishes before a reconnect.
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Second,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.SendTimeout(time.Second),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	msg := wrp.Message{
+		Type:   wrp.SimpleEventMessageType,
+		Source: "client",
+	}
+
+	assert.Equal(ws.Disconnected, got.ConnectionState())
+	assert.ErrorIs(got.Send(context.Background(), msg), ws.ErrClosed)
+
+	got.Start()
+	defer got.Stop()
+
+	<-fetching
+	assert.Equal(ws.Connecting, got.ConnectionState())
+	assert.ErrorIs(got.Send(context.Background(), msg), ws.ErrClosed)
+	close(release)
+
+	require.Eventually(func() bool {
+		return got.ConnectionState() == ws.Connected
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(s.URL, got.URL())
+	assert.NoError(got.Send(context.Background(), msg))
+
+	close(closeConn)
+	require.Eventually(func() bool {
+		return got.ConnectionState() == ws.Disconnected
+	}, time.Second, 10*time.Millisecond)
+	assert.ErrorIs(got.Send(context.Background(), msg), ws.ErrClosed)
+}
+
+func TestEndToEndEncoding(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	received := make(chan wrp.Message, 1)
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+				defer cancel()
+
+				msg := wrp.Message{
+					Type:   wrp.SimpleEventMessageType,
+					Source: "server",
+				}
+				err = c.Write(ctx, websocket.MessageText, wrp.MustEncode(&msg, wrp.JSON))
+				require.NoError(err)
+
+				mt, got, err := c.Read(ctx)
+				require.NoError(err)
+				require.Equal(websocket.MessageText, mt)
+
+				var reply wrp.Message
+				require.NoError(wrp.NewDecoderBytes(got, wrp.JSON).Decode(&reply))
+				received <- reply
+
+				c.Close(websocket.StatusNormalClosure, "")
+			}))
+	defer s.Close()
+
+	msgs := make(chan wrp.Message, 1)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.Encoding(wrp.JSON),
+		ws.AddMessageListener(
+			event.MsgListenerFunc(
+				func(m wrp.Message) {
+					msgs <- m
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Second,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.SendTimeout(time.Second),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	select {
+	case m := <-msgs:
+		assert.Equal(wrp.SimpleEventMessageType, m.Type)
+		assert.Equal("server", m.Source)
+	case <-time.After(time.Second):
+		require.Fail("timed out waiting for the server message")
+	}
+
+	require.NoError(got.Send(context.Background(),
+		wrp.Message{
+			Type:   wrp.SimpleEventMessageType,
+			Source: "client",
+		}))
+
+	select {
+	case m := <-received:
+		assert.Equal(wrp.SimpleEventMessageType, m.Type)
+		assert.Equal("client", m.Source)
+	case <-time.After(time.Second):
+		require.Fail("timed out waiting for the client message")
+	}
+}
+
+// TestEndToEndStartSendStop is a regression test, run it with -race.
+func TestEndToEndStartSendStop(t *testing.T) {
+	require := require.New(t)
+
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.CloseNow()
+
+				for {
+					if _, _, err := c.Read(r.Context()); err != nil {
+						return
+					}
+				}
+			}))
+	defer s.Close()
+
+	for i := 0; i < 20; i++ {
+		connected := make(chan struct{}, 1)
+		got, err := ws.New(
+			ws.URL(s.URL),
+			ws.DeviceID("mac:112233445566"),
+			ws.AddConnectListener(
+				event.ConnectListenerFunc(
+					func(e event.Connect) {
+						if e.Err == nil {
+							select {
+							case connected <- struct{}{}:
+							default:
+							}
+						}
+					})),
+			ws.RetryPolicy(&retry.Config{
+				Interval: time.Millisecond,
+			}),
+			ws.WithIPv4(),
+			ws.NowFunc(time.Now),
+			ws.SendTimeout(time.Second),
+			ws.SendQueueDepth(i%2),
+			ws.FetchURLTimeout(30*time.Second),
+			ws.MaxMessageBytes(256*1024),
+			ws.CredentialsDecorator(func(h http.Header) error {
+				return nil
+			}),
+			ws.ConveyDecorator(func(h http.Header) error {
+				return nil
+			}),
+		)
+		require.NoError(err)
+
+		got.Start()
+		select {
+		case <-connected:
+		case <-time.After(time.Second):
+			require.Fail("timed out waiting for the connection")
+		}
+
+		_ = got.Send(context.Background(),
+			wrp.Message{
+				Type:   wrp.SimpleEventMessageType,
+				Source: "client",
+			})
+
+		got.Stop()
+		require.Equal(ws.Disconnected, got.ConnectionState())
+		require.ErrorIs(got.Send(context.Background(), wrp.Message{}), ws.ErrClosed)
+	}
+}
+
+func TestEndToEndShutdownContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.CloseNow()
+
+				for {
+					if _, _, err := c.Read(r.Context()); err != nil {
+						return
+					}
+				}
+			}))
+	defer s.Close()
+
+	var connects atomic.Int64
+	ctx, cancel := context.WithCancel(context.Background())
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connects.Add(1)
+					}
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: time.Millisecond,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ShutdownContext(ctx),
+	)
+	require.NoError(err)
+
+	got.Start()
+	defer got.Stop()
+
+	require.Eventually(func() bool {
+		return connects.Load() == 1
+	}, time.Second, time.Millisecond)
+
+	// Canceling the shutdown context drops the connection without calling Stop.
+	cancel()
+	require.Eventually(func() bool {
+		return got.ConnectionState() == ws.Disconnected
+	}, time.Second, time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(int64(1), connects.Load())
+}
+
+func TestEndToEndSendFailure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	done := make(chan struct{})
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				// Never read, so large writes stall until they time out.
+				select {
+				case <-done:
+				case <-r.Context().Done():
+				}
+			}))
+	defer s.Close()
+	defer close(done)
+
+	connected := make(chan struct{}, 1)
+	failures := make(chan event.SendFailure, 1)
+	got, err := ws.New(
+		ws.URL(s.URL),
+		ws.DeviceID("mac:112233445566"),
+		ws.AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connected <- struct{}{}
+					}
+				})),
+		ws.AddSendFailureListener(
+			event.SendFailureListenerFunc(
+				func(e event.SendFailure) {
+					failures <- e
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: 10 * time.Second,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.SendTimeout(100*time.Millisecond),
+		ws.FetchURLTimeout(30*time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ws.ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		require.Fail("timed out waiting for the connection")
+	}
+
+	msg := wrp.Message{
+		Type:            wrp.SimpleRequestResponseMessageType,
+		Source:          "mac:112233445566/service",
+		Destination:     "event:device-status/mac:112233445566",
+		TransactionUUID: "15f04fb5-6ac3-4217-a8b3-2ad768a5d277",
+		// Larger than the socket buffers.
+		Payload: make([]byte, 64*1024*1024),
+	}
+	err = got.Send(context.Background(), msg)
+	require.Error(err)
+
+	select {
+	case e := <-failures:
+		assert.Equal(msg.TransactionUUID, e.TransactionUUID)
+		assert.Equal(msg.Destination, e.Destination)
+		// The write times out, which closes the connection.
+		assert.Equal(err, e.Err)
+		assert.False(e.At.IsZero())
+	case <-time.After(time.Second):
+		require.Fail("timed out waiting for the send failure")
+	}
+}
+
+func TestEndToEndSubprotocols(t *testing.T) {
+	tests := []struct {
+		description string
+		accept      []string
+		expectedErr error
+	}{
+		{
+			description: "negotiated",
+			accept:      []string{"wrp-0.1"},
+		}, {
+			description: "not negotiated",
+			expectedErr: ws.ErrSubprotocolMismatch,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			offered := make(chan string, 1)
+			s := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						select {
+						case offered <- r.Header.Get("Sec-WebSocket-Protocol"):
+						default:
+						}
+
+						c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+							Subprotocols: tc.accept,
+						})
+						if err != nil {
+							return
+						}
+						defer c.CloseNow()
+
+						_, _, _ = c.Read(r.Context())
+					}))
+			defer s.Close()
+
+			connects := make(chan event.Connect, 1)
+			got, err := ws.New(
+				ws.URL(s.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.Subprotocols([]string{"wrp-0.2", "wrp-0.1"}),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connects <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: 10 * time.Second,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+			)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			select {
+			case e := <-connects:
+				assert.ErrorIs(e.Err, tc.expectedErr)
+			case <-time.After(time.Second):
+				require.Fail("timed out waiting for the connect event")
+			}
+
+			assert.Equal("wrp-0.2,wrp-0.1", <-offered)
+		})
+	}
+}
+
+func TestEndToEndCloseRedirect(t *testing.T) {
+	tests := []struct {
+		description string
+		opts        []ws.Option
+		redirected  bool
+	}{
+		{
+			description: "redirect hint followed",
+			opts: []ws.Option{
+				ws.CloseRedirect(ws.ParseCloseRedirect),
+			},
+			redirected: true,
+		}, {
+			description: "redirect hint ignored",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var hinted atomic.Int64
+			hintedServer := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						c, err := websocket.Accept(w, r, nil)
+						require.NoError(err)
+						defer c.CloseNow()
+
+						hinted.Add(1)
+						c.Close(websocket.StatusNormalClosure, "")
+					}))
+			defer hintedServer.Close()
+
+			var primary atomic.Int64
+			primaryServer := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						c, err := websocket.Accept(w, r, nil)
+						require.NoError(err)
+						defer c.CloseNow()
+
+						primary.Add(1)
+						reason := fmt.Sprintf(`{"redirect":"%s"}`, hintedServer.URL)
+						c.Close(websocket.StatusTryAgainLater, reason)
+					}))
+			defer primaryServer.Close()
+
+			opts := append([]ws.Option{
+				ws.URL(primaryServer.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.RetryPolicy(&retry.Config{
+					Interval: 10 * time.Millisecond,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30 * time.Second),
+				ws.MaxMessageBytes(256 * 1024),
+			}, tc.opts...)
+			got, err := ws.New(opts...)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			if tc.redirected {
+				// The hint only applies to the next dial, so the client
+				// alternates between the two servers.
+				require.Eventually(func() bool {
+					return hinted.Load() >= 2 && primary.Load() >= 2
+				}, 2*time.Second, 10*time.Millisecond)
+				return
+			}
+
+			require.Eventually(func() bool {
+				return primary.Load() >= 3
+			}, 2*time.Second, 10*time.Millisecond)
+			assert.Zero(hinted.Load())
+		})
+	}
+}
+
+// pipeListener is a net.Listener that accepts the server ends of in-memory
+// pipes created by its conn factory.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+func (l *pipeListener) factory(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestEndToEndConnFactory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fromServer := wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "server",
+		Destination: "mac:112233445566",
+	}
+	fromClient := wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "mac:112233445566",
+		Destination: "server",
+	}
+
+	received := make(chan wrp.Message, 1)
+	l := newPipeListener()
+	s := http.Server{
+		Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal("mac:112233445566", r.Header.Get("X-Webpa-Device-Name"))
+
+				c, err := websocket.Accept(w, r, nil)
+				require.NoError(err)
+				defer c.CloseNow()
+
+				err = c.Write(r.Context(), websocket.MessageBinary, wrp.MustEncode(&fromServer, wrp.Msgpack))
+				require.NoError(err)
+
+				_, data, err := c.Read(r.Context())
+				require.NoError(err)
+
+				var msg wrp.Message
+				require.NoError(wrp.NewDecoderBytes(data, wrp.Msgpack).Decode(&msg))
+				received <- msg
+
+				c.Close(websocket.StatusNormalClosure, "")
+			}),
+		ReadHeaderTimeout: time.Second,
+	}
+	go func() {
+		_ = s.Serve(l)
+	}()
+	defer s.Close()
+
+	msgs := make(chan wrp.Message, 1)
+	got, err := ws.New(
+		ws.URL("ws://pipe/api/v2/device"),
+		ws.DeviceID("mac:112233445566"),
+		ws.ConnFactory(l.factory),
+		ws.AddMessageListener(
+			event.MsgListenerFunc(
+				func(m wrp.Message) {
+					msgs <- m
+				})),
+		ws.RetryPolicy(&retry.Config{
+			Interval: time.Second,
+		}),
+		ws.WithIPv4(),
+		ws.NowFunc(time.Now),
+		ws.SendTimeout(time.Second),
+		ws.MaxMessageBytes(256*1024),
+		ws.Once(),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	got.Start()
+	defer got.Stop()
+
+	select {
+	case m := <-msgs:
+		assert.Equal(fromServer, m)
+	case <-time.After(2 * time.Second):
+		require.Fail("timed out waiting for the server message")
+	}
+
+	require.NoError(got.Send(context.Background(), fromClient))
+
+	select {
+	case m := <-received:
+		assert.Equal(fromClient, m)
+	case <-time.After(2 * time.Second):
+		require.Fail("timed out waiting for the client message")
+	}
+}
+
+func TestEndToEndMaxHeaderBytes(t *testing.T) {
+	tests := []struct {
+		description string
+		header      int
+		rejected    bool
+	}{
+		{
+			description: "headers within the limit",
+			header:      512,
+		}, {
+			description: "oversized headers",
+			header:      64 * 1024,
+			rejected:    true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			s := httptest.NewServer(
+				http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("X-Padding", strings.Repeat("a", tc.header))
+						c, err := websocket.Accept(w, r, nil)
+						if err != nil {
+							return
+						}
+						defer c.CloseNow()
+
+						_, _, _ = c.Read(r.Context())
+					}))
+			defer s.Close()
+
+			connected := make(chan event.Connect, 10)
+			got, err := ws.New(
+				ws.URL(s.URL),
+				ws.DeviceID("mac:112233445566"),
+				ws.AddConnectListener(
+					event.ConnectListenerFunc(
+						func(e event.Connect) {
+							select {
+							case connected <- e:
+							default:
+							}
+						})),
+				ws.RetryPolicy(&retry.Config{
+					Interval: time.Second,
+				}),
+				ws.WithIPv4(),
+				ws.NowFunc(time.Now),
+				ws.FetchURLTimeout(30*time.Second),
+				ws.MaxMessageBytes(256*1024),
+				ws.MaxHeaderBytes(4096),
+			)
+			require.NoError(err)
+			require.NotNil(got)
+
+			got.Start()
+			defer got.Stop()
+
+			select {
+			case e := <-connected:
+				if tc.rejected {
+					assert.Error(e.Err)
+					assert.Equal(ws.Disconnected, got.ConnectionState())
+					return
+				}
+				assert.NoError(e.Err)
+			case <-time.After(2 * time.Second):
+				assert.Fail("timed out waiting for the connection")
+			}
+		})
+	}
+}
@@ -44,6 +44,10 @@ type Connect struct {
 
 	// Error is the error returned from the attempt to connect.
 	Err error
+
+	// Compressed is true if the server accepted permessage-deflate
+	// compression for the connection.
+	Compressed bool
 }
 
 func (c Connect) String() string {
@@ -55,6 +59,9 @@ func (c Connect) String() string {
 	if !c.RetryingAt.IsZero() {
 		fmt.Fprintf(&buf, "  RetryingAt: %s\n", c.RetryingAt.Format(time.RFC3339Nano))
 	}
+	if c.Compressed {
+		fmt.Fprintf(&buf, "  Compressed: %t\n", c.Compressed)
+	}
 	if c.Err != nil {
 		fmt.Fprintf(&buf, "  Err:        %s\n", c.Err)
 	}
@@ -110,6 +117,14 @@ type Disconnect struct {
 
 	// Error is the error returned from the disconnection.
 	Err error
+
+	// Code is the WebSocket close status code sent by the server.  It is zero
+	// if the disconnection was not initiated by the server.
+	Code int
+
+	// Reason is the close reason sent by the server.  It is empty if the
+	// disconnection was not initiated by the server.
+	Reason string
 }
 
 // DisconnectListener is the interface that must be implemented by types that
@@ -141,3 +156,152 @@ type MsgListenerFunc func(wrp.Message)
 func (f MsgListenerFunc) OnMessage(m wrp.Message) {
 	f(m)
 }
+
+// SendFailure is the event that is sent when a message could not be written
+// to the websocket, and was dropped.
+type SendFailure struct {
+	// At holds the time when the write failed.
+	At time.Time
+
+	// TransactionUUID is the transaction uuid of the dropped message.
+	TransactionUUID string
+
+	// Destination is the destination of the dropped message.
+	Destination string
+
+	// Err is the error returned from the write.
+	Err error
+}
+
+// SendFailureListener is the interface that must be implemented by types that
+// want to receive SendFailure notifications.
+type SendFailureListener interface {
+	OnSendFailure(SendFailure)
+}
+
+// SendFailureListenerFunc is a function type that implements
+// SendFailureListener.  It can be used as an adapter for functions that need to
+// implement the SendFailureListener interface.
+type SendFailureListenerFunc func(SendFailure)
+
+func (f SendFailureListenerFunc) OnSendFailure(s SendFailure) {
+	f(s)
+}
+
+// ModeSwitch is the event that is sent when a connection attempt uses a
+// different IP mode than the attempt before it.
+type ModeSwitch struct {
+	// At holds the time when the attempt using the new mode was started.
+	At time.Time
+
+	// From is the IP mode used by the prior attempt.
+	From IPMode
+
+	// To is the IP mode used by this attempt.
+	To IPMode
+
+	// PriorErr is the error returned from the prior attempt to connect, or
+	// nil if the prior attempt connected.
+	PriorErr error
+}
+
+// ModeSwitchListener is the interface that must be implemented by types that
+// want to receive ModeSwitch notifications.
+type ModeSwitchListener interface {
+	OnModeSwitch(ModeSwitch)
+}
+
+// ModeSwitchListenerFunc is a function type that implements
+// ModeSwitchListener.  It can be used as an adapter for functions that need to
+// implement the ModeSwitchListener interface.
+type ModeSwitchListenerFunc func(ModeSwitch)
+
+func (f ModeSwitchListenerFunc) OnModeSwitch(m ModeSwitch) {
+	f(m)
+}
+
+// Rotation is the event that is sent when a healthy connection is closed
+// because it reached the maximum connection lifetime.
+type Rotation struct {
+	// At holds the time when the connection was closed.
+	At time.Time
+
+	// Lifetime is how long the connection was up.
+	Lifetime time.Duration
+}
+
+// RotationListener is the interface that must be implemented by types that
+// want to receive Rotation notifications.
+type RotationListener interface {
+	OnRotation(Rotation)
+}
+
+// RotationListenerFunc is a function type that implements RotationListener.
+// It can be used as an adapter for functions that need to implement the
+// RotationListener interface.
+type RotationListenerFunc func(Rotation)
+
+func (f RotationListenerFunc) OnRotation(r Rotation) {
+	f(r)
+}
+
+// URLFallback is the event that is sent when fetching the url fails and the
+// backup url is used instead.
+type URLFallback struct {
+	// At holds the time when the fallback occurred.
+	At time.Time
+
+	// URL is the backup url now in use.
+	URL string
+
+	// Err is the error fetching the url.
+	Err error
+}
+
+// URLFallbackListener is the interface that must be implemented by types that
+// want to receive URLFallback notifications.
+type URLFallbackListener interface {
+	OnURLFallback(URLFallback)
+}
+
+// URLFallbackListenerFunc is a function type that implements
+// URLFallbackListener.  It can be used as an adapter for functions that need
+// to implement the URLFallbackListener interface.
+type URLFallbackListenerFunc func(URLFallback)
+
+func (f URLFallbackListenerFunc) OnURLFallback(u URLFallback) {
+	f(u)
+}
+
+// DecodeBackoff is the event that is sent when the connection is closed for a
+// malformed message too many times in a row, and the longer decode failure
+// backoff is used before reconnecting.
+type DecodeBackoff struct {
+	// At holds the time when the backoff started.
+	At time.Time
+
+	// Failures is the number of consecutive connections closed for a
+	// malformed message.
+	Failures int
+
+	// Backoff is how long to wait before reconnecting.
+	Backoff time.Duration
+
+	// Err is the error decoding the last malformed message.
+	Err error
+}
+
+// DecodeBackoffListener is the interface that must be implemented by types
+// that want to receive DecodeBackoff notifications.
+type DecodeBackoffListener interface {
+	OnDecodeBackoff(DecodeBackoff)
+}
+
+// DecodeBackoffListenerFunc is a function type that implements
+// DecodeBackoffListener.  It can be used as an adapter for functions that need
+// to implement the DecodeBackoffListener interface.
+type DecodeBackoffListenerFunc func(DecodeBackoff)
+
+func (f DecodeBackoffListenerFunc) OnDecodeBackoff(d DecodeBackoff) {
+	f(d)
+}
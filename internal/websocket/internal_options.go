@@ -5,6 +5,9 @@ package websocket
 
 import (
 	"fmt"
+	"slices"
+
+	"github.com/xmidt-org/wrp-go/v3"
 )
 
 func validateDeviceID() Option {
@@ -86,3 +89,13 @@ func validRetryPolicy() Option {
 			return nil
 		})
 }
+
+func validateEncoding() Option {
+	return optionFunc(
+		func(c *Websocket) error {
+			if !slices.Contains(wrp.AllFormats(), c.encoding) {
+				return fmt.Errorf("%w: unsupported Encoding %d", ErrMisconfiguredWS, c.encoding)
+			}
+			return nil
+		})
+}
@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	nhws "github.com/xmidt-org/xmidt-agent/internal/nhooyr.io/websocket"
+)
+
+// Disconnect reasons reported to Metrics.IncDisconnect.
+const (
+	DisconnectReasonClosed         = "closed"
+	DisconnectReasonInactivity     = "inactivity"
+	DisconnectReasonWatchdog       = "watchdog"
+	DisconnectReasonRotated        = "rotated"
+	DisconnectReasonInvalidMessage = "invalid_message"
+	DisconnectReasonError          = "error"
+)
+
+// Metrics is the interface implemented by types that collect operational
+// telemetry for the WS connection.  The methods are called synchronously, so
+// they should not block.
+type Metrics interface {
+	// IncConnectAttempt is called before every connection attempt.
+	IncConnectAttempt()
+
+	// IncConnectSuccess is called when a connection attempt succeeds.
+	IncConnectSuccess()
+
+	// IncDisconnect is called when an established connection is lost, with
+	// one of the DisconnectReason values.
+	IncDisconnect(reason string)
+
+	// ObserveSentBytes is called with the size of each message written.
+	ObserveSentBytes(n int)
+
+	// ObserveReceivedBytes is called with the size of each message read.
+	ObserveReceivedBytes(n int)
+}
+
+// nopMetrics is the default Metrics that discards everything.
+type nopMetrics struct{}
+
+func (nopMetrics) IncConnectAttempt()       {}
+func (nopMetrics) IncConnectSuccess()       {}
+func (nopMetrics) IncDisconnect(string)     {}
+func (nopMetrics) ObserveSentBytes(int)     {}
+func (nopMetrics) ObserveReceivedBytes(int) {}
+
+// disconnectReason classifies the error that ended a connection.
+func disconnectReason(err error) string {
+	var closeErr nhws.CloseError
+	switch {
+	case errors.As(err, &closeErr):
+		return DisconnectReasonClosed
+	case errors.Is(err, ErrWatchdogTimeout):
+		return DisconnectReasonWatchdog
+	case errors.Is(err, ErrRotated):
+		return DisconnectReasonRotated
+	case errors.Is(err, context.DeadlineExceeded):
+		return DisconnectReasonInactivity
+	case errors.Is(err, ErrInvalidMsgType):
+		return DisconnectReasonInvalidMessage
+	}
+
+	return DisconnectReasonError
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
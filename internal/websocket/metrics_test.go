@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/xmidt-agent/internal/nhooyr.io/websocket"
+)
+
+func TestDisconnectReason(t *testing.T) {
+	tests := []struct {
+		description string
+		err         error
+		expected    string
+	}{
+		{
+			description: "closed by the server",
+			err:         errors.Join(errUnknown, websocket.CloseError{Code: websocket.StatusPolicyViolation}),
+			expected:    DisconnectReasonClosed,
+		}, {
+			description: "watchdog",
+			err:         ErrWatchdogTimeout,
+			expected:    DisconnectReasonWatchdog,
+		}, {
+			description: "rotated",
+			err:         errors.Join(errUnknown, ErrRotated),
+			expected:    DisconnectReasonRotated,
+		}, {
+			description: "inactivity",
+			err:         errors.Join(errUnknown, context.DeadlineExceeded),
+			expected:    DisconnectReasonInactivity,
+		}, {
+			description: "invalid message",
+			err:         ErrInvalidMsgType,
+			expected:    DisconnectReasonInvalidMessage,
+		}, {
+			description: "other",
+			err:         errUnknown,
+			expected:    DisconnectReasonError,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.Equal(t, tc.expected, disconnectReason(tc.err))
+		})
+	}
+}
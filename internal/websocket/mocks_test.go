@@ -22,6 +22,22 @@ func (m *MockListeners) OnDisconnect(e event.Disconnect) {
 	m.Called(e)
 }
 
+func (m *MockListeners) OnModeSwitch(e event.ModeSwitch) {
+	m.Called(e)
+}
+
+func (m *MockListeners) OnRotation(e event.Rotation) {
+	m.Called(e)
+}
+
+func (m *MockListeners) OnURLFallback(e event.URLFallback) {
+	m.Called(e)
+}
+
+func (m *MockListeners) OnDecodeBackoff(e event.DecodeBackoff) {
+	m.Called(e)
+}
+
 func (m *MockListeners) OnHeartbeat(e event.Heartbeat) {
 	m.Called(e)
 }
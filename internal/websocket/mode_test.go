@@ -33,3 +33,10 @@ func Test_ipMode_ToEvent(t *testing.T) {
 		})
 	}
 }
+
+func TestStateString(t *testing.T) {
+	assert.Equal(t, "disconnected", Disconnected.String())
+	assert.Equal(t, "connecting", Connecting.String())
+	assert.Equal(t, "connected", Connected.String())
+	assert.Equal(t, "unknown", State(42).String())
+}
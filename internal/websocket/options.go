@@ -5,14 +5,24 @@ package websocket
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/xmidt-org/arrange/arrangehttp"
 	"github.com/xmidt-org/retry"
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/budget"
+	nhws "github.com/xmidt-org/xmidt-agent/internal/nhooyr.io/websocket"
 	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
 )
 
@@ -49,6 +59,21 @@ func URL(url string) Option {
 		})
 }
 
+// BackupURL sets the url used for the WS connection when the url fetcher
+// fails.  Each time it is used, the URLFallback listeners are called.  If this
+// is not set, a failed url fetch fails the connect attempt.
+func BackupURL(url string) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if url == "" {
+				return fmt.Errorf("%w: empty BackupURL", ErrMisconfiguredWS)
+			}
+
+			ws.backupURL = url
+			return nil
+		})
+}
+
 // FetchURL sets the FetchURL for the WS connection.
 func FetchURL(f func(context.Context) (string, error)) Option {
 	return optionFunc(
@@ -114,6 +139,38 @@ func InactivityTimeout(d time.Duration) Option {
 		})
 }
 
+// WatchdogTimeout sets the maximum time the WS connection may go without any
+// progress (received messages, pings or pongs) before a reconnect is forced.  This
+// is independent of the read loop, so a stalled read path or a message
+// listener that never returns is still detected; the connection is closed and
+// a fresh one is dialed.  If this is not set or is zero, the watchdog is disabled.
+func WatchdogTimeout(d time.Duration) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if d < 0 {
+				return fmt.Errorf("%w: negative WatchdogTimeout", ErrMisconfiguredWS)
+			}
+
+			ws.watchdogTimeout = d
+			return nil
+		})
+}
+
+// MaxConnectionLifetime sets the maximum time a WS connection is kept before it
+// is closed and reconnected, even if it is healthy.  A rotation event is sent
+// each time.  If this is not set or is zero, connections are kept indefinitely.
+func MaxConnectionLifetime(d time.Duration) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if d < 0 {
+				return fmt.Errorf("%w: negative MaxConnectionLifetime", ErrMisconfiguredWS)
+			}
+
+			ws.maxConnectionLifetime = d
+			return nil
+		})
+}
+
 // PingWriteTimeout sets the maximum time allowed between PINGs for the WS connection
 // before the connection is closed.  If this is not set, the default is 90 seconds.
 func PingWriteTimeout(d time.Duration) Option {
@@ -153,7 +210,9 @@ func WithIPv4(with ...bool) Option {
 		})
 }
 
-// WithIPv6 sets whether or not to allow IPv6 for the WS connection.  If this
+// WithIPv6 sets whether or not to allow IPv6 for the WS connection.  When
+// IPv6 is not allowed, only IPv4 (A) DNS lookups are made for the WS and proxy
+// hosts, so broken IPv6 (AAAA) resolution doesn't delay connecting.  If this
 // is not set, the default is true.
 func WithIPv6(with ...bool) Option {
 	with = append(with, true)
@@ -164,6 +223,49 @@ func WithIPv6(with ...bool) Option {
 		})
 }
 
+// Resolver sets the DNS resolver used to look up the WS and proxy hosts.  If
+// this is not set, net.DefaultResolver is used.
+func Resolver(r *net.Resolver) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if r == nil {
+				return fmt.Errorf("%w: nil Resolver", ErrMisconfiguredWS)
+			}
+
+			ws.resolver = r
+			return nil
+		})
+}
+
+// StickyIPMode sets whether the IP mode of the last successful connection is
+// used again for the next attempt, only alternating IP modes after a failed
+// attempt.  If this is not set, the default is false, alternating the IP modes
+// on every attempt.
+func StickyIPMode(sticky ...bool) Option {
+	sticky = append(sticky, true)
+	return optionFunc(
+		func(ws *Websocket) error {
+			ws.stickyIPMode = sticky[0]
+			return nil
+		})
+}
+
+// HappyEyeballs sets the delay between starting the IPv6 and IPv4 dials when
+// both are allowed.  The dials race and the first to connect is used; the
+// other is canceled.  The IPv4 dial starts early if the IPv6 dial fails.  If
+// this is not set or is zero, the IP modes are alternated across attempts.
+func HappyEyeballs(delay time.Duration) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if delay < 0 {
+				return fmt.Errorf("%w: negative HappyEyeballs delay", ErrMisconfiguredWS)
+			}
+
+			ws.happyEyeballsDelay = delay
+			return nil
+		})
+}
+
 // SendTimeout sets the send timeout for the WS connection.
 func SendTimeout(d time.Duration) Option {
 	return optionFunc(
@@ -177,6 +279,133 @@ func SendTimeout(d time.Duration) Option {
 		})
 }
 
+// Compression sets the permessage-deflate compression mode offered to the
+// server and the minimum size of a message before it is compressed.  A
+// threshold of zero uses the default for the mode.  Compression is only used
+// if the server accepts it.  If this is not set, compression is disabled.
+func Compression(mode nhws.CompressionMode, threshold int) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			switch mode {
+			case nhws.CompressionDisabled, nhws.CompressionContextTakeover, nhws.CompressionNoContextTakeover:
+			default:
+				return fmt.Errorf("%w: invalid Compression mode", ErrMisconfiguredWS)
+			}
+
+			if threshold < 0 {
+				return fmt.Errorf("%w: negative Compression threshold", ErrMisconfiguredWS)
+			}
+
+			ws.compressionMode = mode
+			ws.compressionThreshold = threshold
+			return nil
+		})
+}
+
+// CompressionSkipContentTypes sets the content types of messages that are
+// sent uncompressed because their payloads are already compressed.  Entries
+// are media types, such as `application/zip`, or `type/*` to match every
+// subtype.  Calling this with no types compresses every message.  If this is
+// not set, DefaultCompressionSkipContentTypes is used.
+func CompressionSkipContentTypes(types ...string) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			skip := make([]string, 0, len(types))
+			for _, t := range types {
+				mediaType, _, err := mime.ParseMediaType(t)
+				if err != nil {
+					return fmt.Errorf("%w: invalid CompressionSkipContentTypes entry '%s': %w",
+						ErrMisconfiguredWS, t, err)
+				}
+				skip = append(skip, mediaType)
+			}
+
+			ws.compressionSkipContentTypes = skip
+			return nil
+		})
+}
+
+// NormalizeURLScheme sets whether the urls from the url fetcher and close
+// redirects are validated before dialing.  Both websocket (ws, wss) and http
+// (http, https) schemes are accepted, with http schemes converted to their
+// websocket equivalents; any other scheme or a missing host fails the connect
+// attempt with ErrInvalidURL.  If this is not set, the default is false and
+// urls are dialed as is.
+func NormalizeURLScheme(normalize ...bool) Option {
+	normalize = append(normalize, true)
+	return optionFunc(
+		func(ws *Websocket) error {
+			ws.normalizeURLScheme = normalize[0]
+			return nil
+		})
+}
+
+// CloseRedirect sets the CloseRedirectFunc used to find a reconnect-elsewhere
+// hint in the close frame sent by the server.  When a hint is found, the next
+// dial targets the hinted url instead of the one from the url fetcher; later
+// dials use the url fetcher again.  ParseCloseRedirect handles JSON close
+// reasons.  If this is not set, close reasons are ignored.
+func CloseRedirect(f CloseRedirectFunc) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if f == nil {
+				return fmt.Errorf("%w: nil CloseRedirect", ErrMisconfiguredWS)
+			}
+
+			ws.closeRedirect = f
+			return nil
+		})
+}
+
+// ConnFactory sets the ConnFactoryFunc that provides the connection for each
+// connect attempt instead of dialing.  The websocket handshake is performed
+// over the returned connection using the url from the url fetcher, and the
+// HTTP client, IP mode, proxy and pinned certificate configuration are not
+// used.  This is intended for tests that exchange messages over an in-memory
+// connection.  If this is not set, connections are dialed.
+func ConnFactory(f ConnFactoryFunc) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if f == nil {
+				return fmt.Errorf("%w: nil ConnFactory", ErrMisconfiguredWS)
+			}
+
+			ws.connFactory = f
+			return nil
+		})
+}
+
+// WithMetrics sets the Metrics used to collect operational telemetry for the
+// WS connection.  If this is not set, no metrics are collected.
+func WithMetrics(m Metrics) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if m == nil {
+				return fmt.Errorf("%w: nil Metrics", ErrMisconfiguredWS)
+			}
+
+			ws.metrics = m
+			return nil
+		})
+}
+
+// SendQueueDepth sets the number of messages that may be queued for sending.
+// When set, Send queues messages for a dedicated writer goroutine and returns
+// ErrSendQueueFull instead of blocking when the queue is saturated.  Each
+// queued message is still subject to the SendTimeout.  If this is not set or
+// is zero, Send writes synchronously.
+func SendQueueDepth(n int) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if n < 0 {
+				return fmt.Errorf("%w: negative SendQueueDepth", ErrMisconfiguredWS)
+			}
+
+			ws.sendQueueDepth = n
+			return nil
+		})
+}
+
 // HTTPClient is the configuration for the HTTP client used for connection attempts.
 func HTTPClient(c arrangehttp.ClientConfig) Option {
 	return optionFunc(
@@ -211,6 +440,103 @@ func HTTPClientWithForceSets(c arrangehttp.ClientConfig) Option {
 		})
 }
 
+// InsecureSkipTLSVerify disables the verification of the server certificate
+// chain and host name, so a server with a self-signed certificate can be
+// used.  This is only meant for lab environments and must never be used in
+// production.  Pinned certificates are still verified.  The default is to
+// verify the server certificate.
+func InsecureSkipTLSVerify(skip bool) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			ws.insecureSkipTLSVerify = skip
+			return nil
+		})
+}
+
+// ALPNProtocols sets the ALPN protocols offered to the server in the TLS
+// handshake, in order of preference, for load balancers that route on them.
+// The websocket upgrade is always made over HTTP/1.1, so "h2" may not be
+// offered.  The protocols are not offered when connecting through a proxy.
+// If this is not set, no ALPN protocols are offered.
+func ALPNProtocols(protocols []string) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			for _, p := range protocols {
+				if p == "" || len(p) > 255 {
+					return fmt.Errorf("%w: invalid ALPN protocol '%s'", ErrMisconfiguredWS, p)
+				}
+				if p == "h2" {
+					return fmt.Errorf("%w: the ALPN protocol 'h2' can't be used for a websocket", ErrMisconfiguredWS)
+				}
+			}
+
+			ws.alpnProtocols = slices.Clone(protocols)
+			return nil
+		})
+}
+
+// RequireALPN fails the TLS handshake with ErrALPNMismatch unless the server
+// negotiated one of the ALPNProtocols.  Like ALPNProtocols, it has no effect
+// when connecting through a proxy.  If this is not set, the default is false and a server that
+// doesn't negotiate a protocol is accepted.
+func RequireALPN(require ...bool) Option {
+	require = append(require, true)
+	return optionFunc(
+		func(ws *Websocket) error {
+			ws.requireALPN = require[0]
+			return nil
+		})
+}
+
+// PinnedCerts sets the hex encoded SHA-256 fingerprints of the server leaf
+// certificates that are allowed.  The TLS handshake fails with ErrPinMismatch
+// if the server presents any other certificate.  If this is not set, no
+// certificate pinning is done.
+func PinnedCerts(fingerprints ...string) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			pins := make(map[string]struct{}, len(fingerprints))
+			for _, fp := range fingerprints {
+				fp = strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+				if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+					return fmt.Errorf("%w: invalid pinned certificate fingerprint '%s'", ErrMisconfiguredWS, fp)
+				}
+				pins[fp] = struct{}{}
+			}
+
+			ws.pinnedCerts = pins
+			return nil
+		})
+}
+
+// ProxyConfig sets a fixed proxy for the WS connection.  If user is not
+// empty, the user and pass are sent to the proxy using basic authentication
+// in the Proxy-Authorization header of the CONNECT request.  If this is not
+// set, the proxy is taken from the environment.
+func ProxyConfig(proxy string, user, pass string) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			u, err := url.Parse(proxy)
+			if err != nil {
+				return errors.Join(fmt.Errorf("%w: invalid proxy URL", ErrMisconfiguredWS), err)
+			}
+			if u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("%w: invalid proxy URL", ErrMisconfiguredWS)
+			}
+
+			ws.proxyURL = u
+			ws.proxyConnectHeader = nil
+			if user != "" {
+				auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+				ws.proxyConnectHeader = http.Header{
+					"Proxy-Authorization": []string{"Basic " + auth},
+				}
+			}
+
+			return nil
+		})
+}
+
 // AdditionalHeaders sets the additional headers for the WS connection.
 func AdditionalHeaders(headers http.Header) Option {
 	return optionFunc(
@@ -225,6 +551,24 @@ func AdditionalHeaders(headers http.Header) Option {
 		})
 }
 
+// Subprotocols sets the subprotocols offered to the server during the
+// handshake, in order of preference.  If set, the server must negotiate one of
+// them, otherwise the attempt fails with ErrSubprotocolMismatch and is
+// retried.
+func Subprotocols(protocols []string) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			for _, p := range protocols {
+				if p == "" || strings.ContainsAny(p, ", ") {
+					return fmt.Errorf("%w: invalid Subprotocol '%s'", ErrMisconfiguredWS, p)
+				}
+			}
+
+			ws.subprotocols = slices.Clone(protocols)
+			return nil
+		})
+}
+
 // Once sets whether or not to only attempt to connect once.
 func Once(once ...bool) Option {
 	once = append(once, true)
@@ -235,6 +579,87 @@ func Once(once ...bool) Option {
 		})
 }
 
+// MaxReconnects sets the number of consecutive failed connection attempts
+// allowed before the WS connection gives up.  Once reached, a final
+// disconnect event with ErrMaxReconnectsExceeded is sent, no further attempts
+// are made and Start may be called to try again.  If this is not set or is
+// zero, there is no limit.
+func MaxReconnects(n int) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if n < 0 {
+				return fmt.Errorf("%w: negative MaxReconnects", ErrMisconfiguredWS)
+			}
+
+			ws.maxReconnects = n
+			return nil
+		})
+}
+
+// DecodeFailureBackoff sets the number of consecutive connections that may be
+// closed for a malformed message (one that can't be decoded or has the wrong
+// message type) before waiting at least backoff to reconnect, so a server in
+// a bad state isn't hammered with reconnects.  Each time the backoff is used,
+// the DecodeBackoff listeners are called.  Failed connect attempts between the
+// connections don't reset the count.  If this is not set, there is no decode
+// failure backoff.
+func DecodeFailureBackoff(threshold int, backoff time.Duration) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if threshold < 1 || backoff <= 0 {
+				return fmt.Errorf("%w: DecodeFailureBackoff requires a positive threshold and backoff", ErrMisconfiguredWS)
+			}
+
+			ws.decodeFailureThreshold = threshold
+			ws.decodeFailureBackoff = backoff
+			return nil
+		})
+}
+
+// MinReconnectInterval sets the minimum time between the starts of consecutive
+// connection attempts, regardless of the retry policy.  This keeps a
+// connection that fails right after connecting from reconnecting in a tight
+// loop, since each successful connection resets the retry policy.  If this is
+// not set or is zero, there is no minimum.
+func MinReconnectInterval(d time.Duration) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if d < 0 {
+				return fmt.Errorf("%w: negative MinReconnectInterval", ErrMisconfiguredWS)
+			}
+
+			ws.minReconnectInterval = d
+			return nil
+		})
+}
+
+// RetryBudget sets the retry budget consulted before each connection attempt.
+// The budget may be shared with other components, such as the credentials
+// service, to bound the combined rate of network attempts.  If this is not set
+// or is nil, attempts are only limited by the retry policy.
+func RetryBudget(b *budget.Budget) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			ws.retryBudget = b
+			return nil
+		})
+}
+
+// ShutdownContext sets the context the connection is maintained with.  Once
+// it is canceled the connection is closed and no further attempts are made,
+// without waiting for Stop.  The default is context.Background().
+func ShutdownContext(ctx context.Context) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if ctx == nil {
+				return fmt.Errorf("%w: nil ShutdownContext", ErrMisconfiguredWS)
+			}
+
+			ws.shutdownCtx = ctx
+			return nil
+		})
+}
+
 // NowFunc sets the now function for the WS connection.
 func NowFunc(f func() time.Time) Option {
 	return optionFunc(
@@ -275,6 +700,32 @@ func MaxMessageBytes(bytes int64) Option {
 		})
 }
 
+// MaxHeaderBytes sets the maximum size in bytes of the handshake response
+// headers.  Responses with larger headers are rejected and the connection is
+// retried.  If this is not set, the http.Transport default is used.
+func MaxHeaderBytes(bytes int64) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			if bytes < 0 {
+				return fmt.Errorf("%w: negative MaxHeaderBytes", ErrMisconfiguredWS)
+			}
+
+			ws.maxHeaderBytes = bytes
+			return nil
+		})
+}
+
+// Encoding sets the WRP format used to encode sent messages and decode
+// received messages.  JSON messages are framed as text, while msgpack messages
+// are framed as binary.  The default is wrp.Msgpack.
+func Encoding(f wrp.Format) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			ws.encoding = f
+			return nil
+		})
+}
+
 // AddMessageListener adds a message listener to the WS connection.
 // The listener will be called for every message received from the WS.
 func AddMessageListener(listener event.MsgListener, cancel ...*event.CancelFunc) Option {
@@ -309,6 +760,66 @@ func AddDisconnectListener(listener event.DisconnectListener, cancel ...*event.C
 		})
 }
 
+// AddSendFailureListener adds a send failure listener to the WS connection.
+// The listener will be called for every message that could not be written.
+func AddSendFailureListener(listener event.SendFailureListener, cancel ...*event.CancelFunc) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			var ignored event.CancelFunc
+			cancel = append(cancel, &ignored)
+			*cancel[0] = event.CancelFunc(ws.sendFailureListeners.Add(listener))
+			return nil
+		})
+}
+
+// AddModeSwitchListener adds a listener that is called each time a connection
+// attempt uses a different IP mode than the attempt before it.
+func AddModeSwitchListener(listener event.ModeSwitchListener, cancel ...*event.CancelFunc) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			var ignored event.CancelFunc
+			cancel = append(cancel, &ignored)
+			*cancel[0] = event.CancelFunc(ws.modeSwitchListeners.Add(listener))
+			return nil
+		})
+}
+
+// AddRotationListener adds a listener that is called each time a connection is
+// closed for reaching the max connection lifetime.
+func AddRotationListener(listener event.RotationListener, cancel ...*event.CancelFunc) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			var ignored event.CancelFunc
+			cancel = append(cancel, &ignored)
+			*cancel[0] = event.CancelFunc(ws.rotationListeners.Add(listener))
+			return nil
+		})
+}
+
+// AddURLFallbackListener adds a listener that is called each time the url
+// fetcher fails and the backup url is used instead.
+func AddURLFallbackListener(listener event.URLFallbackListener, cancel ...*event.CancelFunc) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			var ignored event.CancelFunc
+			cancel = append(cancel, &ignored)
+			*cancel[0] = event.CancelFunc(ws.urlFallbackListeners.Add(listener))
+			return nil
+		})
+}
+
+// AddDecodeBackoffListener adds a listener that is called each time a
+// reconnect is delayed by the decode failure backoff.
+func AddDecodeBackoffListener(listener event.DecodeBackoffListener, cancel ...*event.CancelFunc) Option {
+	return optionFunc(
+		func(ws *Websocket) error {
+			var ignored event.CancelFunc
+			cancel = append(cancel, &ignored)
+			*cancel[0] = event.CancelFunc(ws.decodeBackoffListeners.Add(listener))
+			return nil
+		})
+}
+
 // AddHeartbeatListener adds a heartbeat listener to the WS connection.
 func AddHeartbeatListener(listener event.HeartbeatListener, cancel ...*event.CancelFunc) Option {
 	return optionFunc(
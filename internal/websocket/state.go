@@ -0,0 +1,31 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package websocket
+
+// State is the connection state of the WS connection.
+type State int32
+
+const (
+	// Disconnected means there is no connection and no attempt in progress.
+	Disconnected State = iota
+
+	// Connecting means a connection attempt is in progress.
+	Connecting
+
+	// Connected means the connection is established.
+	Connected
+)
+
+func (s State) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	}
+
+	return "unknown"
+}
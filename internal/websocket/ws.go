@@ -5,16 +5,28 @@ package websocket
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xmidt-org/arrange/arrangehttp"
 	"github.com/xmidt-org/eventor"
 	"github.com/xmidt-org/retry"
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/budget"
 	nhws "github.com/xmidt-org/xmidt-agent/internal/nhooyr.io/websocket"
 	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
 )
@@ -23,8 +35,32 @@ var (
 	ErrMisconfiguredWS = errors.New("misconfigured WS")
 	ErrClosed          = errors.New("websocket closed")
 	ErrInvalidMsgType  = errors.New("invalid message type")
+	ErrWatchdogTimeout = errors.New("watchdog timeout")
+	ErrRotated         = errors.New("max connection lifetime reached")
+	ErrSendQueueFull   = errors.New("send queue full")
+
+	ErrMaxReconnectsExceeded = errors.New("max reconnects exceeded")
+	ErrPinMismatch           = errors.New("server certificate does not match any pinned certificate")
+	ErrSubprotocolMismatch   = errors.New("server did not negotiate a requested subprotocol")
+	ErrALPNMismatch          = errors.New("server did not negotiate an offered ALPN protocol")
+	ErrInvalidURL            = errors.New("invalid websocket url")
 )
 
+// DefaultCompressionSkipContentTypes are the content types of payloads that
+// are already compressed, so compressing them again only costs CPU.
+var DefaultCompressionSkipContentTypes = []string{
+	"image/*",
+	"video/*",
+	"audio/*",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+}
+
 // Egress interface is the egress route used to handle wrp messages that
 // targets something other than this device
 type Egress interface {
@@ -39,6 +75,9 @@ type Websocket struct {
 	// urlFetcher is the URLFetcher for the WS connection.
 	urlFetcher func(context.Context) (string, error)
 
+	// backupURL is the url used when the urlFetcher fails, if not empty.
+	backupURL string
+
 	// urlFetchingTimeout is the URLFetchingTimeout for the WS connection.
 	urlFetchingTimeout time.Duration
 
@@ -52,30 +91,111 @@ type Websocket struct {
 	// Defaults to 1 minute.
 	inactivityTimeout time.Duration
 
+	// watchdogTimeout is the maximum time the connection may go without any
+	// progress (messages, pings or pongs) before it is forced to reconnect.
+	// A value of zero disables the watchdog.
+	watchdogTimeout time.Duration
+
+	// maxConnectionLifetime is the maximum time a connection is kept before
+	// it is closed and reconnected, even if healthy.  A value of zero keeps
+	// connections indefinitely.
+	maxConnectionLifetime time.Duration
+
 	// pingWriteTimeout is the ping timeout for the WS connection.
 	pingWriteTimeout time.Duration
 
 	// sendTimeout is the send timeout for the WS connection.
 	sendTimeout time.Duration
 
+	// sendQueueDepth is the number of messages that may be queued for the
+	// writer goroutine.  A value of zero means Send writes synchronously.
+	sendQueueDepth int
+
+	// sendQueue holds the messages waiting to be written when sendQueueDepth
+	// is set.
+	sendQueue chan wrp.Message
+
 	// keepAliveInterval is the keep alive interval for the WS connection.
 	keepAliveInterval time.Duration
 
 	// httpClientConfig is the configuration and factory for the HTTP client.
 	httpClientConfig arrangehttp.ClientConfig
 
+	// pinnedCerts are the hex encoded SHA-256 fingerprints of the server leaf
+	// certificates that are allowed.  If empty, no pinning is done.
+	pinnedCerts map[string]struct{}
+
+	// insecureSkipTLSVerify disables the verification of the server
+	// certificate.  It is only meant for lab environments.
+	insecureSkipTLSVerify bool
+
+	// alpnProtocols are the ALPN protocols offered in the TLS handshake.  If
+	// empty, none are offered.
+	alpnProtocols []string
+
+	// requireALPN fails the TLS handshake unless the server negotiated one of
+	// the alpnProtocols.
+	requireALPN bool
+
+	// proxyURL is the fixed proxy used for the WS connection.  If nil, the
+	// proxy is taken from the environment.
+	proxyURL *url.URL
+
+	// proxyConnectHeader holds the headers sent to the proxy during CONNECT.
+	proxyConnectHeader http.Header
+
 	// additionalHeaders are any additional headers for the WS connection.
 	additionalHeaders http.Header
 
+	// subprotocols are the subprotocols offered to the server, in order of
+	// preference.
+	subprotocols []string
+
 	// maxMessageBytes is the largest allowable message to send or receive.
 	maxMessageBytes int64
 
+	// maxHeaderBytes is the largest allowable handshake response header.
+	// Zero uses the http.Transport default.
+	maxHeaderBytes int64
+
+	// encoding is the WRP format used to encode and decode messages.
+	// Defaults to wrp.Msgpack.
+	encoding wrp.Format
+
+	// compressionMode is the permessage-deflate mode offered to the server.
+	// Defaults to nhws.CompressionDisabled.
+	compressionMode nhws.CompressionMode
+
+	// compressionThreshold is the minimum size of a message before it is
+	// compressed.  Zero uses the library default for the mode.
+	compressionThreshold int
+
+	// compressionSkipContentTypes are the media types of messages that are
+	// sent uncompressed.  A `type/*` entry matches every subtype.
+	// Defaults to DefaultCompressionSkipContentTypes.
+	compressionSkipContentTypes []string
+
 	// withIPv4 is whether or not to allow IPv4 for the WS connection.
 	withIPv4 bool
 
 	// withIPv6 is whether or not to allow IPv6 for the WS connection.
 	withIPv6 bool
 
+	// resolver is the DNS resolver used by the dialer, nil for the default.
+	resolver *net.Resolver
+
+	// normalizeURLScheme is whether fetched urls are validated and their
+	// http(s) schemes converted to ws(s) before dialing.
+	normalizeURLScheme bool
+
+	// stickyIPMode is whether the IP mode is kept after a successful
+	// connection instead of alternating.
+	stickyIPMode bool
+
+	// happyEyeballsDelay is the stagger between racing IPv6 and IPv4 dials.
+	// Zero means the IP modes are alternated across attempts instead.
+	happyEyeballsDelay time.Duration
+
 	// connectListeners are the connect listeners for the WS connection.
 	connectListeners eventor.Eventor[event.ConnectListener]
 
@@ -88,15 +208,83 @@ type Websocket struct {
 	// msgListeners are the message listeners for messages from the WS.
 	msgListeners eventor.Eventor[event.MsgListener]
 
+	// sendFailureListeners are the listeners for messages that could not be
+	// written to the WS.
+	sendFailureListeners eventor.Eventor[event.SendFailureListener]
+
+	// modeSwitchListeners are the listeners for changes of the IP mode
+	// between connection attempts.
+	modeSwitchListeners eventor.Eventor[event.ModeSwitchListener]
+
+	// rotationListeners are the listeners for connections closed after the
+	// max connection lifetime.
+	rotationListeners eventor.Eventor[event.RotationListener]
+
+	// urlFallbackListeners are the listeners for url fetches that fell back
+	// to the backup url.
+	urlFallbackListeners eventor.Eventor[event.URLFallbackListener]
+
+	// decodeBackoffListeners are the listeners for reconnects delayed by the
+	// decode failure backoff.
+	decodeBackoffListeners eventor.Eventor[event.DecodeBackoffListener]
+
 	// nowFunc is the now function for the WS connection.
 	nowFunc func() time.Time
 
 	// retryPolicyFactory is the retry policy factory for the WS connection.
 	retryPolicyFactory retry.PolicyFactory
 
+	// retryBudget limits the connection attempts, possibly along with other
+	// components.  Nil means no limit.
+	retryBudget *budget.Budget
+
+	// metrics collects the operational telemetry for the WS connection.
+	metrics Metrics
+
 	// once is whether or not to only attempt to connect once.
 	once bool
 
+	// maxReconnects is the number of consecutive failed reconnect attempts
+	// allowed before giving up.  Zero means unlimited.
+	maxReconnects int
+
+	// minReconnectInterval is the minimum time between the starts of
+	// consecutive connection attempts.  Zero means no minimum.
+	minReconnectInterval time.Duration
+
+	// decodeFailureThreshold is the number of consecutive connections closed
+	// for a malformed message before decodeFailureBackoff is used.  Zero
+	// disables the decode failure backoff.
+	decodeFailureThreshold int
+
+	// decodeFailureBackoff is the minimum wait before reconnecting once
+	// decodeFailureThreshold is reached.
+	decodeFailureBackoff time.Duration
+
+	// closeRedirect extracts a reconnect-elsewhere hint from a server close.
+	// If nil, close reasons are ignored.
+	closeRedirect CloseRedirectFunc
+
+	// redirectURL is the hinted url used for the next dial, guarded by m.
+	redirectURL string
+
+	// url is the url of the most recent connection attempt, guarded by m.
+	url string
+
+	// connFactory provides ready connections used instead of dialing.
+	// If nil, connections are dialed with the configured HTTP client.
+	connFactory ConnFactoryFunc
+
+	// state is the current State of the WS connection.
+	state atomic.Int32
+
+	// stopping is set once Stop has been called.
+	stopping atomic.Bool
+
+	// shutdownCtx is the parent of the context the connection is maintained
+	// with, so the connection is dropped as soon as it is canceled.
+	shutdownCtx context.Context
+
 	m        sync.Mutex
 	wg       sync.WaitGroup
 	shutdown context.CancelFunc
@@ -104,6 +292,15 @@ type Websocket struct {
 	conn *nhws.Conn
 }
 
+// CloseRedirectFunc inspects the close frame sent by the server and returns
+// the url to use for the next dial, if the server asked the client to
+// reconnect elsewhere.
+type CloseRedirectFunc func(nhws.CloseError) (string, bool)
+
+// ConnFactoryFunc returns an established connection that the websocket
+// handshake is performed over.
+type ConnFactoryFunc func(context.Context) (net.Conn, error)
+
 // Option is a functional option type for WS.
 type Option interface {
 	apply(*Websocket) error
@@ -125,6 +322,10 @@ func New(opts ...Option) (*Websocket, error) {
 		inactivityTimeout: time.Minute,
 		credDecorator:     emptyDecorator,
 		conveyDecorator:   emptyDecorator,
+		metrics:           nopMetrics{},
+		shutdownCtx:       context.Background(),
+
+		compressionSkipContentTypes: DefaultCompressionSkipContentTypes,
 		// same default as `xmidt-agent/cmd/xmidt-agent/config.go`'s defaultConfig.Websocket.HTTPClient
 		httpClientConfig: arrangehttp.ClientConfig{
 			Timeout: 30 * time.Second,
@@ -144,6 +345,7 @@ func New(opts ...Option) (*Websocket, error) {
 		validateCredentialsDecorator(),
 		validateConveyDecorator(),
 		validateNowFunc(),
+		validateEncoding(),
 		validRetryPolicy(),
 	)
 
@@ -155,6 +357,10 @@ func New(opts ...Option) (*Websocket, error) {
 		}
 	}
 
+	if ws.sendQueueDepth > 0 {
+		ws.sendQueue = make(chan wrp.Message, ws.sendQueueDepth)
+	}
+
 	return &ws, nil
 }
 
@@ -169,21 +375,32 @@ func (ws *Websocket) Start() {
 	}
 
 	var ctx context.Context
-	ctx, ws.shutdown = context.WithCancel(context.Background())
+	ctx, ws.shutdown = context.WithCancel(ws.shutdownCtx)
 
+	// Add before starting run so Stop can never miss it.
+	ws.wg.Add(1)
 	go ws.run(ctx)
 }
 
-// Stop stops the websocket connection.
+// Stop stops the websocket connection and blocks until the connection has
+// been closed and the run goroutine has exited.
 func (ws *Websocket) Stop() {
 	ws.m.Lock()
-	if ws.conn != nil {
-		_ = ws.conn.Close(nhws.StatusNormalClosure, "")
-	}
-
+	conn := ws.conn
 	shutdown := ws.shutdown
+	if shutdown != nil {
+		// Mark the stop before closing the connection, so run doesn't
+		// reconnect before the shutdown below is observed.
+		ws.stopping.Store(true)
+	}
 	ws.m.Unlock()
 
+	// The close handshake requires the run goroutine, which may need ws.m, so
+	// ws.m must not be held here.
+	if conn != nil {
+		_ = conn.Close(nhws.StatusNormalClosure, "")
+	}
+
 	if shutdown != nil {
 		shutdown()
 	}
@@ -191,6 +408,15 @@ func (ws *Websocket) Stop() {
 	ws.wg.Wait()
 }
 
+// ConnectionState returns the current state of the WS connection.
+func (ws *Websocket) ConnectionState() State {
+	return State(ws.state.Load())
+}
+
+func (ws *Websocket) setState(s State) {
+	ws.state.Store(int32(s))
+}
+
 func (ws *Websocket) HandleWrp(m wrp.Message) error {
 	return ws.Send(context.Background(), m)
 }
@@ -201,55 +427,311 @@ func (ws *Websocket) AddMessageListener(listener event.MsgListener) event.Cancel
 	return event.CancelFunc(ws.msgListeners.Add(listener))
 }
 
+// AddConnectListener adds a connect listener to the WS connection.
+// The listener will be called for every connection attempt.
+func (ws *Websocket) AddConnectListener(listener event.ConnectListener) event.CancelFunc {
+	return event.CancelFunc(ws.connectListeners.Add(listener))
+}
+
+// AddDisconnectListener adds a disconnect listener to the WS connection.
+// The listener will be called every time the connection is lost.
+func (ws *Websocket) AddDisconnectListener(listener event.DisconnectListener) event.CancelFunc {
+	return event.CancelFunc(ws.disconnectListeners.Add(listener))
+}
+
+// URL returns the url of the most recent connection attempt.  An empty string
+// is returned if no attempt has fetched a url yet.
+func (ws *Websocket) URL() string {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+
+	return ws.url
+}
+
+// Subprotocol returns the subprotocol negotiated with the server for the
+// current connection.  An empty string is returned if no subprotocol was
+// negotiated or there is no connection.
+func (ws *Websocket) Subprotocol() string {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+
+	if ws.conn == nil {
+		return ""
+	}
+
+	return ws.conn.Subprotocol()
+}
+
+// AddSendFailureListener adds a send failure listener to the WS connection.
+// The listener will be called for every message that could not be written.
+func (ws *Websocket) AddSendFailureListener(listener event.SendFailureListener) event.CancelFunc {
+	return event.CancelFunc(ws.sendFailureListeners.Add(listener))
+}
+
+// SetDeviceID changes the device ID used by the WS connection.  The new ID is
+// sent in the X-Webpa-Device-Name header on the next connection attempt, and
+// any existing connection is closed so the next cycle reconnects with the new
+// identity.
+func (ws *Websocket) SetDeviceID(id wrp.DeviceID) error {
+	if _, err := wrp.ParseDeviceID(string(id)); err != nil {
+		return errors.Join(fmt.Errorf("%w: invalid DeviceID", ErrMisconfiguredWS), err)
+	}
+
+	ws.m.Lock()
+	ws.id = id
+	conn := ws.conn
+	ws.m.Unlock()
+
+	if conn != nil {
+		_ = conn.Close(nhws.StatusServiceRestart, "device id changed")
+	}
+
+	return nil
+}
+
 // Send sends the provided WRP message through the existing websocket.  This
-// call synchronously blocks until the write is complete.
+// call synchronously blocks until the write is complete, unless a send queue
+// depth is configured.  In that case the message is queued for the writer
+// goroutine and ErrSendQueueFull is returned if the queue is saturated.
 func (ws *Websocket) Send(ctx context.Context, msg wrp.Message) error {
+	if ws.ConnectionState() != Connected {
+		return ErrClosed
+	}
+
+	if ws.sendQueue != nil {
+		return ws.enqueue(msg)
+	}
+
 	err := ErrClosed
 	ctx, cancel := context.WithTimeout(ctx, ws.sendTimeout)
 	defer cancel()
 
+	var failed bool
 	ws.m.Lock()
 	if ws.conn != nil {
-		err = ws.conn.Write(ctx, nhws.MessageBinary, wrp.MustEncode(&msg, wrp.Msgpack))
+		var n int
+		n, err = ws.write(ctx, ws.conn, msg)
+		if err == nil {
+			ws.metrics.ObserveSentBytes(n)
+		}
+		failed = err != nil
 	}
 	ws.m.Unlock()
 
+	// Dispatched without holding ws.m, so listeners may call Send.
+	if failed {
+		ws.sendFailed(msg, err)
+	}
+
 	return err
 }
 
+// sendFailed dispatches a send failure event for the dropped message.
+func (ws *Websocket) sendFailed(msg wrp.Message, err error) {
+	e := event.SendFailure{
+		At:              ws.nowFunc(),
+		TransactionUUID: msg.TransactionUUID,
+		Destination:     msg.Destination,
+		Err:             err,
+	}
+	ws.sendFailureListeners.Visit(func(l event.SendFailureListener) {
+		l.OnSendFailure(e)
+	})
+}
+
+// write encodes and writes the message to the connection, returning the number
+// of encoded bytes.  Messages with a content type in the skip list are never
+// compressed.
+func (ws *Websocket) write(ctx context.Context, conn *nhws.Conn, msg wrp.Message) (int, error) {
+	buf := wrp.MustEncode(&msg, ws.encoding)
+	if ws.skipCompression(msg.ContentType) {
+		return len(buf), conn.WriteUncompressed(ctx, ws.messageType(), buf)
+	}
+
+	return len(buf), conn.Write(ctx, ws.messageType(), buf)
+}
+
+// skipCompression reports whether the content type indicates data that is
+// already compressed.
+func (ws *Websocket) skipCompression(contentType string) bool {
+	if ws.compressionMode == nhws.CompressionDisabled || contentType == "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	major, _, _ := strings.Cut(mediaType, "/")
+	for _, skip := range ws.compressionSkipContentTypes {
+		if skip == mediaType || skip == major+"/*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// messageType returns the websocket frame type used for the configured encoding.
+func (ws *Websocket) messageType() nhws.MessageType {
+	if ws.encoding == wrp.JSON {
+		return nhws.MessageText
+	}
+
+	return nhws.MessageBinary
+}
+
+// enqueue queues the message for the writer goroutine without blocking.
+func (ws *Websocket) enqueue(msg wrp.Message) error {
+	ws.m.Lock()
+	connected := ws.conn != nil
+	ws.m.Unlock()
+
+	if !connected {
+		return ErrClosed
+	}
+
+	select {
+	case ws.sendQueue <- msg:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// writer drains the send queue onto the connection until the context is
+// canceled.  The returned channel is closed once the writer has exited.
+func (ws *Websocket) writer(ctx context.Context, conn *nhws.Conn) <-chan struct{} {
+	done := make(chan struct{})
+	if ws.sendQueue == nil {
+		close(done)
+		return done
+	}
+
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-ws.sendQueue:
+				wctx, cancel := context.WithTimeout(ctx, ws.sendTimeout)
+				if n, err := ws.write(wctx, conn, msg); err == nil {
+					ws.metrics.ObserveSentBytes(n)
+				} else {
+					ws.sendFailed(msg, err)
+				}
+				cancel()
+			}
+		}
+	}()
+
+	return done
+}
+
 func (ws *Websocket) run(ctx context.Context) {
-	ws.wg.Add(1)
 	defer ws.wg.Done()
+	defer ws.setState(Disconnected)
 
-	decoder := wrp.NewDecoder(nil, wrp.Msgpack)
+	decoder := wrp.NewDecoder(nil, ws.encoding)
 	mode := ws.nextMode(ipv4)
 
 	policy := ws.retryPolicyFactory.NewPolicy(ctx)
+	var (
+		triesSinceLastConnect int
+		// decodeFailures is the number of consecutive connections closed
+		// for a malformed message.
+		decodeFailures int
+	)
+
+	// The mode and result of the prior attempt, to report mode switches.
+	var (
+		priorMode ipMode
+		priorErr  error
+	)
 
 	for {
-		var next time.Duration
+		var (
+			next time.Duration
+			// rotated is whether the connection was closed for reaching its
+			// max lifetime, which reconnects without waiting.
+			rotated bool
+			// malformedErr is the error reading the message that closed the
+			// connection, if the message was malformed.
+			malformedErr error
+		)
+
+		// Shutdown is the only reason the wait fails.
+		if ws.retryBudget.Wait(ctx) != nil {
+			return
+		}
 
-		mode = ws.nextMode(mode)
+		// Keep the mode that worked last time if sticky.
+		if !ws.stickyIPMode || priorErr != nil || priorMode == "" {
+			mode = ws.nextMode(mode)
+		}
 		cEvent := event.Connect{
 			Started: ws.nowFunc(),
 			Mode:    mode.ToEvent(),
 		}
 
+		// The device ID may have changed since the last attempt.
+		ws.m.Lock()
+		ws.additionalHeaders.Set("X-Webpa-Device-Name", string(ws.id))
+		ws.m.Unlock()
+
 		// If auth fails, then continue with no credentials.
 		ws.credDecorator(ws.additionalHeaders)
 
 		ws.conveyDecorator(ws.additionalHeaders)
 
-		conn, _, dialErr := ws.dial(ctx, mode) //nolint:bodyclose
+		ws.setState(Connecting)
+		ws.metrics.IncConnectAttempt()
+		var (
+			conn    *nhws.Conn
+			resp    *http.Response
+			dialErr error
+		)
+		if ws.racing() {
+			conn, resp, mode, dialErr = ws.raceDial(ctx) //nolint:bodyclose
+			cEvent.Mode = mode.ToEvent()
+		} else {
+			conn, resp, dialErr = ws.dial(ctx, mode) //nolint:bodyclose
+		}
 		cEvent.At = ws.nowFunc()
+		cEvent.Compressed = dialErr == nil && compressionNegotiated(resp)
+
+		if priorMode != "" && priorMode != mode {
+			msEvent := event.ModeSwitch{
+				At:       cEvent.Started,
+				From:     priorMode.ToEvent(),
+				To:       mode.ToEvent(),
+				PriorErr: priorErr,
+			}
+			ws.modeSwitchListeners.Visit(func(l event.ModeSwitchListener) {
+				l.OnModeSwitch(msEvent)
+			})
+		}
+		priorMode, priorErr = mode, dialErr
 
 		if dialErr == nil {
+			ws.metrics.IncConnectSuccess()
 			ws.connectListeners.Visit(func(l event.ConnectListener) {
 				l.OnConnect(cEvent)
 			})
 
 			// Reset the retry policy on a successful connection.
 			policy = ws.retryPolicyFactory.NewPolicy(ctx)
+			triesSinceLastConnect = 0
+
+			// connCtx is scoped to this connection so the watchdog can force
+			// the read loop to give up on a stalled connection.
+			connCtx, connCancel := context.WithCancelCause(ctx)
+			progress := make(chan struct{}, 1)
+			ws.watchdog(connCtx, connCancel, conn, progress)
+			expired := ws.rotate(connCtx, conn)
 
 			// Store the connection so writing can take place.
 			ws.m.Lock()
@@ -270,6 +752,8 @@ func (ws *Websocket) run(ctx context.Context) {
 				if len(activity) == 0 {
 					activity <- struct{}{}
 				}
+
+				signal(progress)
 			}))
 			ws.conn.SetPongListener(func(ctx context.Context, b []byte) {
 				if ctx.Err() != nil {
@@ -282,13 +766,19 @@ func (ws *Websocket) run(ctx context.Context) {
 						Type: event.PONG,
 					})
 				})
+
+				signal(progress)
 			})
 			ws.m.Unlock()
+			ws.setState(Connected)
+
+			writerDone := ws.writer(connCtx, conn)
+			deliver := ws.deliverer(connCtx)
 
 			// Read loop
 			for {
 				var msg wrp.Message
-				ctx, cancel := context.WithCancelCause(ctx)
+				ctx, cancel := context.WithCancelCause(connCtx)
 
 				// Monitor for activity.
 				go func() {
@@ -308,7 +798,7 @@ func (ws *Websocket) run(ctx context.Context) {
 					}
 				}()
 
-				typ, reader, err := ws.conn.Reader(ctx)
+				typ, reader, err := conn.Reader(ctx)
 				ctxErr := context.Cause(ctx)
 				err = errors.Join(err, ctxErr)
 				// If ctxErr is context.Canceled then the parent context has been canceled.
@@ -318,54 +808,142 @@ func (ws *Websocket) run(ctx context.Context) {
 				}
 
 				if err == nil {
-					if typ != nhws.MessageBinary {
+					if typ != ws.messageType() {
 						err = ErrInvalidMsgType
 					} else {
-						decoder.Reset(reader)
+						counter := countingReader{r: reader}
+						decoder.Reset(&counter)
 						err = decoder.Decode(&msg)
+						ws.metrics.ObserveReceivedBytes(counter.n)
 					}
+					malformedErr = err
 				}
 
 				// Cancel ws.conn.Reader()'s context after wrp decoding.
 				cancel(nil)
 				if err != nil {
+					ws.setState(Disconnected)
 					ws.m.Lock()
 					ws.conn = nil
 					ws.m.Unlock()
 
-					// The websocket gave us an unexpected message, or a message
-					// that could not be decoded.  Close & reconnect.
-					_ = conn.Close(nhws.StatusUnsupportedData, limit(err.Error()))
+					// The connection was already closed if it reached its max lifetime.
+					rotated = expired.Load()
+					if rotated {
+						err = errors.Join(ErrRotated, err)
+					} else if !errors.Is(err, ErrWatchdogTimeout) {
+						// The websocket gave us an unexpected message, or a message
+						// that could not be decoded.  Close & reconnect.  The
+						// watchdog closes the connection itself.
+						_ = conn.Close(nhws.StatusUnsupportedData, limit(err.Error()))
+					}
 
 					dEvent := event.Disconnect{
 						At:  ws.nowFunc(),
 						Err: err,
 					}
+					var closeErr nhws.CloseError
+					if !rotated && errors.As(err, &closeErr) {
+						dEvent.Code = int(closeErr.Code)
+						dEvent.Reason = closeErr.Reason
+						ws.redirect(closeErr)
+					}
+					ws.metrics.IncDisconnect(disconnectReason(err))
 					ws.disconnectListeners.Visit(func(l event.DisconnectListener) {
 						l.OnDisconnect(dEvent)
 					})
 
+					if rotated {
+						rEvent := event.Rotation{
+							At:       dEvent.At,
+							Lifetime: dEvent.At.Sub(cEvent.At),
+						}
+						ws.rotationListeners.Visit(func(l event.RotationListener) {
+							l.OnRotation(rEvent)
+						})
+					}
+
 					break
 				}
 
-				ws.msgListeners.Visit(func(l event.MsgListener) {
-					l.OnMessage(msg)
-				})
+				signal(progress)
+				deliver(msg)
 			}
+
+			connCancel(nil)
+			<-writerDone
+
+			ws.m.Lock()
+			ws.conn = nil
+			ws.m.Unlock()
 		}
 
-		if ws.once {
+		ws.setState(Disconnected)
+
+		// Don't retry once Stop has been called.
+		if ws.stopping.Load() || ctx.Err() != nil || ws.once {
 			return
 		}
 
 		next, _ = policy.Next()
+		if rotated {
+			next = 0
+		}
+
+		// Failed dials don't break a run of connections closed for a
+		// malformed message.
+		if dialErr == nil {
+			decodeFailures++
+			if malformedErr == nil {
+				decodeFailures = 0
+			}
+		}
+
+		// A connection that fails right after connecting resets the retry
+		// policy, so the floor keeps it from reconnecting in a tight loop.
+		if floor := ws.minReconnectInterval - ws.nowFunc().Sub(cEvent.Started); next < floor {
+			next = floor
+		}
+
+		// A server that keeps sending malformed messages gets a longer
+		// backoff instead of a reconnect after every message.
+		if ws.decodeFailureThreshold > 0 && decodeFailures >= ws.decodeFailureThreshold && malformedErr != nil {
+			next = max(next, ws.decodeFailureBackoff)
+			dbEvent := event.DecodeBackoff{
+				At:       ws.nowFunc(),
+				Failures: decodeFailures,
+				Backoff:  next,
+				Err:      malformedErr,
+			}
+			ws.decodeBackoffListeners.Visit(func(l event.DecodeBackoffListener) {
+				l.OnDecodeBackoff(dbEvent)
+			})
+		}
 
 		if dialErr != nil {
+			triesSinceLastConnect++
+			exceeded := 0 < ws.maxReconnects && ws.maxReconnects <= triesSinceLastConnect
+
 			cEvent.Err = dialErr
-			cEvent.RetryingAt = ws.nowFunc().Add(next)
+			if !exceeded {
+				cEvent.RetryingAt = ws.nowFunc().Add(next)
+			}
 			ws.connectListeners.Visit(func(l event.ConnectListener) {
 				l.OnConnect(cEvent)
 			})
+
+			if exceeded {
+				dEvent := event.Disconnect{
+					At:  ws.nowFunc(),
+					Err: errors.Join(ErrMaxReconnectsExceeded, dialErr),
+				}
+				ws.disconnectListeners.Visit(func(l event.DisconnectListener) {
+					l.OnDisconnect(dEvent)
+				})
+
+				ws.giveUp()
+				return
+			}
 		}
 
 		select {
@@ -376,14 +954,241 @@ func (ws *Websocket) run(ctx context.Context) {
 	}
 }
 
+// deliverer returns the function passing the messages read from the
+// connection to the message listeners.  With the watchdog enabled, a single
+// goroutine per connection calls the listeners in order, so a listener that
+// never returns can't keep the read loop from giving up on the connection once
+// ctx is done; the stuck goroutine is left behind.  The goroutine exits once
+// ctx is done.
+func (ws *Websocket) deliverer(ctx context.Context) func(wrp.Message) {
+	visit := func(msg wrp.Message) {
+		ws.msgListeners.Visit(func(l event.MsgListener) {
+			l.OnMessage(msg)
+		})
+	}
+
+	if ws.watchdogTimeout == 0 {
+		return visit
+	}
+
+	msgs := make(chan wrp.Message)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-msgs:
+				visit(msg)
+			}
+		}
+	}()
+
+	return func(msg wrp.Message) {
+		select {
+		case msgs <- msg:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// giveUp leaves the websocket as if it was never started once run stops
+// reconnecting on its own, so Start can try again.  A websocket that is being
+// stopped is left alone.
+func (ws *Websocket) giveUp() {
+	ws.m.Lock()
+	defer ws.m.Unlock()
+
+	if ws.shutdown != nil && !ws.stopping.Load() {
+		ws.shutdown()
+		ws.shutdown = nil
+	}
+}
+
+// watchdog starts an independent goroutine that forces a reconnect if no
+// progress is signaled on the connection within the watchdog timeout.  The
+// goroutine exits once ctx is done.
+func (ws *Websocket) watchdog(ctx context.Context, cancel context.CancelCauseFunc, conn *nhws.Conn, progress <-chan struct{}) {
+	if ws.watchdogTimeout == 0 {
+		return
+	}
+
+	go func() {
+		timer := time.NewTimer(ws.watchdogTimeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-progress:
+				timer.Reset(ws.watchdogTimeout)
+			case <-timer.C:
+				// Cancelling the connection's context ends the read loop, even
+				// if it is waiting on a stuck listener, and closing the
+				// connection releases it so a fresh one is dialed.
+				cancel(ErrWatchdogTimeout)
+				_ = conn.Close(nhws.StatusGoingAway, ErrWatchdogTimeout.Error())
+				return
+			}
+		}
+	}()
+}
+
+// rotate starts an independent goroutine that normally closes the connection
+// once it has been up for the max connection lifetime, which ends the read
+// loop.  The returned flag is set before the connection is closed.  The
+// goroutine exits once ctx is done.
+func (ws *Websocket) rotate(ctx context.Context, conn *nhws.Conn) *atomic.Bool {
+	var expired atomic.Bool
+	if ws.maxConnectionLifetime == 0 {
+		return &expired
+	}
+
+	go func() {
+		timer := time.NewTimer(ws.maxConnectionLifetime)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+			expired.Store(true)
+			_ = conn.Close(nhws.StatusNormalClosure, limit(ErrRotated.Error()))
+		}
+	}()
+
+	return &expired
+}
+
+// signal performs a non-blocking send on ch.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
 func (ws *Websocket) dial(ctx context.Context, mode ipMode) (*nhws.Conn, *http.Response, error) {
-	fetchCtx, cancel := context.WithTimeout(ctx, ws.urlFetchingTimeout)
-	defer cancel()
-	url, err := ws.urlFetcher(fetchCtx)
+	url, err := ws.fetchURL(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return ws.dialURL(ctx, url, mode)
+}
+
+func (ws *Websocket) fetchURL(ctx context.Context) (string, error) {
+	// A redirect hint only applies to the dial immediately after the close.
+	ws.m.Lock()
+	url := ws.redirectURL
+	ws.redirectURL = ""
+	ws.m.Unlock()
+
+	var err error
+	if url == "" {
+		fetchCtx, cancel := context.WithTimeout(ctx, ws.urlFetchingTimeout)
+		defer cancel()
+
+		url, err = ws.urlFetcher(fetchCtx)
+		if err != nil {
+			if ws.backupURL == "" {
+				return "", err
+			}
+
+			url = ws.backupURL
+			fe := event.URLFallback{
+				At:  ws.nowFunc(),
+				URL: url,
+				Err: err,
+			}
+			ws.urlFallbackListeners.Visit(func(l event.URLFallbackListener) {
+				l.OnURLFallback(fe)
+			})
+		}
+	}
+
+	if ws.normalizeURLScheme {
+		url, err = normalizeURL(url)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ws.m.Lock()
+	ws.url = url
+	ws.m.Unlock()
+
+	return url, nil
+}
+
+// raceDial dials the url over IPv6 and IPv4 in parallel, with the IPv4 dial
+// staggered by the happy eyeballs delay unless the IPv6 dial fails first.
+// The first connection made is returned along with its mode; the losing dial
+// is canceled and its connection closed if it was made anyway.
+func (ws *Websocket) raceDial(ctx context.Context) (*nhws.Conn, *http.Response, ipMode, error) {
+	url, err := ws.fetchURL(ctx)
+	if err != nil {
+		return nil, nil, ipv6, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn *nhws.Conn
+		resp *http.Response
+		mode ipMode
+		err  error
+	}
+	results := make(chan result, 2)
+	v6Failed := make(chan struct{})
+
+	go func() {
+		conn, resp, err := ws.dialURL(ctx, url, ipv6) //nolint:bodyclose
+		if err != nil {
+			close(v6Failed)
+		}
+		results <- result{conn: conn, resp: resp, mode: ipv6, err: err}
+	}()
+	go func() {
+		stagger := time.NewTimer(ws.happyEyeballsDelay)
+		defer stagger.Stop()
+
+		select {
+		case <-stagger.C:
+		case <-v6Failed:
+		case <-ctx.Done():
+			results <- result{mode: ipv4, err: ctx.Err()}
+			return
+		}
+
+		conn, resp, err := ws.dialURL(ctx, url, ipv4) //nolint:bodyclose
+		results <- result{conn: conn, resp: resp, mode: ipv4, err: err}
+	}()
+
+	var errs error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			errs = errors.Join(errs, r.err)
+			continue
+		}
+
+		if i == 0 {
+			// Close the losing connection if it was made anyway.
+			go func() {
+				if loser := <-results; loser.err == nil {
+					_ = loser.conn.Close(nhws.StatusNormalClosure, "")
+				}
+			}()
+		}
+
+		return r.conn, r.resp, r.mode, nil
+	}
+
+	return nil, nil, ipv6, errs
+}
+
+func (ws *Websocket) dialURL(ctx context.Context, url string, mode ipMode) (*nhws.Conn, *http.Response, error) {
 	client, err := ws.newHTTPClient(mode)
 	if err != nil {
 		return nil, nil, err
@@ -391,19 +1196,118 @@ func (ws *Websocket) dial(ctx context.Context, mode ipMode) (*nhws.Conn, *http.R
 
 	conn, resp, err := nhws.Dial(ctx, url,
 		&nhws.DialOptions{
-			HTTPHeader: ws.additionalHeaders,
-			HTTPClient: client,
+			HTTPHeader:           ws.additionalHeaders,
+			HTTPClient:           client,
+			CompressionMode:      ws.compressionMode,
+			CompressionThreshold: ws.compressionThreshold,
+			Subprotocols:         ws.subprotocols,
 		},
 	)
 	if err != nil {
 		return nil, resp, err
 	}
 
+	// The server may decline every requested subprotocol, which is treated
+	// as a failed attempt so the connection is retried.
+	if len(ws.subprotocols) > 0 && !slices.Contains(ws.subprotocols, conn.Subprotocol()) {
+		_ = conn.Close(nhws.StatusProtocolError, "subprotocol mismatch")
+		return nil, resp, fmt.Errorf("%w: got '%s'", ErrSubprotocolMismatch, conn.Subprotocol())
+	}
+
 	conn.SetReadLimit(ws.maxMessageBytes)
 	conn.SetPingWriteTimeout(ws.pingWriteTimeout)
 	return conn, resp, nil
 }
 
+// redirect records the url hinted by the server's close frame, if any, so the
+// next dial targets it.
+func (ws *Websocket) redirect(closeErr nhws.CloseError) {
+	if ws.closeRedirect == nil {
+		return
+	}
+
+	hint, ok := ws.closeRedirect(closeErr)
+	if !ok || !validRedirect(hint) {
+		return
+	}
+
+	ws.m.Lock()
+	ws.redirectURL = hint
+	ws.m.Unlock()
+}
+
+// validRedirect reports whether the hinted url is an absolute websocket or
+// http(s) url.
+func validRedirect(hint string) bool {
+	u, err := url.Parse(hint)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "ws", "wss", "http", "https":
+		return true
+	}
+
+	return false
+}
+
+// normalizeURL validates that raw is an absolute websocket or http(s) url and
+// returns it with the equivalent websocket scheme, ws or wss.
+func normalizeURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", errors.Join(ErrInvalidURL, err)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "ws", "http":
+		u.Scheme = "ws"
+	case "wss", "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("%w: unsupported scheme '%s'", ErrInvalidURL, u.Scheme)
+	}
+
+	if u.Host == "" {
+		return "", fmt.Errorf("%w: missing host", ErrInvalidURL)
+	}
+
+	return u.String(), nil
+}
+
+// ParseCloseRedirect is a CloseRedirectFunc for servers that send a JSON
+// close reason of the form `{"redirect":"wss://example.com/api/v2/device"}`.
+func ParseCloseRedirect(closeErr nhws.CloseError) (string, bool) {
+	var reason struct {
+		Redirect string `json:"redirect"`
+	}
+	if err := json.Unmarshal([]byte(closeErr.Reason), &reason); err != nil {
+		return "", false
+	}
+
+	return reason.Redirect, reason.Redirect != ""
+}
+
+// compressionNegotiated reports whether the server accepted the
+// permessage-deflate extension during the handshake.
+func compressionNegotiated(resp *http.Response) bool {
+	if resp == nil {
+		return false
+	}
+
+	for _, ext := range resp.Header.Values("Sec-WebSocket-Extensions") {
+		for _, e := range strings.Split(ext, ",") {
+			name, _, _ := strings.Cut(e, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 type custRT struct {
 	transport *http.Transport
 }
@@ -414,6 +1318,10 @@ func (rt *custRT) RoundTrip(r *http.Request) (*http.Response, error) {
 
 // newHTTPClient returns a HTTP client using the provided `mode` as its named network.
 func (ws *Websocket) newHTTPClient(mode ipMode) (*http.Client, error) {
+	if ws.connFactory != nil {
+		return ws.newFactoryClient(), nil
+	}
+
 	config := ws.httpClientConfig
 	client, err := config.NewClient()
 	if err != nil {
@@ -435,20 +1343,132 @@ func (ws *Websocket) newHTTPClient(mode ipMode) (*http.Client, error) {
 		return nil, err
 	}
 
+	if len(ws.pinnedCerts) > 0 || ws.insecureSkipTLSVerify || len(ws.alpnProtocols) > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{} //nolint:gosec
+		}
+	}
+	if len(ws.pinnedCerts) > 0 {
+		transport.TLSClientConfig.VerifyPeerCertificate = ws.verifyPinnedCert
+	}
+	if ws.insecureSkipTLSVerify {
+		transport.TLSClientConfig.InsecureSkipVerify = true //nolint:gosec
+	}
+
 	transport.Proxy = http.ProxyFromEnvironment
+	if ws.proxyURL != nil {
+		transport.Proxy = http.ProxyURL(ws.proxyURL)
+		transport.ProxyConnectHeader = ws.proxyConnectHeader.Clone()
+	}
 	dialer := &net.Dialer{
 		Timeout:   client.Timeout,
 		KeepAlive: ws.keepAliveInterval,
 		DualStack: false,
+		Resolver:  ws.resolver,
 	}
+	// Dialing with the mode's network (tcp4 or tcp6) limits the DNS lookups
+	// to that address family, so no AAAA lookups are made in IPv4 mode.
 	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		return dialer.DialContext(ctx, string(mode), addr)
 	}
+	if len(ws.alpnProtocols) > 0 {
+		// The transport doesn't offer any ALPN protocols for upgrade requests,
+		// so the TLS handshake is done here instead.  Connections through a
+		// proxy still use the transport's handshake.
+		config := transport.TLSClientConfig.Clone()
+		config.NextProtos = slices.Clone(ws.alpnProtocols)
+		if ws.requireALPN {
+			config.VerifyConnection = verifyALPN
+		}
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(ctx, transport.DialContext, config, network, addr)
+		}
+	}
+	if ws.maxHeaderBytes > 0 {
+		transport.MaxResponseHeaderBytes = ws.maxHeaderBytes
+	}
 	client.Transport = &custRT{transport: transport}
 
 	return client, nil
 }
 
+// newFactoryClient returns a HTTP client that performs every request over a
+// connection from the conn factory, bypassing the HTTP client configuration.
+// The connection is used as is, even for secure urls.
+func (ws *Websocket) newFactoryClient() *http.Client {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return ws.connFactory(ctx)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:            dial,
+			DialTLSContext:         dial,
+			DisableKeepAlives:      true,
+			MaxResponseHeaderBytes: ws.maxHeaderBytes,
+		},
+	}
+}
+
+// dialTLS dials the address and performs the TLS handshake using a copy of the
+// config, with the server name taken from the address if it isn't set.
+func dialTLS(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error),
+	config *tls.Config, network, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config = config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// verifyALPN fails the TLS handshake unless the server negotiated one of the
+// offered ALPN protocols.  The TLS client already rejects protocols that were
+// not offered, so only the lack of a negotiated protocol is checked.
+func verifyALPN(cs tls.ConnectionState) error {
+	if cs.NegotiatedProtocol == "" {
+		return ErrALPNMismatch
+	}
+
+	return nil
+}
+
+// verifyPinnedCert fails the TLS handshake unless the SHA-256 fingerprint of
+// the presented leaf certificate is one of the pinned certificates.
+func (ws *Websocket) verifyPinnedCert(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("%w: no certificate presented", ErrPinMismatch)
+	}
+
+	sum := sha256.Sum256(rawCerts[0])
+	fingerprint := hex.EncodeToString(sum[:])
+	if _, found := ws.pinnedCerts[fingerprint]; !found {
+		return fmt.Errorf("%w: sha256 %s", ErrPinMismatch, fingerprint)
+	}
+
+	return nil
+}
+
+// racing reports whether IPv4 and IPv6 dials are raced instead of alternated.
+func (ws *Websocket) racing() bool {
+	return ws.connFactory == nil && ws.happyEyeballsDelay > 0 && ws.withIPv4 && ws.withIPv6
+}
+
 func (ws *Websocket) nextMode(mode ipMode) ipMode {
 	if mode == ipv4 && ws.withIPv6 {
 		return ipv6
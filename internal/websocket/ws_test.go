@@ -122,6 +122,25 @@ func TestNew(t *testing.T) {
 				WithIPv6(false),
 			},
 			expectedErr: errUnknown,
+		}, {
+			description: "sticky ip mode",
+			opts: append(
+				wsDefaults,
+				DeviceID("mac:112233445566"),
+				URL("http://example.com"),
+				StickyIPMode(),
+				CredentialsDecorator(func(h http.Header) error {
+					return nil
+				}),
+				ConveyDecorator(func(h http.Header) error {
+					return nil
+				}),
+				NowFunc(time.Now),
+				RetryPolicy(retry.Config{}),
+			),
+			check: func(assert *assert.Assertions, c *Websocket) {
+				assert.True(c.stickyIPMode)
+			},
 		},
 
 		// Boundary testing for options
@@ -137,12 +156,181 @@ func TestNew(t *testing.T) {
 				InactivityTimeout(-1),
 			},
 			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "negative watchdog timeout",
+			opts: []Option{
+				WatchdogTimeout(-1),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "negative min reconnect interval",
+			opts: []Option{
+				MinReconnectInterval(-1),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "zero decode failure threshold",
+			opts: []Option{
+				DecodeFailureBackoff(0, time.Minute),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "zero decode failure backoff",
+			opts: []Option{
+				DecodeFailureBackoff(3, 0),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "empty backup url",
+			opts: []Option{
+				BackupURL(""),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "nil resolver",
+			opts: []Option{
+				Resolver(nil),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "negative max connection lifetime",
+			opts: []Option{
+				MaxConnectionLifetime(-1),
+			},
+			expectedErr: ErrMisconfiguredWS,
 		}, {
 			description: "negative ping write timeout",
 			opts: []Option{
 				PingWriteTimeout(-1),
 			},
 			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "invalid compression mode",
+			opts: []Option{
+				Compression(websocket.CompressionMode(42), 0),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "negative compression threshold",
+			opts: []Option{
+				Compression(websocket.CompressionContextTakeover, -1),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "compression skip content types",
+			opts: append(
+				wsDefaults,
+				URL("http://example.com"),
+				DeviceID("mac:112233445566"),
+				NowFunc(time.Now),
+				RetryPolicy(retry.Config{}),
+				CompressionSkipContentTypes("image/*", "Application/ZIP"),
+			),
+			check: func(assert *assert.Assertions, c *Websocket) {
+				assert.Equal([]string{"image/*", "application/zip"}, c.compressionSkipContentTypes)
+			},
+		}, {
+			description: "invalid compression skip content type",
+			opts: []Option{
+				CompressionSkipContentTypes("not a type"),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "nil close redirect",
+			opts: []Option{
+				CloseRedirect(nil),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "negative max header bytes",
+			opts: []Option{
+				MaxHeaderBytes(-1),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "nil conn factory",
+			opts: []Option{
+				ConnFactory(nil),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "negative happy eyeballs delay",
+			opts: []Option{
+				HappyEyeballs(-1),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "invalid pinned cert",
+			opts: []Option{
+				PinnedCerts("not-hex"),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "short pinned cert",
+			opts: []Option{
+				PinnedCerts("abcd"),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "empty ALPN protocol",
+			opts: []Option{
+				ALPNProtocols([]string{"edge/1", ""}),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "h2 ALPN protocol",
+			opts: []Option{
+				ALPNProtocols([]string{"h2", "http/1.1"}),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "invalid proxy url",
+			opts: []Option{
+				ProxyConfig("not a url", "", ""),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "unparsable proxy url",
+			opts: []Option{
+				ProxyConfig("http://[::1", "", ""),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "negative max reconnects",
+			opts: []Option{
+				MaxReconnects(-1),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "nil metrics",
+			opts: []Option{
+				WithMetrics(nil),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "negative send queue depth",
+			opts: []Option{
+				SendQueueDepth(-1),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "empty subprotocol",
+			opts: []Option{
+				Subprotocols([]string{"wrp", ""}),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "subprotocol list",
+			opts: []Option{
+				Subprotocols([]string{"wrp, wrp-0.1"}),
+			},
+			expectedErr: ErrMisconfiguredWS,
+		}, {
+			description: "unsupported encoding",
+			opts: []Option{
+				Encoding(wrp.Format(42)),
+			},
+			expectedErr: ErrMisconfiguredWS,
 		},
 
 		// Test the now func option
@@ -168,6 +356,12 @@ func TestNew(t *testing.T) {
 					assert.Equal(time.Unix(1234, 0), c.nowFunc())
 				}
 			},
+		}, {
+			description: "nil shutdown context",
+			opts: []Option{
+				ShutdownContext(nil), //nolint:staticcheck
+			},
+			expectedErr: ErrMisconfiguredWS,
 		}, {
 			description: "nil now func",
 			opts: []Option{
@@ -265,6 +459,24 @@ func TestConnectListener(t *testing.T) {
 		})
 		m.AssertExpectations(t)
 	}
+
+	// Listeners may also be added after the websocket is created.
+	var added MockListeners
+	added.On("OnConnect", mock.Anything).Return()
+
+	if assert.NotNil(got) {
+		cancel := got.AddConnectListener(&added)
+		got.connectListeners.Visit(func(l event.ConnectListener) {
+			l.OnConnect(event.Connect{})
+		})
+		added.AssertNumberOfCalls(t, "OnConnect", 1)
+
+		cancel()
+		got.connectListeners.Visit(func(l event.ConnectListener) {
+			l.OnConnect(event.Connect{})
+		})
+		added.AssertNumberOfCalls(t, "OnConnect", 1)
+	}
 }
 
 func TestDisconnectListener(t *testing.T) {
@@ -296,6 +508,24 @@ func TestDisconnectListener(t *testing.T) {
 		})
 		m.AssertExpectations(t)
 	}
+
+	// Listeners may also be added after the websocket is created.
+	var added MockListeners
+	added.On("OnDisconnect", mock.Anything).Return()
+
+	if assert.NotNil(got) {
+		cancel := got.AddDisconnectListener(&added)
+		got.disconnectListeners.Visit(func(l event.DisconnectListener) {
+			l.OnDisconnect(event.Disconnect{})
+		})
+		added.AssertNumberOfCalls(t, "OnDisconnect", 1)
+
+		cancel()
+		got.disconnectListeners.Visit(func(l event.DisconnectListener) {
+			l.OnDisconnect(event.Disconnect{})
+		})
+		added.AssertNumberOfCalls(t, "OnDisconnect", 1)
+	}
 }
 
 func TestHeartbeatListener(t *testing.T) {
@@ -329,6 +559,137 @@ func TestHeartbeatListener(t *testing.T) {
 	}
 }
 
+func TestModeSwitchListener(t *testing.T) {
+	assert := assert.New(t)
+
+	var m MockListeners
+
+	m.On("OnModeSwitch", mock.Anything).Return()
+
+	got, err := New(
+		URL("http://example.com"),
+		DeviceID("mac:112233445566"),
+		AddModeSwitchListener(&m),
+		WithIPv6(),
+		CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		NowFunc(time.Now),
+		RetryPolicy(retry.Config{}),
+	)
+
+	assert.NoError(err)
+	if assert.NotNil(got) {
+		got.modeSwitchListeners.Visit(func(l event.ModeSwitchListener) {
+			l.OnModeSwitch(event.ModeSwitch{})
+		})
+		m.AssertExpectations(t)
+	}
+}
+
+func TestRotationListener(t *testing.T) {
+	assert := assert.New(t)
+
+	var m MockListeners
+
+	m.On("OnRotation", mock.Anything).Return()
+
+	got, err := New(
+		URL("http://example.com"),
+		DeviceID("mac:112233445566"),
+		AddRotationListener(&m),
+		MaxConnectionLifetime(time.Hour),
+		WithIPv4(),
+		CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		NowFunc(time.Now),
+		RetryPolicy(retry.Config{}),
+	)
+
+	assert.NoError(err)
+	if assert.NotNil(got) {
+		assert.Equal(time.Hour, got.maxConnectionLifetime)
+		got.rotationListeners.Visit(func(l event.RotationListener) {
+			l.OnRotation(event.Rotation{})
+		})
+		m.AssertExpectations(t)
+	}
+}
+
+func TestURLFallbackListener(t *testing.T) {
+	assert := assert.New(t)
+
+	var m MockListeners
+
+	m.On("OnURLFallback", mock.Anything).Return()
+
+	got, err := New(
+		URL("http://example.com"),
+		BackupURL("http://backup.example.com"),
+		DeviceID("mac:112233445566"),
+		AddURLFallbackListener(&m),
+		WithIPv4(),
+		CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		NowFunc(time.Now),
+		RetryPolicy(retry.Config{}),
+	)
+
+	assert.NoError(err)
+	if assert.NotNil(got) {
+		assert.Equal("http://backup.example.com", got.backupURL)
+		got.urlFallbackListeners.Visit(func(l event.URLFallbackListener) {
+			l.OnURLFallback(event.URLFallback{})
+		})
+		m.AssertExpectations(t)
+	}
+}
+
+func TestDecodeBackoffListener(t *testing.T) {
+	assert := assert.New(t)
+
+	var m MockListeners
+
+	m.On("OnDecodeBackoff", mock.Anything).Return()
+
+	got, err := New(
+		URL("http://example.com"),
+		DeviceID("mac:112233445566"),
+		AddDecodeBackoffListener(&m),
+		DecodeFailureBackoff(3, time.Minute),
+		WithIPv4(),
+		CredentialsDecorator(func(h http.Header) error {
+			return nil
+		}),
+		ConveyDecorator(func(h http.Header) error {
+			return nil
+		}),
+		NowFunc(time.Now),
+		RetryPolicy(retry.Config{}),
+	)
+
+	assert.NoError(err)
+	if assert.NotNil(got) {
+		assert.Equal(3, got.decodeFailureThreshold)
+		assert.Equal(time.Minute, got.decodeFailureBackoff)
+		got.decodeBackoffListeners.Visit(func(l event.DecodeBackoffListener) {
+			l.OnDecodeBackoff(event.DecodeBackoff{})
+		})
+		m.AssertExpectations(t)
+	}
+}
+
 func TestNextMode(t *testing.T) {
 	defaults := []Option{
 		CredentialsDecorator(func(h http.Header) error {
@@ -478,3 +839,322 @@ func Test_CancelCtx(t *testing.T) {
 	got.Stop()
 
 }
+
+func TestSendQueueFull(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	got, err := New(
+		URL("http://example.com"),
+		DeviceID("mac:112233445566"),
+		WithIPv4(),
+		NowFunc(time.Now),
+		RetryPolicy(retry.Config{}),
+		SendQueueDepth(1),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	msg := wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "server",
+		Destination: "mac:112233445566",
+	}
+
+	// Without a connection nothing is queued.
+	assert.ErrorIs(got.Send(context.Background(), msg), ErrClosed)
+
+	// Simulate a connection with no writer draining the queue.
+	got.conn = &websocket.Conn{}
+	got.setState(Connected)
+	assert.NoError(got.Send(context.Background(), msg))
+	assert.ErrorIs(got.Send(context.Background(), msg), ErrSendQueueFull)
+}
+
+func TestSubprotocol(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	s := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+					Subprotocols: []string{"wrp.msgpack"},
+				})
+				require.NoError(err)
+				defer c.CloseNow()
+
+				_, _, _ = c.Read(r.Context())
+			}))
+	defer s.Close()
+
+	connected := make(chan struct{}, 1)
+	got, err := New(
+		URL(s.URL),
+		DeviceID("mac:112233445566"),
+		AddConnectListener(
+			event.ConnectListenerFunc(
+				func(e event.Connect) {
+					if e.Err == nil {
+						connected <- struct{}{}
+					}
+				})),
+		RetryPolicy(&retry.Config{
+			Interval: 10 * time.Second,
+		}),
+		WithIPv4(),
+		NowFunc(time.Now),
+		FetchURLTimeout(30*time.Second),
+		MaxMessageBytes(256*1024),
+		Subprotocols([]string{"wrp.json", "wrp.msgpack"}),
+	)
+	require.NoError(err)
+	require.NotNil(got)
+
+	assert.Empty(got.Subprotocol())
+
+	got.Start()
+	defer got.Stop()
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		require.Fail("timed out waiting for the connection")
+	}
+
+	require.Eventually(func() bool {
+		return got.ConnectionState() == Connected
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal("wrp.msgpack", got.Subprotocol())
+}
+
+func TestParseCloseRedirect(t *testing.T) {
+	tests := []struct {
+		description string
+		reason      string
+		expected    string
+		ok          bool
+	}{
+		{
+			description: "redirect hint",
+			reason:      `{"redirect":"wss://example.com/api/v2/device"}`,
+			expected:    "wss://example.com/api/v2/device",
+			ok:          true,
+		}, {
+			description: "no redirect hint",
+			reason:      `{"other":"value"}`,
+		}, {
+			description: "empty redirect hint",
+			reason:      `{"redirect":""}`,
+		}, {
+			description: "unstructured reason",
+			reason:      "going away",
+		}, {
+			description: "empty reason",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, ok := ParseCloseRedirect(websocket.CloseError{
+				Code:   websocket.StatusTryAgainLater,
+				Reason: tc.reason,
+			})
+			assert.Equal(tc.ok, ok)
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		description string
+		url         string
+		expected    string
+		expectedErr error
+	}{
+		{
+			description: "ws",
+			url:         "ws://example.com/api/v2/device",
+			expected:    "ws://example.com/api/v2/device",
+		}, {
+			description: "wss",
+			url:         "wss://example.com/api/v2/device",
+			expected:    "wss://example.com/api/v2/device",
+		}, {
+			description: "http",
+			url:         "http://example.com:8080/api/v2/device",
+			expected:    "ws://example.com:8080/api/v2/device",
+		}, {
+			description: "https",
+			url:         "https://example.com/api/v2/device?x=1",
+			expected:    "wss://example.com/api/v2/device?x=1",
+		}, {
+			description: "upper case scheme",
+			url:         "HTTPS://example.com/api/v2/device",
+			expected:    "wss://example.com/api/v2/device",
+		}, {
+			description: "unsupported scheme",
+			url:         "ftp://example.com/api/v2/device",
+			expectedErr: ErrInvalidURL,
+		}, {
+			description: "missing scheme",
+			url:         "example.com/api/v2/device",
+			expectedErr: ErrInvalidURL,
+		}, {
+			description: "missing host",
+			url:         "wss:///api/v2/device",
+			expectedErr: ErrInvalidURL,
+		}, {
+			description: "invalid url",
+			url:         "wss://exa mple.com:port",
+			expectedErr: ErrInvalidURL,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			got, err := normalizeURL(tc.url)
+			assert.ErrorIs(err, tc.expectedErr)
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
+func TestBackupURL(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+	now := time.Date(2024, time.May, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		fetchErr    error
+		opts        []Option
+		expected    string
+		expectedErr error
+		fallback    bool
+	}{
+		{
+			description: "primary url",
+			opts:        []Option{BackupURL("http://backup.example.com")},
+			expected:    "http://primary.example.com",
+		}, {
+			description: "primary fails and the backup is used",
+			fetchErr:    errFetch,
+			opts:        []Option{BackupURL("http://backup.example.com")},
+			expected:    "http://backup.example.com",
+			fallback:    true,
+		}, {
+			description: "primary fails without a backup",
+			fetchErr:    errFetch,
+			expectedErr: errFetch,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var fallbacks []event.URLFallback
+			got, err := New(append(tc.opts,
+				FetchURL(func(context.Context) (string, error) {
+					return "http://primary.example.com", tc.fetchErr
+				}),
+				AddURLFallbackListener(
+					event.URLFallbackListenerFunc(func(e event.URLFallback) {
+						fallbacks = append(fallbacks, e)
+					})),
+				DeviceID("mac:112233445566"),
+				WithIPv4(),
+				NowFunc(func() time.Time { return now }),
+				RetryPolicy(retry.Config{}),
+			)...)
+			require.NoError(err)
+			require.NotNil(got)
+
+			u, err := got.fetchURL(context.Background())
+			assert.ErrorIs(err, tc.expectedErr)
+			if tc.expectedErr != nil {
+				assert.Empty(u)
+				assert.Empty(got.URL())
+			} else {
+				assert.Equal(tc.expected, u)
+				assert.Equal(tc.expected, got.URL())
+			}
+
+			if !tc.fallback {
+				assert.Empty(fallbacks)
+				return
+			}
+
+			require.Len(fallbacks, 1)
+			assert.Equal(now, fallbacks[0].At)
+			assert.Equal(tc.expected, fallbacks[0].URL)
+			assert.ErrorIs(fallbacks[0].Err, errFetch)
+		})
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		description string
+		hint        string
+		expected    string
+	}{
+		{
+			description: "websocket url",
+			hint:        "wss://example.com/api/v2/device",
+			expected:    "wss://example.com/api/v2/device",
+		}, {
+			description: "http url",
+			hint:        "http://example.com",
+			expected:    "http://example.com",
+		}, {
+			description: "unsupported scheme",
+			hint:        "ftp://example.com",
+		}, {
+			description: "relative url",
+			hint:        "/api/v2/device",
+		}, {
+			description: "invalid url",
+			hint:        "wss://exa mple.com:port",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			got, err := New(
+				URL("http://example.com/primary"),
+				DeviceID("mac:112233445566"),
+				WithIPv4(),
+				NowFunc(time.Now),
+				RetryPolicy(retry.Config{}),
+				CloseRedirect(func(websocket.CloseError) (string, bool) {
+					return tc.hint, true
+				}),
+			)
+			require.NoError(err)
+			require.NotNil(got)
+			assert.Empty(got.URL())
+
+			got.redirect(websocket.CloseError{})
+			assert.Equal(tc.expected, got.redirectURL)
+
+			// The hint is only used for the next dial.
+			if tc.expected != "" {
+				u, err := got.fetchURL(context.Background())
+				require.NoError(err)
+				assert.Equal(tc.expected, u)
+				assert.Equal(tc.expected, got.URL())
+			}
+
+			u, err := got.fetchURL(context.Background())
+			require.NoError(err)
+			assert.Equal("http://example.com/primary", u)
+			assert.Equal("http://example.com/primary", got.URL())
+		})
+	}
+}
@@ -0,0 +1,192 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package diagnostics
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+var (
+	ErrInvalidInput = errors.New("invalid input")
+)
+
+const (
+	// DefaultMaxDisconnects is the default number of recent disconnects reported.
+	DefaultMaxDisconnects = 10
+)
+
+// Option is a functional option type for diagnostics Handler.
+type Option interface {
+	apply(*Handler) error
+}
+
+type optionFunc func(*Handler) error
+
+func (f optionFunc) apply(c *Handler) error {
+	return f(c)
+}
+
+// Transport is the state of the connection to the cloud.
+type Transport struct {
+	// State is the connection state, e.g. connected.
+	State string `json:"state"`
+	// URL is the url of the most recent connection attempt.
+	URL string `json:"url,omitempty"`
+}
+
+// Credentials is the state of the device credentials.
+type Credentials struct {
+	// Valid is whether the credentials are present and unexpired.
+	Valid bool `json:"valid"`
+	// ExpiresAt is when the credentials expire, if any are present.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Err is the reason the credentials are unavailable, if any.
+	Err string `json:"error,omitempty"`
+}
+
+// QOS is the state of the qos queue.
+type QOS struct {
+	QueuedMessages int               `json:"queued_messages"`
+	QueuedBytes    int64             `json:"queued_bytes"`
+	MaxQueueBytes  int64             `json:"max_queue_bytes"`
+	Dropped        map[string]uint64 `json:"dropped"`
+}
+
+// Disconnect is a recent disconnection from the cloud.
+type Disconnect struct {
+	At     time.Time `json:"at"`
+	Code   int       `json:"code,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Err    string    `json:"error,omitempty"`
+}
+
+// Snapshot is the diagnostics response payload.  Sections without a source
+// configured are omitted.
+type Snapshot struct {
+	At          time.Time    `json:"at"`
+	Transport   *Transport   `json:"transport,omitempty"`
+	Credentials *Credentials `json:"credentials,omitempty"`
+	QOS         *QOS         `json:"qos,omitempty"`
+	Disconnects []Disconnect `json:"recent_disconnects"`
+}
+
+// Handler responds to requests with a snapshot of the agent's transport,
+// credential and qos state, along with the most recent disconnects.
+type Handler struct {
+	egress wrpkit.Handler
+	source string
+
+	transport      func() Transport
+	credentials    func() Credentials
+	qos            func() QOS
+	maxDisconnects int
+	nowFunc        func() time.Time
+
+	m           sync.Mutex
+	disconnects []Disconnect
+}
+
+// New creates a new instance of the Handler struct.  The parameter egress is
+// the handler that will be called to send the response.  The parameter source
+// is the source to use in the response message.
+func New(egress wrpkit.Handler, source string, opts ...Option) (*Handler, error) {
+	h := Handler{
+		egress:         egress,
+		source:         source,
+		maxDisconnects: DefaultMaxDisconnects,
+		nowFunc:        time.Now,
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			if err := opt.apply(&h); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if h.egress == nil || h.source == "" {
+		return nil, ErrInvalidInput
+	}
+
+	return &h, nil
+}
+
+// OnDisconnect records the disconnect so it is reported by later snapshots.
+func (h *Handler) OnDisconnect(e event.Disconnect) {
+	d := Disconnect{
+		At:     e.At,
+		Code:   e.Code,
+		Reason: e.Reason,
+	}
+	if e.Err != nil {
+		d.Err = e.Err.Error()
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.disconnects = append(h.disconnects, d)
+	if len(h.disconnects) > h.maxDisconnects {
+		h.disconnects = h.disconnects[len(h.disconnects)-h.maxDisconnects:]
+	}
+}
+
+// Snapshot returns the current diagnostics.
+func (h *Handler) Snapshot() Snapshot {
+	s := Snapshot{
+		At: h.nowFunc(),
+	}
+
+	if h.transport != nil {
+		t := h.transport()
+		s.Transport = &t
+	}
+	if h.credentials != nil {
+		c := h.credentials()
+		s.Credentials = &c
+	}
+	if h.qos != nil {
+		q := h.qos()
+		s.QOS = &q
+	}
+
+	h.m.Lock()
+	s.Disconnects = append([]Disconnect{}, h.disconnects...)
+	h.m.Unlock()
+
+	return s
+}
+
+// HandleWrp responds to messages expecting a response with the current
+// snapshot.  Other messages are not handled.
+func (h *Handler) HandleWrp(msg wrp.Message) error {
+	if !msg.Type.RequiresTransaction() {
+		return wrpkit.ErrNotHandled
+	}
+
+	payload, err := json.Marshal(h.Snapshot())
+	if err != nil {
+		return err
+	}
+
+	statusCode := int64(http.StatusOK)
+
+	response := msg
+	response.Destination = msg.Source
+	response.Source = h.source
+	response.ContentType = "application/json"
+	response.Status = &statusCode
+	response.Payload = payload
+
+	return h.egress.HandleWrp(response)
+}
@@ -0,0 +1,202 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package diagnostics_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/websocket/event"
+	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/diagnostics"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+func TestNew(t *testing.T) {
+	egress := wrpkit.HandlerFunc(func(wrp.Message) error { return nil })
+
+	tests := []struct {
+		description string
+		egress      wrpkit.Handler
+		source      string
+		opts        []diagnostics.Option
+		expectedErr error
+	}{
+		{
+			description: "valid",
+			egress:      egress,
+			source:      "mac:112233445566",
+		}, {
+			description: "all options",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts: []diagnostics.Option{
+				diagnostics.TransportFunc(func() diagnostics.Transport { return diagnostics.Transport{} }),
+				diagnostics.CredentialsFunc(func() diagnostics.Credentials { return diagnostics.Credentials{} }),
+				diagnostics.QOSFunc(func() diagnostics.QOS { return diagnostics.QOS{} }),
+				diagnostics.MaxDisconnects(0),
+				diagnostics.NowFunc(time.Now),
+			},
+		}, {
+			description: "nil egress",
+			source:      "mac:112233445566",
+			expectedErr: diagnostics.ErrInvalidInput,
+		}, {
+			description: "empty source",
+			egress:      egress,
+			expectedErr: diagnostics.ErrInvalidInput,
+		}, {
+			description: "nil transport func",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []diagnostics.Option{diagnostics.TransportFunc(nil)},
+			expectedErr: diagnostics.ErrInvalidInput,
+		}, {
+			description: "nil credentials func",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []diagnostics.Option{diagnostics.CredentialsFunc(nil)},
+			expectedErr: diagnostics.ErrInvalidInput,
+		}, {
+			description: "nil qos func",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []diagnostics.Option{diagnostics.QOSFunc(nil)},
+			expectedErr: diagnostics.ErrInvalidInput,
+		}, {
+			description: "negative max disconnects",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []diagnostics.Option{diagnostics.MaxDisconnects(-1)},
+			expectedErr: diagnostics.ErrInvalidInput,
+		}, {
+			description: "nil now func",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []diagnostics.Option{diagnostics.NowFunc(nil)},
+			expectedErr: diagnostics.ErrInvalidInput,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			h, err := diagnostics.New(tc.egress, tc.source, tc.opts...)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				assert.Nil(t, h)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.NotNil(t, h)
+		})
+	}
+}
+
+func TestHandler_HandleWrp(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expires := now.Add(time.Hour)
+
+	var response wrp.Message
+	egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+		response = msg
+		return nil
+	})
+
+	h, err := diagnostics.New(egress, "mac:112233445566/diagnostics",
+		diagnostics.NowFunc(func() time.Time { return now }),
+		diagnostics.MaxDisconnects(2),
+		diagnostics.TransportFunc(func() diagnostics.Transport {
+			return diagnostics.Transport{State: "connected", URL: "wss://example.com/api/v2/device"}
+		}),
+		diagnostics.CredentialsFunc(func() diagnostics.Credentials {
+			return diagnostics.Credentials{Valid: true, ExpiresAt: &expires}
+		}),
+		diagnostics.QOSFunc(func() diagnostics.QOS {
+			return diagnostics.QOS{
+				QueuedMessages: 3,
+				QueuedBytes:    42,
+				MaxQueueBytes:  1024,
+				Dropped:        map[string]uint64{"low": 1},
+			}
+		}),
+	)
+	require.NoError(t, err)
+
+	h.OnDisconnect(event.Disconnect{At: now.Add(-3 * time.Minute), Err: errors.New("first")})
+	h.OnDisconnect(event.Disconnect{At: now.Add(-2 * time.Minute), Code: 4000, Reason: "shutdown"})
+	h.OnDisconnect(event.Disconnect{At: now.Add(-time.Minute), Err: errors.New("third")})
+
+	// Messages that don't expect a response are not handled.
+	err = h.HandleWrp(wrp.Message{Type: wrp.SimpleEventMessageType})
+	assert.ErrorIs(t, err, wrpkit.ErrNotHandled)
+
+	err = h.HandleWrp(wrp.Message{
+		Type:            wrp.SimpleRequestResponseMessageType,
+		Source:          "dns:tr1d1um.example.com/service/ignored",
+		Destination:     "mac:112233445566/diagnostics",
+		TransactionUUID: "1234",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "dns:tr1d1um.example.com/service/ignored", response.Destination)
+	assert.Equal(t, "mac:112233445566/diagnostics", response.Source)
+	assert.Equal(t, "1234", response.TransactionUUID)
+	assert.Equal(t, "application/json", response.ContentType)
+	require.NotNil(t, response.Status)
+	assert.Equal(t, int64(200), *response.Status)
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(response.Payload, &got))
+
+	assert.Equal(t, "2024-01-02T03:04:05Z", got["at"])
+	assert.Equal(t, map[string]any{
+		"state": "connected",
+		"url":   "wss://example.com/api/v2/device",
+	}, got["transport"])
+	assert.Equal(t, map[string]any{
+		"valid":      true,
+		"expires_at": "2024-01-02T04:04:05Z",
+	}, got["credentials"])
+	assert.Equal(t, map[string]any{
+		"queued_messages": float64(3),
+		"queued_bytes":    float64(42),
+		"max_queue_bytes": float64(1024),
+		"dropped":         map[string]any{"low": float64(1)},
+	}, got["qos"])
+
+	// Only the most recent disconnects are kept.
+	assert.Equal(t, []any{
+		map[string]any{"at": "2024-01-02T03:02:05Z", "code": float64(4000), "reason": "shutdown"},
+		map[string]any{"at": "2024-01-02T03:03:05Z", "error": "third"},
+	}, got["recent_disconnects"])
+}
+
+func TestHandler_SnapshotSections(t *testing.T) {
+	egress := wrpkit.HandlerFunc(func(wrp.Message) error { return nil })
+
+	h, err := diagnostics.New(egress, "mac:112233445566")
+	require.NoError(t, err)
+
+	// Sections without a source are omitted.
+	s := h.Snapshot()
+	assert.Nil(t, s.Transport)
+	assert.Nil(t, s.Credentials)
+	assert.Nil(t, s.QOS)
+	assert.Empty(t, s.Disconnects)
+
+	payload, err := json.Marshal(s)
+	require.NoError(t, err)
+
+	var got map[string]any
+	require.NoError(t, json.Unmarshal(payload, &got))
+	assert.NotContains(t, got, "transport")
+	assert.NotContains(t, got, "credentials")
+	assert.NotContains(t, got, "qos")
+	assert.Equal(t, []any{}, got["recent_disconnects"])
+}
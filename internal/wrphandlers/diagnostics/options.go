@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package diagnostics
+
+import (
+	"fmt"
+	"time"
+)
+
+// TransportFunc sets the source of the transport section of the snapshot.
+func TransportFunc(f func() Transport) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if f == nil {
+				return fmt.Errorf("%w: nil transport func", ErrInvalidInput)
+			}
+
+			h.transport = f
+			return nil
+		})
+}
+
+// CredentialsFunc sets the source of the credentials section of the snapshot.
+func CredentialsFunc(f func() Credentials) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if f == nil {
+				return fmt.Errorf("%w: nil credentials func", ErrInvalidInput)
+			}
+
+			h.credentials = f
+			return nil
+		})
+}
+
+// QOSFunc sets the source of the qos section of the snapshot.
+func QOSFunc(f func() QOS) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if f == nil {
+				return fmt.Errorf("%w: nil qos func", ErrInvalidInput)
+			}
+
+			h.qos = f
+			return nil
+		})
+}
+
+// MaxDisconnects sets the number of recent disconnects reported.  Zero uses
+// DefaultMaxDisconnects.
+func MaxDisconnects(n int) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if n < 0 {
+				return fmt.Errorf("%w: negative max disconnects", ErrInvalidInput)
+			}
+
+			h.maxDisconnects = n
+			if n == 0 {
+				h.maxDisconnects = DefaultMaxDisconnects
+			}
+			return nil
+		})
+}
+
+// NowFunc sets the function used to timestamp the snapshot.
+func NowFunc(f func() time.Time) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if f == nil {
+				return fmt.Errorf("%w: nil now func", ErrInvalidInput)
+			}
+
+			h.nowFunc = f
+			return nil
+		})
+}
@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package metadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+var (
+	ErrInvalidInput   = errors.New("invalid input")
+	ErrInvalidRequest = errors.New("invalid metadata request")
+)
+
+// Provider computes the metadata returned by the Handler.
+type Provider interface {
+	// GetMetadata returns all of the configured metadata fields.
+	GetMetadata() map[string]interface{}
+	// GetMetadataFields returns the requested metadata fields, intersected
+	// with the configured fields.
+	GetMetadataFields(fields []string) map[string]interface{}
+}
+
+// Request is the optional payload of a metadata request.
+type Request struct {
+	// Fields limits the response to the listed fields, intersected with the
+	// configured fields.  All of the configured fields are returned if it is
+	// empty.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Handler responds to requests with the device metadata, optionally limited
+// to the fields listed by the request.
+type Handler struct {
+	egress   wrpkit.Handler
+	source   string
+	provider Provider
+}
+
+// New creates a new instance of the Handler struct.  The parameter egress is
+// the handler that will be called to send the response.  The parameter source
+// is the source to use in the response message and provider computes the
+// metadata.
+func New(egress wrpkit.Handler, source string, provider Provider) (*Handler, error) {
+	if egress == nil || source == "" || provider == nil {
+		return nil, ErrInvalidInput
+	}
+
+	return &Handler{
+		egress:   egress,
+		source:   source,
+		provider: provider,
+	}, nil
+}
+
+// HandleWrp responds to messages expecting a response with the metadata
+// fields asked for by the optional Request payload.  Other messages are not
+// handled.
+func (h *Handler) HandleWrp(msg wrp.Message) error {
+	if !msg.Type.RequiresTransaction() {
+		return wrpkit.ErrNotHandled
+	}
+
+	response := msg
+	response.Destination = msg.Source
+	response.Source = h.source
+	response.ContentType = "application/json"
+
+	var req Request
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &req); err != nil {
+			code := int64(http.StatusBadRequest)
+			response.Status = &code
+			response.Payload = []byte(fmt.Sprintf(`{statusCode: %d, message:"Invalid metadata request."}`, code))
+			return errors.Join(ErrInvalidRequest, err, h.egress.HandleWrp(response))
+		}
+	}
+
+	metadata := h.provider.GetMetadata()
+	if len(req.Fields) > 0 {
+		metadata = h.provider.GetMetadataFields(req.Fields)
+	}
+
+	payload, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	code := int64(http.StatusOK)
+	response.Status = &code
+	response.Payload = payload
+
+	return h.egress.HandleWrp(response)
+}
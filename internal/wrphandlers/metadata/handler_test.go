@@ -0,0 +1,202 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package metadata_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/metadata"
+	handler "github.com/xmidt-org/xmidt-agent/internal/wrphandlers/metadata"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+func newProvider(t *testing.T) *metadata.MetadataProvider {
+	provider, err := metadata.New(
+		metadata.FieldsOpt([]string{metadata.Firmware, metadata.Hardware, metadata.BootTime}),
+		metadata.FirmwareOpt("1.1"),
+		metadata.HardwareModelOpt("some-model"),
+		metadata.BootTimeOpt("1111111111"),
+	)
+	require.NoError(t, err)
+
+	return provider
+}
+
+func TestNew(t *testing.T) {
+	egress := wrpkit.HandlerFunc(func(wrp.Message) error { return nil })
+	provider := newProvider(t)
+
+	tests := []struct {
+		description string
+		egress      wrpkit.Handler
+		source      string
+		provider    handler.Provider
+		expectedErr error
+	}{
+		{
+			description: "valid",
+			egress:      egress,
+			source:      "mac:112233445566",
+			provider:    provider,
+		}, {
+			description: "nil egress",
+			source:      "mac:112233445566",
+			provider:    provider,
+			expectedErr: handler.ErrInvalidInput,
+		}, {
+			description: "empty source",
+			egress:      egress,
+			provider:    provider,
+			expectedErr: handler.ErrInvalidInput,
+		}, {
+			description: "nil provider",
+			egress:      egress,
+			source:      "mac:112233445566",
+			expectedErr: handler.ErrInvalidInput,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			h, err := handler.New(tc.egress, tc.source, tc.provider)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				assert.Nil(t, h)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.NotNil(t, h)
+		})
+	}
+}
+
+func TestHandler_HandleWrp(t *testing.T) {
+	tests := []struct {
+		description    string
+		msg            wrp.Message
+		expectedErr    error
+		expectedStatus int64
+		responded      bool
+		expected       map[string]interface{}
+	}{
+		{
+			description: "full set",
+			msg: wrp.Message{
+				Type:   wrp.SimpleRequestResponseMessageType,
+				Source: "dns:talaria.example.com/service",
+			},
+			expectedStatus: 200,
+			responded:      true,
+			expected: map[string]interface{}{
+				metadata.Firmware: "1.1",
+				metadata.Hardware: "some-model",
+				metadata.BootTime: "1111111111",
+			},
+		}, {
+			description: "empty field list",
+			msg: wrp.Message{
+				Type:    wrp.SimpleRequestResponseMessageType,
+				Source:  "dns:talaria.example.com/service",
+				Payload: []byte(`{"fields":[]}`),
+			},
+			expectedStatus: 200,
+			responded:      true,
+			expected: map[string]interface{}{
+				metadata.Firmware: "1.1",
+				metadata.Hardware: "some-model",
+				metadata.BootTime: "1111111111",
+			},
+		}, {
+			description: "subset",
+			msg: wrp.Message{
+				Type:    wrp.SimpleRequestResponseMessageType,
+				Source:  "dns:talaria.example.com/service",
+				Payload: []byte(`{"fields":["fw-name","boot-time"]}`),
+			},
+			expectedStatus: 200,
+			responded:      true,
+			expected: map[string]interface{}{
+				metadata.Firmware: "1.1",
+				metadata.BootTime: "1111111111",
+			},
+		}, {
+			description: "fields that are not configured are ignored",
+			msg: wrp.Message{
+				Type:    wrp.SimpleRequestResponseMessageType,
+				Source:  "dns:talaria.example.com/service",
+				Payload: []byte(`{"fields":["hw-model","webpa-uptime"]}`),
+			},
+			expectedStatus: 200,
+			responded:      true,
+			expected: map[string]interface{}{
+				metadata.Hardware: "some-model",
+			},
+		}, {
+			description: "invalid request",
+			msg: wrp.Message{
+				Type:    wrp.SimpleRequestResponseMessageType,
+				Source:  "dns:talaria.example.com/service",
+				Payload: []byte(`{"fields":`),
+			},
+			expectedErr:    handler.ErrInvalidRequest,
+			expectedStatus: 400,
+			responded:      true,
+		}, {
+			description: "no response expected",
+			msg: wrp.Message{
+				Type:   wrp.SimpleEventMessageType,
+				Source: "dns:talaria.example.com/service",
+			},
+			expectedErr: wrpkit.ErrNotHandled,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var (
+				responded bool
+				response  wrp.Message
+			)
+			egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+				responded = true
+				response = msg
+				return nil
+			})
+
+			h, err := handler.New(egress, "mac:112233445566", newProvider(t))
+			require.NoError(err)
+
+			err = h.HandleWrp(tc.msg)
+			assert.ErrorIs(err, tc.expectedErr)
+			if tc.expectedErr == nil {
+				assert.NoError(err)
+			}
+
+			require.Equal(tc.responded, responded)
+			if !responded {
+				return
+			}
+
+			assert.Equal(tc.msg.Source, response.Destination)
+			assert.Equal("mac:112233445566", response.Source)
+			assert.Equal("application/json", response.ContentType)
+			require.NotNil(response.Status)
+			assert.Equal(tc.expectedStatus, *response.Status)
+			if tc.expected == nil {
+				return
+			}
+
+			var got map[string]interface{}
+			require.NoError(json.Unmarshal(response.Payload, &got))
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
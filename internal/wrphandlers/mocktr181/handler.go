@@ -4,13 +4,20 @@
 package mocktr181
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/xmidt-org/wrp-go/v3"
 	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
@@ -20,10 +27,32 @@ var (
 	ErrInvalidInput           = fmt.Errorf("invalid input")
 	ErrInvalidFileInput       = fmt.Errorf("misconfigured file input")
 	ErrUnableToReadFile       = fmt.Errorf("unable to read file")
+	ErrUnableToWriteFile      = fmt.Errorf("unable to write file")
 	ErrInvalidPayload         = fmt.Errorf("invalid request payload")
 	ErrInvalidResponsePayload = fmt.Errorf("invalid response payload")
 )
 
+// wildcard is the name segment that matches any single segment of a parameter name.
+const wildcard = "*"
+
+// maxPatternLength is the longest pattern accepted by GET_REGEX.
+const maxPatternLength = 256
+
+// The tr181 parameter data types.
+const (
+	dataTypeString = iota
+	dataTypeInt
+	dataTypeUnsignedInt
+	dataTypeBoolean
+	dataTypeDateTime
+	dataTypeBase64
+	dataTypeLong
+	dataTypeUnsignedLong
+	dataTypeFloat
+	dataTypeDouble
+	dataTypeByte
+)
+
 // Option is a functional option type for mocktr181 Handler.
 type Option interface {
 	apply(*Handler) error
@@ -36,20 +65,28 @@ func (f optionFunc) apply(c *Handler) error {
 }
 
 type Handler struct {
-	egress     wrpkit.Handler
-	source     string
-	filePath   string
-	parameters []MockParameter
-	enabled    bool
+	egress        wrpkit.Handler
+	source        string
+	filePath      string
+	parameters    []MockParameter
+	enabled       bool
+	persist       bool
+	subscriptions *subscriptions
+}
+
+// subscriptions tracks the parameter names watched by each subscriber.
+type subscriptions struct {
+	lock  sync.Mutex
+	names map[string][]string
 }
 
 type MockParameter struct {
-	Name       string
-	Value      string
-	Access     string
-	DataType   int // add json labels here
-	Attributes map[string]interface{}
-	Delay      int
+	Name       string                 `json:"name"`
+	Value      string                 `json:"value"`
+	Access     string                 `json:"access"`
+	DataType   int                    `json:"type"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Delay      int                    `json:"delay,omitempty"`
 }
 
 type MockParameters struct {
@@ -59,6 +96,7 @@ type MockParameters struct {
 type Tr181Payload struct {
 	Command    string      `json:"command"`
 	Names      []string    `json:"names"`
+	Attributes string      `json:"attributes,omitempty"`
 	Parameters []Parameter `json:"parameters"`
 	StatusCode int         `json:"statusCode"`
 }
@@ -85,6 +123,9 @@ func New(egress wrpkit.Handler, source string, opts ...Option) (*Handler, error)
 	h := Handler{
 		egress: egress,
 		source: source,
+		subscriptions: &subscriptions{
+			names: make(map[string][]string),
+		},
 	}
 
 	for _, opt := range opts {
@@ -113,9 +154,10 @@ func (h Handler) Enabled() bool {
 	return h.enabled
 }
 
-// HandleWrp is called to process a tr181 command
+// HandleWrp is called to process a tr181 command.  Any parameter changes made by
+// the command are then sent as events to the subscribers watching them.
 func (h Handler) HandleWrp(msg wrp.Message) error {
-	statusCode, payloadResponse, err := h.proccessCommand(msg.Payload)
+	statusCode, payloadResponse, events, err := h.proccessCommand(msg.Source, msg.Payload)
 	if err != nil {
 		return errors.Join(err, wrpkit.ErrNotHandled)
 	}
@@ -130,34 +172,69 @@ func (h Handler) HandleWrp(msg wrp.Message) error {
 		return errors.Join(err, wrpkit.ErrNotHandled)
 	}
 
-	return nil
+	var errs error
+	for _, event := range events {
+		errs = errors.Join(errs, h.egress.HandleWrp(event))
+	}
+
+	return errs
 }
 
-func (h Handler) proccessCommand(wrpPayload []byte) (int64, []byte, error) {
+// proccessCommand runs the tr181 command requested by source and returns the
+// response status code and payload, along with the events to send for any
+// parameter changes.
+func (h Handler) proccessCommand(source string, wrpPayload []byte) (int64, []byte, []wrp.Message, error) {
 	var (
 		err             error
 		payloadResponse []byte
+		changed         []Parameter
+		events          []wrp.Message
 		statusCode      = int64(520)
 	)
 
 	if len(wrpPayload) == 0 {
-		return statusCode, []byte(fmt.Sprintf(`{"message": ""Invalid Input Command"", "statusCode": %d}`, statusCode)), nil
+		return statusCode, []byte(fmt.Sprintf(`{"message": ""Invalid Input Command"", "statusCode": %d}`, statusCode)), nil, nil
 	}
 
 	payload := new(Tr181Payload)
 	err = json.Unmarshal(wrpPayload, &payload)
 	if err != nil {
-		return statusCode, payloadResponse, err
+		return statusCode, payloadResponse, nil, err
 	}
 
 	switch payload.Command {
 	case "GET":
-		return h.get(payload)
+		statusCode, payloadResponse, err = h.get(payload)
+		return statusCode, payloadResponse, nil, err
+	case "GET_REGEX":
+		statusCode, payloadResponse, err = h.getRegex(payload)
+		return statusCode, payloadResponse, nil, err
+	case "GET_ATTRIBUTES":
+		statusCode, payloadResponse, err = h.getAttributes(payload)
+		return statusCode, payloadResponse, nil, err
 	case "SET":
-		return h.set(payload)
+		statusCode, payloadResponse, changed, err = h.set(payload)
+		if err != nil {
+			return statusCode, payloadResponse, nil, err
+		}
+
+		if h.persist && statusCode == http.StatusAccepted {
+			if err = h.saveFile(); err != nil {
+				return statusCode, payloadResponse, nil, err
+			}
+		}
+
+		events, err = h.notifications(changed)
+		return statusCode, payloadResponse, events, err
+	case "SUBSCRIBE":
+		statusCode, payloadResponse, err = h.subscribe(source, payload)
+		return statusCode, payloadResponse, nil, err
+	case "UNSUBSCRIBE":
+		statusCode, payloadResponse, err = h.unsubscribe(source, payload)
+		return statusCode, payloadResponse, nil, err
 	default:
-		// currently only get and set are implemented for existing mocktr181
-		return statusCode, []byte(fmt.Sprintf(`{"message": "command '%s' is not supported", "statusCode": %d}`, payload.Command, statusCode)), nil
+		// currently only get, get regex, get attributes, set, subscribe and unsubscribe are implemented for existing mocktr181
+		return statusCode, []byte(fmt.Sprintf(`{"message": "command '%s' is not supported", "statusCode": %d}`, payload.Command, statusCode)), nil, nil
 	}
 }
 
@@ -179,7 +256,7 @@ func (h Handler) get(tr181 *Tr181Payload) (int64, []byte, error) {
 				continue
 			}
 
-			if !strings.HasPrefix(mockParameter.Name, name) {
+			if !matches(mockParameter.Name, name) {
 				continue
 			}
 
@@ -199,7 +276,7 @@ func (h Handler) get(tr181 *Tr181Payload) (int64, []byte, error) {
 
 			// If the requested parameter is a wild card and is not readable,
 			// then continue and don't count it as a failure.
-			if name[len(name)-1] == '.' {
+			if name[len(name)-1] == '.' || strings.Contains(name, wildcard) {
 				continue
 			}
 
@@ -231,7 +308,203 @@ func (h Handler) get(tr181 *Tr181Payload) (int64, []byte, error) {
 	return int64(result.StatusCode), payload, nil
 }
 
-func (h Handler) set(tr181 *Tr181Payload) (int64, []byte, error) {
+// getRegex returns every readable parameter whose name matches the RE2
+// pattern of the first requested name.  Matching is unanchored, so patterns
+// should use ^ and $ to match whole names.
+func (h Handler) getRegex(tr181 *Tr181Payload) (int64, []byte, error) {
+	result := Tr181Payload{
+		Command:    tr181.Command,
+		Names:      tr181.Names,
+		StatusCode: http.StatusOK,
+	}
+
+	var (
+		pattern *regexp.Regexp
+		err     error
+	)
+	switch {
+	case len(tr181.Names) == 0 || tr181.Names[0] == "":
+		err = errors.New("missing pattern")
+	case len(tr181.Names[0]) > maxPatternLength:
+		err = fmt.Errorf("pattern is longer than %d characters", maxPatternLength)
+	default:
+		// RE2 patterns run in linear time, so only their length needs a limit.
+		pattern, err = regexp.Compile(tr181.Names[0])
+	}
+
+	if err == nil {
+		for _, mockParameter := range h.parameters {
+			if !strings.Contains(mockParameter.Access, "r") || !pattern.MatchString(mockParameter.Name) {
+				continue
+			}
+
+			result.Parameters = append(result.Parameters, Parameter{
+				Name:       mockParameter.Name,
+				Value:      mockParameter.Value,
+				DataType:   mockParameter.DataType,
+				Attributes: mockParameter.Attributes,
+				Message:    "Success",
+				Count:      1,
+			})
+		}
+
+		if len(result.Parameters) == 0 {
+			// No parameters matched the pattern.
+			result.Parameters = []Parameter{{
+				Message: fmt.Sprintf("Invalid parameter names: %s", tr181.Names[:1]),
+			}}
+			result.StatusCode = 520
+		}
+	}
+
+	if err != nil {
+		result.Parameters = []Parameter{{
+			Message: fmt.Sprintf("Invalid pattern: %s", err),
+		}}
+		result.StatusCode = 520
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return http.StatusInternalServerError, payload, errors.Join(ErrInvalidResponsePayload, err)
+	}
+
+	return int64(result.StatusCode), payload, nil
+}
+
+// getAttributes returns the requested attributes of every readable parameter
+// selected by the requested names, or all of their attributes if none are
+// requested.  The attributes are requested as a comma separated list (e.g.
+// "notify").  Missing attributes and names that select no parameters are
+// reported alongside the successful parameters, with an error status.
+func (h Handler) getAttributes(tr181 *Tr181Payload) (int64, []byte, error) {
+	result := Tr181Payload{
+		Command:    tr181.Command,
+		Names:      tr181.Names,
+		Attributes: tr181.Attributes,
+		StatusCode: http.StatusOK,
+	}
+
+	var attributes []string
+	for _, attribute := range strings.Split(tr181.Attributes, ",") {
+		if attribute = strings.TrimSpace(attribute); attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+
+	var (
+		failedParams   []Parameter
+		readableParams []Parameter
+	)
+	for _, name := range tr181.Names {
+		var found bool
+		for _, mockParameter := range h.parameters {
+			if name == "" || !matches(mockParameter.Name, name) {
+				continue
+			}
+
+			// Unreadable parameters are skipped, like GET.
+			if !strings.Contains(mockParameter.Access, "r") {
+				continue
+			}
+
+			found = true
+			if len(attributes) == 0 {
+				readableParams = append(readableParams, Parameter{
+					Name:       mockParameter.Name,
+					Attributes: mockParameter.Attributes,
+					Message:    "Success",
+					Count:      1,
+				})
+				continue
+			}
+
+			var missing []string
+			values := make(map[string]interface{}, len(attributes))
+			for _, attribute := range attributes {
+				value, ok := mockParameter.Attributes[attribute]
+				if !ok {
+					missing = append(missing, attribute)
+					continue
+				}
+
+				values[attribute] = value
+			}
+
+			if len(missing) != 0 {
+				failedParams = append(failedParams, Parameter{
+					Name:    mockParameter.Name,
+					Message: fmt.Sprintf("Invalid attributes: %s", missing),
+				})
+				continue
+			}
+
+			readableParams = append(readableParams, Parameter{
+				Name:       mockParameter.Name,
+				Attributes: values,
+				Message:    "Success",
+				Count:      1,
+			})
+		}
+
+		if !found {
+			// Requested parameter was not found.
+			failedParams = append(failedParams, Parameter{
+				Name:    name,
+				Message: "Invalid parameter name",
+			})
+		}
+	}
+
+	result.Parameters = append(readableParams, failedParams...)
+	if len(tr181.Names) == 0 || len(failedParams) != 0 {
+		result.StatusCode = 520
+	}
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return http.StatusInternalServerError, payload, errors.Join(ErrInvalidResponsePayload, err)
+	}
+
+	return int64(result.StatusCode), payload, nil
+}
+
+// matches determines whether the requested name selects the parameter.  Names
+// select parameters by prefix, unless they contain a `*` segment, which matches
+// any single segment (e.g. Device.WiFi.Radio.*.Channel selects the channel of
+// every radio).  Names with a wildcard are matched segment by segment, where a
+// trailing `.` selects the whole subtree.
+func matches(parameter, name string) bool {
+	if !strings.Contains(name, wildcard) {
+		return strings.HasPrefix(parameter, name)
+	}
+
+	want := strings.Split(name, ".")
+	got := strings.Split(parameter, ".")
+	if want[len(want)-1] == "" {
+		want = want[:len(want)-1]
+		if len(got) <= len(want) {
+			return false
+		}
+		got = got[:len(want)]
+	}
+
+	if len(got) != len(want) {
+		return false
+	}
+
+	for i := range want {
+		if want[i] != wildcard && want[i] != got[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// set updates the requested parameters and returns the parameters whose values
+// changed, along with the response status code and payload.
+func (h Handler) set(tr181 *Tr181Payload) (int64, []byte, []Parameter, error) {
 	result := Tr181Payload{
 		Command:    tr181.Command,
 		Names:      tr181.Names,
@@ -241,6 +514,7 @@ func (h Handler) set(tr181 *Tr181Payload) (int64, []byte, error) {
 	var (
 		writableParams []*MockParameter
 		failedParams   []Parameter
+		changedParams  []Parameter
 	)
 	// Check for any parameters that are not writable.
 	for _, parameter := range tr181.Parameters {
@@ -254,6 +528,15 @@ func (h Handler) set(tr181 *Tr181Payload) (int64, []byte, error) {
 			// Check whether mockParameter is writable.
 			if strings.Contains(mockParameter.Access, "w") {
 				found = true
+				// Check whether the value matches the declared data type of mockParameter.
+				if !validValue(mockParameter.DataType, parameter.Value) {
+					failedParams = append(failedParams, Parameter{
+						Name:    mockParameter.Name,
+						Message: "Invalid value type",
+					})
+					continue
+				}
+
 				// Add mockParameter to the list of parameters to be updated.
 				writableParams = append(writableParams, mockParameter)
 				continue
@@ -291,8 +574,9 @@ func (h Handler) set(tr181 *Tr181Payload) (int64, []byte, error) {
 				continue
 			}
 
+			// The declared data type of mockParameter is kept.
+			changed := mockParameter.Value != parameter.Value
 			mockParameter.Value = parameter.Value
-			mockParameter.DataType = parameter.DataType
 			mockParameter.Attributes = parameter.Attributes
 			result.Parameters = append(result.Parameters, Parameter{
 				Name:       mockParameter.Name,
@@ -301,9 +585,100 @@ func (h Handler) set(tr181 *Tr181Payload) (int64, []byte, error) {
 				Attributes: mockParameter.Attributes,
 				Message:    "Success",
 			})
+
+			if changed {
+				changedParams = append(changedParams, Parameter{
+					Name:       mockParameter.Name,
+					Value:      mockParameter.Value,
+					DataType:   mockParameter.DataType,
+					Attributes: mockParameter.Attributes,
+				})
+			}
 		}
 	}
 
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return http.StatusInternalServerError, payload, nil, errors.Join(ErrInvalidResponsePayload, err)
+	}
+
+	return int64(result.StatusCode), payload, changedParams, nil
+}
+
+// validValue determines whether value is a valid value of the data type.
+// Unknown data types accept any value.
+func validValue(dataType int, value string) bool {
+	var err error
+	switch dataType {
+	case dataTypeInt:
+		_, err = strconv.ParseInt(value, 10, 32)
+	case dataTypeUnsignedInt:
+		_, err = strconv.ParseUint(value, 10, 32)
+	case dataTypeBoolean:
+		_, err = strconv.ParseBool(value)
+	case dataTypeDateTime:
+		if _, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			// Local date times without a time zone are allowed too.
+			_, err = time.Parse("2006-01-02T15:04:05.999999999", value)
+		}
+	case dataTypeBase64:
+		_, err = base64.StdEncoding.DecodeString(value)
+	case dataTypeLong:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case dataTypeUnsignedLong:
+		_, err = strconv.ParseUint(value, 10, 64)
+	case dataTypeFloat:
+		_, err = strconv.ParseFloat(value, 32)
+	case dataTypeDouble:
+		_, err = strconv.ParseFloat(value, 64)
+	case dataTypeByte:
+		_, err = strconv.ParseUint(value, 10, 8)
+	}
+
+	return err == nil
+}
+
+// subscribe registers the requested names as watched by source, so changes to
+// the parameters they select are sent to source as events.  Names select
+// parameters the same way as GET.
+func (h Handler) subscribe(source string, tr181 *Tr181Payload) (int64, []byte, error) {
+	result := Tr181Payload{
+		Command:    tr181.Command,
+		Names:      tr181.Names,
+		StatusCode: http.StatusOK,
+	}
+
+	var failedNames []string
+	for _, name := range tr181.Names {
+		found := slices.ContainsFunc(h.parameters, func(p MockParameter) bool {
+			return name != "" && matches(p.Name, name)
+		})
+		if !found {
+			failedNames = append(failedNames, name)
+		}
+	}
+
+	switch {
+	case source == "" || len(tr181.Names) == 0:
+		result.Parameters = []Parameter{{
+			Message: "Invalid subscription",
+		}}
+		result.StatusCode = 520
+	case len(failedNames) != 0:
+		result.Parameters = []Parameter{{
+			Message: fmt.Sprintf("Invalid parameter names: %s", failedNames),
+		}}
+		result.StatusCode = 520
+	default:
+		h.subscriptions.lock.Lock()
+		for _, name := range tr181.Names {
+			if !slices.Contains(h.subscriptions.names[source], name) {
+				h.subscriptions.names[source] = append(h.subscriptions.names[source], name)
+			}
+		}
+		h.subscriptions.lock.Unlock()
+	}
+
 	payload, err := json.Marshal(result)
 	if err != nil {
 		return http.StatusInternalServerError, payload, errors.Join(ErrInvalidResponsePayload, err)
@@ -312,6 +687,88 @@ func (h Handler) set(tr181 *Tr181Payload) (int64, []byte, error) {
 	return int64(result.StatusCode), payload, nil
 }
 
+// unsubscribe stops watching the requested names for source, or all of the
+// names watched by source if none are requested.
+func (h Handler) unsubscribe(source string, tr181 *Tr181Payload) (int64, []byte, error) {
+	result := Tr181Payload{
+		Command:    tr181.Command,
+		Names:      tr181.Names,
+		StatusCode: http.StatusOK,
+	}
+
+	h.subscriptions.lock.Lock()
+	names := slices.DeleteFunc(h.subscriptions.names[source], func(name string) bool {
+		return len(tr181.Names) == 0 || slices.Contains(tr181.Names, name)
+	})
+	if len(names) == 0 {
+		delete(h.subscriptions.names, source)
+	} else {
+		h.subscriptions.names[source] = names
+	}
+	h.subscriptions.lock.Unlock()
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return http.StatusInternalServerError, payload, errors.Join(ErrInvalidResponsePayload, err)
+	}
+
+	return int64(result.StatusCode), payload, nil
+}
+
+// notifications returns an event for each subscriber watching any of the
+// changed parameters, listing the changed parameters it watches.
+func (h Handler) notifications(changed []Parameter) ([]wrp.Message, error) {
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	h.subscriptions.lock.Lock()
+	defer h.subscriptions.lock.Unlock()
+
+	subscribers := make([]string, 0, len(h.subscriptions.names))
+	for subscriber := range h.subscriptions.names {
+		subscribers = append(subscribers, subscriber)
+	}
+	slices.Sort(subscribers)
+
+	var events []wrp.Message
+	for _, subscriber := range subscribers {
+		names := h.subscriptions.names[subscriber]
+
+		var watched []Parameter
+		for _, parameter := range changed {
+			if slices.ContainsFunc(names, func(name string) bool {
+				return matches(parameter.Name, name)
+			}) {
+				watched = append(watched, parameter)
+			}
+		}
+
+		if len(watched) == 0 {
+			continue
+		}
+
+		payload, err := json.Marshal(Tr181Payload{
+			Command:    "NOTIFY",
+			Parameters: watched,
+			StatusCode: http.StatusOK,
+		})
+		if err != nil {
+			return nil, errors.Join(ErrInvalidResponsePayload, err)
+		}
+
+		events = append(events, wrp.Message{
+			Type:        wrp.SimpleEventMessageType,
+			Source:      h.source,
+			Destination: subscriber,
+			ContentType: "application/json",
+			Payload:     payload,
+		})
+	}
+
+	return events, nil
+}
+
 func (h Handler) loadFile() ([]MockParameter, error) {
 	jsonFile, err := os.Open(h.filePath)
 	if err != nil {
@@ -328,3 +785,35 @@ func (h Handler) loadFile() ([]MockParameter, error) {
 
 	return parameters, nil
 }
+
+// saveFile writes the parameters back to the file they were loaded from.  The
+// parameters are written to a temporary file that then replaces the original,
+// so the file is never left partially written.
+func (h Handler) saveFile() error {
+	byteValue, err := json.MarshalIndent(h.parameters, "", "    ")
+	if err != nil {
+		return errors.Join(ErrUnableToWriteFile, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.filePath), filepath.Base(h.filePath)+".*.tmp")
+	if err != nil {
+		return errors.Join(ErrUnableToWriteFile, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(byteValue, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.filePath)
+	}
+	if err != nil {
+		return errors.Join(ErrUnableToWriteFile, err)
+	}
+
+	return nil
+}
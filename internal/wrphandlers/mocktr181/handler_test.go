@@ -5,7 +5,11 @@ package mocktr181
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -63,6 +67,62 @@ func TestHandler_HandleWrp(t *testing.T) {
 				a.True(h.Enabled())
 				return nil
 			},
+		}, {
+			description:     "get with a wildcard segment",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"GET\",\"names\":[\"Device.WiFi.Radio.*.Channel\"]}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(http.StatusOK), *msg.Status)
+				var result Tr181Payload
+				err := json.Unmarshal(msg.Payload, &result)
+				a.NoError(err)
+
+				// Only the channel of each radio, not ChannelsInUse etc.
+				got := make(map[string]string)
+				for _, p := range result.Parameters {
+					got[p.Name] = p.Value
+				}
+				a.Equal(map[string]string{
+					"Device.WiFi.Radio.10000.Channel": "8",
+					"Device.WiFi.Radio.10100.Channel": "165",
+				}, got)
+				return nil
+			},
+		}, {
+			description:     "get with a wildcard subtree",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"GET\",\"names\":[\"Device.WiFi.Radio.*.\"]}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(http.StatusOK), *msg.Status)
+				var result Tr181Payload
+				err := json.Unmarshal(msg.Payload, &result)
+				a.NoError(err)
+				a.Equal(328, len(result.Parameters))
+				return nil
+			},
+		}, {
+			description:     "get with a wildcard and no matching parameter",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"GET\",\"names\":[\"Device.WiFi.Radio.*.NoSuchParameter\"]}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(520), *msg.Status)
+				return nil
+			},
 		}, {
 			description:     "set, success",
 			egressCallCount: 1,
@@ -94,6 +154,117 @@ func TestHandler_HandleWrp(t *testing.T) {
 				return nil
 			},
 		}, {
+			description:     "set, valid value types",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"SET\",\"parameters\":[{\"name\":\"Device.Bridging.Bridge.1.Port.1.PVID\",\"dataType\":1,\"value\":\"-5\"},{\"name\":\"Device.Bridging.MaxDBridgeEntries\",\"dataType\":2,\"value\":\"16\"},{\"name\":\"Device.Bridging.Bridge.1.Enable\",\"dataType\":3,\"value\":\"false\"},{\"name\":\"Device.DeviceInfo.FirstUseDate\",\"dataType\":4,\"value\":\"2024-05-01T10:00:00Z\"}]}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(http.StatusAccepted), *msg.Status)
+				var result Tr181Payload
+				err := json.Unmarshal(msg.Payload, &result)
+				a.NoError(err)
+				a.Len(result.Parameters, 4)
+				for _, p := range result.Parameters {
+					a.Equal("Success", p.Message)
+				}
+
+				return nil
+			},
+		}, {
+			description:     "set, mismatched value types",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"SET\",\"parameters\":[{\"name\":\"Device.WiFi.Radio.10000.Name\",\"dataType\":0,\"value\":\"anothername\"},{\"name\":\"Device.Bridging.Bridge.1.Port.1.PVID\",\"dataType\":0,\"value\":\"abc\"},{\"name\":\"Device.Bridging.MaxDBridgeEntries\",\"dataType\":2,\"value\":\"-1\"},{\"name\":\"Device.Bridging.Bridge.1.Enable\",\"dataType\":3,\"value\":\"yes\"},{\"name\":\"Device.DeviceInfo.FirstUseDate\",\"dataType\":4,\"value\":\"yesterday\"}]}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(520), *msg.Status)
+				var result Tr181Payload
+				err := json.Unmarshal(msg.Payload, &result)
+				a.NoError(err)
+
+				// Only the mismatched parameters are reported and none are updated.
+				got := make(map[string]string)
+				for _, p := range result.Parameters {
+					got[p.Name] = p.Message
+				}
+				a.Equal(map[string]string{
+					"Device.Bridging.Bridge.1.Port.1.PVID": "Invalid value type",
+					"Device.Bridging.MaxDBridgeEntries":    "Invalid value type",
+					"Device.Bridging.Bridge.1.Enable":      "Invalid value type",
+					"Device.DeviceInfo.FirstUseDate":       "Invalid value type",
+				}, got)
+				for _, p := range h.parameters {
+					if p.Name == "Device.WiFi.Radio.10000.Name" {
+						a.Equal("wifi1", p.Value)
+					}
+				}
+
+				return nil
+			},
+		}, {
+			description:     "subscribe, success",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"SUBSCRIBE\",\"names\":[\"Device.WiFi.Radio.*.Name\"]}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(http.StatusOK), *msg.Status)
+
+				return nil
+			},
+		}, {
+			description:     "subscribe with no matching parameter",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"SUBSCRIBE\",\"names\":[\"NoSuchParameter\"]}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(520), *msg.Status)
+
+				return nil
+			},
+		}, {
+			description:     "subscribe with no names",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"SUBSCRIBE\"}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(520), *msg.Status)
+
+				return nil
+			},
+		}, {
+			description:     "unsubscribe, success",
+			egressCallCount: 1,
+			msg: wrp.Message{
+				Type:        wrp.SimpleEventMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "event:event_1/ignored",
+				Payload:     []byte("{\"command\":\"UNSUBSCRIBE\"}"),
+			},
+			validate: func(a *assert.Assertions, msg wrp.Message, h *Handler) error {
+				a.Equal(int64(http.StatusOK), *msg.Status)
+
+				return nil
+			},
+		}, {
 			description:     "unknown command",
 			egressCallCount: 1,
 			msg: wrp.Message{
@@ -154,3 +325,422 @@ func TestHandler_HandleWrp(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_Subscriptions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const (
+		subscriber = "dns:subscriber.example.com/service/ignored"
+		setter     = "dns:tr1d1um.example.com/service/ignored"
+	)
+
+	var sent []wrp.Message
+	egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+		sent = append(sent, msg)
+		return nil
+	})
+
+	h, err := New(egress, "some-source", FilePath("mock_tr181_test.json"), Enabled(true))
+	require.NoError(err)
+
+	command := func(source, payload string) {
+		sent = nil
+		require.NoError(h.HandleWrp(wrp.Message{
+			Type:        wrp.SimpleRequestResponseMessageType,
+			Source:      source,
+			Destination: "mac:112233445566/config",
+			Payload:     []byte(payload),
+		}))
+	}
+	set := func(value string) {
+		command(setter, `{"command":"SET","parameters":[{"name":"Device.WiFi.Radio.10000.Name","dataType":0,"value":"`+value+`"}]}`)
+	}
+
+	command(subscriber, `{"command":"SUBSCRIBE","names":["Device.WiFi.Radio.*.Name"]}`)
+	require.Len(sent, 1)
+	assert.Equal(int64(http.StatusOK), *sent[0].Status)
+
+	// A change to a watched parameter is sent to the subscriber after the
+	// response to the setter.
+	set("anothername")
+	require.Len(sent, 2)
+	assert.Equal(setter, sent[0].Destination)
+	assert.Equal(int64(http.StatusAccepted), *sent[0].Status)
+
+	event := sent[1]
+	assert.Equal(wrp.SimpleEventMessageType, event.Type)
+	assert.Equal("some-source", event.Source)
+	assert.Equal(subscriber, event.Destination)
+	assert.Equal("application/json", event.ContentType)
+
+	var result Tr181Payload
+	require.NoError(json.Unmarshal(event.Payload, &result))
+	assert.Equal("NOTIFY", result.Command)
+	require.Len(result.Parameters, 1)
+	assert.Equal("Device.WiFi.Radio.10000.Name", result.Parameters[0].Name)
+	assert.Equal("anothername", result.Parameters[0].Value)
+
+	// Setting the same value is not a change.
+	set("anothername")
+	assert.Len(sent, 1)
+
+	// Changes to other parameters are not sent.
+	command(setter, `{"command":"SET","parameters":[{"name":"Device.Bridging.MaxDBridgeEntries","dataType":2,"value":"9"}]}`)
+	assert.Len(sent, 1)
+
+	command(subscriber, `{"command":"UNSUBSCRIBE","names":["Device.WiFi.Radio.*.Name"]}`)
+	require.Len(sent, 1)
+	assert.Equal(int64(http.StatusOK), *sent[0].Status)
+
+	set("yetanothername")
+	assert.Len(sent, 1)
+}
+
+func TestHandler_GetRegex(t *testing.T) {
+	tests := []struct {
+		description string
+		names       []string
+		status      int64
+		expected    []string
+		message     string
+	}{
+		{
+			description: "matching pattern",
+			names:       []string{`^Device\.WiFi\.Radio\.[0-9]+\.Channel$`},
+			status:      http.StatusOK,
+			expected: []string{
+				"Device.WiFi.Radio.10000.Channel",
+				"Device.WiFi.Radio.10100.Channel",
+			},
+		}, {
+			description: "only the first name is used",
+			names:       []string{`^Device\.WiFi\.Radio\.10000\.Channel$`, `.*`},
+			status:      http.StatusOK,
+			expected:    []string{"Device.WiFi.Radio.10000.Channel"},
+		}, {
+			description: "non-matching pattern",
+			names:       []string{`^NoSuchParameter\.`},
+			status:      520,
+			message:     `Invalid parameter names: [^NoSuchParameter\.]`,
+		}, {
+			description: "malformed pattern",
+			names:       []string{`^Device\.(WiFi`},
+			status:      520,
+			message:     "Invalid pattern: error parsing regexp: missing closing ): `^Device\\.(WiFi`",
+		}, {
+			description: "pattern too long",
+			names:       []string{strings.Repeat("a", maxPatternLength+1)},
+			status:      520,
+			message:     "Invalid pattern: pattern is longer than 256 characters",
+		}, {
+			description: "missing pattern",
+			status:      520,
+			message:     "Invalid pattern: missing pattern",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var sent wrp.Message
+			egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+				sent = msg
+				return nil
+			})
+
+			h, err := New(egress, "some-source", FilePath("mock_tr181_test.json"), Enabled(true))
+			require.NoError(err)
+
+			payload, err := json.Marshal(Tr181Payload{
+				Command: "GET_REGEX",
+				Names:   tc.names,
+			})
+			require.NoError(err)
+			require.NoError(h.HandleWrp(wrp.Message{
+				Type:        wrp.SimpleRequestResponseMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "mac:112233445566/config",
+				Payload:     payload,
+			}))
+			assert.Equal(tc.status, *sent.Status)
+
+			var result Tr181Payload
+			require.NoError(json.Unmarshal(sent.Payload, &result))
+			if tc.message != "" {
+				require.Len(result.Parameters, 1)
+				assert.Equal(tc.message, result.Parameters[0].Message)
+				return
+			}
+
+			var got []string
+			for _, p := range result.Parameters {
+				got = append(got, p.Name)
+			}
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
+func TestHandler_GetAttributes(t *testing.T) {
+	tests := []struct {
+		description string
+		payload     string
+		status      int64
+		expected    map[string]Parameter
+	}{
+		{
+			description: "subtree where one parameter lacks the attribute",
+			payload:     `{"command":"GET_ATTRIBUTES","names":["Device.WiFi.Radio.*.Name"],"attributes":"notify"}`,
+			status:      520,
+			expected: map[string]Parameter{
+				"Device.WiFi.Radio.10000.Name": {
+					Name:       "Device.WiFi.Radio.10000.Name",
+					Attributes: map[string]interface{}{"notify": float64(1)},
+					Message:    "Success",
+					Count:      1,
+				},
+				"Device.WiFi.Radio.10100.Name": {
+					Name:    "Device.WiFi.Radio.10100.Name",
+					Message: "Invalid attributes: [notify]",
+				},
+			},
+		}, {
+			description: "only the requested attributes",
+			payload:     `{"command":"GET_ATTRIBUTES","names":["Device.WiFi.Radio.10000.Name"],"attributes":"notify"}`,
+			status:      http.StatusOK,
+			expected: map[string]Parameter{
+				"Device.WiFi.Radio.10000.Name": {
+					Name:       "Device.WiFi.Radio.10000.Name",
+					Attributes: map[string]interface{}{"notify": float64(1)},
+					Message:    "Success",
+					Count:      1,
+				},
+			},
+		}, {
+			description: "all attributes",
+			payload:     `{"command":"GET_ATTRIBUTES","names":["Device.WiFi.Radio.*.Name"]}`,
+			status:      http.StatusOK,
+			expected: map[string]Parameter{
+				"Device.WiFi.Radio.10000.Name": {
+					Name:       "Device.WiFi.Radio.10000.Name",
+					Attributes: map[string]interface{}{"notify": float64(1), "access": "readOnly"},
+					Message:    "Success",
+					Count:      1,
+				},
+				"Device.WiFi.Radio.10100.Name": {
+					Name:    "Device.WiFi.Radio.10100.Name",
+					Message: "Success",
+					Count:   1,
+				},
+			},
+		}, {
+			description: "no matching parameter",
+			payload:     `{"command":"GET_ATTRIBUTES","names":["Device.WiFi.Radio.10000.Name","NoSuchParameter"],"attributes":"notify"}`,
+			status:      520,
+			expected: map[string]Parameter{
+				"Device.WiFi.Radio.10000.Name": {
+					Name:       "Device.WiFi.Radio.10000.Name",
+					Attributes: map[string]interface{}{"notify": float64(1)},
+					Message:    "Success",
+					Count:      1,
+				},
+				"NoSuchParameter": {
+					Name:    "NoSuchParameter",
+					Message: "Invalid parameter name",
+				},
+			},
+		}, {
+			description: "no names",
+			payload:     `{"command":"GET_ATTRIBUTES","attributes":"notify"}`,
+			status:      520,
+			expected:    map[string]Parameter{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var sent wrp.Message
+			egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+				sent = msg
+				return nil
+			})
+
+			h, err := New(egress, "some-source", FilePath("mock_tr181_test.json"), Enabled(true))
+			require.NoError(err)
+
+			command := func(payload string) {
+				require.NoError(h.HandleWrp(wrp.Message{
+					Type:        wrp.SimpleRequestResponseMessageType,
+					Source:      "dns:tr1d1um.example.com/service/ignored",
+					Destination: "mac:112233445566/config",
+					Payload:     []byte(payload),
+				}))
+			}
+
+			command(`{"command":"SET","parameters":[{"name":"Device.WiFi.Radio.10000.Name","dataType":0,"value":"wifi1","attributes":{"notify":1,"access":"readOnly"}}]}`)
+			require.Equal(int64(http.StatusAccepted), *sent.Status)
+
+			command(tc.payload)
+			assert.Equal(tc.status, *sent.Status)
+
+			var result Tr181Payload
+			require.NoError(json.Unmarshal(sent.Payload, &result))
+			got := make(map[string]Parameter)
+			for _, p := range result.Parameters {
+				got[p.Name] = p
+			}
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
+func TestHandler_Persist(t *testing.T) {
+	tests := []struct {
+		description string
+		persist     bool
+		payload     string
+		expected    string
+	}{
+		{
+			description: "set is persisted",
+			persist:     true,
+			payload:     `{"command":"SET","parameters":[{"name":"Device.WiFi.Radio.10000.Name","dataType":0,"value":"persisted"}]}`,
+			expected:    "persisted",
+		}, {
+			description: "failed set is not persisted",
+			persist:     true,
+			payload:     `{"command":"SET","parameters":[{"name":"Device.WiFi.Radio.10000.Name","dataType":0,"value":"persisted"},{"name":"Device.Bridging.MaxBridgeEntries","dataType":2,"value":"9"}]}`,
+			expected:    "wifi1",
+		}, {
+			description: "get is not persisted",
+			persist:     true,
+			payload:     `{"command":"GET","names":["Device.WiFi.Radio.10000.Name"]}`,
+			expected:    "wifi1",
+		}, {
+			description: "set without persist",
+			payload:     `{"command":"SET","parameters":[{"name":"Device.WiFi.Radio.10000.Name","dataType":0,"value":"persisted"}]}`,
+			expected:    "wifi1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			original, err := os.ReadFile("mock_tr181_test.json")
+			require.NoError(err)
+
+			path := filepath.Join(t.TempDir(), "mock_tr181.json")
+			require.NoError(os.WriteFile(path, original, 0600))
+
+			egress := wrpkit.HandlerFunc(func(wrp.Message) error {
+				return nil
+			})
+
+			h, err := New(egress, "some-source", FilePath(path), Enabled(true), Persist(tc.persist))
+			require.NoError(err)
+			require.NoError(h.HandleWrp(wrp.Message{
+				Type:        wrp.SimpleRequestResponseMessageType,
+				Source:      "dns:tr1d1um.example.com/service/ignored",
+				Destination: "mac:112233445566/config",
+				Payload:     []byte(tc.payload),
+			}))
+
+			if tc.expected == "wifi1" {
+				got, err := os.ReadFile(path)
+				require.NoError(err)
+				assert.Equal(original, got)
+			}
+
+			// A new handler loads the parameters from the same file.
+			restarted, err := New(egress, "some-source", FilePath(path), Enabled(true))
+			require.NoError(err)
+			assert.Equal(len(h.parameters), len(restarted.parameters))
+			for _, p := range restarted.parameters {
+				switch p.Name {
+				case "Device.WiFi.Radio.10000.Name":
+					assert.Equal(tc.expected, p.Value)
+				case "Device.Bridging.MaxBridgeEntries":
+					assert.Equal("8", p.Value)
+					assert.Equal(dataTypeUnsignedInt, p.DataType)
+				}
+			}
+
+			files, err := os.ReadDir(filepath.Dir(path))
+			require.NoError(err)
+			assert.Len(files, 1)
+		})
+	}
+}
+
+func TestValidValue(t *testing.T) {
+	tests := []struct {
+		dataType int
+		value    string
+		expected bool
+	}{
+		{dataTypeString, "anything", true},
+		{dataTypeString, "", true},
+		{dataTypeInt, "-42", true},
+		{dataTypeInt, "4.2", false},
+		{dataTypeInt, "4294967296", false},
+		{dataTypeUnsignedInt, "42", true},
+		{dataTypeUnsignedInt, "-42", false},
+		{dataTypeBoolean, "true", true},
+		{dataTypeBoolean, "0", true},
+		{dataTypeBoolean, "yes", false},
+		{dataTypeDateTime, "2024-05-01T10:00:00Z", true},
+		{dataTypeDateTime, "2018-01-29T15:23:47", true},
+		{dataTypeDateTime, "2018-01-29T15:23:47.123456", true},
+		{dataTypeDateTime, "2018-01-29", false},
+		{dataTypeBase64, "aGVsbG8=", true},
+		{dataTypeBase64, "not base64!", false},
+		{dataTypeLong, "-4294967296", true},
+		{dataTypeLong, "forty two", false},
+		{dataTypeUnsignedLong, "4294967296", true},
+		{dataTypeUnsignedLong, "-1", false},
+		{dataTypeFloat, "4.2", true},
+		{dataTypeFloat, "42", true},
+		{dataTypeFloat, "4,2", false},
+		{dataTypeDouble, "-4.2e10", true},
+		{dataTypeDouble, "42", true},
+		{dataTypeDouble, "NaN-ish", false},
+		{dataTypeByte, "255", true},
+		{dataTypeByte, "256", false},
+		{99, "anything", true},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%d %s", tc.dataType, tc.value), func(t *testing.T) {
+			assert.Equal(t, tc.expected, validValue(tc.dataType, tc.value))
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		parameter string
+		name      string
+		expected  bool
+	}{
+		{"Device.WiFi.Radio.10000.Channel", "Device.WiFi.Radio.", true},
+		{"Device.WiFi.Radio.10000.ChannelsInUse", "Device.WiFi.Radio.10000.Channel", true},
+		{"Device.WiFi.RadioNumberOfEntries", "Device.WiFi.Radio", true},
+		{"Device.WiFi.Radio.10000.Channel", "Device.WiFi.SSID.", false},
+		{"Device.WiFi.Radio.10000.Channel", "Device.WiFi.Radio.*.Channel", true},
+		{"Device.WiFi.Radio.10000.ChannelsInUse", "Device.WiFi.Radio.*.Channel", false},
+		{"Device.WiFi.Radio.10000.Stats.Channel", "Device.WiFi.Radio.*.Channel", false},
+		{"Device.WiFi.Radio.10000.Stats.Noise", "Device.WiFi.*.*.Stats.Noise", true},
+		{"Device.WiFi.Radio.10000.Stats.Noise", "Device.WiFi.Radio.*.", true},
+		{"Device.WiFi.Radio.10000", "Device.WiFi.Radio.*.", false},
+		{"Device.WiFi.SSID.10001.Enable", "Device.WiFi.Radio.*.", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name+" "+tc.parameter, func(t *testing.T) {
+			assert.Equal(t, tc.expected, matches(tc.parameter, tc.name))
+		})
+	}
+}
@@ -28,3 +28,13 @@ func Enabled(enabled bool) Option {
 			return nil
 		})
 }
+
+// Persist writes the parameters back to the mocktr181 data file after each
+// successful SET, so changes survive restarts.  GETs never touch the file.
+func Persist(persist bool) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			h.persist = persist
+			return nil
+		})
+}
@@ -19,6 +19,17 @@ func validateQueueConstraints() Option {
 		})
 }
 
+func validateWatermarks() Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if h.backpressure != nil && h.highWaterMark > h.maxQueueBytes {
+				return fmt.Errorf("%w: Backpressure highWaterMark > MaxQueueBytes", ErrMisconfiguredQOS)
+			}
+
+			return nil
+		})
+}
+
 func validatePriority() Option {
 	return optionFunc(
 		func(h *Handler) error {
@@ -0,0 +1,48 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package qos
+
+import (
+	"runtime"
+	"time"
+)
+
+// DefaultMemorySampleInterval is the minimum time between process memory samples.
+const DefaultMemorySampleInterval = time.Second
+
+// memorySampler returns the memory, in bytes, currently used by the process.
+type memorySampler func() uint64
+
+// runtimeMemory samples the memory obtained from the OS by the go runtime.
+func runtimeMemory() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	return ms.Sys
+}
+
+// memoryGuard limits the queue's footprint to a fraction of the process memory.
+// Sampling is rate limited, since runtime.ReadMemStats stops the world.
+type memoryGuard struct {
+	// fraction is the max fraction of the process memory the queue may use.
+	fraction float64
+	// sample returns the process memory.
+	sample memorySampler
+	// interval is the minimum time between samples.
+	interval time.Duration
+	// sampledAt is the time of the last sample.
+	sampledAt time.Time
+	// memory is the last sampled process memory.
+	memory uint64
+}
+
+// limit returns the max number of bytes the queue may use.
+func (g *memoryGuard) limit(now time.Time) int64 {
+	if g.sampledAt.IsZero() || now.Sub(g.sampledAt) >= g.interval {
+		g.memory = g.sample()
+		g.sampledAt = now
+	}
+
+	return int64(g.fraction * float64(g.memory))
+}
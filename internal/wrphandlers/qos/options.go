@@ -4,9 +4,13 @@
 package qos
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/fs"
 )
 
 const (
@@ -14,6 +18,9 @@ const (
 	DefaultMaxQueueBytes   = 1 * 1024 * 1024 // 1MB max/queue
 	DefaultMaxMessageBytes = 256 * 1024      // 256 KB
 
+	// Delivery defaults.
+	DefaultDeliveryConcurrency = 1
+
 	// QOS expires defaults.
 	DefaultLowExpires      = time.Minute * 15
 	DefaultMediumExpires   = time.Minute * 20
@@ -53,6 +60,137 @@ func MaxMessageBytes(s int) Option {
 		})
 }
 
+// MaxQueueCount is the allowable max number of queued wrp messages, regardless of their size,
+// beyond which the lowest priority messages are trimmed.
+// Note, the default zero behavior is no count constraint.
+func MaxQueueCount(n int) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if n < 0 {
+				return fmt.Errorf("%w: negative MaxQueueCount", ErrMisconfiguredQOS)
+			}
+
+			h.maxQueueCount = n
+
+			return nil
+		})
+}
+
+// DeliveryConcurrency is the number of queued messages that may be delivered concurrently,
+// for transports that support concurrent sends.
+// Note, the default zero behavior is a single (serial) delivery at a time.
+func DeliveryConcurrency(n int) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if n < 0 {
+				return fmt.Errorf("%w: negative DeliveryConcurrency", ErrMisconfiguredQOS)
+			} else if n == 0 {
+				n = DefaultDeliveryConcurrency
+			}
+
+			h.deliveryConcurrency = n
+
+			return nil
+		})
+}
+
+// PreserveOrderPerDestination prevents concurrent deliveries of messages with the same destination,
+// preserving their delivery order when DeliveryConcurrency is greater than one.  A message whose
+// delivery failed is retried before any other message to the same destination.
+func PreserveOrderPerDestination(preserve ...bool) Option {
+	preserve = append(preserve, true)
+	return optionFunc(
+		func(h *Handler) error {
+			h.preserveOrderPerDestination = preserve[0]
+
+			return nil
+		})
+}
+
+// PerDestinationFairness takes turns between the destinations of the queued messages with the
+// same qos level, so a flood of messages to one destination doesn't starve the others.
+// Higher qos levels are still delivered first and trimming is unaffected.
+func PerDestinationFairness(fair ...bool) Option {
+	fair = append(fair, true)
+	return optionFunc(
+		func(h *Handler) error {
+			h.perDestinationFairness = fair[0]
+
+			return nil
+		})
+}
+
+// Backpressure registers a callback used to apply flow control to upstream producers.
+// The callback is called with true once the queue size (in bytes) reaches highWaterMark
+// and with false once it drops to lowWaterMark.  The callback is called from the
+// goroutine servicing the queue, so it must not block or call Handler.HandleWrp.
+func Backpressure(highWaterMark, lowWaterMark int64, f func(active bool)) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if f == nil {
+				return fmt.Errorf("%w: nil Backpressure callback", ErrMisconfiguredQOS)
+			}
+			if lowWaterMark < 0 || highWaterMark <= lowWaterMark {
+				return fmt.Errorf("%w: Backpressure requires 0 <= lowWaterMark < highWaterMark", ErrMisconfiguredQOS)
+			}
+
+			h.highWaterMark = highWaterMark
+			h.lowWaterMark = lowWaterMark
+			h.backpressure = f
+
+			return nil
+		})
+}
+
+// WithDropHandler registers a callback that is called with each message dropped from the queue
+// and the reason: DropQueueFull, DropExpired or DropTooLarge.  The message is passed as it was
+// queued, before its payload is discarded.  The callback is called from the goroutine servicing
+// the queue, so it must not block or call Handler.HandleWrp.
+func WithDropHandler(f func(msg wrp.Message, reason string)) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if f == nil {
+				return fmt.Errorf("%w: nil drop handler", ErrMisconfiguredQOS)
+			}
+
+			h.dropHandler = f
+
+			return nil
+		})
+}
+
+// ShutdownContext stops starting new deliveries once ctx is canceled, without waiting for
+// Handler.Stop.  Incoming messages are still queued, and persisted by Handler.Stop.
+func ShutdownContext(ctx context.Context) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if ctx == nil {
+				return fmt.Errorf("%w: nil ShutdownContext", ErrMisconfiguredQOS)
+			}
+
+			h.shutdownCtx = ctx
+
+			return nil
+		})
+}
+
+// MaxQueueMemoryFraction is the max fraction (0, 1] of the process memory the queue may use.
+// Once exceeded, low qos messages are trimmed, oldest first, until the queue fits again.
+// The process memory is sampled at most once per second.
+// Note, the default zero behavior disables the guard.
+func MaxQueueMemoryFraction(f float64) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if f < 0 || f > 1 {
+				return fmt.Errorf("%w: MaxQueueMemoryFraction must be within [0, 1]", ErrMisconfiguredQOS)
+			}
+
+			h.maxQueueMemoryFraction = f
+
+			return nil
+		})
+}
+
 // Priority determines what is used [newest, oldest message] for QualityOfService tie breakers and trimming,
 // with the default being to prioritize the newest messages.
 func Priority(p PriorityType) Option {
@@ -133,3 +271,21 @@ func CriticalExpires(t time.Duration) Option {
 			return err
 		})
 }
+
+// Persist saves the queued messages to the path of fsys on Handler.Stop and requeues them on
+// Handler.Start, dropping those that expired in between.  Messages being delivered when
+// Handler.Stop is called are not saved.
+// Note, the default is no persistence.
+func Persist(fsys fs.FS, path string) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if fsys == nil || path == "" {
+				return fmt.Errorf("%w: Persist requires a filesystem and path", ErrMisconfiguredQOS)
+			}
+
+			h.persistFS = fsys
+			h.persistPath = path
+
+			return nil
+		})
+}
@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package qos
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/ugorji/go/codec"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/fs"
+)
+
+const (
+	// persistPerm is the permission of the persisted queue.
+	persistPerm = 0600
+
+	// persistDirPerm is the permission of any directories created for the
+	// persisted queue.
+	persistDirPerm = 0700
+)
+
+// persistedItem is a queued message as recorded in the persisted queue.
+type persistedItem struct {
+	// Msg is the msgpack encoded wrp message.
+	Msg     []byte    `codec:"msg"`
+	Expires time.Time `codec:"expires"`
+}
+
+// persist writes the messages still queued in pq, so they survive a restart.
+// Messages being delivered are not part of the queue and are not persisted.
+func (h *Handler) persist(pq *priorityQueue) error {
+	if h.persistFS == nil {
+		return nil
+	}
+
+	items := make([]persistedItem, 0, pq.Len())
+	for _, itm := range pq.queue {
+		if itm.discard {
+			continue
+		}
+
+		var msg []byte
+		if err := wrp.NewEncoderBytes(&msg, wrp.Msgpack).Encode(itm.msg); err != nil {
+			return err
+		}
+
+		items = append(items, persistedItem{
+			Msg:     msg,
+			Expires: itm.expires,
+		})
+	}
+
+	var buf []byte
+	enc := codec.NewEncoderBytes(&buf, new(codec.MsgpackHandle))
+	if err := enc.Encode(items); err != nil {
+		return err
+	}
+
+	return fs.Operate(h.persistFS,
+		fs.WithPath(h.persistPath, persistDirPerm),
+		fs.WriteFileWithSHA256(h.persistPath, buf, persistPerm))
+}
+
+// restore queues the messages persisted by a previous run into pq, dropping
+// the ones that have expired since.  The persisted queue is removed once read,
+// so a crash doesn't redeliver the messages again.  A missing or corrupt
+// persisted queue is treated as empty.
+func (h *Handler) restore(pq *priorityQueue) {
+	if h.persistFS == nil {
+		return
+	}
+
+	var buf []byte
+	err := fs.Operate(h.persistFS,
+		fs.WithPath(h.persistPath, persistDirPerm),
+		fs.ReadFileWithSHA256(h.persistPath, &buf))
+	if err != nil {
+		return
+	}
+
+	// The messages are queued regardless, a failure only risks a redelivery.
+	_ = fs.Operate(h.persistFS, fs.RemoveFileWithSHA256(h.persistPath))
+
+	var items []persistedItem
+	dec := codec.NewDecoderBytes(buf, new(codec.MsgpackHandle))
+	if err := dec.Decode(&items); err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, pi := range items {
+		var msg wrp.Message
+		if err := wrp.NewDecoderBytes(pi.Msg, wrp.Msgpack).Decode(&msg); err != nil {
+			continue
+		}
+
+		deadline, _ := messageDeadline(msg)
+		itm := item{
+			msg:      &msg,
+			expires:  pi.Expires,
+			deadline: deadline,
+		}
+		if !now.Before(itm.expires) || itm.pastDeadline(now) {
+			pq.drop(&itm, DropExpired)
+			continue
+		}
+
+		heap.Push(pq, itm)
+	}
+
+	pq.trim()
+}
@@ -7,6 +7,7 @@ import (
 	"container/heap"
 	"errors"
 	"fmt"
+	"maps"
 	"slices"
 	"time"
 
@@ -15,6 +16,21 @@ import (
 
 var ErrMaxMessageBytes = errors.New("wrp message payload exceeds maxMessageBytes")
 
+// Reasons a message is dropped, reported to the drop handler.
+const (
+	// DropQueueFull is the reason for messages trimmed to make room in the queue,
+	// either by maxQueueBytes or by the queue's share of the process memory.
+	DropQueueFull = "queue full"
+	// DropExpired is the reason for messages trimmed after their qos expiry or deadline.
+	DropExpired = "expired"
+	// DropTooLarge is the reason for messages rejected for exceeding maxMessageBytes.
+	DropTooLarge = "too large"
+)
+
+// ExpiresMetadataKey is the wrp metadata entry holding a message specific deadline,
+// formatted as RFC 3339.  A message is dropped once either its deadline or its qos expiry passes.
+const ExpiresMetadataKey = "X-Midt-Expires"
+
 const (
 	// https://xmidt.io/docs/wrp/basics/#request-delivery-response-rdr-codes
 	messageIsTooLarge                int64 = 4
@@ -36,6 +52,9 @@ type priorityQueue struct {
 	maxQueueBytes int64
 	// MaxMessageBytes is the largest allowable wrp message payload.
 	maxMessageBytes int
+	// maxQueueCount is the allowable max number of queued wrp messages, regardless of their size.
+	// Zero value will disable the count constraint.
+	maxQueueCount int
 	// sizeBytes is the sum of all queued wrp message's payloads.
 	// An int64 overflow is unlikely since that'll be over 9*10^18 bytes
 	sizeBytes int64
@@ -49,6 +68,24 @@ type priorityQueue struct {
 	highExpires time.Duration
 	// criticalExpires determines when critical qos messages are trimmed.
 	criticalExpires time.Duration
+
+	// memoryGuard aggressively trims low qos messages once the queue exceeds its share
+	// of the process memory. Nil disables the guard.
+	memoryGuard *memoryGuard
+
+	// perDestinationFairness determines whether dequeues take turns between the destinations
+	// queued within the same qos level.
+	perDestinationFairness bool
+	// lastDestination is the destination most recently dequeued for each qos level.
+	lastDestination map[wrp.QOSLevel]string
+	// held is the number of queued items requeued after a failed delivery.
+	held int
+
+	// dropped is the number of messages dropped per qos level, indexed by wrp.QOSLevel.
+	dropped [wrp.QOSCritical + 1]uint64
+	// dropHandler is called with each dropped message and the reason it was dropped.
+	// Nil disables the callback.
+	dropHandler func(wrp.Message, string)
 }
 
 type tieBreaker func(i, j item) bool
@@ -58,8 +95,14 @@ type item struct {
 	msg *wrp.Message
 	// expires is the time the messge is good upto before it is eligible to be trimmed.
 	expires time.Time
+	// deadline is the time set by the message's ExpiresMetadataKey entry, after which
+	// the message is dropped. The zero value means the message has no deadline.
+	deadline time.Time
 	// discard determines whether a message should be discarded or not
 	discard bool
+	// held determines whether the message was requeued after a failed delivery, which holds it
+	// ahead of every other message to the same destination.
+	held bool
 }
 
 func (itm *item) dispose() (payloadSize int64) {
@@ -76,8 +119,47 @@ func (itm *item) dispose() (payloadSize int64) {
 	return payloadSize
 }
 
+// drop disposes of itm and reports it as dropped for the given reason, returning the size of its payload.
+func (pq *priorityQueue) drop(itm *item, reason string) int64 {
+	pq.dropped[itm.msg.QualityOfService.Level()]++
+	if pq.dropHandler != nil {
+		pq.dropHandler(*itm.msg, reason)
+	}
+
+	return itm.dispose()
+}
+
+// expired determines whether itm's qos expiry or deadline has passed.
+func (itm *item) expired(now time.Time) bool {
+	return now.After(itm.expires) || itm.pastDeadline(now)
+}
+
+// pastDeadline determines whether itm's deadline has passed.
+func (itm *item) pastDeadline(now time.Time) bool {
+	return !itm.deadline.IsZero() && now.After(itm.deadline)
+}
+
+// dropPastDeadline drops the queued messages whose deadline has passed, regardless of
+// whether the queue is full.
+func (pq *priorityQueue) dropPastDeadline() {
+	now := time.Now()
+	for i := range pq.queue {
+		itm := &pq.queue[i]
+		if itm.discard || !itm.pastDeadline(now) {
+			continue
+		}
+
+		pq.sizeBytes -= pq.drop(itm, DropExpired)
+	}
+}
+
 // Dequeue returns the next highest priority message.
 func (pq *priorityQueue) Dequeue() (msg wrp.Message, ok bool) {
+	pq.dropPastDeadline()
+	if pq.perDestinationFairness {
+		return pq.dequeueFair(nil)
+	}
+
 	if pq.Len() == 0 {
 		return msg, false
 	}
@@ -91,8 +173,134 @@ func (pq *priorityQueue) Dequeue() (msg wrp.Message, ok bool) {
 	return msg, ok
 }
 
+// DequeueFunc returns the next highest priority message for which eligible returns true.
+// A nil eligible behaves like Dequeue.
+func (pq *priorityQueue) DequeueFunc(eligible func(wrp.Message) bool) (msg wrp.Message, ok bool) {
+	if eligible == nil {
+		return pq.Dequeue()
+	}
+
+	pq.dropPastDeadline()
+	if pq.perDestinationFairness {
+		return pq.dequeueFair(eligible)
+	}
+
+	held := pq.heldDestinations()
+	best := -1
+	for i := range pq.queue {
+		if !eligible(*pq.queue[i].msg) || pq.behindHeld(held, i) {
+			continue
+		}
+
+		if best < 0 || pq.Less(i, best) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return msg, false
+	}
+
+	itm, ok := heap.Remove(pq, best).(item)
+	if ok {
+		msg = *itm.msg
+	}
+
+	return msg, ok
+}
+
+// dequeueFair returns the next message of the highest qos level queued, taking turns
+// (in destination order) between the destinations queued within that level.
+// A nil eligible allows every message.
+func (pq *priorityQueue) dequeueFair(eligible func(wrp.Message) bool) (msg wrp.Message, ok bool) {
+	var (
+		found bool
+		level wrp.QOSLevel
+		// best is the index of the highest priority message of each destination within level.
+		best = make(map[string]int)
+		held = pq.heldDestinations()
+	)
+	for i := range pq.queue {
+		m := pq.queue[i].msg
+		if (eligible != nil && !eligible(*m)) || pq.behindHeld(held, i) {
+			continue
+		}
+
+		l := m.QualityOfService.Level()
+		if found && l < level {
+			continue
+		}
+		if !found || l > level {
+			found = true
+			level = l
+			clear(best)
+		}
+
+		if j, ok := best[m.Destination]; !ok || pq.Less(i, j) {
+			best[m.Destination] = i
+		}
+	}
+
+	if !found {
+		return msg, false
+	}
+
+	// Take the destination following the last one served, wrapping around.
+	destinations := slices.Sorted(maps.Keys(best))
+	next := destinations[0]
+	for _, d := range destinations {
+		if d > pq.lastDestination[level] {
+			next = d
+			break
+		}
+	}
+
+	if pq.lastDestination == nil {
+		pq.lastDestination = make(map[wrp.QOSLevel]string)
+	}
+	pq.lastDestination[level] = next
+
+	itm, ok := heap.Remove(pq, best[next]).(item)
+	if ok {
+		msg = *itm.msg
+	}
+
+	return msg, ok
+}
+
+// heldDestinations returns the destinations with a held item, or nil if there are none.
+func (pq *priorityQueue) heldDestinations() map[string]bool {
+	if pq.held == 0 {
+		return nil
+	}
+
+	held := make(map[string]bool, pq.held)
+	for i := range pq.queue {
+		if pq.queue[i].held {
+			held[pq.queue[i].msg.Destination] = true
+		}
+	}
+
+	return held
+}
+
+// behindHeld determines whether the item at i waits for a held item to the same destination.
+func (pq *priorityQueue) behindHeld(held map[string]bool, i int) bool {
+	return held[pq.queue[i].msg.Destination] && !pq.queue[i].held
+}
+
 // Enqueue queues the given message.
 func (pq *priorityQueue) Enqueue(msg wrp.Message) error {
+	return pq.enqueue(msg, false)
+}
+
+// Requeue queues a message whose delivery failed, holding it ahead of every other message
+// to the same destination until it is dequeued again.
+func (pq *priorityQueue) Requeue(msg wrp.Message) error {
+	return pq.enqueue(msg, true)
+}
+
+func (pq *priorityQueue) enqueue(msg wrp.Message, held bool) error {
 	var err error
 
 	// Check whether msg violates maxMessageBytes.
@@ -100,21 +308,66 @@ func (pq *priorityQueue) Enqueue(msg wrp.Message) error {
 	if pq.maxMessageBytes != 0 && len(msg.Payload) > pq.maxMessageBytes {
 		var rdr = messageIsTooLarge
 
+		pq.dropped[msg.QualityOfService.Level()]++
+		if pq.dropHandler != nil {
+			pq.dropHandler(msg, DropTooLarge)
+		}
+
 		msg.Payload = nil
 		msg.RequestDeliveryResponse = &rdr
 		err = fmt.Errorf("%w: %v", ErrMaxMessageBytes, pq.maxMessageBytes)
 	}
 
-	heap.Push(pq, msg)
+	itm := pq.newItem(msg)
+	itm.held = held
+	heap.Push(pq, itm)
 	pq.trim()
+	pq.trimMemory()
 
 	return err
 }
 
-// trim removes messages with the lowest QualityOfService until the queue no longer violates `maxQueueSize“.
+// trimMemory removes low qos messages until the queue no longer exceeds its share of the process memory.
+func (pq *priorityQueue) trimMemory() {
+	if pq.memoryGuard == nil {
+		return
+	}
+
+	limit := pq.memoryGuard.limit(time.Now())
+	if pq.sizeBytes <= limit {
+		return
+	}
+
+	// Trim the oldest low qos messages first.
+	itemsCache := make([]*item, 0, len(pq.queue))
+	for i := range pq.queue {
+		itm := &pq.queue[i]
+		if itm.discard || itm.msg.QualityOfService.Level() != wrp.QOSLow {
+			continue
+		}
+
+		itemsCache = append(itemsCache, itm)
+	}
+
+	slices.SortFunc(itemsCache, func(i, j *item) int {
+		return i.expires.Compare(j.expires)
+	})
+
+	for _, itm := range itemsCache {
+		if pq.sizeBytes <= limit {
+			break
+		}
+
+		// Mark itm to be discarded.
+		pq.sizeBytes -= pq.drop(itm, DropQueueFull)
+	}
+}
+
+// trim removes messages with the lowest QualityOfService until the queue no longer violates `maxQueueSize“
+// or `maxQueueCount`.
 func (pq *priorityQueue) trim() {
-	// If priorityQueue.queue doesn't violates `maxQueueSize`, then return.
-	if pq.sizeBytes <= pq.maxQueueBytes {
+	// If priorityQueue.queue doesn't violates `maxQueueSize` or `maxQueueCount`, then return.
+	if pq.sizeBytes <= pq.maxQueueBytes && !pq.exceedsCount(pq.count()) {
 		return
 	}
 
@@ -128,9 +381,9 @@ func (pq *priorityQueue) trim() {
 		if itm.discard {
 			continue
 		}
-		if now.After(itm.expires) {
+		if itm.expired(now) {
 			// Mark itm to be discarded.
-			pq.sizeBytes -= itm.dispose()
+			pq.sizeBytes -= pq.drop(itm, DropExpired)
 			continue
 		}
 
@@ -158,20 +411,44 @@ func (pq *priorityQueue) trim() {
 		}
 	})
 
-	// Continue trimming until the pq.queue no longer violates maxQueueBytes.
+	// Continue trimming until the pq.queue no longer violates maxQueueBytes or maxQueueCount.
 	// Remove the messages with the lowest priority.
+	count := len(itemsCache)
 	for _, itm := range itemsCache {
-		// If pq.queue doesn't violates `maxQueueSize`, then return.
-		if pq.sizeBytes <= pq.maxQueueBytes {
+		// If pq.queue doesn't violates `maxQueueSize` or `maxQueueCount`, then return.
+		if pq.sizeBytes <= pq.maxQueueBytes && !pq.exceedsCount(count) {
 			break
 		}
 
 		// Mark itm to be discarded.
-		pq.sizeBytes -= itm.dispose()
+		pq.sizeBytes -= pq.drop(itm, DropQueueFull)
+		count--
 	}
 
 }
 
+// count returns the number of queued messages that haven't been marked to be discarded.
+// The count is only needed, and only calculated, when maxQueueCount is set.
+func (pq *priorityQueue) count() int {
+	if pq.maxQueueCount == 0 {
+		return 0
+	}
+
+	var n int
+	for i := range pq.queue {
+		if !pq.queue[i].discard {
+			n++
+		}
+	}
+
+	return n
+}
+
+// exceedsCount determines whether count violates maxQueueCount.
+func (pq *priorityQueue) exceedsCount(count int) bool {
+	return pq.maxQueueCount != 0 && count > pq.maxQueueCount
+}
+
 // heap.Interface related implementations https://pkg.go.dev/container/heap#Interface
 
 func (pq *priorityQueue) Len() int { return len(pq.queue) }
@@ -192,10 +469,23 @@ func (pq *priorityQueue) Swap(i, j int) {
 	pq.queue[i], pq.queue[j] = pq.queue[j], pq.queue[i]
 }
 
+// Push queues either a wrp.Message, which expires based on its qos, or an item restored
+// with its original expiry.
 func (pq *priorityQueue) Push(x any) {
-	msg := x.(wrp.Message)
-	pq.sizeBytes += int64(len(msg.Payload))
+	itm, ok := x.(item)
+	if !ok {
+		itm = pq.newItem(x.(wrp.Message))
+	}
+
+	pq.sizeBytes += int64(len(itm.msg.Payload))
+	if itm.held {
+		pq.held++
+	}
+	pq.queue = append(pq.queue, itm)
+}
 
+// newItem creates the item of msg, which expires based on its qos.
+func (pq *priorityQueue) newItem(msg wrp.Message) item {
 	var qosExpires time.Duration
 	switch msg.QualityOfService.Level() {
 	case wrp.QOSLow:
@@ -208,10 +498,29 @@ func (pq *priorityQueue) Push(x any) {
 		qosExpires = pq.criticalExpires
 	}
 
-	pq.queue = append(pq.queue, item{
-		msg:     &msg,
-		expires: time.Now().Add(qosExpires),
-		discard: false})
+	deadline, _ := messageDeadline(msg)
+
+	return item{
+		msg:      &msg,
+		expires:  time.Now().Add(qosExpires),
+		deadline: deadline,
+		discard:  false}
+}
+
+// messageDeadline returns the deadline set by the message's ExpiresMetadataKey entry.
+// Missing or malformed entries are ignored.
+func messageDeadline(msg wrp.Message) (time.Time, bool) {
+	v, ok := msg.Metadata[ExpiresMetadataKey]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	deadline, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return deadline, true
 }
 
 func (pq *priorityQueue) Pop() any {
@@ -222,6 +531,9 @@ func (pq *priorityQueue) Pop() any {
 
 	itm := pq.queue[last]
 	pq.sizeBytes -= int64(len(itm.msg.Payload))
+	if itm.held {
+		pq.held--
+	}
 	// avoid memory leak
 	pq.queue[last] = item{}
 	pq.queue = pq.queue[0:last]
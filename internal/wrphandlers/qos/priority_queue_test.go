@@ -4,6 +4,8 @@
 package qos
 
 import (
+	"fmt"
+	"slices"
 	"testing"
 	"time"
 
@@ -19,10 +21,20 @@ func TestPriorityQueue(t *testing.T) {
 	}{
 		{"Enqueue and Dequeue", testEnqueueDequeue},
 		{"Enqueue and Dequeue with age priority", testEnqueueDequeueAgePriority},
+		{"DequeueFunc", testDequeueFunc},
+		{"Requeue", testRequeue},
+		{"Per destination fairness", testPerDestinationFairness},
+		{"Drop handler", testDropHandler},
+		{"Message deadline", testMessageDeadline},
+		{"Message deadline under the queue limits", testMessageDeadlineUnderLimits},
+		{"Message deadline tie breaker", testMessageDeadlineTieBreaker},
 		{"Size", testSize},
 		{"Len", testLen},
 		{"Less", testLess},
 		{"Trim", testTrim},
+		{"Trim count", testTrimCount},
+		{"Trim memory", testTrimMemory},
+		{"Memory guard sampling", testMemoryGuardSampling},
 		{"Swap", testSwap},
 		{"Push", testPush},
 		{"Pop", testPop},
@@ -33,6 +45,323 @@ func TestPriorityQueue(t *testing.T) {
 	}
 }
 
+func testPerDestinationFairness(t *testing.T) {
+	const (
+		flood = "event:test/flood"
+		other = "event:test/other"
+	)
+
+	tests := []struct {
+		description string
+		fair        bool
+		expected    []string
+	}{
+		{
+			description: "without fairness",
+			expected: []string{
+				flood, flood, flood, flood, flood, flood, other,
+			},
+		},
+		{
+			description: "with fairness",
+			fair:        true,
+			expected: []string{
+				flood, flood, other, flood, flood, flood, flood,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			pq := priorityQueue{
+				maxQueueBytes:          DefaultMaxQueueBytes,
+				lowExpires:             DefaultLowExpires,
+				highExpires:            DefaultHighExpires,
+				tieBreaker:             PriorityOldestMsg,
+				perDestinationFairness: tc.fair,
+			}
+
+			// A burst to one destination, followed by a single message to another.
+			for i := 0; i < 5; i++ {
+				require.NoError(pq.Enqueue(wrp.Message{Destination: flood, QualityOfService: wrp.QOSLowValue}))
+				time.Sleep(time.Millisecond)
+			}
+			require.NoError(pq.Enqueue(wrp.Message{Destination: other, QualityOfService: wrp.QOSLowValue}))
+
+			// Higher qos levels are still delivered first.
+			require.NoError(pq.Enqueue(wrp.Message{Destination: flood, QualityOfService: wrp.QOSHighValue}))
+
+			var got []string
+			var levels []wrp.QOSLevel
+			for pq.Len() > 0 {
+				msg, ok := pq.Dequeue()
+				require.True(ok)
+				got = append(got, msg.Destination)
+				levels = append(levels, msg.QualityOfService.Level())
+			}
+
+			assert.Equal(tc.expected, got)
+			assert.Equal(wrp.QOSHigh, levels[0])
+
+			_, ok := pq.Dequeue()
+			assert.False(ok)
+		})
+	}
+}
+
+func testDropHandler(t *testing.T) {
+	payload := []byte("0123456789")
+	low := wrp.Message{Destination: "mac:00deadbeef00/low", Payload: payload, QualityOfService: wrp.QOSLowValue}
+	critical := wrp.Message{Destination: "mac:00deadbeef00/critical", Payload: payload, QualityOfService: wrp.QOSCriticalValue}
+	big := wrp.Message{Destination: "mac:00deadbeef00/big", Payload: make([]byte, 30), QualityOfService: wrp.QOSCriticalValue}
+
+	tests := []struct {
+		description string
+		lowExpires  time.Duration
+		messages    []wrp.Message
+		expected    []string
+	}{
+		{
+			description: "queue full",
+			lowExpires:  time.Hour,
+			messages:    []wrp.Message{low, critical, critical},
+			expected:    []string{low.Destination + ": " + DropQueueFull},
+		},
+		{
+			description: "incoming message lower priority than everything queued",
+			lowExpires:  time.Hour,
+			messages:    []wrp.Message{critical, critical, low},
+			expected:    []string{low.Destination + ": " + DropQueueFull},
+		},
+		{
+			description: "expired",
+			messages:    []wrp.Message{low, critical, critical},
+			expected:    []string{low.Destination + ": " + DropExpired},
+		},
+		{
+			description: "too large",
+			lowExpires:  time.Hour,
+			messages:    []wrp.Message{big},
+			expected:    []string{big.Destination + ": " + DropTooLarge},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var (
+				got      []string
+				payloads []int
+			)
+			pq := priorityQueue{
+				maxQueueBytes:   20,
+				maxMessageBytes: 20,
+				lowExpires:      tc.lowExpires,
+				criticalExpires: time.Hour,
+				tieBreaker:      PriorityNewestMsg,
+				dropHandler: func(msg wrp.Message, reason string) {
+					got = append(got, msg.Destination+": "+reason)
+					payloads = append(payloads, len(msg.Payload))
+				},
+			}
+
+			for _, msg := range tc.messages {
+				_ = pq.Enqueue(msg)
+			}
+
+			assert.Equal(tc.expected, got)
+			// The handler gets the message before its payload is discarded.
+			for _, n := range payloads {
+				assert.NotZero(n)
+			}
+		})
+	}
+}
+
+func testMessageDeadline(t *testing.T) {
+	payload := []byte("0123456789")
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	future := time.Now().Add(time.Minute).Format(time.RFC3339)
+
+	low := wrp.Message{Destination: "mac:00deadbeef00/low", Payload: payload, QualityOfService: wrp.QOSLowValue}
+	critical := wrp.Message{Destination: "mac:00deadbeef00/critical", Payload: payload, QualityOfService: wrp.QOSCriticalValue}
+	criticalPast := wrp.Message{
+		Destination:      "mac:00deadbeef00/critical-past",
+		Payload:          payload,
+		QualityOfService: wrp.QOSCriticalValue,
+		Metadata:         map[string]string{ExpiresMetadataKey: past},
+	}
+	criticalFuture := wrp.Message{
+		Destination:      "mac:00deadbeef00/critical-future",
+		Payload:          payload,
+		QualityOfService: wrp.QOSCriticalValue,
+		Metadata:         map[string]string{ExpiresMetadataKey: future},
+	}
+	criticalMalformed := wrp.Message{
+		Destination:      "mac:00deadbeef00/critical-malformed",
+		Payload:          payload,
+		QualityOfService: wrp.QOSCriticalValue,
+		Metadata:         map[string]string{ExpiresMetadataKey: "tomorrow"},
+	}
+
+	tests := []struct {
+		description string
+		messages    []wrp.Message
+		dropped     []string
+		expected    []string
+	}{
+		{
+			description: "passed deadline is dropped before a lower class",
+			messages:    []wrp.Message{low, criticalPast, critical},
+			dropped:     []string{criticalPast.Destination + ": " + DropExpired},
+			expected:    []string{critical.Destination, low.Destination},
+		},
+		{
+			description: "future deadline is kept",
+			messages:    []wrp.Message{low, criticalFuture, critical},
+			dropped:     []string{low.Destination + ": " + DropQueueFull},
+			expected:    []string{critical.Destination, criticalFuture.Destination},
+		},
+		{
+			description: "malformed deadline is ignored",
+			messages:    []wrp.Message{low, criticalMalformed, critical},
+			dropped:     []string{low.Destination + ": " + DropQueueFull},
+			expected:    []string{critical.Destination, criticalMalformed.Destination},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var dropped []string
+			pq := priorityQueue{
+				maxQueueBytes:   20,
+				lowExpires:      time.Hour,
+				criticalExpires: time.Hour,
+				tieBreaker:      PriorityNewestMsg,
+				dropHandler: func(msg wrp.Message, reason string) {
+					dropped = append(dropped, msg.Destination+": "+reason)
+				},
+			}
+
+			for _, msg := range tc.messages {
+				_ = pq.Enqueue(msg)
+			}
+
+			var got []string
+			for {
+				msg, ok := pq.Dequeue()
+				if !ok {
+					break
+				}
+				if msg.Payload != nil {
+					got = append(got, msg.Destination)
+				}
+			}
+
+			assert.Equal(tc.dropped, dropped)
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
+func testMessageDeadlineUnderLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	critical := wrp.Message{Destination: "mac:00deadbeef00/critical", Payload: []byte("{}"), QualityOfService: wrp.QOSCriticalValue}
+	criticalPast := wrp.Message{
+		Destination:      "mac:00deadbeef00/critical-past",
+		Payload:          []byte("{}"),
+		QualityOfService: wrp.QOSCriticalValue,
+		Metadata:         map[string]string{ExpiresMetadataKey: time.Now().Add(-time.Minute).Format(time.RFC3339)},
+	}
+
+	var dropped []string
+	pq := priorityQueue{
+		maxQueueBytes:   100,
+		criticalExpires: time.Hour,
+		tieBreaker:      PriorityNewestMsg,
+		dropHandler: func(msg wrp.Message, reason string) {
+			dropped = append(dropped, msg.Destination+": "+reason)
+		},
+	}
+
+	assert.NoError(pq.Enqueue(criticalPast))
+	assert.NoError(pq.Enqueue(critical))
+	// The queue is under its limits, so nothing has been trimmed yet.
+	assert.Empty(dropped)
+
+	var got []string
+	for {
+		msg, ok := pq.DequeueFunc(func(wrp.Message) bool { return true })
+		if !ok {
+			break
+		}
+		if msg.Payload != nil {
+			got = append(got, msg.Destination)
+		}
+	}
+
+	assert.Equal([]string{criticalPast.Destination + ": " + DropExpired}, dropped)
+	assert.Equal([]string{critical.Destination}, got)
+}
+
+func testMessageDeadlineTieBreaker(t *testing.T) {
+	older := wrp.Message{Destination: "mac:00deadbeef00/older", Payload: []byte("{}"), QualityOfService: wrp.QOSCriticalValue}
+	// newer's deadline is well before older's qos expiry, which mustn't make it look older.
+	newer := wrp.Message{
+		Destination:      "mac:00deadbeef00/newer",
+		Payload:          []byte("{}"),
+		QualityOfService: wrp.QOSCriticalValue,
+		Metadata:         map[string]string{ExpiresMetadataKey: time.Now().Add(time.Minute).Format(time.RFC3339)},
+	}
+
+	tests := []struct {
+		description string
+		tieBreaker  tieBreaker
+		expected    []string
+	}{
+		{
+			description: "newest first",
+			tieBreaker:  PriorityNewestMsg,
+			expected:    []string{newer.Destination, older.Destination},
+		},
+		{
+			description: "oldest first",
+			tieBreaker:  PriorityOldestMsg,
+			expected:    []string{older.Destination, newer.Destination},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			pq := priorityQueue{
+				maxQueueBytes:   100,
+				criticalExpires: time.Hour,
+				tieBreaker:      tc.tieBreaker,
+			}
+
+			assert.NoError(pq.Enqueue(older))
+			time.Sleep(time.Millisecond)
+			assert.NoError(pq.Enqueue(newer))
+
+			var got []string
+			for {
+				msg, ok := pq.Dequeue()
+				if !ok {
+					break
+				}
+				got = append(got, msg.Destination)
+			}
+
+			assert.Equal(tc.expected, got)
+		})
+	}
+}
+
 func testEnqueueDequeueAgePriority(t *testing.T) {
 	smallLowQOSMsgNewest := wrp.Message{
 		Destination:      "mac:00deadbeef00/config",
@@ -104,6 +433,102 @@ func testEnqueueDequeueAgePriority(t *testing.T) {
 	}
 }
 
+func testDequeueFunc(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	criticalMsg := wrp.Message{
+		Destination:      "mac:00deadbeef00/config",
+		QualityOfService: wrp.QOSCriticalValue,
+	}
+	highMsg := wrp.Message{
+		Destination:      "mac:00deadbeef01/config",
+		QualityOfService: wrp.QOSHighValue,
+	}
+	lowMsg := wrp.Message{
+		Destination:      "mac:00deadbeef02/config",
+		QualityOfService: wrp.QOSLowValue,
+	}
+	pq := priorityQueue{
+		maxQueueBytes: DefaultMaxQueueBytes,
+		tieBreaker:    PriorityNewestMsg,
+	}
+	for _, msg := range []wrp.Message{lowMsg, criticalMsg, highMsg} {
+		require.NoError(pq.Enqueue(msg))
+	}
+
+	// Skip the critical message, the high message is the next best.
+	msg, ok := pq.DequeueFunc(func(m wrp.Message) bool {
+		return m.Destination != criticalMsg.Destination
+	})
+	require.True(ok)
+	assert.Equal(highMsg, msg)
+
+	// Nothing is eligible.
+	_, ok = pq.DequeueFunc(func(wrp.Message) bool { return false })
+	assert.False(ok)
+	assert.Equal(2, pq.Len())
+
+	// A nil eligible behaves like Dequeue.
+	msg, ok = pq.DequeueFunc(nil)
+	require.True(ok)
+	assert.Equal(criticalMsg, msg)
+
+	msg, ok = pq.DequeueFunc(func(wrp.Message) bool { return true })
+	require.True(ok)
+	assert.Equal(lowMsg, msg)
+
+	_, ok = pq.DequeueFunc(nil)
+	assert.False(ok)
+}
+
+func testRequeue(t *testing.T) {
+	for _, fair := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fairness %t", fair), func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			failed := wrp.Message{
+				Destination:      "mac:00deadbeef00/config",
+				QualityOfService: wrp.QOSLowValue,
+				Payload:          []byte("failed"),
+			}
+			critical := wrp.Message{
+				Destination:      failed.Destination,
+				QualityOfService: wrp.QOSCriticalValue,
+				Payload:          []byte("critical"),
+			}
+			other := wrp.Message{
+				Destination:      "mac:00deadbeef01/config",
+				QualityOfService: wrp.QOSLowValue,
+				Payload:          []byte("other"),
+			}
+			pq := priorityQueue{
+				maxQueueBytes:          DefaultMaxQueueBytes,
+				tieBreaker:             PriorityOldestMsg,
+				perDestinationFairness: fair,
+			}
+			require.NoError(pq.Enqueue(critical))
+			require.NoError(pq.Enqueue(other))
+			require.NoError(pq.Requeue(failed))
+
+			var got []string
+			for {
+				msg, ok := pq.DequeueFunc(func(wrp.Message) bool { return true })
+				if !ok {
+					break
+				}
+				got = append(got, string(msg.Payload))
+			}
+
+			// The requeued message is held ahead of the critical message to the same destination.
+			require.Len(got, 3)
+			assert.Less(slices.Index(got, "failed"), slices.Index(got, "critical"))
+			assert.Zero(pq.held)
+		})
+	}
+}
+
 func testEnqueueDequeue(t *testing.T) {
 	var rdr = messageIsTooLarge
 	emptyLowQOSMsg := wrp.Message{
@@ -464,6 +889,51 @@ func testTrim(t *testing.T) {
 	assert.Equal(*pq.queue[3].msg, msg3)
 }
 
+func testTrimCount(t *testing.T) {
+	assert := assert.New(t)
+
+	pq := priorityQueue{
+		maxQueueBytes:   100,
+		maxQueueCount:   5,
+		lowExpires:      time.Hour,
+		criticalExpires: time.Hour,
+		tieBreaker:      PriorityNewestMsg,
+		priority:        NewestType,
+	}
+
+	// Empty payloads never exceed the byte budget.
+	for i := 0; i < 3; i++ {
+		assert.NoError(pq.Enqueue(wrp.Message{
+			Destination:      fmt.Sprintf("mac:00deadbeef00/critical/%d", i),
+			QualityOfService: wrp.QOSCriticalValue,
+		}))
+	}
+	for i := 0; i < 20; i++ {
+		assert.NoError(pq.Enqueue(wrp.Message{
+			Destination:      fmt.Sprintf("mac:00deadbeef00/low/%d", i),
+			QualityOfService: wrp.QOSLowValue,
+		}))
+	}
+
+	var live []string
+	for _, itm := range pq.queue {
+		if !itm.discard {
+			live = append(live, itm.msg.Destination)
+		}
+	}
+
+	assert.Len(live, 5)
+	assert.Zero(pq.sizeBytes)
+	assert.Equal(uint64(18), pq.dropped[wrp.QOSLow])
+	assert.Zero(pq.dropped[wrp.QOSCritical])
+	for i := 0; i < 3; i++ {
+		assert.Contains(live, fmt.Sprintf("mac:00deadbeef00/critical/%d", i))
+	}
+	// The newest low qos messages are kept.
+	assert.Contains(live, "mac:00deadbeef00/low/18")
+	assert.Contains(live, "mac:00deadbeef00/low/19")
+}
+
 func testSwap(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -598,3 +1068,88 @@ func testPop(t *testing.T) {
 		})
 	}
 }
+
+func testTrimMemory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var memory uint64
+	pq := priorityQueue{
+		maxQueueBytes:   DefaultMaxQueueBytes,
+		lowExpires:      DefaultLowExpires,
+		mediumExpires:   DefaultMediumExpires,
+		highExpires:     DefaultHighExpires,
+		criticalExpires: DefaultCriticalExpires,
+		tieBreaker:      PriorityNewestMsg,
+		memoryGuard: &memoryGuard{
+			fraction: 0.5,
+			sample: func() uint64 {
+				return memory
+			},
+		},
+	}
+
+	payload := []byte("0123456789")
+	oldLow := wrp.Message{Destination: "mac:00deadbeef00/old", Payload: payload, QualityOfService: wrp.QOSLowValue}
+	newLow := wrp.Message{Destination: "mac:00deadbeef00/new", Payload: payload, QualityOfService: wrp.QOSLowValue}
+	critical := wrp.Message{Destination: "mac:00deadbeef00/critical", Payload: payload, QualityOfService: wrp.QOSCriticalValue}
+
+	// Plenty of memory, nothing is trimmed.
+	memory = 1000
+	for _, msg := range []wrp.Message{oldLow, critical, newLow} {
+		require.NoError(pq.Enqueue(msg))
+	}
+	assert.Equal(int64(3*len(payload)), pq.sizeBytes)
+
+	// The queue may only use 30 bytes, the oldest low qos message is trimmed.
+	memory = 60
+	require.NoError(pq.Enqueue(critical))
+	assert.Equal(int64(3*len(payload)), pq.sizeBytes)
+	assert.True(pq.queue[slices.IndexFunc(pq.queue, func(i item) bool {
+		return i.msg.Destination == oldLow.Destination
+	})].discard)
+
+	// The queue may only use 10 bytes, but only low qos messages are trimmed.
+	memory = 20
+	require.NoError(pq.Enqueue(critical))
+	assert.Equal(int64(3*len(payload)), pq.sizeBytes)
+
+	var trimmed, delivered []string
+	for pq.Len() > 0 {
+		msg, ok := pq.Dequeue()
+		require.True(ok)
+		if msg.Payload == nil {
+			trimmed = append(trimmed, msg.Destination)
+			continue
+		}
+
+		delivered = append(delivered, msg.Destination)
+	}
+
+	assert.ElementsMatch([]string{oldLow.Destination, newLow.Destination}, trimmed)
+	assert.ElementsMatch([]string{critical.Destination, critical.Destination, critical.Destination}, delivered)
+	assert.Equal(uint64(2), pq.dropped[wrp.QOSLow])
+	assert.Zero(pq.dropped[wrp.QOSCritical])
+}
+
+func testMemoryGuardSampling(t *testing.T) {
+	assert := assert.New(t)
+
+	var samples int
+	g := memoryGuard{
+		fraction: 0.25,
+		interval: time.Minute,
+		sample: func() uint64 {
+			samples++
+			return 400
+		},
+	}
+
+	now := time.Now()
+	assert.Equal(int64(100), g.limit(now))
+	assert.Equal(int64(100), g.limit(now.Add(time.Second)))
+	assert.Equal(1, samples)
+
+	assert.Equal(int64(100), g.limit(now.Add(time.Minute)))
+	assert.Equal(2, samples)
+}
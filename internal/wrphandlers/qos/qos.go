@@ -4,11 +4,13 @@
 package qos
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
 
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/fs"
 	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
 )
 
@@ -43,6 +45,41 @@ type Handler struct {
 	maxQueueBytes int64
 	// MaxMessageBytes is the largest allowable wrp message payload.
 	maxMessageBytes int
+	// maxQueueCount is the allowable max number of queued wrp messages, regardless of their size.
+	maxQueueCount int
+	// deliveryConcurrency is the number of messages that may be delivered to next concurrently.
+	deliveryConcurrency int
+	// preserveOrderPerDestination determines whether concurrent deliveries to the same destination are prevented.
+	preserveOrderPerDestination bool
+	// perDestinationFairness determines whether deliveries take turns between destinations of the same qos level.
+	perDestinationFairness bool
+
+	// Backpressure notifications.
+	// highWaterMark is the queue size, in bytes, at or above which backpressure is signaled.
+	highWaterMark int64
+	// lowWaterMark is the queue size, in bytes, at or below which backpressure is cleared.
+	lowWaterMark int64
+	// backpressure is called with true when the high water mark is crossed and false when the low water mark is reached.
+	backpressure func(active bool)
+
+	// dropHandler is called with each message dropped from the queue and the reason.
+	dropHandler func(wrp.Message, string)
+
+	// Persistence.
+	// persistFS is the filesystem the queue is persisted to on Stop, and restored from on Start.
+	// Nil disables persistence.
+	persistFS fs.FS
+	// persistPath is the path of the persisted queue, relative to persistFS.
+	persistPath string
+
+	// Memory guard.
+	// maxQueueMemoryFraction is the max fraction of the process memory the queue may use,
+	// beyond which low qos messages are trimmed. Zero disables the guard.
+	maxQueueMemoryFraction float64
+	// memorySampler returns the process memory.
+	memorySampler memorySampler
+	// memorySampleInterval is the minimum time between process memory samples.
+	memorySampleInterval time.Duration
 
 	// QOS expiries.
 	// lowExpires determines when low qos messages are trimmed.
@@ -54,7 +91,38 @@ type Handler struct {
 	// criticalExpires determines when critical qos messages are trimmed.
 	criticalExpires time.Duration
 
+	// shutdownCtx stops new deliveries once canceled, leaving the queued
+	// messages to be persisted by Handler.Stop.
+	shutdownCtx context.Context
+
 	lock sync.Mutex
+	// stopped is closed once serviceQOS has exited.
+	stopped chan struct{}
+
+	// statsLock protects stats, which serviceQOS publishes after each change to the queue.
+	statsLock sync.RWMutex
+	stats     queueStats
+}
+
+// Stats is a snapshot of the qos' priority queue statistics.
+type Stats struct {
+	// QueuedMessages is the number of queued messages, including dropped messages
+	// whose failure is yet to be delivered.
+	QueuedMessages int
+	// QueuedBytes is the sum of all queued wrp message's payloads.
+	QueuedBytes int64
+	// MaxQueueBytes is the allowable max size of the queue.
+	MaxQueueBytes int64
+	// Dropped is the number of messages dropped per qos level since Handler.Start was called,
+	// either for being too large, expiring or being trimmed to make room.
+	Dropped map[wrp.QOSLevel]uint64
+}
+
+// queueStats are the priority queue statistics published by serviceQOS.
+type queueStats struct {
+	messages int
+	bytes    int64
+	dropped  [wrp.QOSCritical + 1]uint64
 }
 
 // New creates a new instance of the Handler struct.  The parameter next is the
@@ -67,14 +135,18 @@ func New(next wrpkit.Handler, opts ...Option) (*Handler, error) {
 	}
 
 	// Add configuration validators.
-	opts = append(opts, validateQueueConstraints(), validatePriority(), validateTieBreaker())
+	opts = append(opts, validateQueueConstraints(), validatePriority(), validateTieBreaker(), validateWatermarks())
 
 	h := Handler{
-		next:            next,
-		lowExpires:      DefaultLowExpires,
-		mediumExpires:   DefaultMediumExpires,
-		highExpires:     DefaultHighExpires,
-		criticalExpires: DefaultCriticalExpires,
+		next:                 next,
+		deliveryConcurrency:  DefaultDeliveryConcurrency,
+		lowExpires:           DefaultLowExpires,
+		mediumExpires:        DefaultMediumExpires,
+		highExpires:          DefaultHighExpires,
+		criticalExpires:      DefaultCriticalExpires,
+		memorySampler:        runtimeMemory,
+		memorySampleInterval: DefaultMemorySampleInterval,
+		shutdownCtx:          context.Background(),
 	}
 
 	var errs error
@@ -93,13 +165,44 @@ func New(next wrpkit.Handler, opts ...Option) (*Handler, error) {
 	return &h, errs
 }
 
+// Stats returns a snapshot of the queue statistics.  It is safe to call at any time.
+func (h *Handler) Stats() Stats {
+	h.statsLock.RLock()
+	defer h.statsLock.RUnlock()
+
+	s := Stats{
+		QueuedMessages: h.stats.messages,
+		QueuedBytes:    h.stats.bytes,
+		MaxQueueBytes:  h.maxQueueBytes,
+		Dropped:        make(map[wrp.QOSLevel]uint64, len(h.stats.dropped)),
+	}
+	for level, n := range h.stats.dropped {
+		s.Dropped[wrp.QOSLevel(level)] = n
+	}
+
+	return s
+}
+
+// publishStats makes the current statistics of pq available to Stats.
+func (h *Handler) publishStats(pq *priorityQueue) {
+	h.statsLock.Lock()
+	defer h.statsLock.Unlock()
+
+	h.stats = queueStats{
+		messages: pq.Len(),
+		bytes:    pq.sizeBytes,
+		dropped:  pq.dropped,
+	}
+}
+
 func (h *Handler) Start() {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
 	if h.queue == nil {
 		h.queue = make(chan wrp.Message)
-		go h.serviceQOS(h.queue)
+		h.stopped = make(chan struct{})
+		go h.serviceQOS(h.queue, h.stopped)
 	}
 }
 
@@ -110,6 +213,11 @@ func (h *Handler) Stop() {
 	if h.queue != nil {
 		close(h.queue)
 		h.queue = nil
+
+		// Wait for the queue to be persisted, so a restart finds it.
+		if h.persistFS != nil {
+			<-h.stopped
+		}
 	}
 }
 
@@ -132,64 +240,136 @@ func (h *Handler) HandleWrp(msg wrp.Message) error {
 // where the highest QOS messages are prioritized.
 // Handler.Start starts serviceQOS.
 // Handler.Stop stops serviceQOS.
-func (h *Handler) serviceQOS(queue <-chan wrp.Message) {
+func (h *Handler) serviceQOS(queue <-chan wrp.Message, stopped chan<- struct{}) {
+	defer close(stopped)
+
 	var (
-		// Signaling channel from the handleWRP.
-		ready <-chan struct{}
-		// Channel for failed deliveries, re-enqueue message.
-		failedMsg <-chan wrp.Message
+		// Channel for finished deliveries, buffered so in flight deliveries
+		// never block once serviceQOS has stopped.
+		results = make(chan delivery, h.deliveryConcurrency)
+		// inflight is the number of deliveries in progress.
+		inflight int
+		// busy is the number of deliveries in progress per destination.
+		busy = make(map[string]int)
+		// throttled is whether backpressure is currently signaled.
+		throttled bool
+		// shutdown is closed once no further deliveries may be started.
+		shutdown = h.shutdownCtx.Done()
 	)
 
+	// eligible determines whether a message can be delivered now, preventing
+	// concurrent deliveries to the same destination when required.
+	var eligible func(wrp.Message) bool
+	if h.preserveOrderPerDestination {
+		eligible = func(msg wrp.Message) bool {
+			return busy[msg.Destination] == 0
+		}
+	}
+
 	// create and manage the priority queue
 	pq := priorityQueue{
 		maxQueueBytes:   h.maxQueueBytes,
 		maxMessageBytes: h.maxMessageBytes,
+		maxQueueCount:   h.maxQueueCount,
+		priority:        h.priority,
 		tieBreaker:      h.tieBreaker,
+		lowExpires:      h.lowExpires,
+		mediumExpires:   h.mediumExpires,
+		highExpires:     h.highExpires,
+		criticalExpires: h.criticalExpires,
+		dropHandler:     h.dropHandler,
+
+		perDestinationFairness: h.perDestinationFairness,
+	}
+	if h.maxQueueMemoryFraction > 0 {
+		pq.memoryGuard = &memoryGuard{
+			fraction: h.maxQueueMemoryFraction,
+			sample:   h.memorySampler,
+			interval: h.memorySampleInterval,
+		}
 	}
+	// Restored messages are delivered before waiting for new ones.
+	h.restore(&pq)
 	for {
+		for inflight < h.deliveryConcurrency && h.shutdownCtx.Err() == nil {
+			top, ok := pq.DequeueFunc(eligible)
+			if !ok {
+				break
+			}
+
+			inflight++
+			busy[top.Destination]++
+			go h.wrpHandler(top, results)
+		}
+
+		throttled = h.signalBackpressure(throttled, pq.sizeBytes)
+		h.publishStats(&pq)
+
 		select {
+		case <-shutdown:
+			// The queue is kept until Handler.Stop is called.
+			shutdown = nil
 		case msg, ok := <-queue:
 			if !ok {
 				// Handler.Stop has been called.
+				// Persistence is best effort, the queue is lost on failure like without it.
+				_ = h.persist(&pq)
 				return
 			}
 
 			// ErrMaxMessageBytes errrors are ignored.
 			_ = pq.Enqueue(msg)
-		case <-ready:
-			// Previous Handler.wrpHandler has finished, check whether it
+		case d := <-results:
+			// A previous Handler.wrpHandler has finished, check whether it
 			// was successful or not.
-			if msg, ok := <-failedMsg; ok {
+			inflight--
+			if busy[d.msg.Destination]--; busy[d.msg.Destination] <= 0 {
+				delete(busy, d.msg.Destination)
+			}
+
+			if d.err != nil {
 				// Delivery failed, re-enqueue message and try again later.
 				// ErrMaxMessageBytes errrors are ignored.
-				_ = pq.Enqueue(msg)
+				if h.preserveOrderPerDestination {
+					// Hold the message ahead of the rest of its destination's messages.
+					_ = pq.Requeue(d.msg)
+				} else {
+					_ = pq.Enqueue(d.msg)
+				}
 			}
-
-			ready, failedMsg = nil, nil
 		}
 
-		if top, ok := pq.Dequeue(); ok {
-			failedMsg, ready = h.wrpHandler(top)
-		}
 	}
 }
 
-// wrpHandler calls handler.next.HandleWrp to deliver incoming messages.
-// Returns a signaling channel indicating handler.next.HandleWrp is done
-// and a message channel for failed deliveries.
-func (h *Handler) wrpHandler(msg wrp.Message) (<-chan wrp.Message, <-chan struct{}) {
-	ready := make(chan struct{})
-	failedMsg := make(chan wrp.Message, 1)
-	go func() {
-		defer close(ready)
-		defer close(failedMsg)
-
-		if err := h.next.HandleWrp(msg); err != nil {
-			// Delivery failed, re-enqueue message and try again later.
-			failedMsg <- msg
-			// The err itself is ignored.
-		}
-	}()
+// signalBackpressure notifies the backpressure callback whenever the queue size crosses
+// the high water mark or drops to the low water mark, returning the new throttled state.
+func (h *Handler) signalBackpressure(throttled bool, size int64) bool {
+	if h.backpressure == nil {
+		return throttled
+	}
+
+	switch {
+	case !throttled && size >= h.highWaterMark:
+		throttled = true
+		h.backpressure(throttled)
+	case throttled && size <= h.lowWaterMark:
+		throttled = false
+		h.backpressure(throttled)
+	}
+
+	return throttled
+}
+
+// delivery is the outcome of a single call to handler.next.HandleWrp.
+type delivery struct {
+	msg wrp.Message
+	err error
+}
 
-	return failedMsg, ready
+// wrpHandler calls handler.next.HandleWrp to deliver incoming messages and
+// reports the outcome to results.
+func (h *Handler) wrpHandler(msg wrp.Message, results chan<- delivery) {
+	// The err itself is ignored beyond triggering a re-enqueue.
+	results <- delivery{msg: msg, err: h.next.HandleWrp(msg)}
 }
@@ -6,7 +6,9 @@ package qos_test
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -14,6 +16,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/fs/mem"
 	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/qos"
 	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
 )
@@ -101,6 +104,16 @@ func TestHandler_HandleWrp(t *testing.T) {
 			}),
 			shouldHalt: true,
 		},
+		{
+			description:   "enqueued and delivered message with a memory guard",
+			options:       []qos.Option{qos.MaxQueueBytes(int64(100)), qos.MaxQueueMemoryFraction(0.5), qos.Priority(qos.NewestType)},
+			nextCallCount: 1,
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+		},
 		{
 			description:   "zero MaxQueueBytes option value",
 			options:       []qos.Option{qos.MaxQueueBytes(int64(100)), qos.MaxMessageBytes(50), qos.Priority(qos.NewestType)},
@@ -177,6 +190,116 @@ func TestHandler_HandleWrp(t *testing.T) {
 			}),
 			expectedNewErr: qos.ErrMisconfiguredQOS,
 		},
+		{
+			description: "negative MaxQueueMemoryFraction option value",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.MaxQueueMemoryFraction(-0.1), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "MaxQueueMemoryFraction option value above one",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.MaxQueueMemoryFraction(1.5), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "negative MaxQueueCount option value",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.MaxQueueCount(-1), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "negative DeliveryConcurrency option value",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.DeliveryConcurrency(-1), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "nil drop handler",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.WithDropHandler(nil), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "nil shutdown context",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.ShutdownContext(nil), qos.Priority(qos.NewestType)}, //nolint:staticcheck
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "Persist without a filesystem",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.Persist(nil, "queue.msgpack"), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "Persist without a path",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.Persist(mem.New(), ""), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "invalid Backpressure watermarks",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.Backpressure(10, 20, func(bool) {}), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "Backpressure high water mark exceeds MaxQueueBytes",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.Backpressure(200, 20, func(bool) {}), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
+		{
+			description: "nil Backpressure callback",
+			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.Backpressure(50, 20, nil), qos.Priority(qos.NewestType)},
+			next: wrpkit.HandlerFunc(func(wrp.Message) error {
+				nextCallCount.Add(1)
+
+				return nil
+			}),
+			expectedNewErr: qos.ErrMisconfiguredQOS,
+		},
 		{
 			description: "negative MaxMessageBytes option value",
 			options:     []qos.Option{qos.MaxQueueBytes(int64(100)), qos.MaxMessageBytes(-1), qos.Priority(qos.NewestType)},
@@ -342,3 +465,664 @@ func TestHandler_HandleWrp(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_DeliveryConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const (
+		concurrency = 4
+		count       = 12
+		delay       = 50 * time.Millisecond
+	)
+	var (
+		delivered, current, peak atomic.Int64
+	)
+
+	next := wrpkit.HandlerFunc(func(wrp.Message) error {
+		n := current.Add(1)
+		defer current.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		time.Sleep(delay)
+		delivered.Add(1)
+
+		return nil
+	})
+
+	h, err := qos.New(next, qos.MaxQueueBytes(int64(1000)), qos.Priority(qos.OldestType), qos.DeliveryConcurrency(concurrency))
+	require.NoError(err)
+	require.NotNil(h)
+
+	h.Start()
+	defer h.Stop()
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		require.NoError(h.HandleWrp(wrp.Message{
+			Type:             wrp.SimpleEventMessageType,
+			Source:           "mac:00deadbeef00/service",
+			Destination:      fmt.Sprintf("event:test/%d", i),
+			QualityOfService: wrp.QOSLowValue,
+		}))
+	}
+
+	require.Eventually(func() bool {
+		return delivered.Load() == count
+	}, 2*time.Second, 5*time.Millisecond)
+
+	// Serial delivery would take count*delay.
+	assert.Less(time.Since(start), count*delay/2)
+	assert.LessOrEqual(peak.Load(), int64(concurrency))
+	assert.Greater(peak.Load(), int64(1))
+}
+
+func TestHandler_QOSExpires(t *testing.T) {
+	tests := []struct {
+		description string
+		expires     time.Duration
+		// wait is how long to wait before the queue is trimmed.
+		wait time.Duration
+		// expectedBytes is the size of the queue once it is trimmed.
+		expectedBytes int64
+		// expectedDropped is the number of low qos messages dropped.
+		expectedDropped uint64
+	}{
+		{
+			description: "unexpired messages are trimmed by priority",
+			expires:     time.Hour,
+			// 4 queued * 30 bytes exceeds maxQueueBytes, so one message is trimmed.
+			expectedBytes:   90,
+			expectedDropped: 1,
+		},
+		{
+			description: "expired messages are trimmed first",
+			expires:     10 * time.Millisecond,
+			wait:        20 * time.Millisecond,
+			// Only the newest message is yet to expire.
+			expectedBytes:   30,
+			expectedDropped: 3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			release := make(chan struct{})
+			next := wrpkit.HandlerFunc(func(wrp.Message) error {
+				<-release
+
+				return nil
+			})
+
+			h, err := qos.New(next,
+				qos.MaxQueueBytes(int64(100)),
+				qos.Priority(qos.NewestType),
+				qos.LowExpires(tc.expires),
+			)
+			require.NoError(err)
+			require.NotNil(h)
+
+			h.Start()
+			defer func() {
+				close(release)
+				h.Stop()
+			}()
+
+			msg := wrp.Message{
+				Type:             wrp.SimpleEventMessageType,
+				Source:           "mac:00deadbeef00/service",
+				Destination:      "event:test",
+				Payload:          make([]byte, 30),
+				QualityOfService: wrp.QOSLowValue,
+			}
+
+			// The first message is held by the blocked delivery, the rest are queued.
+			require.NoError(h.HandleWrp(msg))
+			require.Eventually(func() bool {
+				return h.Stats().QueuedBytes == 0
+			}, time.Second, 5*time.Millisecond)
+
+			for i := 0; i < 3; i++ {
+				require.NoError(h.HandleWrp(msg))
+			}
+			require.Eventually(func() bool {
+				return h.Stats().QueuedBytes == 90
+			}, time.Second, 5*time.Millisecond)
+
+			// Exceeding maxQueueBytes trims the queue.
+			time.Sleep(tc.wait)
+			require.NoError(h.HandleWrp(msg))
+			require.Eventually(func() bool {
+				return h.Stats().Dropped[wrp.QOSLow] > 0
+			}, time.Second, 5*time.Millisecond)
+
+			stats := h.Stats()
+			assert.Equal(tc.expectedBytes, stats.QueuedBytes)
+			assert.Equal(tc.expectedDropped, stats.Dropped[wrp.QOSLow])
+		})
+	}
+}
+
+func TestHandler_PreserveOrderPerDestination(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const (
+		perDestination = 5
+	)
+	var (
+		lock      sync.Mutex
+		received  = make(map[string][]int)
+		current   = make(map[string]int)
+		overlaps  atomic.Int64
+		delivered atomic.Int64
+		dests     = []string{"event:test/a", "event:test/b", "event:test/c"}
+	)
+
+	next := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+		lock.Lock()
+		current[msg.Destination]++
+		if current[msg.Destination] > 1 {
+			overlaps.Add(1)
+		}
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		var i int
+		_, _ = fmt.Sscanf(string(msg.Payload), "%d", &i)
+
+		lock.Lock()
+		current[msg.Destination]--
+		received[msg.Destination] = append(received[msg.Destination], i)
+		lock.Unlock()
+		delivered.Add(1)
+
+		return nil
+	})
+
+	h, err := qos.New(next,
+		qos.MaxQueueBytes(int64(1000)),
+		qos.Priority(qos.OldestType),
+		qos.DeliveryConcurrency(len(dests)*2),
+		qos.PreserveOrderPerDestination(),
+	)
+	require.NoError(err)
+	require.NotNil(h)
+
+	h.Start()
+	defer h.Stop()
+
+	for i := 0; i < perDestination; i++ {
+		for _, dest := range dests {
+			require.NoError(h.HandleWrp(wrp.Message{
+				Type:             wrp.SimpleEventMessageType,
+				Source:           "mac:00deadbeef00/service",
+				Destination:      dest,
+				Payload:          []byte(fmt.Sprintf("%d", i)),
+				QualityOfService: wrp.QOSLowValue,
+			}))
+		}
+	}
+
+	require.Eventually(func() bool {
+		return delivered.Load() == int64(perDestination*len(dests))
+	}, 2*time.Second, 5*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Zero(overlaps.Load())
+	for _, dest := range dests {
+		assert.Equal([]int{0, 1, 2, 3, 4}, received[dest], dest)
+	}
+}
+
+func TestHandler_PreserveOrderPerDestinationRetry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const (
+		perDestination = 5
+	)
+	var (
+		lock      sync.Mutex
+		received  = make(map[string][]int)
+		failed    = make(map[string]bool)
+		delivered atomic.Int64
+		dests     = []string{"event:test/a", "event:test/b"}
+	)
+
+	next := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+		time.Sleep(5 * time.Millisecond)
+
+		var i int
+		_, _ = fmt.Sscanf(string(msg.Payload), "%d", &i)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		// The first delivery of each destination's second message fails.
+		if i == 1 && !failed[msg.Destination] {
+			failed[msg.Destination] = true
+			return errors.New("delivery failed")
+		}
+
+		received[msg.Destination] = append(received[msg.Destination], i)
+		delivered.Add(1)
+
+		return nil
+	})
+
+	h, err := qos.New(next,
+		qos.MaxQueueBytes(int64(1000)),
+		qos.Priority(qos.OldestType),
+		qos.DeliveryConcurrency(len(dests)*2),
+		qos.PreserveOrderPerDestination(),
+	)
+	require.NoError(err)
+	require.NotNil(h)
+
+	h.Start()
+	defer h.Stop()
+
+	for i := 0; i < perDestination; i++ {
+		for _, dest := range dests {
+			require.NoError(h.HandleWrp(wrp.Message{
+				Type:             wrp.SimpleEventMessageType,
+				Source:           "mac:00deadbeef00/service",
+				Destination:      dest,
+				Payload:          []byte(fmt.Sprintf("%d", i)),
+				QualityOfService: wrp.QOSLowValue,
+			}))
+		}
+	}
+
+	require.Eventually(func() bool {
+		return delivered.Load() == int64(perDestination*len(dests))
+	}, 2*time.Second, 5*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, dest := range dests {
+		assert.True(failed[dest], dest)
+		assert.Equal([]int{0, 1, 2, 3, 4}, received[dest], dest)
+	}
+}
+
+func TestHandler_Backpressure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var (
+		lock    sync.Mutex
+		signals []bool
+		release = make(chan struct{})
+	)
+
+	next := wrpkit.HandlerFunc(func(wrp.Message) error {
+		<-release
+
+		return nil
+	})
+
+	h, err := qos.New(next,
+		qos.MaxQueueBytes(int64(100)),
+		qos.Priority(qos.NewestType),
+		qos.CriticalExpires(time.Hour),
+		qos.Backpressure(50, 20, func(active bool) {
+			lock.Lock()
+			defer lock.Unlock()
+			signals = append(signals, active)
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(h)
+
+	h.Start()
+	defer h.Stop()
+
+	getSignals := func() []bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]bool{}, signals...)
+	}
+
+	msg := wrp.Message{
+		Type:             wrp.SimpleEventMessageType,
+		Source:           "mac:00deadbeef00/service",
+		Destination:      "event:test",
+		Payload:          []byte("0123456789"),
+		QualityOfService: wrp.QOSCriticalValue,
+	}
+
+	// The first message is held by the blocked delivery, the rest are queued.
+	for i := 0; i < 5; i++ {
+		require.NoError(h.HandleWrp(msg))
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(getSignals())
+
+	// Crossing the high water mark signals backpressure.
+	require.NoError(h.HandleWrp(msg))
+	require.Eventually(func() bool {
+		return len(getSignals()) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal([]bool{true}, getSignals())
+
+	// Draining to the low water mark clears backpressure.
+	close(release)
+	require.Eventually(func() bool {
+		return len(getSignals()) == 2
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal([]bool{true, false}, getSignals())
+}
+
+func TestHandler_ShutdownContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var delivered atomic.Int64
+	next := wrpkit.HandlerFunc(func(wrp.Message) error {
+		delivered.Add(1)
+
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h, err := qos.New(next,
+		qos.MaxQueueBytes(int64(100)),
+		qos.Priority(qos.NewestType),
+		qos.ShutdownContext(ctx),
+	)
+	require.NoError(err)
+	require.NotNil(h)
+
+	h.Start()
+	defer h.Stop()
+
+	msg := wrp.Message{
+		Type:             wrp.SimpleEventMessageType,
+		Source:           "mac:00deadbeef00/service",
+		Destination:      "event:test",
+		Payload:          []byte("{}"),
+		QualityOfService: wrp.QOSLowValue,
+	}
+
+	require.NoError(h.HandleWrp(msg))
+	require.Eventually(func() bool {
+		return delivered.Load() == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// Once the shutdown context is canceled, messages are queued but no longer delivered.
+	cancel()
+	require.NoError(h.HandleWrp(msg))
+	require.Eventually(func() bool {
+		return h.Stats().QueuedMessages == 1
+	}, time.Second, 5*time.Millisecond)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(int64(1), delivered.Load())
+}
+
+func TestHandler_Stats(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	release := make(chan struct{})
+	next := wrpkit.HandlerFunc(func(wrp.Message) error {
+		<-release
+
+		return nil
+	})
+
+	h, err := qos.New(next,
+		qos.MaxQueueBytes(int64(100)),
+		qos.MaxMessageBytes(50),
+		qos.Priority(qos.NewestType),
+	)
+	require.NoError(err)
+	require.NotNil(h)
+
+	stats := h.Stats()
+	assert.Equal(int64(100), stats.MaxQueueBytes)
+	assert.Zero(stats.QueuedMessages)
+	assert.Zero(stats.QueuedBytes)
+
+	h.Start()
+	defer func() {
+		close(release)
+		h.Stop()
+	}()
+
+	msg := wrp.Message{
+		Type:             wrp.SimpleEventMessageType,
+		Source:           "mac:00deadbeef00/service",
+		Destination:      "event:test",
+		Payload:          make([]byte, 30),
+		QualityOfService: wrp.QOSLowValue,
+	}
+
+	// The first message is held by the blocked delivery, the rest are queued.
+	require.NoError(h.HandleWrp(msg))
+	require.NoError(h.HandleWrp(msg))
+	require.NoError(h.HandleWrp(msg))
+	require.Eventually(func() bool {
+		return h.Stats().QueuedMessages == 2
+	}, time.Second, 5*time.Millisecond)
+
+	stats = h.Stats()
+	assert.Equal(int64(60), stats.QueuedBytes)
+	assert.Zero(stats.Dropped[wrp.QOSLow])
+
+	// Exceeding maxQueueBytes trims the queue.
+	require.NoError(h.HandleWrp(msg))
+	require.NoError(h.HandleWrp(msg))
+	require.Eventually(func() bool {
+		return h.Stats().Dropped[wrp.QOSLow] > 0
+	}, time.Second, 5*time.Millisecond)
+	assert.LessOrEqual(h.Stats().QueuedBytes, int64(100))
+
+	// Messages larger than maxMessageBytes are dropped.
+	big := msg
+	big.Payload = make([]byte, 60)
+	big.QualityOfService = wrp.QOSCriticalValue
+	require.NoError(h.HandleWrp(big))
+	require.Eventually(func() bool {
+		return h.Stats().Dropped[wrp.QOSCritical] == 1
+	}, time.Second, 5*time.Millisecond)
+
+	stats = h.Stats()
+	assert.Zero(stats.Dropped[wrp.QOSMedium])
+	assert.Zero(stats.Dropped[wrp.QOSHigh])
+}
+
+func TestHandler_DropHandler(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	type drop struct {
+		destination string
+		payload     int
+		reason      string
+	}
+
+	var (
+		lock    sync.Mutex
+		drops   []drop
+		release = make(chan struct{})
+	)
+
+	next := wrpkit.HandlerFunc(func(wrp.Message) error {
+		<-release
+
+		return nil
+	})
+
+	h, err := qos.New(next,
+		qos.MaxQueueBytes(int64(100)),
+		qos.MaxMessageBytes(50),
+		qos.Priority(qos.NewestType),
+		qos.WithDropHandler(func(msg wrp.Message, reason string) {
+			lock.Lock()
+			defer lock.Unlock()
+			drops = append(drops, drop{
+				destination: msg.Destination,
+				payload:     len(msg.Payload),
+				reason:      reason,
+			})
+		}),
+	)
+	require.NoError(err)
+	require.NotNil(h)
+
+	h.Start()
+	defer func() {
+		close(release)
+		h.Stop()
+	}()
+
+	getDrops := func() []drop {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]drop{}, drops...)
+	}
+
+	msg := wrp.Message{
+		Type:             wrp.SimpleEventMessageType,
+		Source:           "mac:00deadbeef00/service",
+		Destination:      "event:test/critical",
+		Payload:          make([]byte, 40),
+		QualityOfService: wrp.QOSCriticalValue,
+	}
+
+	// The first message is held by the blocked delivery, the rest are queued.
+	require.NoError(h.HandleWrp(msg))
+	require.NoError(h.HandleWrp(msg))
+	require.NoError(h.HandleWrp(msg))
+
+	// The queue is full of higher priority messages, so the incoming one is dropped.
+	low := msg
+	low.Destination = "event:test/low"
+	low.QualityOfService = wrp.QOSLowValue
+	require.NoError(h.HandleWrp(low))
+
+	big := msg
+	big.Destination = "event:test/big"
+	big.Payload = make([]byte, 60)
+	require.NoError(h.HandleWrp(big))
+
+	require.Eventually(func() bool {
+		return len(getDrops()) == 2
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal([]drop{
+		{destination: "event:test/low", payload: 40, reason: qos.DropQueueFull},
+		{destination: "event:test/big", payload: 60, reason: qos.DropTooLarge},
+	}, getDrops())
+}
+
+func TestHandler_Persist(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fsys := mem.New(mem.WithDir(".", 0755))
+	release := make(chan struct{})
+	defer close(release)
+
+	// The first handler never finishes a delivery, so the messages stay queued.
+	blocked := wrpkit.HandlerFunc(func(wrp.Message) error {
+		<-release
+
+		return nil
+	})
+
+	h, err := qos.New(blocked,
+		qos.MaxQueueBytes(1024),
+		qos.Priority(qos.OldestType),
+		qos.LowExpires(50*time.Millisecond),
+		qos.Persist(fsys, "qos/queue.msgpack"),
+	)
+	require.NoError(err)
+
+	h.Start()
+
+	msg := wrp.Message{
+		Type:             wrp.SimpleEventMessageType,
+		Source:           "mac:00deadbeef00/service",
+		QualityOfService: wrp.QOSCriticalValue,
+		Payload:          []byte("payload"),
+	}
+	for _, dest := range []string{"event:test/inflight", "event:test/1", "event:test/2"} {
+		msg.Destination = dest
+		require.NoError(h.HandleWrp(msg))
+	}
+
+	low := msg
+	low.Destination = "event:test/low"
+	low.QualityOfService = wrp.QOSLowValue
+	require.NoError(h.HandleWrp(low))
+
+	require.Eventually(func() bool {
+		return h.Stats().QueuedMessages == 3
+	}, time.Second, 5*time.Millisecond)
+	h.Stop()
+
+	// Let the low qos message expire before the restart.
+	time.Sleep(100 * time.Millisecond)
+
+	var (
+		lock      sync.Mutex
+		delivered []wrp.Message
+		drops     []string
+	)
+	next := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+		delivered = append(delivered, msg)
+
+		return nil
+	})
+
+	h, err = qos.New(next,
+		qos.MaxQueueBytes(1024),
+		qos.Priority(qos.OldestType),
+		qos.Persist(fsys, "qos/queue.msgpack"),
+		qos.WithDropHandler(func(msg wrp.Message, reason string) {
+			lock.Lock()
+			defer lock.Unlock()
+			drops = append(drops, msg.Destination+": "+reason)
+		}),
+	)
+	require.NoError(err)
+
+	h.Start()
+	defer h.Stop()
+
+	require.Eventually(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(delivered) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// The message being delivered when stopped is not persisted.
+	require.Len(delivered, 2)
+	assert.Equal("event:test/1", delivered[0].Destination)
+	assert.Equal("event:test/2", delivered[1].Destination)
+	assert.Equal([]byte("payload"), delivered[0].Payload)
+	assert.Equal(wrp.QOSCriticalValue, delivered[0].QualityOfService)
+	assert.Equal([]string{"event:test/low: " + qos.DropExpired}, drops)
+
+	// The persisted queue is removed once restored.
+	_, err = fsys.ReadFile("qos/queue.msgpack")
+	assert.Error(err)
+}
@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package stackdump
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"strings"
+
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+var (
+	ErrInvalidInput = errors.New("invalid input")
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+const (
+	// DefaultMaxBytes is the default size limit of the goroutine dump.
+	DefaultMaxBytes = 64 * 1024
+)
+
+// Option is a functional option type for stackdump Handler.
+type Option interface {
+	apply(*Handler) error
+}
+
+type optionFunc func(*Handler) error
+
+func (f optionFunc) apply(c *Handler) error {
+	return f(c)
+}
+
+// Handler responds to requests from trusted sources with a dump of the stacks
+// of all goroutines, truncated to a maximum size.
+type Handler struct {
+	egress   wrpkit.Handler
+	source   string
+	trusted  []string
+	maxBytes int
+}
+
+// New creates a new instance of the Handler struct.  The parameter egress is
+// the handler that will be called to send the response.  The parameter source
+// is the source to use in the response message.  At least one trusted source
+// is required.
+func New(egress wrpkit.Handler, source string, opts ...Option) (*Handler, error) {
+	h := Handler{
+		egress:   egress,
+		source:   source,
+		maxBytes: DefaultMaxBytes,
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			if err := opt.apply(&h); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if h.egress == nil || h.source == "" || len(h.trusted) == 0 {
+		return nil, ErrInvalidInput
+	}
+
+	return &h, nil
+}
+
+// HandleWrp responds to messages expecting a response with the goroutine dump,
+// provided the message is from a trusted source.  Other messages are not
+// handled.
+func (h *Handler) HandleWrp(msg wrp.Message) error {
+	if !msg.Type.RequiresTransaction() {
+		return wrpkit.ErrNotHandled
+	}
+
+	response := msg
+	response.Destination = msg.Source
+	response.Source = h.source
+
+	if !h.isTrusted(msg.Source) {
+		code := int64(http.StatusForbidden)
+		response.ContentType = "application/json"
+		response.Status = &code
+		response.Payload = []byte(fmt.Sprintf(`{statusCode: %d, message:"Source '%s' not allowed."}`, code, msg.Source))
+
+		return errors.Join(ErrUnauthorized, h.egress.HandleWrp(response))
+	}
+
+	code := int64(http.StatusOK)
+	response.ContentType = "text/plain"
+	response.Status = &code
+	response.Payload = goroutines(h.maxBytes)
+
+	return h.egress.HandleWrp(response)
+}
+
+// isTrusted determines whether the source is, or is a service of, one of the
+// trusted sources.
+func (h *Handler) isTrusted(source string) bool {
+	for _, trusted := range h.trusted {
+		if source == trusted || strings.HasPrefix(source, trusted+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// goroutines returns the stacks of all goroutines, truncated to max bytes.
+func goroutines(max int) []byte {
+	w := limitWriter{max: max}
+
+	// The limitWriter never fails, so neither can WriteTo.
+	_ = pprof.Lookup("goroutine").WriteTo(&w, 2)
+
+	return w.buf.Bytes()
+}
+
+// limitWriter keeps the first max bytes written to it and discards the rest.
+type limitWriter struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if room := w.max - w.buf.Len(); room > 0 {
+		w.buf.Write(p[:min(len(p), room)])
+	}
+
+	return len(p), nil
+}
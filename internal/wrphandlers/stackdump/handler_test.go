@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package stackdump_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+	"github.com/xmidt-org/xmidt-agent/internal/wrphandlers/stackdump"
+	"github.com/xmidt-org/xmidt-agent/internal/wrpkit"
+)
+
+func TestNew(t *testing.T) {
+	egress := wrpkit.HandlerFunc(func(wrp.Message) error { return nil })
+
+	tests := []struct {
+		description string
+		egress      wrpkit.Handler
+		source      string
+		opts        []stackdump.Option
+		expectedErr error
+	}{
+		{
+			description: "valid",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts: []stackdump.Option{
+				stackdump.TrustedSources("dns:talaria.example.com"),
+				stackdump.MaxBytes(0),
+			},
+		}, {
+			description: "nil egress",
+			source:      "mac:112233445566",
+			opts:        []stackdump.Option{stackdump.TrustedSources("dns:talaria.example.com")},
+			expectedErr: stackdump.ErrInvalidInput,
+		}, {
+			description: "empty source",
+			egress:      egress,
+			opts:        []stackdump.Option{stackdump.TrustedSources("dns:talaria.example.com")},
+			expectedErr: stackdump.ErrInvalidInput,
+		}, {
+			description: "no trusted sources",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts:        []stackdump.Option{stackdump.TrustedSources(" ", "")},
+			expectedErr: stackdump.ErrInvalidInput,
+		}, {
+			description: "negative max bytes",
+			egress:      egress,
+			source:      "mac:112233445566",
+			opts: []stackdump.Option{
+				stackdump.TrustedSources("dns:talaria.example.com"),
+				stackdump.MaxBytes(-1),
+			},
+			expectedErr: stackdump.ErrInvalidInput,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			h, err := stackdump.New(tc.egress, tc.source, tc.opts...)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				assert.Nil(t, h)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.NotNil(t, h)
+		})
+	}
+}
+
+func TestHandler_HandleWrp(t *testing.T) {
+	tests := []struct {
+		description    string
+		maxBytes       int
+		msg            wrp.Message
+		expectedErr    error
+		expectedStatus int64
+		responded      bool
+		validate       func(*assert.Assertions, []byte)
+	}{
+		{
+			description: "dump",
+			msg: wrp.Message{
+				Type:   wrp.SimpleRequestResponseMessageType,
+				Source: "dns:talaria.example.com/service",
+			},
+			expectedStatus: 200,
+			responded:      true,
+			validate: func(assert *assert.Assertions, payload []byte) {
+				assert.Contains(string(payload), "goroutine ")
+				assert.Contains(string(payload), "TestHandler_HandleWrp")
+				assert.LessOrEqual(len(payload), stackdump.DefaultMaxBytes)
+			},
+		}, {
+			description: "truncated dump",
+			maxBytes:    100,
+			msg: wrp.Message{
+				Type:   wrp.SimpleRequestResponseMessageType,
+				Source: "dns:talaria.example.com",
+			},
+			expectedStatus: 200,
+			responded:      true,
+			validate: func(assert *assert.Assertions, payload []byte) {
+				assert.Len(payload, 100)
+				assert.Contains(string(payload), "goroutine ")
+			},
+		}, {
+			description: "untrusted source",
+			msg: wrp.Message{
+				Type:   wrp.SimpleRequestResponseMessageType,
+				Source: "dns:talaria.example.com.evil.com/service",
+			},
+			expectedErr:    stackdump.ErrUnauthorized,
+			expectedStatus: 403,
+			responded:      true,
+			validate: func(assert *assert.Assertions, payload []byte) {
+				assert.NotContains(string(payload), "goroutine ")
+			},
+		}, {
+			description: "no response expected",
+			msg: wrp.Message{
+				Type:   wrp.SimpleEventMessageType,
+				Source: "dns:talaria.example.com/service",
+			},
+			expectedErr: wrpkit.ErrNotHandled,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			var (
+				responded bool
+				response  wrp.Message
+			)
+			egress := wrpkit.HandlerFunc(func(msg wrp.Message) error {
+				responded = true
+				response = msg
+				return nil
+			})
+
+			h, err := stackdump.New(egress, "mac:112233445566",
+				stackdump.TrustedSources("dns:talaria.example.com"),
+				stackdump.MaxBytes(tc.maxBytes),
+			)
+			require.NoError(err)
+
+			err = h.HandleWrp(tc.msg)
+			assert.ErrorIs(err, tc.expectedErr)
+			if tc.expectedErr == nil {
+				assert.NoError(err)
+			}
+
+			require.Equal(tc.responded, responded)
+			if !responded {
+				return
+			}
+
+			assert.Equal(tc.msg.Source, response.Destination)
+			assert.Equal("mac:112233445566", response.Source)
+			require.NotNil(response.Status)
+			assert.Equal(tc.expectedStatus, *response.Status)
+			tc.validate(assert, response.Payload)
+		})
+	}
+}
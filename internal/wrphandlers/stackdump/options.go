@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2024 Comcast Cable Communications Management, LLC
+// SPDX-License-Identifier: Apache-2.0
+
+package stackdump
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TrustedSources sets the sources allowed to request a goroutine dump.  A
+// source is trusted if it matches an entry or is a service of it, e.g.
+// dns:talaria.example.com trusts dns:talaria.example.com/service.  Blank
+// entries are ignored.
+func TrustedSources(sources ...string) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			for _, source := range sources {
+				source = strings.TrimSpace(source)
+				if source != "" {
+					h.trusted = append(h.trusted, source)
+				}
+			}
+
+			return nil
+		})
+}
+
+// MaxBytes sets the size limit of the goroutine dump.  Zero uses
+// DefaultMaxBytes.
+func MaxBytes(n int) Option {
+	return optionFunc(
+		func(h *Handler) error {
+			if n < 0 {
+				return fmt.Errorf("%w: negative max bytes", ErrInvalidInput)
+			}
+
+			h.maxBytes = n
+			if n == 0 {
+				h.maxBytes = DefaultMaxBytes
+			}
+			return nil
+		})
+}